@@ -0,0 +1,254 @@
+/*
+File summary: logfile Apache/Nginx style access logs
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Access log templates in Apache's LogFormat syntax
+const (
+	CommonLogFormat   = `%h %l %u %t "%r" %>s %b`
+	CombinedLogFormat = CommonLogFormat + ` "%{Referer}i" "%{User-Agent}i"`
+)
+
+// accessTimeLayout is the layout of %t
+const accessTimeLayout = "[02/Jan/2006:15:04:05 -0700]"
+
+// AccessLogEntry is one request to be written to an access log
+type AccessLogEntry struct {
+	Time       time.Time // When the request started
+	RemoteHost string
+	User       string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int64 // Size of the response body
+	Latency    time.Duration
+	Header     http.Header // Request headers, for %{Name}i
+}
+
+// AccessLogWriter writes access log lines to a LogFile
+type AccessLogWriter struct {
+	lp     *LogFile
+	fields []accessField
+}
+
+// accessField appends one part of an access log line
+type accessField func(b *bytes.Buffer, e *AccessLogEntry)
+
+// NewAccessLogWriter returns an AccessLogWriter writing lines to lp in
+// format. format is a template in Apache's LogFormat syntax, usually
+// CommonLogFormat or CombinedLogFormat. The supported directives are
+// %h %l %u %t %r %s %>s %b %B %D %T %m %U %q %H %{Name}i and %%.
+func NewAccessLogWriter(lp *LogFile, format string) (*AccessLogWriter, error) {
+	fields, err := parseAccessFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessLogWriter{lp: lp, fields: fields}, nil
+}
+
+// Log writes e to the access log
+func (a *AccessLogWriter) Log(e *AccessLogEntry) error {
+	var b bytes.Buffer
+	for _, field := range a.fields {
+		field(&b, e)
+	}
+	b.WriteByte('\n')
+	_, err := a.lp.Write(b.Bytes())
+	return err
+}
+
+// LogRequest writes an access log line for r, which was answered with status
+// and a body of size bytes after latency
+func (a *AccessLogWriter) LogRequest(r *http.Request, status int, bytes int64, latency time.Duration) error {
+	return a.Log(newAccessLogEntry(r, status, bytes, latency))
+}
+
+// newAccessLogEntry returns the AccessLogEntry for r
+func newAccessLogEntry(r *http.Request, status int, bytes int64, latency time.Duration) *AccessLogEntry {
+	e := &AccessLogEntry{
+		Time:       time.Now().Add(-latency),
+		RemoteHost: r.RemoteAddr,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      bytes,
+		Latency:    latency,
+		Header:     r.Header,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.RemoteHost = host
+	}
+	if e.URI == "" && r.URL != nil {
+		e.URI = r.URL.RequestURI()
+	}
+	if r.URL != nil && r.URL.User != nil {
+		e.User = r.URL.User.Username()
+	} else if user, _, ok := r.BasicAuth(); ok {
+		e.User = user
+	}
+	return e
+}
+
+// parseAccessFormat turns an access log template into the fields that
+// write it
+func parseAccessFormat(format string) ([]accessField, error) {
+	var fields []accessField
+	literal := func(s string) {
+		fields = append(fields, func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteString(s) })
+	}
+
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			if format != "" {
+				literal(format)
+			}
+			return fields, nil
+		}
+		if i > 0 {
+			literal(format[:i])
+		}
+		format = format[i+1:]
+
+		// Apache allows > and < to pick the final or original request,
+		// there is only ever one here
+		format = strings.TrimLeft(format, "<>")
+		if format == "" {
+			return nil, fmt.Errorf("LogFile access log format ends in %%")
+		}
+
+		directive := format[0]
+		var name string
+		if directive == '{' {
+			end := strings.IndexByte(format, '}')
+			if end < 0 || end+1 >= len(format) {
+				return nil, fmt.Errorf("LogFile access log format has unterminated %%{")
+			}
+			name = format[1:end]
+			format = format[end+1:]
+			directive = format[0]
+			if directive != 'i' {
+				return nil, fmt.Errorf("LogFile access log format directive %%{%s}%c not supported", name, directive)
+			}
+		}
+		format = format[1:]
+
+		field := accessDirective(directive, name)
+		if field == nil {
+			return nil, fmt.Errorf("LogFile access log format directive %%%c not supported", directive)
+		}
+		fields = append(fields, field)
+	}
+}
+
+// accessDirective returns the field for a single % directive, nil if it is
+// not supported
+func accessDirective(directive byte, name string) accessField {
+	switch directive {
+	case '%':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteByte('%') }
+	case 'h':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { writeAccessValue(b, e.RemoteHost) }
+	case 'l':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteByte('-') }
+	case 'u':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { writeAccessValue(b, e.User) }
+	case 't':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteString(e.Time.Format(accessTimeLayout)) }
+	case 'r':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			writeAccessValue(b, e.Method+" "+e.URI+" "+e.Proto)
+		}
+	case 's':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteString(strconv.Itoa(e.Status)) }
+	case 'b':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			if e.Bytes == 0 {
+				b.WriteByte('-')
+				return
+			}
+			b.WriteString(strconv.FormatInt(e.Bytes, 10))
+		}
+	case 'B':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { b.WriteString(strconv.FormatInt(e.Bytes, 10)) }
+	case 'D':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			b.WriteString(strconv.FormatInt(int64(e.Latency/time.Microsecond), 10))
+		}
+	case 'T':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			b.WriteString(strconv.FormatInt(int64(e.Latency/time.Second), 10))
+		}
+	case 'm':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { writeAccessValue(b, e.Method) }
+	case 'U':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			path := e.URI
+			if i := strings.IndexByte(path, '?'); i >= 0 {
+				path = path[:i]
+			}
+			writeAccessValue(b, path)
+		}
+	case 'q':
+		return func(b *bytes.Buffer, e *AccessLogEntry) {
+			if i := strings.IndexByte(e.URI, '?'); i >= 0 {
+				writeAccessValue(b, e.URI[i:])
+			}
+		}
+	case 'H':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { writeAccessValue(b, e.Proto) }
+	case 'i':
+		return func(b *bytes.Buffer, e *AccessLogEntry) { writeAccessValue(b, e.Header.Get(name)) }
+	}
+	return nil
+}
+
+// writeAccessValue writes s the way Apache does: - if empty, quotes,
+// backslashes and control characters escaped
+func writeAccessValue(b *bytes.Buffer, s string) {
+	if s == "" {
+		b.WriteByte('-')
+		return
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
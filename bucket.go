@@ -0,0 +1,188 @@
+/*
+File summary: logfile a log file per hour or day
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bucketLayouts are the time layouts, in local time, NewBucketed names
+// files by for each period it supports
+var bucketLayouts = map[time.Duration]string{
+	time.Hour:      "2006010215",
+	24 * time.Hour: "20060102",
+}
+
+// NewBucketed is like New but writes to a new log file for each hour or day
+// (every must be time.Hour or 24 hours). The last "*" in template is
+// replaced by the hour or day (for example "app-*.log" might become
+// "app-2024061213.log" hourly or "app-20240612.log" daily) and at the first
+// write in the next one FileName is switched to its file.
+// A program restarted part way through an hour or day reopens that bucket's
+// file and appends to it, rather than OverWriteOnStart, RotateOnStart or
+// ExclusiveCreate replacing it, so a crash looping service doesn't leave
+// dozens of tiny files. The state file records which bucket a file was
+// started for. Only the current bucket's state file is kept, earlier ones
+// are removed unless they pin files. KeepBuckets limits how many earlier
+// buckets' files are kept.
+// FileName is ignored as it is set from template. As the LogFile's goroutine
+// changes it don't read FileName while the LogFile is open.
+func NewBucketed(template string, every time.Duration, lp *LogFile) (*LogFile, error) {
+	i := strings.LastIndex(template, "*")
+	if i < 0 {
+		return lp, fmt.Errorf("LogFile bucketed template %s has no *", template)
+	}
+	layout, ok := bucketLayouts[every]
+	if !ok {
+		return lp, fmt.Errorf("LogFile bucketed files can only be hourly or daily not every %s", every)
+	}
+
+	if lp == nil {
+		lp = new(LogFile)
+	}
+	if lp.Flags&AutoUniqueName == AutoUniqueName {
+		return lp, fmt.Errorf("LogFile bucketed files cannot use AutoUniqueName")
+	}
+	lp.bucketPrefix, lp.bucketSuffix = template[:i], template[i+1:]
+	lp.bucketLayout = layout
+	lp.bucketID = lp.bucketOf(time.Now())
+	lp.FileName = lp.bucketPrefix + lp.bucketID + lp.bucketSuffix
+
+	return New(lp)
+}
+
+// bucketOf returns the id of the bucket t is in
+func (lp *LogFile) bucketOf(t time.Time) string {
+	return t.Local().Format(lp.bucketLayout)
+}
+
+// bucketDue returns true, with NewBucketed, once the time is past the bucket
+// of the open file. Like newDay it is checked at each write.
+func (lp *LogFile) bucketDue() bool {
+	return lp.bucketLayout != "" && lp.bucketOf(time.Now()) != lp.bucketID
+}
+
+// startFlags returns the Flags to start the log file with. A restarted
+// program that finds, from the state file, its bucket was already started
+// carries on appending to it.
+func (lp *LogFile) startFlags() int {
+	if lp.bucketLayout == "" {
+		return lp.Flags
+	}
+	lp.removeOldBuckets()
+	if state := lp.loadState(); state.Bucket == lp.bucketID {
+		return lp.Flags &^ (OverWriteOnStart | RotateOnStart | ExclusiveCreate)
+	}
+	lp.updateState(func(state *logState) {
+		state.Bucket = lp.bucketID
+	})
+	return lp.Flags
+}
+
+// switchBucket closes the file of the last bucket and opens the current
+// one's, returning false if it couldn't be opened
+func (lp *LogFile) switchBucket() bool {
+	id := lp.bucketOf(time.Now())
+	fileName := lp.bucketPrefix + id + lp.bucketSuffix
+	if err := movePath(lp, fileName); err != nil {
+		lp.PrintError("LogFile unable to switch to %s: %s\n", fileName, err)
+		return false
+	}
+
+	lp.closeLog()
+	lp.updateState(func(state *logState) {
+		state.Bucket = ""
+	})
+	lp.changeFileName(fileName)
+	lp.bucketID = id
+	lp.updateState(func(state *logState) {
+		state.Bucket = id
+	})
+	lp.loadPins()
+	lp.removeOldBuckets()
+	return lp.openLogFile(noTruncateLog)
+}
+
+// removeOldBuckets removes the state files of earlier buckets, as only the
+// current bucket's is read, unless they pin files. With KeepBuckets it also
+// removes the files of all but the newest KeepBuckets earlier buckets.
+func (lp *LogFile) removeOldBuckets() {
+	dir := filepath.Dir(lp.bucketPrefix + "*")
+	base := strings.TrimSuffix(filepath.Base(lp.bucketPrefix+"*"), "*")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		lp.PrintError("LogFile unable to read directory %s: %s\n", dir, err)
+		return
+	}
+
+	// buckets maps the ids of earlier buckets to their files
+	buckets := make(map[string][]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if len(name) < len(base)+len(lp.bucketLayout) || !strings.HasPrefix(name, base) {
+			continue
+		}
+		id := name[len(base) : len(base)+len(lp.bucketLayout)]
+		if _, err := time.Parse(lp.bucketLayout, id); err != nil || id >= lp.bucketID {
+			continue
+		}
+		if rest := name[len(base)+len(id):]; !strings.HasPrefix(rest, lp.bucketSuffix) {
+			continue
+		}
+		buckets[id] = append(buckets[id], filepath.Join(dir, name))
+	}
+
+	// Bucket ids are times so the newest sort first
+	ids := make([]string, 0, len(buckets))
+	for id := range buckets {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	for i, id := range ids {
+		// A bucket with pinned files is kept whole
+		stateName := stateFileName(lp.bucketPrefix + id + lp.bucketSuffix)
+		pins := statePins(stateName)
+		remove := lp.KeepBuckets > 0 && i >= lp.KeepBuckets && !pins
+		for _, name := range buckets[id] {
+			if name == stateName {
+				if !pins {
+					os.Remove(name)
+				}
+			} else if remove {
+				lp.removeOldFile(name)
+			}
+		}
+	}
+}
+
+// statePins returns true if the state file stateName pins files
+func statePins(stateName string) bool {
+	var state logState
+	b, err := os.ReadFile(stateName)
+	return err == nil && json.Unmarshal(b, &state) == nil && len(state.Pins) > 0
+}
@@ -0,0 +1,136 @@
+/*
+File summary: logfile logging budgets
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"time"
+)
+
+// Thresholds are logging budgets. Going over one is told to OnThreshold and
+// noted by a line in the log file itself, once in each day or hour, so that
+// a program logging far more than expected is noticed before the disk
+// fills. Fields left zero are not checked.
+type Thresholds struct {
+	// BytesPerDay is the most to be written to the file in a (local) day
+	BytesPerDay int64
+
+	// RotationsPerHour is the most times the file should be rotated in an
+	// hour
+	RotationsPerHour int64
+
+	// ErrorsPerHour is the most entries at LevelError or above (see
+	// WriteEntry) to be written in an hour
+	ErrorsPerHour int64
+}
+
+// ThresholdEvent tells OnThreshold which of the Thresholds was gone over
+type ThresholdEvent struct {
+	FileName string
+
+	// Threshold is the name of the Thresholds field, "BytesPerDay"...
+	Threshold string
+
+	// Limit is the threshold and Value what it has reached so far in the
+	// day or hour starting at Since
+	Limit int64
+	Value int64
+	Since time.Time
+}
+
+// budgetCount is the count, since the start of the day or hour, kept for
+// one of the Thresholds
+type budgetCount struct {
+	since    time.Time
+	value    int64
+	notified bool
+}
+
+// add adds n to the count for the period starting at since, returning true
+// the first time in the period that it goes over limit
+func (c *budgetCount) add(n, limit int64, since time.Time) bool {
+	if !c.since.Equal(since) {
+		*c = budgetCount{since: since}
+	}
+	c.value += n
+	if limit <= 0 || c.value <= limit || c.notified {
+		return false
+	}
+	c.notified = true
+	return true
+}
+
+// startOfDay returns the local midnight starting t's day
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Local().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// startOfHour returns the start of t's local hour, which in zones whose
+// offset isn't a whole number of hours isn't t.Truncate(time.Hour)
+func startOfHour(t time.Time) time.Time {
+	year, month, day := t.Local().Date()
+	return time.Date(year, month, day, t.Local().Hour(), 0, 0, 0, time.Local)
+}
+
+// budgetWritten counts n bytes, and an entry at LevelError or above if
+// errorLevel, towards the Thresholds
+func (lp *LogFile) budgetWritten(n int64, errorLevel bool) {
+	now := time.Now()
+	if lp.budgetBytes.add(n, lp.Thresholds.BytesPerDay, startOfDay(now)) {
+		lp.overBudget("BytesPerDay", lp.Thresholds.BytesPerDay, &lp.budgetBytes)
+	}
+	if !errorLevel {
+		return
+	}
+	if lp.budgetErrors.add(1, lp.Thresholds.ErrorsPerHour, startOfHour(now)) {
+		lp.overBudget("ErrorsPerHour", lp.Thresholds.ErrorsPerHour, &lp.budgetErrors)
+	}
+}
+
+// budgetRotated counts a rotation towards the Thresholds
+func (lp *LogFile) budgetRotated() {
+	if lp.budgetRotations.add(1, lp.Thresholds.RotationsPerHour, startOfHour(time.Now())) {
+		lp.overBudget("RotationsPerHour", lp.Thresholds.RotationsPerHour, &lp.budgetRotations)
+	}
+}
+
+// overBudget reports going over threshold, to OnThreshold and with a line
+// in the log file. As it's called part way through writing or rotating the
+// line is only kept, for writeBudgetNotices to write once that's done.
+func (lp *LogFile) overBudget(threshold string, limit int64, c *budgetCount) {
+	line := fmt.Sprintf("LogFile %s has gone over its %s threshold of %d, reaching %d since %s\n",
+		lp.FileName, threshold, limit, c.value, c.since.Format(time.RFC3339))
+	if lp.OnThreshold != nil {
+		lp.OnThreshold(ThresholdEvent{FileName: lp.FileName, Threshold: threshold, Limit: limit, Value: c.value, Since: c.since})
+	}
+	lp.budgetNotices = append(lp.budgetNotices, line)
+}
+
+// writeBudgetNotices writes the lines kept by overBudget
+func (lp *LogFile) writeBudgetNotices() {
+	for len(lp.budgetNotices) > 0 {
+		line := lp.budgetNotices[0]
+		lp.budgetNotices = lp.budgetNotices[1:]
+		lp.writeLog([]byte(line), nil, time.Now(), lp.nextSeq(), FileOnly)
+	}
+	lp.budgetNotices = nil
+}
@@ -0,0 +1,160 @@
+/*
+File summary: logfile checksums of rotated files
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// startChecksum starts the checksum of the newly opened file. Anything
+// already in it is read back so the checksum covers the whole file.
+func (lp *LogFile) startChecksum() {
+	if lp.Flags&Checksum != Checksum {
+		return
+	}
+	lp.checksum = sha256.New()
+	lp.checksumValid = true
+	if lp.size == 0 {
+		return
+	}
+	var r io.Reader = io.NewSectionReader(lp.file, 0, lp.size)
+	if lp.gzip != nil {
+		// The checksum is of the uncompressed contents
+		zr, err := NewReader(r, lp.Dictionary)
+		if err != nil {
+			lp.PrintError("LogFile error reading %s to checksum it: %s\n", lp.FileName, err)
+			lp.checksumValid = false
+			return
+		}
+		r = zr
+	}
+	_, err := io.Copy(lp.checksum, r)
+	if err != nil {
+		lp.PrintError("LogFile error reading %s to checksum it: %s\n", lp.FileName, err)
+		lp.checksumValid = false
+	}
+}
+
+// addChecksum adds entries that have reached the file to the checksum
+func (lp *LogFile) addChecksum(entries []bufferedEntry) {
+	if lp.checksum == nil {
+		return
+	}
+	for _, e := range entries {
+		lp.checksum.Write(e.data)
+	}
+}
+
+// rotateChecksums moves the checksums in the state file along with the
+// files they are of and adds the checksum of the file just rotated to
+// rotated (version 1). Checksums are kept by the base name of the version.
+func (lp *LogFile) rotateChecksums(rotated string) {
+	if lp.Flags&Checksum != Checksum {
+		return
+	}
+	sum := ""
+	if lp.checksum != nil && lp.checksumValid {
+		sum = hex.EncodeToString(lp.checksum.Sum(nil))
+	}
+	lp.checksum = nil
+
+	lp.updateState(func(state *logState) {
+		checksums := make(map[string]string)
+		if lp.Flags&TimestampVersions == TimestampVersions {
+			// Timestamped versions keep their names, those removed go
+			dir := filepath.Dir(lp.FileName)
+			for name, old := range state.Checksums {
+				if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					checksums[name] = old
+				}
+			}
+		}
+		for v := 1; v < lp.OldVersions && lp.Flags&TimestampVersions != TimestampVersions; v++ {
+			if old, ok := state.Checksums[filepath.Base(FileNameVersion(lp.FileName, v))]; ok {
+				checksums[filepath.Base(FileNameVersion(lp.FileName, v+1))] = old
+			}
+		}
+		if sum != "" && rotated != "" {
+			checksums[filepath.Base(rotated)] = sum
+		}
+		state.Checksums = checksums
+		if len(checksums) == 0 {
+			state.Checksums = nil
+		}
+	})
+}
+
+// VerifyChecksums checks the rotated files against the checksums recorded,
+// with the Checksum flag, when they were rotated and returns the names of
+// any that no longer match: they have been corrupted or tampered with.
+// Compressed (gzip or Dictionary) files are checked by their uncompressed
+// contents.
+// Files that have since been removed are ignored.
+func (lp *LogFile) VerifyChecksums() ([]string, error) {
+	lp.stateMutex.Lock()
+	state := lp.loadState()
+	lp.stateMutex.Unlock()
+
+	var bad []string
+	dir := filepath.Dir(lp.FileName)
+	for name, sum := range state.Checksums {
+		fileName := filepath.Join(dir, name)
+		fileSum, err := fileChecksum(fileName, lp.Dictionary)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return bad, fmt.Errorf("LogFile unable to checksum %s: %w", fileName, err)
+		}
+		if fileSum != sum {
+			bad = append(bad, fileName)
+		}
+	}
+	sort.Strings(bad)
+	return bad, nil
+}
+
+// fileChecksum returns the hex SHA-256 of fileName's (uncompressed) contents.
+// dict is needed for FormatDictionary files, see NewReader.
+func fileChecksum(fileName string, dict []byte) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := NewReader(f, dict)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,191 @@
+/*
+File summary: logtail command following a log file
+Package: main
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Command logtail follows a log file, like tail -F, carrying on across
+rotations and truncations, decompressing files written with GzipFile. It
+is pure Go so works where there is no GNU tail, such as minimal containers
+and Windows.
+
+	logtail [flags] file
+
+	-since 10m            start 10 minutes back, or at a time (RFC3339)
+	-grep 'timeout|refused'  only lines matching the regexp
+	-json level=ERROR,component=db  only JSON entries with these fields
+	-follow=false         stop at the end of the file
+
+Without -since only lines written from now on are shown. The time of an
+entry is its JSON time field, or the date and time the standard log
+package starts lines with; lines without one (such as the rest of a stack
+trace) are shown if the line before was.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/leemcloughlin/logfile"
+)
+
+// filter decides which lines are shown
+type filter struct {
+	since  time.Time
+	grep   *regexp.Regexp
+	fields map[string]string
+	shown  bool // was the line before shown
+}
+
+func main() {
+	since := flag.String("since", "", "Show lines from this long ago (10m, 2h...) or this time (RFC3339)")
+	grep := flag.String("grep", "", "Only show lines matching this regular expression")
+	fields := flag.String("json", "", "Only show JSON entries with these fields, as field=value,...")
+	follow := flag.Bool("follow", true, "Keep following the file once the end is reached")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := newFilter(*since, *grep, *fields)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logtail: %s\n", err)
+		os.Exit(2)
+	}
+
+	fromStart := !f.since.IsZero() || !*follow
+	tail, err := logfile.NewTail(flag.Arg(0), fromStart)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logtail: %s\n", err)
+		os.Exit(1)
+	}
+	defer tail.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for {
+		lineCtx := ctx
+		cancel := func() {}
+		if !*follow {
+			// Just wait long enough to spot the end of the file
+			lineCtx, cancel = context.WithTimeout(ctx, 2*tail.PollInterval+time.Second)
+		}
+		line, err := tail.ReadLine(lineCtx)
+		cancel()
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "logtail: %s\n", err)
+			os.Exit(1)
+		}
+		if f.show(line) {
+			fmt.Println(line)
+		}
+	}
+}
+
+// newFilter returns the filter for the -since, -grep and -json flags
+func newFilter(since, grep, fields string) (*filter, error) {
+	f := &filter{}
+	if since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.since = t
+		} else {
+			return nil, fmt.Errorf("-since %q is neither a duration nor an RFC3339 time", since)
+		}
+	}
+	if grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			return nil, fmt.Errorf("-grep: %s", err)
+		}
+		f.grep = re
+	}
+	if fields != "" {
+		f.fields = make(map[string]string)
+		for _, field := range strings.Split(fields, ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("-json %q is not field=value", field)
+			}
+			f.fields[kv[0]] = kv[1]
+		}
+	}
+	return f, nil
+}
+
+// show returns true if line passes the filter
+func (f *filter) show(line string) bool {
+	var entry map[string]interface{}
+	isJSON := strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &entry) == nil
+
+	if !f.since.IsZero() {
+		if t, ok := lineTime(line, entry); ok {
+			f.shown = !t.Before(f.since)
+		}
+		if !f.shown {
+			return false
+		}
+	}
+	if f.grep != nil && !f.grep.MatchString(line) {
+		return false
+	}
+	if f.fields != nil {
+		if !isJSON {
+			return false
+		}
+		for k, v := range f.fields {
+			if value, ok := entry[k]; !ok || !strings.EqualFold(fmt.Sprint(value), v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lineTime returns when the entry on line was written, if that can be told
+func lineTime(line string, entry map[string]interface{}) (time.Time, bool) {
+	if s, ok := entry[logfile.TimeKey].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+	}
+	const logLayout = "2006/01/02 15:04:05"
+	if len(line) >= len(logLayout) {
+		if t, err := time.ParseInLocation(logLayout, line[:len(logLayout)], time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,216 @@
+/*
+File summary: logfile component loggers
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ComponentKey is the name of the component field in entries and metadata
+const ComponentKey = "component"
+
+// Component writes to its LogFile with every entry tagged with the
+// component's name. Entries below the component's level are dropped.
+// Use it to give each part of a program its own name and level while they
+// all share one file, for example log.New(lp.Component("db"), "", log.LstdFlags)
+type Component struct {
+	lp    *LogFile
+	name  string
+	level int64 // a Level, use atomic
+}
+
+// Component returns the component called name, creating it if needed. A
+// new component's level comes from the -loglevels command line flag, or is
+// LevelDebug. The same name always returns the same Component.
+func (lp *LogFile) Component(name string) *Component {
+	lp.componentMutex.Lock()
+	defer lp.componentMutex.Unlock()
+
+	if c, ok := lp.components[name]; ok {
+		return c
+	}
+	if lp.components == nil {
+		lp.components = make(map[string]*Component)
+	}
+
+	level := LevelDebug
+	if levels, err := ParseComponentLevels(ComponentLevels); err == nil {
+		if l, ok := levels[name]; ok {
+			level = l
+		}
+	}
+	c := &Component{lp: lp, name: name, level: int64(level)}
+	lp.components[name] = c
+	return c
+}
+
+// SetComponentLevel sets the level of the component called name, creating
+// it if needed. It can be used at any time, for example to turn on debug
+// for one component of a running program.
+func (lp *LogFile) SetComponentLevel(name string, level Level) {
+	lp.Component(name).SetLevel(level)
+}
+
+// SetComponentLevels sets the levels of components from a list in the same
+// form as the -loglevels flag: component=level,component=level...
+func (lp *LogFile) SetComponentLevels(s string) error {
+	levels, err := ParseComponentLevels(s)
+	if err != nil {
+		return err
+	}
+	for name, level := range levels {
+		lp.SetComponentLevel(name, level)
+	}
+	return nil
+}
+
+// ComponentLevels returns the level of every component
+func (lp *LogFile) ComponentLevels() map[string]Level {
+	lp.componentMutex.Lock()
+	defer lp.componentMutex.Unlock()
+
+	levels := make(map[string]Level, len(lp.components))
+	for name, c := range lp.components {
+		levels[name] = c.Level()
+	}
+	return levels
+}
+
+// ParseComponentLevels parses a list of component levels in the form
+// component=level,component=level...
+func ParseComponentLevels(s string) (map[string]Level, error) {
+	levels := make(map[string]Level)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("LogFile component level %q is not component=level", item)
+		}
+		level, ok := ParseLevel(parts[1])
+		if !ok {
+			return nil, fmt.Errorf("LogFile unknown level %q for component %s", parts[1], parts[0])
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+// LevelHandler returns an http.Handler for viewing and changing component
+// levels while the program runs. GET returns the levels as JSON. POST (or
+// PUT) with component and level form values sets a level, for example:
+//
+//	curl -d component=db -d level=debug http://localhost:8080/loglevels
+//
+// The handler does no authentication, only expose it where that is safe.
+func (lp *LogFile) LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPost, http.MethodPut:
+			name := r.FormValue("component")
+			level, ok := ParseLevel(r.FormValue("level"))
+			if name == "" || !ok {
+				http.Error(w, "component and a valid level are required", http.StatusBadRequest)
+				return
+			}
+			lp.SetComponentLevel(name, level)
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		levels := lp.ComponentLevels()
+		out := make(map[string]string, len(levels))
+		for name, level := range levels {
+			out[name] = level.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
+
+// Name returns the component's name
+func (c *Component) Name() string {
+	return c.name
+}
+
+// Level returns the lowest level of entry the component writes
+func (c *Component) Level() Level {
+	return Level(atomic.LoadInt64(&c.level))
+}
+
+// SetLevel sets the lowest level of entry the component writes
+func (c *Component) SetLevel(level Level) {
+	atomic.StoreInt64(&c.level, int64(level))
+}
+
+// Enabled returns true if entries at level are written
+func (c *Component) Enabled(level Level) bool {
+	return level >= c.Level()
+}
+
+// Write writes p, at LevelInfo, prefixed by the component's name
+func (c *Component) Write(p []byte) (n int, err error) {
+	return c.WriteLevel(LevelInfo, p)
+}
+
+// WriteLevel writes p, at level, prefixed by the component's name. The
+// name and level are also passed to any Formatter in the metadata.
+func (c *Component) WriteLevel(level Level, p []byte) (n int, err error) {
+	if !c.Enabled(level) {
+		return len(p), nil
+	}
+
+	prefix := c.name + ": "
+	buf := make([]byte, 0, len(prefix)+len(p))
+	buf = append(append(buf, prefix...), p...)
+	meta := map[string]string{ComponentKey: c.name, LevelKey: level.String()}
+	_, err = c.lp.WriteWithMeta(buf, meta)
+	return len(p), err
+}
+
+// WriteEntry writes e, as LogFile's WriteEntry does, with a component field
+// added. Entries with a level field below the component's level are dropped,
+// those without a level are treated as LevelInfo.
+func (c *Component) WriteEntry(e Entry) error {
+	level := LevelInfo
+	if l, ok := levelOf(e[LevelKey]); ok {
+		level = l
+	}
+	if !c.Enabled(level) {
+		return nil
+	}
+
+	entry := make(Entry, len(e)+1)
+	for k, v := range e {
+		entry[k] = v
+	}
+	entry[ComponentKey] = c.name
+	return c.lp.writeEntry(entry, 1)
+}
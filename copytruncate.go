@@ -0,0 +1,107 @@
+/*
+File summary: logfile moving the log file aside when rotating
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// With the CopyTruncate flag the default RotateFile copies the log file to
+// its first old version and then truncates it, rather than renaming it, as
+// logrotate's copytruncate does. The file stays the same file so other
+// processes that have it open (with O_APPEND) carry on writing to it, and
+// it works on Windows where a file that is open can't be renamed. Anything
+// they write between the copy and the truncation is lost.
+
+// moveLive moves the log file, closed for rotating, to rotated calling
+// PreRotate and PostRotate (unless it is left for compactFile) around it
+func (lp *LogFile) moveLive(rotated string) error {
+	lp.rotateHook("PreRotate", lp.PreRotate, lp.FileName, rotated)
+	var err error
+	if lp.Flags&CopyTruncate != CopyTruncate {
+		err = os.Rename(lp.FileName, rotated)
+	} else {
+		err = copyTruncate(lp.FileName, rotated, lp.FileMode)
+	}
+	if err != nil {
+		return err
+	}
+	lp.rotated = append(lp.rotated, rotated)
+	lp.replicateRename(lp.FileName, rotated)
+	if lp.CompactFunc == nil {
+		lp.rotateHook("PostRotate", lp.PostRotate, lp.FileName, rotated)
+	}
+	return nil
+}
+
+// rotateHook calls hook, PreRotate or PostRotate, if set and reports any
+// error it returns
+func (lp *LogFile) rotateHook(name string, hook func(oldName, newName string) error, oldName, newName string) {
+	if hook == nil {
+		return
+	}
+	if err := hook(oldName, newName); err != nil {
+		lp.PrintError("LogFile %s of %s to %s failed: %s\n", name, oldName, newName, err)
+		lp.noteError(fmt.Errorf("LogFile %s of %s to %s failed: %w", name, oldName, newName, err))
+	}
+}
+
+// copyTruncate copies fileName to rotated and then empties fileName
+func copyTruncate(fileName, rotated string, mode os.FileMode) error {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(rotated, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	// The copy must be on disk before the original is truncated, or a
+	// crash could lose both
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(rotated)
+		return err
+	}
+	syncDir(filepath.Dir(rotated))
+	return os.Truncate(fileName, 0)
+}
+
+// syncDir syncs dir so a file just created in it is sure to be found after
+// a crash. Not every OS can sync a directory (Windows can't) so failing is
+// ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,219 @@
+/*
+File summary: logfile deferred opening, buffering entries until a file is known
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultDeferredMaxBytes is used when DeferredMaxBytes is zero
+const defaultDeferredMaxBytes = 1024 * 1024
+
+// NewDeferred creates a LogFile, like New, that has no file yet. Entries
+// written to it are held in memory, up to DeferredMaxBytes, until Attach is
+// called with the file name. This allows logging from the very start of a
+// program, before its configuration has been read.
+// lp's FileName must be empty. If Close is called before Attach the held
+// entries are written to stderr so they are not lost.
+func NewDeferred(lp *LogFile) (*LogFile, error) {
+	if lp == nil {
+		lp = new(LogFile)
+	}
+	if !lp.claim() {
+		return lp, ErrInUse
+	}
+	if lp.FileName != "" {
+		lp.release()
+		return lp, fmt.Errorf("LogFile NewDeferred given file name %s, use New", lp.FileName)
+	}
+	lp.deferred = true
+	lp.setDefaults()
+	if err := lp.Validate(); err != nil {
+		lp.release()
+		return lp, err
+	}
+
+	lp.lifetimeBytes = lp.PreviousLifetimeBytes
+	lp.pending = true
+	lp.overflowCond.L = &lp.overflowMutex
+	if lp.TailBufferSize > 0 {
+		lp.recent = newRecentRing(lp.TailBufferSize)
+	}
+	lp.synchronous = lp.Flags&Synchronous == Synchronous || forceSynchronous
+	if !lp.synchronous {
+		lp.messages = make(chan logMessage, lp.QueueSize)
+		goroutineStarted()
+		go logger(lp, nil)
+	}
+
+	return lp, nil
+}
+
+// NewMemoryFirst creates a LogFile, like NewDeferred, that holds up to
+// limitBytes of entries in memory until AttachFile is called. Use it for
+// programs, like init systems and agents, whose log volume isn't writable
+// until they have mounted it or dropped privileges. A limitBytes of zero
+// means 1MB, as for DeferredMaxBytes.
+func NewMemoryFirst(limitBytes int64) (*LogFile, error) {
+	return NewDeferred(&LogFile{DeferredMaxBytes: limitBytes})
+}
+
+// AttachFile is Attach for cfg's FileName that also takes cfg's FileMode,
+// MaxSize, OldVersions, MaxTotalSize and MaxAge, since they are often not
+// known until the configuration they come from can be read. Other fields
+// of cfg are ignored.
+func (lp *LogFile) AttachFile(cfg *LogFile) error {
+	return lp.attach(cfg.FileName, cfg)
+}
+
+// Attach opens fileName as the file of a LogFile created by NewDeferred and
+// writes the entries held so far to it. The AutoUniqueName flag applies to
+// fileName as it would for New.
+// If the file cannot be opened an error is returned and entries continue to
+// be held so Attach can be tried again.
+func (lp *LogFile) Attach(fileName string) error {
+	return lp.attach(fileName, nil)
+}
+
+// attach does the work of Attach and AttachFile
+func (lp *LogFile) attach(fileName string, settings *LogFile) error {
+	if !lp.deferred {
+		return fmt.Errorf("LogFile %s was not created by NewDeferred", lp.FileName)
+	}
+	if lp.Flags&AutoUniqueName == AutoUniqueName {
+		fileName = uniqueFileName(fileName, time.Now())
+	}
+	if err := validateFileName(fileName, lp.AllowedDir); err != nil {
+		return err
+	}
+
+	complete := make(chan error, 1)
+	if !lp.sendOpen(logMessage{action: attachLog, fileName: fileName, settings: settings, complete: complete}) {
+		return ErrClosed
+	}
+	return <-complete
+}
+
+// attachLog opens fileName for a pending LogFile and replays the entries
+// held for it. settings, if not nil, are from AttachFile.
+func (lp *LogFile) attachLog(fileName string, settings *LogFile) error {
+	if !lp.pending {
+		return fmt.Errorf("LogFile already attached to %s", lp.FileName)
+	}
+
+	// If attaching fails the LogFile is left as it was, still pending
+	restore := lp.attachSettings(settings)
+	failed := func(err error) error {
+		restore()
+		lp.changeFileName("")
+		return err
+	}
+
+	lp.changeFileName(fileName)
+	if err := lp.Validate(); err != nil {
+		return failed(err)
+	}
+	existing, err := claimPath(lp)
+	if err == nil && existing != nil {
+		// Sharing another LogFile's file would leave two writers
+		unregister(existing)
+		err = &FileNameError{FileName: fileName, Reason: "is already open by another LogFile"}
+	}
+	if err != nil {
+		return failed(err)
+	}
+	if !lp.startLog() {
+		unregister(lp)
+		return failed(lp.createError(fileName))
+	}
+	lp.pending = false
+	register(lp)
+
+	for _, message := range lp.pendingEntries {
+		lp.writeMessage(message)
+		if message.errorLevel {
+			lp.markErrors()
+		}
+	}
+	lp.pendingEntries = nil
+	lp.pendingBytes = 0
+	lp.printPendingDrops()
+	return nil
+}
+
+// attachSettings takes the settings AttachFile uses from settings, if not
+// nil, returning a function that puts back those there were before. Only
+// the LogFile's goroutine uses them so they can be changed there.
+func (lp *LogFile) attachSettings(settings *LogFile) (restore func()) {
+	fileMode, maxSize, oldVersions, maxTotalSize, maxAge := lp.FileMode, lp.MaxSize, lp.OldVersions, lp.MaxTotalSize, lp.MaxAge
+	restore = func() {
+		lp.FileMode, lp.MaxSize, lp.OldVersions, lp.MaxTotalSize, lp.MaxAge = fileMode, maxSize, oldVersions, maxTotalSize, maxAge
+	}
+	if settings == nil {
+		return restore
+	}
+	if settings.FileMode != 0 {
+		lp.FileMode = settings.FileMode
+	}
+	lp.MaxSize = settings.MaxSize
+	lp.OldVersions = settings.OldVersions
+	lp.MaxTotalSize = settings.MaxTotalSize
+	lp.MaxAge = settings.MaxAge
+	return restore
+}
+
+// deferLog holds a written entry until the LogFile is attached
+func (lp *LogFile) deferLog(message logMessage) {
+	maxBytes := lp.DeferredMaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultDeferredMaxBytes
+	}
+	if lp.pendingBytes+int64(len(message.data)) > maxBytes {
+		lp.pendingDrops++
+		lp.trace(TraceDrop, message.seq, len(message.data), "DeferredMaxBytes reached")
+		return
+	}
+	lp.pendingBytes += int64(len(message.data))
+	lp.pendingEntries = append(lp.pendingEntries, message)
+}
+
+// stderrPending writes out to stderr any entries still held when a pending
+// LogFile is closed
+func (lp *LogFile) stderrPending() {
+	if !lp.pending {
+		return
+	}
+	for _, message := range lp.pendingEntries {
+		lp.writeStderr(message.data)
+		lp.trace(TraceDrop, message.seq, len(message.data), "closed before a file was attached")
+	}
+	lp.pendingEntries = nil
+	lp.printPendingDrops()
+}
+
+// printPendingDrops reports entries dropped because of DeferredMaxBytes
+func (lp *LogFile) printPendingDrops() {
+	if lp.pendingDrops > 0 {
+		lp.PrintError("LogFile dropped %d entries written before a file was attached\n", lp.pendingDrops)
+		lp.pendingDrops = 0
+	}
+}
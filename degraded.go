@@ -0,0 +1,59 @@
+/*
+File summary: logfile running without a file
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "time"
+
+// If the log file can't be opened, or reopened, the LogFile carries on
+// without it: entries still go to stderr, unless FileOnly, but not the file.
+// That is counted in Stats and reported once a minute rather than for every
+// entry.
+
+// degradedInterval is how often running without a file is reported
+var degradedInterval = time.Duration(errorSeconds) * time.Second
+
+// noteDegraded counts an entry that didn't reach the file as it isn't open.
+// toStderr is true if it still went to stderr.
+func (lp *LogFile) noteDegraded(toStderr bool) {
+	if toStderr {
+		lp.stats.NoFileStderr++
+		lp.degradedStderr++
+	} else {
+		lp.stats.NoFileDrops++
+		lp.degradedDrops++
+	}
+}
+
+// reportDegraded prints, at most once every degradedInterval or always if
+// force is set, how many entries didn't reach the file since the last
+// report
+func (lp *LogFile) reportDegraded(force bool) {
+	if lp.degradedStderr == 0 && lp.degradedDrops == 0 {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(lp.degradedReported) < degradedInterval {
+		return
+	}
+	lp.PrintError("LogFile %s is not open: %d entries went only to stderr and %d were lost\n", lp.FileName, lp.degradedStderr, lp.degradedDrops)
+	lp.degradedStderr, lp.degradedDrops = 0, 0
+	lp.degradedReported = now
+}
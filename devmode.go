@@ -0,0 +1,107 @@
+/*
+File summary: logfile development mode formatting
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// ANSI terminal colours used by DevMode
+const (
+	colourReset  = "\x1b[0m"
+	colourKey    = "\x1b[36m" // cyan
+	colourDebug  = "\x1b[90m" // grey
+	colourInfo   = "\x1b[32m" // green
+	colourWarn   = "\x1b[33m" // yellow
+	colourError  = "\x1b[31m" // red
+	devIndent    = "  "
+	devLevelKeys = "level lvl severity"
+)
+
+// devKeyRegexp matches the key at the start of a line of indented JSON
+var devKeyRegexp = regexp.MustCompile(`^(\s*)("(?:[^"\\]|\\.)*")(: )(.*)$`)
+
+// devFormat is used in DevMode. If p is a JSON object it returns p compacted
+// onto a single line, for the file, and an indented, colourised version, for
+// stderr. Anything else is returned unchanged for both.
+func devFormat(p []byte) (compact []byte, pretty []byte) {
+	trimmed := bytes.TrimSpace(p)
+	if len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+		return p, p
+	}
+
+	var buf bytes.Buffer
+	if json.Compact(&buf, trimmed) != nil {
+		return p, p
+	}
+	buf.WriteByte('\n')
+	compact = buf.Bytes()
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, trimmed, "", devIndent) != nil {
+		return compact, p
+	}
+
+	var out bytes.Buffer
+	for _, line := range strings.Split(indented.String(), "\n") {
+		m := devKeyRegexp.FindStringSubmatch(line)
+		if m == nil {
+			out.WriteString(line)
+		} else {
+			out.WriteString(m[1] + colourKey + m[2] + colourReset + m[3])
+			if colour := devLevelColour(m[1], m[2], m[4]); colour != "" {
+				out.WriteString(colour + m[4] + colourReset)
+			} else {
+				out.WriteString(m[4])
+			}
+		}
+		out.WriteByte('\n')
+	}
+	return compact, out.Bytes()
+}
+
+// devLevelColour returns the colour to show a top level level field's value
+// in or "" if the key isn't a level.
+func devLevelColour(indent, key, value string) string {
+	if indent != devIndent {
+		return ""
+	}
+	key = strings.ToLower(strings.Trim(key, `"`))
+	if !strings.Contains(" "+devLevelKeys+" ", " "+key+" ") {
+		return ""
+	}
+
+	value = strings.ToUpper(value)
+	switch {
+	case strings.Contains(value, "DEBUG"), strings.Contains(value, "TRACE"):
+		return colourDebug
+	case strings.Contains(value, "WARN"):
+		return colourWarn
+	case strings.Contains(value, "ERR"), strings.Contains(value, "FATAL"), strings.Contains(value, "PANIC"):
+		return colourError
+	case strings.Contains(value, "INFO"):
+		return colourInfo
+	}
+	return ""
+}
@@ -0,0 +1,281 @@
+/*
+File summary: logfile compressing old versions with a trained dictionary
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// Logs are very repetitive, the same messages with different values, but
+// each old version compressed on its own has to learn that afresh. A
+// dictionary of typical entries, trained from past logs by TrainDictionary,
+// lets DictionaryCompactFunc compress old versions, and the GzipFile flag
+// with Dictionary the log file as it is written, much smaller, which
+// matters on edge devices shipping logs over slow links. This is not zstd:
+// the standard library has none, so the dictionary is a DEFLATE preset
+// dictionary, which limits it to MaxDictionarySize.
+// Files are written in FormatDictionary: the header, the CRC-32 of the
+// dictionary (so the wrong one is not used to read a file) and the DEFLATE
+// stream, repeated for each time a live file was opened. Read them with
+// NewDictionaryReader or NewReader.
+
+// MaxDictionarySize is the largest useful dictionary, the DEFLATE window
+const MaxDictionarySize = 32 * 1024
+
+// dictionaryVersion is the FormatDictionary version written
+const dictionaryVersion = 1
+
+// TrainDictionary returns a dictionary of up to size bytes (MaxDictionarySize
+// if size is zero or too big) made from the most common entries in the log
+// files named, which may be gzip compressed. Entries are lines, those
+// differing only in their digits (times, ids...) are counted as the same.
+func TrainDictionary(fileNames []string, size int) ([]byte, error) {
+	if size <= 0 || size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+
+	type sample struct {
+		entry []byte
+		count int
+	}
+	samples := make(map[string]*sample)
+	for _, fileName := range fileNames {
+		err := eachEntry(fileName, func(entry []byte) {
+			key := string(maskDigits(entry))
+			if s, ok := samples[key]; ok {
+				s.count++
+				return
+			}
+			samples[key] = &sample{entry: append([]byte{}, entry...), count: 1}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	common := make([]*sample, 0, len(samples))
+	for _, s := range samples {
+		common = append(common, s)
+	}
+	sort.Slice(common, func(i, j int) bool {
+		if common[i].count != common[j].count {
+			return common[i].count > common[j].count
+		}
+		return bytes.Compare(common[i].entry, common[j].entry) < 0
+	})
+
+	// Nearer matches are cheaper so the most common entries go at the end
+	var chosen [][]byte
+	total := 0
+	for _, s := range common {
+		if total+len(s.entry) > size {
+			continue
+		}
+		chosen = append(chosen, s.entry)
+		total += len(s.entry)
+	}
+	dict := make([]byte, 0, total)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		dict = append(dict, chosen[i]...)
+	}
+	return dict, nil
+}
+
+// eachEntry calls fn with every line, including its newline, of fileName
+func eachEntry(fileName string, fn func(entry []byte)) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, _, r, err := DetectFormat(f)
+	if err != nil {
+		return err
+	}
+	if format == FormatGzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			fn(line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maskDigits returns entry with all its digits replaced by 0
+func maskDigits(entry []byte) []byte {
+	masked := append([]byte{}, entry...)
+	for i, c := range masked {
+		if c >= '0' && c <= '9' {
+			masked[i] = '0'
+		}
+	}
+	return masked
+}
+
+// dictionaryHeader returns the header starting a stream compressed with
+// dict: the format's and the CRC-32 of dict
+func dictionaryHeader(dict []byte) []byte {
+	header := fileHeader(FormatDictionary, dictionaryVersion)
+	return binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(dict))
+}
+
+// headerWriter writes header ahead of the first bytes written through it.
+// With Dictionary the header is only written along with the stream, so
+// failing to write it is handled like failing to write the stream.
+type headerWriter struct {
+	w      io.Writer
+	header []byte
+}
+
+func (h *headerWriter) Write(p []byte) (int, error) {
+	if len(h.header) > 0 {
+		n, err := h.w.Write(h.header)
+		h.header = h.header[n:]
+		if err != nil {
+			return 0, err
+		}
+	}
+	return h.w.Write(p)
+}
+
+// DictionaryCompactFunc returns a CompactFunc that compresses each old
+// version with dict, in FormatDictionary
+func DictionaryCompactFunc(dict []byte) func(src io.Reader, dst io.Writer) error {
+	return func(src io.Reader, dst io.Writer) error {
+		if _, err := dst.Write(dictionaryHeader(dict)); err != nil {
+			return err
+		}
+		zw, err := flate.NewWriterDict(dst, flate.BestCompression, dict)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(zw, src); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+}
+
+// NewDictionaryReader returns a reader of the uncompressed contents of r, a
+// file written by DictionaryCompactFunc with the same dict
+func NewDictionaryReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	format, version, r, err := DetectFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	if format != FormatDictionary {
+		return nil, fmt.Errorf("LogFile file is not compressed with a dictionary")
+	}
+	return dictionaryReader(r, version, dict)
+}
+
+// dictionaryStreams reads a FormatDictionary file. A live file written with
+// Dictionary has a stream, each with its header, for each time it was
+// opened.
+type dictionaryStreams struct {
+	r    *bufio.Reader
+	dict []byte
+	zr   io.ReadCloser
+}
+
+// dictionaryReader reads r, positioned after the header of a
+// FormatDictionary file
+func dictionaryReader(r io.Reader, version int, dict []byte) (io.ReadCloser, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &dictionaryStreams{r: br, dict: dict}
+	if err := d.start(version); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// start begins reading a stream once its header, up to the version, has
+// been read
+func (d *dictionaryStreams) start(version int) error {
+	if version != dictionaryVersion {
+		return fmt.Errorf("LogFile unknown dictionary file version %d", version)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(d.r, sum[:]); err != nil {
+		return fmt.Errorf("LogFile unable to read dictionary checksum: %w", err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(d.dict) {
+		return fmt.Errorf("LogFile file was compressed with a different dictionary")
+	}
+	// d.r is an io.ByteReader so flate reads no further than the stream
+	d.zr = flate.NewReaderDict(d.r, d.dict)
+	return nil
+}
+
+func (d *dictionaryStreams) Read(p []byte) (int, error) {
+	for {
+		n, err := d.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if _, err := d.r.Peek(1); err == io.EOF {
+			return n, io.EOF
+		}
+		format, version, _, err := DetectFormat(d.r)
+		if err != nil {
+			return n, err
+		}
+		if format != FormatDictionary {
+			return n, fmt.Errorf("LogFile unexpected data after a dictionary compressed stream")
+		}
+		if err := d.start(version); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (d *dictionaryStreams) Close() error {
+	return d.zr.Close()
+}
@@ -0,0 +1,76 @@
+/*
+File summary: logfile that discards everything
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+// Discard has the same methods as a LogFile but throws away everything
+// written to it and does nothing on Flush, RotateFile or Close. Use it when
+// file logging has been turned off rather than checking for a nil LogFile.
+var Discard = discard{}
+
+type discard struct{}
+
+// Write pretends to write p
+func (discard) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+// WriteWithMeta pretends to write p
+func (discard) WriteWithMeta(p []byte, meta map[string]string) (n int, err error) {
+	return len(p), nil
+}
+
+// WriteCritical pretends to write p
+func (discard) WriteCritical(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+// WriteWithFlags pretends to write p
+func (discard) WriteWithFlags(p []byte, flags int) (n int, err error) {
+	return len(p), nil
+}
+
+// WriteKeyed pretends to write p
+func (discard) WriteKeyed(key string, p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+// WriteEntry pretends to write e
+func (discard) WriteEntry(e Entry) error {
+	return nil
+}
+
+// Flush does nothing
+func (discard) Flush() error {
+	return nil
+}
+
+// RotateFile does nothing
+func (discard) RotateFile() {}
+
+// Close does nothing
+func (discard) Close() error {
+	return nil
+}
+
+// Stats always returns zero counters
+func (discard) Stats() Stats {
+	return Stats{}
+}
@@ -0,0 +1,75 @@
+/*
+File summary: logfile structured entries
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Field names used by WriteEntry
+const (
+	TimeKey   = "time"
+	SourceKey = "source"
+)
+
+// Entry is a structured log entry made up of named fields
+type Entry map[string]interface{}
+
+// WriteEntry writes e to the log as a single line of JSON.
+// If e has no time field the current time is added. If the CallerInfo flag
+// is set the file:line of the caller (see CallerSkip) is added as a source
+// field. e itself is not modified.
+// An entry with a level field of LevelError or above is critical, see
+// SyncCritical.
+func (lp *LogFile) WriteEntry(e Entry) error {
+	return lp.writeEntry(e, 1)
+}
+
+// writeEntry does the work of WriteEntry. skip is the number of stack frames
+// between the caller of interest and writeEntry's caller.
+func (lp *LogFile) writeEntry(e Entry, skip int) error {
+	entry := make(Entry, len(e)+2)
+	for k, v := range e {
+		entry[k] = v
+	}
+	if _, ok := entry[TimeKey]; !ok {
+		entry[TimeKey] = time.Now().Format(time.RFC3339Nano)
+	}
+	if lp.Flags&CallerInfo == CallerInfo {
+		if site, ok := callSite(skip + 1 + lp.CallerSkip); ok {
+			entry[SourceKey] = site
+		}
+	}
+
+	p, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("LogFile cannot encode entry: %w", err)
+	}
+	level, hasLevel := levelOf(entry[LevelKey])
+	critical := hasLevel && level >= LevelError
+	if !critical && lp.rateLimited(skip) {
+		return nil
+	}
+	_, err = lp.write(append(p, '\n'), nil, critical, 0)
+	return err
+}
@@ -0,0 +1,130 @@
+/*
+File summary: logfile limiting the size of entries
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// OversizePolicy decides what happens to an entry bigger than MaxEntryBytes
+type OversizePolicy int
+
+const (
+	// OversizeReject drops the entry and returns ErrEntryTooBig
+	OversizeReject OversizePolicy = iota
+
+	// OversizeChunk writes the entry as several, each no bigger than
+	// MaxEntryBytes. Every chunk but the last ends in a newline, the last
+	// only if the entry did, and those after the first start with
+	// ContinuationPrefix.
+	OversizeChunk
+)
+
+// ContinuationPrefix starts each chunk, after the first, of an entry split
+// by OversizeChunk
+const ContinuationPrefix = "... "
+
+// minChunkedEntryBytes is the smallest MaxEntryBytes OversizeChunk can use,
+// leaving room for at least one byte of the entry in each chunk
+const minChunkedEntryBytes = len(ContinuationPrefix) + 2
+
+// oversized returns true if p is bigger than MaxEntryBytes
+func (lp *LogFile) oversized(p []byte) bool {
+	return lp.MaxEntryBytes > 0 && int64(len(p)) > lp.MaxEntryBytes
+}
+
+// writeOversized rejects or chunks, depending on OversizePolicy, an entry
+// bigger than MaxEntryBytes. The arguments are those of write.
+func (lp *LogFile) writeOversized(p []byte, meta map[string]string, critical bool, flags int) (n int, err error) {
+	if lp.OversizePolicy != OversizeChunk {
+		atomic.AddInt64(&lp.oversizeDrops, 1)
+		return 0, ErrEntryTooBig
+	}
+	atomic.AddInt64(&lp.oversizeChunked, 1)
+
+	// The chunks are built in one buffer, which is also the copy of p that
+	// write would make, and each is a piece of it
+	var buf []byte
+	var ends []int
+	for rest := p; len(rest) > 0; {
+		prefix := 0
+		if len(ends) > 0 {
+			buf = append(buf, ContinuationPrefix...)
+			prefix = len(ContinuationPrefix)
+		}
+		size := splitChunk(rest, int(lp.MaxEntryBytes)-prefix-1)
+		buf = append(buf, rest[:size]...)
+		rest = rest[size:]
+		if len(rest) > 0 && buf[len(buf)-1] != '\n' {
+			buf = append(buf, '\n')
+		}
+		ends = append(ends, len(buf))
+	}
+	chunks := make([][]byte, len(ends))
+	start := 0
+	for i, end := range ends {
+		chunks[i] = buf[start:end:end]
+		start = end
+	}
+	if n, err = lp.queue(buf, chunks, meta, critical, flags); n > 0 {
+		n = len(p)
+	}
+	return n, err
+}
+
+// writeMessage writes a writeLog message's entry, or each of its chunks in
+// turn stopping at the first that fails
+func (lp *LogFile) writeMessage(message logMessage) error {
+	if message.chunks == nil {
+		return lp.writeLog(message.data, message.meta, message.queued, message.seq, message.flags)
+	}
+	for _, chunk := range message.chunks {
+		if err := lp.writeLog(chunk, message.meta, message.queued, message.seq, message.flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitChunk returns how much of p to put in a chunk of at most max bytes
+// (leaving room for a newline). Chunks end at a newline when there is one,
+// and otherwise never in the middle of a UTF-8 character.
+func splitChunk(p []byte, max int) int {
+	if len(p) <= max+1 && p[len(p)-1] == '\n' {
+		return len(p)
+	}
+	if len(p) <= max {
+		return len(p)
+	}
+	if nl := bytes.LastIndexByte(p[:max], '\n'); nl >= 0 {
+		return nl + 1
+	}
+	size := max
+	for size > 0 && !utf8.RuneStart(p[size]) {
+		size--
+	}
+	if size == 0 {
+		size = max
+	}
+	return size
+}
@@ -0,0 +1,265 @@
+/*
+File summary: logfile errors
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrClosed is returned when writing to, or flushing, a LogFile that has
+// been closed
+var ErrClosed = errors.New("LogFile is closed")
+
+// ErrOverflow is returned for entries dropped because MaxPendingBytes was
+// reached (see OverflowPolicy)
+var ErrOverflow = errors.New("LogFile too much pending, entry dropped")
+
+// ErrQueueFull is returned, with the DropWhenFull flag, for entries dropped
+// because the LogFile's goroutine was too far behind to take them
+var ErrQueueFull = errors.New("LogFile queue full, entry dropped")
+
+// ErrEntryTooBig is returned for entries bigger than MaxEntryBytes (see
+// OversizePolicy)
+var ErrEntryTooBig = errors.New("LogFile entry bigger than MaxEntryBytes, entry dropped")
+
+// ErrRetrying is returned for entries that have been queued to be written
+// once earlier failed writes succeed (see RetryMaxBytes)
+var ErrRetrying = errors.New("LogFile write queued for retry")
+
+// ErrRetryDropped is returned, by Close, when entries waiting to be retried
+// (see ErrRetrying) still could not be written and were dropped
+var ErrRetryDropped = errors.New("LogFile retried entries dropped")
+
+// ErrNoFileName is returned by New when there is no FileName to use
+var ErrNoFileName = errors.New("LogFile no file name")
+
+// ErrCreateFailed is returned by New, AttachFile and SetFileName, and when
+// switching to a NewBucketed LogFile's next file, when the log file can't be
+// created or opened. The error returned wraps why as well.
+var ErrCreateFailed = errors.New("LogFile failed to create file")
+
+// ErrRotateFailed is wrapped, along with why, by errors rotating: renaming
+// old versions or reopening the log file afterwards
+var ErrRotateFailed = errors.New("LogFile failed rotating")
+
+// ErrDiskFull is wrapped, along with the OS's error, by errors writing to
+// the log file because the disk (or the user's quota) is full
+var ErrDiskFull = errors.New("LogFile disk full")
+
+// createError returns the error for failing to create fileName, wrapping
+// ErrCreateFailed and why opening it failed
+func (lp *LogFile) createError(fileName string) error {
+	if lp.openErr == nil {
+		return fmt.Errorf("%w %s", ErrCreateFailed, fileName)
+	}
+	return fmt.Errorf("%w %s: %w", ErrCreateFailed, fileName, lp.openErr)
+}
+
+// reopenError returns the error for failing to reopen the log file after
+// rotating it
+func (lp *LogFile) reopenError() error {
+	if lp.openErr == nil {
+		return fmt.Errorf("%w: reopening %s", ErrRotateFailed, lp.FileName)
+	}
+	return fmt.Errorf("%w: reopening %s: %w", ErrRotateFailed, lp.FileName, lp.openErr)
+}
+
+// fileError returns err, from writing to the log file, wrapped with
+// ErrDiskFull if that's why it failed
+func fileError(err error) error {
+	if isDiskFull(err) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+	return err
+}
+
+// noteError keeps err, from the LogFile's goroutine, for the next Write or
+// Flush to return. Until then later errors are not kept, except when
+// closing when they are all kept for Close.
+func (lp *LogFile) noteError(err error) {
+	lp.unreportedMutex.Lock()
+	if lp.closing {
+		lp.closeErrors = append(lp.closeErrors, err)
+	} else if lp.unreported == nil {
+		lp.unreported = err
+	}
+	lp.unreportedMutex.Unlock()
+}
+
+// collectErrors starts keeping every error, and any not yet reported, for
+// Close to return
+func (lp *LogFile) collectErrors() {
+	lp.unreportedMutex.Lock()
+	lp.closing = true
+	if lp.unreported != nil {
+		lp.closeErrors = append(lp.closeErrors, lp.unreported)
+		lp.unreported = nil
+	}
+	lp.unreportedMutex.Unlock()
+}
+
+// takeCloseError returns the errors kept while closing as a *CloseError, or
+// nil if there weren't any
+func (lp *LogFile) takeCloseError() error {
+	lp.unreportedMutex.Lock()
+	defer lp.unreportedMutex.Unlock()
+	errs := lp.closeErrors
+	lp.closeErrors = nil
+	if len(errs) == 0 {
+		return nil
+	}
+	return &CloseError{FileName: lp.FileName, Errors: errs}
+}
+
+// CloseError is returned by Close when anything went wrong. errors.Is and
+// errors.As look at each of the Errors.
+type CloseError struct {
+	FileName string
+	Errors   []error
+}
+
+func (e *CloseError) Error() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.Error()
+	}
+	return "LogFile errors closing " + e.FileName + ": " + strings.Join(errs, "; ")
+}
+
+// Unwrap returns the Errors, for errors.Is and errors.As
+func (e *CloseError) Unwrap() []error {
+	return e.Errors
+}
+
+// StartRotateError is passed to OnError, and counted in Stats.RotateErrors,
+// when RotateOnStart fails to rotate the file. The file is opened, and
+// appended to, anyway unless the StrictStart flag is set. Then New fails,
+// wrapping the StartRotateError. A custom RotateFileFunc is only known to
+// have failed if it calls RotateFailed.
+type StartRotateError struct {
+	FileName string
+	Err      error // wraps ErrRotateFailed
+}
+
+func (e *StartRotateError) Error() string {
+	return "LogFile failed to rotate " + e.FileName + " on start: " + e.Err.Error()
+}
+
+// Unwrap returns Err, for errors.Is and errors.As
+func (e *StartRotateError) Unwrap() error {
+	return e.Err
+}
+
+// rotateFailed counts err, wrapping ErrRotateFailed, from rotating the
+// file. It is kept, as for noteError, for Write to return unless rotating
+// on start, see rotateOnStart.
+func (lp *LogFile) rotateFailed(err error) {
+	lp.stats.RotateErrors++
+	if lp.rotateErr == nil {
+		lp.rotateErr = err
+	}
+	if !lp.startRotate {
+		lp.noteError(err)
+	}
+}
+
+// RotateFailed is for a RotateFileFunc to report err, why it failed to
+// rotate the file, as RotateFileFuncDefault does. It is counted in
+// Stats.RotateErrors and returned by the next Write or, with RotateOnStart,
+// is a StartRotateError. err is wrapped with ErrRotateFailed if it isn't
+// already. Only call it from RotateFileFunc.
+func (lp *LogFile) RotateFailed(err error) {
+	if !errors.Is(err, ErrRotateFailed) {
+		err = fmt.Errorf("%w: %w", ErrRotateFailed, err)
+	}
+	lp.rotateFailed(err)
+}
+
+// rotateOnStart rotates the file, for RotateOnStart, returning a
+// *StartRotateError, also passed to OnError, if that failed. The first
+// Write isn't given the error, it is for New (with StrictStart) to return.
+func (lp *LogFile) rotateOnStart() error {
+	lp.rotateErr = nil
+	lp.startRotate = true
+	lp.RotateFileFunc()
+	lp.startRotate = false
+	err := lp.rotateErr
+	lp.rotateErr = nil
+	if err == nil {
+		return nil
+	}
+	startErr := &StartRotateError{FileName: lp.FileName, Err: err}
+	if lp.OnError != nil {
+		lp.OnError(startErr)
+	}
+	return startErr
+}
+
+// takeError returns, and forgets, the error kept by noteError
+func (lp *LogFile) takeError() error {
+	lp.unreportedMutex.Lock()
+	defer lp.unreportedMutex.Unlock()
+	err := lp.unreported
+	lp.unreported = nil
+	return err
+}
+
+// FileNameError is returned by New when FileName is not acceptable
+type FileNameError struct {
+	FileName string
+	Reason   string
+}
+
+func (e *FileNameError) Error() string {
+	return fmt.Sprintf("LogFile invalid file name %q: %s", e.FileName, e.Reason)
+}
+
+// validateFileName checks fileName is usable as a log file name and, if
+// allowedDir is not empty, that it is inside allowedDir.
+func validateFileName(fileName, allowedDir string) error {
+	if strings.IndexByte(fileName, 0) >= 0 {
+		return &FileNameError{FileName: fileName, Reason: "contains a NUL byte"}
+	}
+	if strings.HasSuffix(fileName, "/") || strings.HasSuffix(fileName, string(os.PathSeparator)) {
+		return &FileNameError{FileName: fileName, Reason: "ends in a path separator"}
+	}
+	if allowedDir == "" {
+		return nil
+	}
+
+	dir, err := filepath.Abs(allowedDir)
+	if err != nil {
+		return &FileNameError{FileName: fileName, Reason: fmt.Sprintf("cannot find allowed directory %s: %s", allowedDir, err)}
+	}
+	name, err := filepath.Abs(fileName)
+	if err != nil {
+		return &FileNameError{FileName: fileName, Reason: fmt.Sprintf("cannot find absolute path: %s", err)}
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &FileNameError{FileName: fileName, Reason: "is outside of " + allowedDir}
+	}
+	return nil
+}
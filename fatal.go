@@ -0,0 +1,89 @@
+/*
+File summary: logfile flushing before log.Fatal exits
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"io"
+	"log"
+	"runtime"
+	"strings"
+)
+
+// fatalFrames is how far up the stack FatalWriter looks for log.Fatal
+const fatalFrames = 10
+
+// HookFatal makes sure entries logged with the standard logger's Fatal
+// functions, and everything logged before them, are on disk before
+// os.Exit is called. Without it anything still buffered is lost. It wraps
+// the standard logger's output, so call it after log.SetOutput.
+func HookFatal() {
+	log.SetOutput(FatalWriter(log.Writer()))
+}
+
+// FatalWriter returns w, usually a LogFile, wrapped so that writes made by
+// a log.Logger's Fatal, Fatalf or Fatalln are followed by a Sync of w, if
+// it is a LogFile, and SyncAll. Use it as the output of a log.Logger other
+// than the standard one, see HookFatal.
+func FatalWriter(w io.Writer) io.Writer {
+	return &fatalWriter{w}
+}
+
+type fatalWriter struct {
+	w io.Writer
+}
+
+func (fw *fatalWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if calledFromFatal() {
+		if lp, ok := fw.w.(*LogFile); ok {
+			lp.Sync()
+		}
+		SyncAll()
+	}
+	return n, err
+}
+
+// calledFromFatal returns true if a log package Fatal function is on the
+// stack
+func calledFromFatal() bool {
+	pcs := make([]uintptr, fatalFrames)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if isFatalFunction(frame.Function) {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+// isFatalFunction returns true for log.Fatal and log.(*Logger).Fatal and
+// their f and ln versions
+func isFatalFunction(function string) bool {
+	name := strings.TrimPrefix(function, "log.")
+	if name == function {
+		return false
+	}
+	name = strings.TrimPrefix(name, "(*Logger).")
+	return name == "Fatal" || name == "Fatalf" || name == "Fatalln"
+}
@@ -0,0 +1,96 @@
+/*
+File summary: logfile logfile writing to a named pipe (FIFO)
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"errors"
+	"os"
+)
+
+// errNoReader is returned writing to a named pipe nothing is reading from
+var errNoReader = errors.New("LogFile no reader on named pipe")
+
+// fifoSink is the Sink used when FileName is a named pipe (FIFO), as read
+// by a pipe based log collector. A pipe has no size and nothing to set
+// aside so it is never rotated. Nothing waits for a reader: until there is
+// one writes fail, and so are retried like any failed write, and when the
+// reader goes away the next one is waited for the same way.
+type fifoSink struct {
+	name string
+	file *os.File // nil while there is no reader
+}
+
+// isFIFO returns true if fileName is a named pipe
+func isFIFO(fileName string) bool {
+	fi, err := os.Stat(fileName)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// fifo returns true if the LogFile is writing to a named pipe. Closing it
+// to rotate would end the reader's input so it is never rotated.
+func (lp *LogFile) fifo() bool {
+	_, ok := lp.Sink.(*fifoSink)
+	return ok
+}
+
+// Open tries to connect to a reader, there not being one yet is not an error
+func (s *fifoSink) Open(truncate bool) error {
+	if err := s.connect(); err != nil && err != errNoReader {
+		return err
+	}
+	return nil
+}
+
+func (s *fifoSink) Write(p []byte) (int, error) {
+	if s.file == nil {
+		if err := s.connect(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(p)
+	if err != nil {
+		// Most likely the reader has gone (EPIPE)
+		s.file.Close()
+		s.file = nil
+	}
+	return n, err
+}
+
+func (s *fifoSink) Flush() error {
+	return nil
+}
+
+func (s *fifoSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *fifoSink) Size() (int64, error) {
+	return 0, nil
+}
+
+func (s *fifoSink) Rotate() error {
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+/*
+File summary: logfile logfile opening a named pipe on Unix
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// connect opens the pipe for writing. Opening non-blocking fails at once,
+// rather than waiting, when there is no reader.
+func (s *fifoSink) connect() error {
+	f, err := os.OpenFile(s.name, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ENXIO) {
+		return errNoReader
+	}
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+File summary: logfile GELF (Graylog) format and UDP sink
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// GELFChunkSize is the default largest UDP packet GELFWriter sends,
+	// suitable for most networks
+	GELFChunkSize = 1420
+
+	gelfVersion     = "1.1"
+	gelfChunkHeader = 12
+	gelfMaxChunks   = 128
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// ErrGELFTooBig is returned by GELFWriter for a message needing more than
+// the 128 chunks GELF allows, which is dropped as Graylog would discard it.
+// As a Tee it is counted in Stats().TeeErrors.
+var ErrGELFTooBig = errors.New("LogFile GELF message too big, dropped")
+
+// gelfLevel maps a Level to the syslog severity used by GELF
+func gelfLevel(level Level) int {
+	switch {
+	case level >= LevelError:
+		return 3
+	case level >= LevelWarn:
+		return 4
+	case level >= LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// gelfMessage returns p as a GELF message from host. meta, as passed to a
+// Formatter, becomes additional fields.
+func gelfMessage(host string, p []byte, meta map[string]string, t time.Time) map[string]interface{} {
+	message := map[string]interface{}{
+		"version":       gelfVersion,
+		"host":          host,
+		"short_message": string(bytes.TrimRight(p, "\n")),
+		"timestamp":     float64(t.UnixNano()) / float64(time.Second),
+		"level":         gelfLevel(LevelInfo),
+	}
+	for k, v := range meta {
+		if k == LevelKey {
+			if level, ok := ParseLevel(v); ok {
+				message["level"] = gelfLevel(level)
+				continue
+			}
+		}
+		// Fields must not start with _ or be called _id
+		if k == "id" {
+			k = "id_"
+		}
+		message["_"+k] = v
+	}
+	return message
+}
+
+// GELFFormatter returns a Formatter that writes entries as GELF messages,
+// one JSON object per line, with host as the source host (the hostname if
+// empty). Metadata passed to WriteWithMeta becomes additional fields.
+func GELFFormatter(host string) func(p []byte, meta map[string]string) []byte {
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return func(p []byte, meta map[string]string) []byte {
+		b, err := json.Marshal(gelfMessage(host, p, meta, time.Now()))
+		if err != nil {
+			return p
+		}
+		return append(b, '\n')
+	}
+}
+
+// GELFWriter sends entries to a Graylog server as GELF over UDP. Use it as
+// one of a LogFile's Tees so the file remains as a durable copy.
+// Entries that are already GELF (see GELFFormatter) are sent as they are,
+// anything else is wrapped as a GELF message.
+type GELFWriter struct {
+	// Host is the source host of wrapped entries
+	Host string
+
+	// ChunkSize is the largest UDP packet sent, larger messages are split
+	// into GELF chunks. Zero means GELFChunkSize.
+	ChunkSize int
+
+	// Compress gzips messages before sending
+	Compress bool
+
+	conn net.Conn
+}
+
+// NewGELFWriter returns a GELFWriter sending to the Graylog GELF UDP input
+// at addr (host:port)
+func NewGELFWriter(addr string) (*GELFWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("LogFile cannot connect to GELF server %s: %w", addr, err)
+	}
+	host, _ := os.Hostname()
+	return &GELFWriter{Host: host, conn: conn}, nil
+}
+
+// Write sends p as a GELF message
+func (g *GELFWriter) Write(p []byte) (n int, err error) {
+	message := bytes.TrimRight(p, "\n")
+	var gelf map[string]interface{}
+	if json.Unmarshal(message, &gelf) != nil || gelf["version"] == nil {
+		message, err = json.Marshal(gelfMessage(g.Host, p, nil, time.Now()))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if g.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(message)
+		zw.Close()
+		message = buf.Bytes()
+	}
+
+	packets := gelfChunks(message, g.ChunkSize)
+	if packets == nil {
+		return 0, ErrGELFTooBig
+	}
+	for _, packet := range packets {
+		_, err = g.conn.Write(packet)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes the connection to the server
+func (g *GELFWriter) Close() error {
+	return g.conn.Close()
+}
+
+// gelfChunks splits message into the packets to send. Small messages are
+// sent as they are, larger ones as GELF chunks of at most chunkSize. It
+// returns nil if message needs more than gelfMaxChunks.
+func gelfChunks(message []byte, chunkSize int) [][]byte {
+	if chunkSize <= gelfChunkHeader {
+		chunkSize = GELFChunkSize
+	}
+	if len(message) <= chunkSize {
+		return [][]byte{message}
+	}
+
+	payload := chunkSize - gelfChunkHeader
+	count := (len(message) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		// Graylog would throw away all of it, or a part
+		return nil
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * payload
+		end := start + payload
+		if end > len(message) {
+			end = len(message)
+		}
+		packet := make([]byte, 0, gelfChunkHeader+end-start)
+		packet = append(packet, gelfChunkMagic...)
+		packet = append(packet, id...)
+		packet = append(packet, byte(i), byte(count))
+		packet = append(packet, message[start:end]...)
+		packets = append(packets, packet)
+	}
+	return packets
+}
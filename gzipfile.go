@@ -0,0 +1,114 @@
+/*
+File summary: logfile writing the log file gzip compressed
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+// With the GzipFile flag the log file is written gzip compressed. Every
+// flush is a gzip sync flush so everything written so far can be read with
+// zcat, or followed with tail -f | gunzip, while the file is still open.
+// Each time the file is opened a new gzip member is started, so appending
+// to an existing file still gives a valid gzip file. With a Dictionary it is
+// a FormatDictionary stream instead, which can be appended to the same way.
+
+// compressor is what a GzipFile is written through, a gzip.Writer or with a
+// Dictionary a flate.Writer
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// startGzip starts a gzip member for the newly opened file
+func (lp *LogFile) startGzip() {
+	lp.gzip = nil
+	if lp.Flags&GzipFile != GzipFile {
+		return
+	}
+	lp.compressedSize = lp.size
+	w := &countingWriter{w: lp.fileTarget(), n: &lp.compressedSize}
+	if lp.Dictionary != nil {
+		// Only a bad level is an error
+		lp.gzip, _ = flate.NewWriterDict(&headerWriter{w: w, header: dictionaryHeader(lp.Dictionary)}, flate.DefaultCompression, lp.Dictionary)
+		return
+	}
+	lp.gzip = gzip.NewWriter(w)
+}
+
+// bufTarget returns what buf writes to
+func (lp *LogFile) bufTarget() io.Writer {
+	if lp.gzip != nil {
+		return lp.gzip
+	}
+	return lp.fileTarget()
+}
+
+// flushGzip makes everything written so far readable in the file. If that
+// fails what was flushed from buf is retried.
+func (lp *LogFile) flushGzip() error {
+	if lp.gzip == nil {
+		return nil
+	}
+	err := lp.gzip.Flush()
+	if err != nil {
+		lp.PrintError("LogFile error flushing %s: %s\n", lp.FileName, err)
+		lp.noteError(err)
+		// None of the unflushed entries can be relied on to be in the file
+		unflushed := 0
+		for _, e := range lp.unflushed {
+			unflushed += len(e.data)
+		}
+		lp.stats.FileBytes -= int64(unflushed)
+		lp.lifetimeBytes -= int64(unflushed)
+		lp.size -= int64(unflushed)
+		lp.retryUnwritten(unflushed)
+	}
+	return err
+}
+
+// closeGzip ends the gzip member, once buf has been flushed, before the file
+// is closed
+func (lp *LogFile) closeGzip() {
+	if lp.gzip == nil {
+		return
+	}
+	err := lp.gzip.Close()
+	if err != nil {
+		lp.PrintError("LogFile error closing %s: %s\n", lp.FileName, err)
+	}
+	lp.gzip = nil
+}
@@ -0,0 +1,188 @@
+/*
+File summary: logfile many log files chosen by key
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// KeyedLogs opens, on first use, a LogFile for each key (tenant, component,
+// audit...). Every LogFile has its own goroutine and opening one doesn't
+// hold up the others, so a stalled disk under one log (an NFS mounted
+// audit log, say) doesn't block writes to the rest. Create it with
+// NewKeyedLogs.
+type KeyedLogs struct {
+	// Workers, if greater than zero, is how many of the LogFiles Flush and
+	// Close work on at once. Zero means all of them.
+	Workers int
+
+	newFunc func(key string) *LogFile
+	mutex   sync.Mutex
+	logs    map[string]*keyedLog
+}
+
+// keyedLog is one key's LogFile, ready is closed once it has been opened
+type keyedLog struct {
+	ready chan struct{}
+	lp    *LogFile
+	err   error
+}
+
+// NewKeyedLogs returns a KeyedLogs that calls newFunc for the settings
+// (FileName and so on) of the LogFile for a key the first time the key is
+// used. It is then passed to New.
+func NewKeyedLogs(newFunc func(key string) *LogFile) *KeyedLogs {
+	return &KeyedLogs{newFunc: newFunc, logs: make(map[string]*keyedLog)}
+}
+
+// Get returns key's LogFile, opening it if this is the first time. Only
+// those getting the same key wait for it to be opened. If it couldn't be
+// opened the error is returned, and tried again next time.
+func (k *KeyedLogs) Get(key string) (*LogFile, error) {
+	k.mutex.Lock()
+	kl, ok := k.logs[key]
+	if !ok {
+		kl = &keyedLog{ready: make(chan struct{})}
+		k.logs[key] = kl
+	}
+	k.mutex.Unlock()
+
+	if !ok {
+		k.openKey(key, kl)
+	}
+	<-kl.ready
+	return kl.lp, kl.err
+}
+
+// openKey opens key's LogFile for kl. Should newFunc, or New, panic those
+// waiting for it are given an error, and the key is tried again next time,
+// as the panic carries on.
+func (k *KeyedLogs) openKey(key string, kl *keyedLog) {
+	kl.err = fmt.Errorf("LogFile opening the log for key %s panicked", key)
+	defer func() {
+		if kl.err != nil {
+			k.mutex.Lock()
+			delete(k.logs, key)
+			k.mutex.Unlock()
+		}
+		close(kl.ready)
+	}()
+	kl.lp, kl.err = New(k.newFunc(key))
+}
+
+// Write writes p to key's LogFile
+func (k *KeyedLogs) Write(key string, p []byte) (n int, err error) {
+	lp, err := k.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return lp.Write(p)
+}
+
+// Keys returns, sorted, the keys with an open LogFile
+func (k *KeyedLogs) Keys() []string {
+	k.mutex.Lock()
+	keys := make([]string, 0, len(k.logs))
+	for key, kl := range k.logs {
+		select {
+		case <-kl.ready:
+			if kl.err == nil {
+				keys = append(keys, key)
+			}
+		default:
+		}
+	}
+	k.mutex.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// Flush flushes every LogFile, Workers at a time, returning the first error
+func (k *KeyedLogs) Flush() error {
+	return forEachLogFile(k.open(false), k.Workers, (*LogFile).Flush)
+}
+
+// Close closes every LogFile, Workers at a time, returning the first error.
+// Keys used afterwards get new LogFiles.
+func (k *KeyedLogs) Close() error {
+	return forEachLogFile(k.open(true), k.Workers, (*LogFile).Close)
+}
+
+// open returns the open LogFiles, forgetting them if forget is true
+func (k *KeyedLogs) open(forget bool) []*LogFile {
+	k.mutex.Lock()
+	kls := make([]*keyedLog, 0, len(k.logs))
+	for _, kl := range k.logs {
+		kls = append(kls, kl)
+	}
+	if forget {
+		k.logs = make(map[string]*keyedLog)
+	}
+	k.mutex.Unlock()
+
+	var logFiles []*LogFile
+	for _, kl := range kls {
+		<-kl.ready
+		if kl.err == nil {
+			logFiles = append(logFiles, kl.lp)
+		}
+	}
+	return logFiles
+}
+
+// forEachLogFile calls fn on each of logFiles, workers at a time (all at
+// once if workers is not greater than zero), so one that is stuck doesn't
+// stop the others being done. It returns the first error.
+func forEachLogFile(logFiles []*LogFile, workers int, fn func(*LogFile) error) error {
+	if workers <= 0 || workers > len(logFiles) {
+		workers = len(logFiles)
+	}
+	work := make(chan *LogFile)
+	errs := make(chan error, len(logFiles))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		goroutineStarted()
+		go func() {
+			defer goroutineStopped()
+			defer wg.Done()
+			for lp := range work {
+				errs <- fn(lp)
+			}
+		}()
+	}
+	for _, lp := range logFiles {
+		work <- lp
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	var first error
+	for err := range errs {
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,85 @@
+/*
+File summary: logfile goroutine counting and leak detection
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// goroutineCount is the number of goroutines started by LogFiles that have
+// not yet finished
+var goroutineCount int64
+
+// leakTracking records where each LogFile was opened for CheckLeaks. It is
+// turned on by building with -tags logfiledebug.
+var leakTracking = false
+
+// GoroutineCount returns the number of goroutines LogFiles are currently
+// running. Once every LogFile is closed it should return to zero, tests can
+// use it to check nothing was left behind.
+func GoroutineCount() int {
+	return int(atomic.LoadInt64(&goroutineCount))
+}
+
+// goroutineStarted counts a goroutine about to be started
+func goroutineStarted() {
+	atomic.AddInt64(&goroutineCount, 1)
+}
+
+// goroutineStopped counts a goroutine finishing
+func goroutineStopped() {
+	atomic.AddInt64(&goroutineCount, -1)
+}
+
+// CheckLeaks returns an error naming every LogFile, including Unregistered
+// ones, that is open. Call it at the end of tests once everything should
+// have been closed. When built with -tags logfiledebug the error includes
+// the stack of where each was opened.
+func CheckLeaks() error {
+	registry.Lock()
+	var leaks []string
+	for _, lp := range registry.paths {
+		leak := lp.CurrentFileName()
+		if lp.openedBy != "" {
+			leak += " opened at:\n" + lp.openedBy
+		}
+		leaks = append(leaks, leak)
+	}
+	registry.Unlock()
+
+	if len(leaks) == 0 {
+		return nil
+	}
+	sort.Strings(leaks)
+	return fmt.Errorf("LogFile %d not closed: %s", len(leaks), strings.Join(leaks, "\n"))
+}
+
+// trackOpen records where lp was opened, if leakTracking
+func trackOpen(lp *LogFile) {
+	if leakTracking {
+		stack := make([]byte, 4096)
+		lp.openedBy = string(stack[:runtime.Stack(stack, false)])
+	}
+}
@@ -0,0 +1,88 @@
+/*
+File summary: logfile entry levels
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the importance of an entry. The values match log/slog's levels.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+// LevelKey is the name of the level field in entries and metadata
+const LevelKey = "level"
+
+// String returns the level's name
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel returns the Level named by s. Case is ignored and common
+// alternatives (WARNING, ERR, FATAL...) are accepted.
+func ParseLevel(s string) (Level, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG", "TRACE":
+		return LevelDebug, true
+	case "INFO", "NOTICE":
+		return LevelInfo, true
+	case "WARN", "WARNING":
+		return LevelWarn, true
+	case "ERROR", "ERR", "FATAL", "PANIC", "CRITICAL":
+		return LevelError, true
+	}
+	return LevelInfo, false
+}
+
+// levelOf returns the level held in a level field, which may be a Level,
+// a number or a level name
+func levelOf(v interface{}) (Level, bool) {
+	switch l := v.(type) {
+	case Level:
+		return l, true
+	case int:
+		return Level(l), true
+	case float64:
+		return Level(l), true
+	case string:
+		return ParseLevel(l)
+	case fmt.Stringer:
+		return ParseLevel(l.String())
+	}
+	return LevelInfo, false
+}
@@ -0,0 +1,125 @@
+/*
+File summary: logfile New once only and Reset
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+)
+
+// A LogFile can only be passed to New (or NewDeferred) once. Calling New
+// again would start a second goroutine sharing the first one's channels. Once
+// Closed it can be used again by calling Reset.
+
+// ErrInUse is returned by New and NewDeferred when given a LogFile they have
+// already been given, and by Reset when the LogFile hasn't been closed
+var ErrInUse = errors.New("LogFile already in use, Close and Reset it first")
+
+// claim marks lp as being used by New, returning false if it already is
+func (lp *LogFile) claim() bool {
+	return atomic.CompareAndSwapInt32(&lp.used, 0, 1)
+}
+
+// release is called when New fails, or returns another LogFile (see
+// ReuseDuplicate), so that lp can be passed to New again
+func (lp *LogFile) release() {
+	atomic.StoreInt32(&lp.used, 0)
+}
+
+// defaultedSetting is a setting New filled in from the defaults, and the value
+// it was given
+type defaultedSetting struct {
+	field int
+	value reflect.Value
+}
+
+// zeroSettings returns the index of each exported field of lp left unset
+func (lp *LogFile) zeroSettings() []int {
+	v := reflect.ValueOf(lp).Elem()
+	t := v.Type()
+	var zero []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" && v.Field(i).IsZero() {
+			zero = append(zero, i)
+		}
+	}
+	return zero
+}
+
+// noteDefaults records which of the fields zeroSettings found unset have
+// since been filled in, so Reset can clear them again
+func (lp *LogFile) noteDefaults(zero []int) {
+	v := reflect.ValueOf(lp).Elem()
+	for _, i := range zero {
+		if !v.Field(i).IsZero() {
+			value := reflect.New(v.Field(i).Type()).Elem()
+			value.Set(v.Field(i))
+			lp.defaulted = append(lp.defaulted, defaultedSetting{i, value})
+		}
+	}
+}
+
+// Reset makes a closed LogFile ready to be passed to New again. Its settings
+// are kept but everything else (Stats, state left by the last run...) is
+// cleared. Settings New filled in from the defaults, such as RotateFileFunc or
+// the Sink for a FIFO, are cleared too, unless changed since, so New fills
+// them in again. FileName goes back to what was given to New, before
+// AutoUniqueName or Attach changed it.
+// Reset returns ErrInUse if the LogFile is still open.
+func (lp *LogFile) Reset() error {
+	if atomic.LoadInt32(&lp.used) == 0 {
+		return nil
+	}
+	lp.closeMutex.RLock()
+	closed := lp.closed
+	lp.closeMutex.RUnlock()
+	if !closed {
+		return ErrInUse
+	}
+	fileName := lp.givenFileName
+
+	// Only the exported fields are settings, the rest go back to zero
+	v := reflect.ValueOf(lp).Elem()
+	t := v.Type()
+	for _, d := range lp.defaulted {
+		field := v.Field(d.field)
+		// funcs can't be compared, they are always cleared
+		if !field.Comparable() || !d.value.Comparable() || field.Equal(d.value) {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	settings := make([]reflect.Value, t.NumField())
+	for i := range settings {
+		if t.Field(i).PkgPath == "" {
+			settings[i] = reflect.New(t.Field(i).Type).Elem()
+			settings[i].Set(v.Field(i))
+		}
+	}
+	*lp = LogFile{}
+	for i, setting := range settings {
+		if setting.IsValid() {
+			v.Field(i).Set(setting)
+		}
+	}
+	lp.FileName = fileName
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+File summary: logfile advisory locking of log files
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockPoll is how often LockFile retries a lock held by another
+const lockPoll = 10 * time.Millisecond
+
+// ErrLockTimeout is returned by LockFile when the lock was not free in time
+var ErrLockTimeout = errors.New("LogFile timed out waiting for lock")
+
+// ErrLockUnsupported is returned by LockFile where the system has no file
+// locking
+var ErrLockUnsupported = errors.New("LogFile locking not supported on this platform")
+
+// FileLock is a lock taken by LockFile
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile takes the advisory lock on fileName that LogFiles with the
+// SharedFile flag hold while writing to or rotating fileName, so an external
+// tool (or a RotateFileFunc of a LogFile without SharedFile) can work on the
+// file without a sharing process writing to it at the same time. The lock is
+// on fileName plus ".lock", created if need be.
+// If another holds the lock LockFile waits for up to timeout, returning
+// ErrLockTimeout if it is still held, or forever if timeout is zero or less.
+// A SharedFile LogFile's RotateFileFunc is already called holding the lock
+// so must not call LockFile, which would wait for itself.
+// Locking uses flock, or LockFileEx on Windows. Elsewhere LockFile returns
+// ErrLockUnsupported, as nothing could be locked, and SharedFile can't be
+// used.
+func LockFile(fileName string, timeout time.Duration) (*FileLock, error) {
+	if !lockSupported {
+		return nil, ErrLockUnsupported
+	}
+	f, err := os.OpenFile(fileName+lockSuffix, os.O_RDWR|os.O_CREATE, Defaults.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		err = lockFile(f)
+	} else {
+		err = tryLockUntil(f, time.Now().Add(timeout))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{file: f}, nil
+}
+
+// tryLockUntil retries locking f until deadline
+func tryLockUntil(f *os.File, deadline time.Time) error {
+	for {
+		locked, err := tryLockFile(f)
+		if locked || err != nil {
+			return err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrLockTimeout
+		}
+		if wait > lockPoll {
+			wait = lockPoll
+		}
+		time.Sleep(wait)
+	}
+}
+
+// UnlockFile releases a lock taken by LockFile
+func UnlockFile(lock *FileLock) error {
+	err := unlockFile(lock.file)
+	if closeErr := lock.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
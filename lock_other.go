@@ -0,0 +1,43 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+/*
+File summary: logfile where there is no file locking
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "os"
+
+// lockSupported is true where lockFile really locks, see LockFile
+const lockSupported = false
+
+// lockFile fails where there is no flock, rather than pretend to lock
+func lockFile(f *os.File) error {
+	return ErrLockUnsupported
+}
+
+// tryLockFile fails where there is no flock
+func tryLockFile(f *os.File) (bool, error) {
+	return false, ErrLockUnsupported
+}
+
+// unlockFile fails where there is no flock
+func unlockFile(f *os.File) error {
+	return ErrLockUnsupported
+}
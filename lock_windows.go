@@ -0,0 +1,88 @@
+//go:build windows
+
+/*
+File summary: logfile file locking with LockFileEx
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// lockSupported is true where lockFile really locks, see LockFile
+const lockSupported = true
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	// errorLockViolation is returned by LockFileEx when another holds
+	// the lock
+	errorLockViolation syscall.Errno = 33
+
+	// allBytes is the low and high halves of the length locked
+	allBytes = uintptr(^uint32(0))
+)
+
+// lockFileEx locks all of f, as much as there could be, with flags
+func lockFileEx(f *os.File, flags uint32) error {
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, allBytes, allBytes, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// lockFile waits for an exclusive lock on f
+func lockFile(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock)
+}
+
+// tryLockFile takes an exclusive lock on f if it is free, returning false if
+// another holds it
+func tryLockFile(f *os.File) (bool, error) {
+	err := lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately)
+	switch err {
+	case nil:
+		return true, nil
+	case errorLockViolation:
+		return false, nil
+	}
+	return false, err
+}
+
+// unlockFile releases the lock on f
+func unlockFile(f *os.File) error {
+	var overlapped syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, allBytes, allBytes, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -32,31 +32,38 @@ LogFile supports the following features:
 
  A log file can be moved aside outside of the program (perhaps by something
  like Linux's logrotate) and LogFile will detect this and close/reopen the file
+ (at once on a SIGHUP with EnableSignalHandling)
 
  A default rotate function is provided but users can provide their own (see
  RotateFile). The default uses the OldVersions value to decide how many
  versions to keep. Note that writing to the log is blocked while rotating so
  keep RotateFile quick.
 
- By default messages are still sent to standard error as well as the file
+ By default messages are still sent to standard error (or AlsoWrite) as well as the file
 
  There are command line flags to override default behavior (requires
- flag.Parse to be called)
+ RegisterFlags and flag.Parse to be called)
 
  Actually buffering can result in a lot less writes which is useful on devices
  (like flash memory) that have limited write cycles. The downside is that
- messages may be lost on panic or unplanned exit.
+ messages may be lost on panic or unplanned exit (use HookFatal for log.Fatal).
 
 Note that LogFile creates a goroutine on New. To ensure its deleted call Close
 
 Command line arguments:
+  -logcheck duration
+    	Default interval to check log file still exists, such as 2m (overrides -logcheckseconds)
   -logcheckseconds int
     	Default seconds to check log file still exists (default 60)
   -logfile string
     	Use as the filename for the first LogFile created without a filename
+  -logflush duration
+    	Default interval to wait before flushing pending writes to the log file, such as 500ms (overrides -logflushseconds)
   -logflushseconds int
     	Default seconds to wait before flushing pending writes to the log file (default -1)
 		If <= 0 then the log is writen before returning.
+  -loglevels string
+    	Default component levels as component=level,... (levels: debug, info, warn, error)
   -logmax int
     	Default maximum file size, 0 = no limit
   -lognostderr
@@ -65,6 +72,9 @@ Command line arguments:
     	Default old versions of file to keep (otherwise deleted)
 
 Example:
+	logfile.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	// was -logfile passed?
 	if logfile.Defaults.FileName != "" {
 		logFileName = logfile.Defaults.FileName
@@ -88,9 +98,18 @@ package logfile
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -107,6 +126,10 @@ var (
 	}
 	NoStderr = false
 
+	// ComponentLevels are the levels new components start at, in the form
+	// component=level,component=level... See also the -loglevels command line flag
+	ComponentLevels = ""
+
 	errorSeconds        = 60
 	defaultFileNameUsed = false
 )
@@ -116,25 +139,65 @@ const (
 	FileOnly         = 1 << iota // Log only to file, not to stderr
 	OverWriteOnStart             // Note the default is to append
 	RotateOnStart
-	NoErrors // Disables printing internal errors to stderr
+	NoErrors          // Disables printing internal errors to stderr
+	DevMode           // JSON entries are pretty printed to stderr, compacted in the file
+	CallerInfo        // WriteEntry adds the caller's file:line to entries
+	ExclusiveCreate   // New fails if the log file already exists
+	AutoUniqueName    // New adds the time and pid to FileName to make it unique
+	SyncCritical      // Critical entries are flushed and synced to disk at once
+	VerifyArchives    // Check the output of CompactFunc before replacing the original
+	Unregistered      // Leave out of ListOpenLogFiles, FlushAll and CloseAll
+	ReuseDuplicate    // New returns the LogFile already open on FileName, if any
+	RotateDaily       // Rotate at the first write of each new (local) day
+	StderrOnly        // Per write (see WriteWithFlags), to stderr but not the file
+	Checksum          // Record a checksum of each file at rotation, see VerifyChecksums
+	Synchronous       // No goroutine or timers, work is done by the caller, see CheckVanished
+	GzipFile          // Write the file gzip compressed, MaxSize is then the compressed size
+	WatchFile         // Notice at once when the file is moved or deleted, where supported
+	TimestampVersions // Name old versions by the time they were rotated, see TimestampVersionFormat
+	SharedFile        // Several processes write to the file, see SharedIdentity
+	VerifyWrites      // Read back each write to the file and compare checksums, see Stats.VerifyErrors
+	CopyTruncate      // Rotate by copying the file then truncating it, for files others have open
+	DropWhenFull      // Write drops the entry, rather than waiting, when the queue is full, see Stats.FullDrops
+	StrictStart       // New fails if RotateOnStart can't rotate the file, see StartRotateError
 
 	truncateLog   = true
 	noTruncateLog = false
 )
 
-func init() {
-	flag.StringVar(&Defaults.FileName, "logfile", Defaults.FileName, "Use as the filename for the first LogFile created without a filename")
-	flag.Int64Var(&Defaults.MaxSize, "logmax", Defaults.MaxSize, "Default maximum file size, 0 = no limit")
-	flag.IntVar(&Defaults.OldVersions, "logversions", Defaults.OldVersions, "Default old versions of file to keep (otherwise deleted)")
-	flag.BoolVar(&NoStderr, "lognostderr", NoStderr, "Default to no logging to stderr")
-	flag.IntVar(&Defaults.CheckSeconds, "logcheckseconds", Defaults.CheckSeconds, "Default seconds to check log file still exists")
-	flag.IntVar(&Defaults.FlushSeconds, "logflushseconds", Defaults.FlushSeconds, "Default seconds to wait before flushing pending writes to the log file")
+// RegisterFlags adds the command line flags that set Defaults (see the
+// package documentation) to fs, usually flag.CommandLine. Importing the
+// package doesn't add them so that libraries using it don't take flag
+// names their programs may want. Call it once per FlagSet, before parsing.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&Defaults.FileName, "logfile", Defaults.FileName, "Use as the filename for the first LogFile created without a filename")
+	fs.Int64Var(&Defaults.MaxSize, "logmax", Defaults.MaxSize, "Default maximum file size, 0 = no limit")
+	fs.IntVar(&Defaults.OldVersions, "logversions", Defaults.OldVersions, "Default old versions of file to keep (otherwise deleted)")
+	fs.BoolVar(&NoStderr, "lognostderr", NoStderr, "Default to no logging to stderr")
+	fs.IntVar(&Defaults.CheckSeconds, "logcheckseconds", Defaults.CheckSeconds, "Default seconds to check log file still exists")
+	fs.IntVar(&Defaults.FlushSeconds, "logflushseconds", Defaults.FlushSeconds, "Default seconds to wait before flushing pending writes to the log file")
+	fs.DurationVar(&Defaults.CheckInterval, "logcheck", Defaults.CheckInterval, "Default interval to check log file still exists, such as 2m (overrides -logcheckseconds)")
+	fs.DurationVar(&Defaults.FlushInterval, "logflush", Defaults.FlushInterval, "Default interval to wait before flushing pending writes to the log file, such as 500ms (overrides -logflushseconds)")
+	fs.StringVar(&ComponentLevels, "loglevels", ComponentLevels, "Default component levels as component=level,... (levels: debug, info, warn, error)")
+}
 
-	if NoStderr {
-		Defaults.Flags = FileOnly
-	}
+// Logger is implemented by LogFile and Discard. Depend on it, rather than
+// on *LogFile, where you want to be able to substitute something else
+// (for example a mock in tests).
+type Logger interface {
+	Write(p []byte) (n int, err error)
+	Flush() error
+	RotateFile()
+	Close() error
+	Stats() Stats
 }
 
+var (
+	_ Logger         = (*LogFile)(nil)
+	_ Logger         = Discard
+	_ io.WriteCloser = (*LogFile)(nil)
+)
+
 // LogFile implements an io.Writer so can used by the standard log library
 type LogFile struct {
 	// Flags override default behaviour (see also command line flag -lognostderr)
@@ -142,8 +205,20 @@ type LogFile struct {
 
 	// FileName to write to.
 	// See also the -logfile command line flag
+	// If it is a named pipe (FIFO) it is never rotated and, while nothing
+	// reads from it, entries are retried as for any failed write.
 	FileName string
 
+	// Sink, if not nil, is written to instead of the file, see Sink.
+	// FileName is still needed to name it (in errors, ListOpenLogFiles...)
+	// and RotateFile defaults to the Sink's Rotate.
+	Sink Sink
+
+	// AllowedDir, if set, is the directory FileName must be inside. Use it
+	// when the file name comes from user supplied configuration. Note that
+	// symbolic links are not followed.
+	AllowedDir string
+
 	// FileMode for any newly created log files
 	FileMode os.FileMode
 
@@ -153,13 +228,21 @@ type LogFile struct {
 	// See also the -logmax command line flag
 	MaxSize int64
 
-	// CheckSeconds is how often LogFile will test to see if the log file
+	// CheckInterval is how often LogFile will test to see if the log file
 	// still exists as it may have been moved aside by something like Linux's
 	// logrotate.
 	// Note that a checking file existance is little expensive on a most
 	// Linux systems so limiting checking is a good option.
-	// On calling New if this is zero the default value (60) will be used
-	// See also the -logcheckseconds command line flag
+	// On calling New if this is zero the default value (a minute) will be
+	// used. If less than zero the file is not checked.
+	// See also the -logcheck command line flag. Set here, or by CheckSeconds,
+	// it overrides the command line.
+	CheckInterval time.Duration
+
+	// CheckSeconds is CheckInterval in whole seconds, used if CheckInterval
+	// is zero.
+	//
+	// Deprecated: Use CheckInterval.
 	CheckSeconds int
 
 	// RotateFileFunc is called whenever the log file needs "rotating"
@@ -169,32 +252,445 @@ type LogFile struct {
 	// If nil a default is provided that rotates up to a OldVerions and deletes
 	// any older.
 	// Never call this directly. If you need to rotate logs call lp.RotateFile()
+	// One that fails should say why with RotateFailed.
 	RotateFileFunc func()
 
+	// PreRotate and PostRotate, if not nil, are called by the default
+	// RotateFile with the log file's name and the name it is rotated to
+	// (log.1, or the timestamped name with TimestampVersions): PreRotate
+	// just before the file is moved and PostRotate once it has been, and
+	// compacted if CompactFunc is set, for example to upload or index it.
+	// An error they return is printed and returned by the next Write, Flush
+	// or Close but the rotation still goes ahead.
+	// They are called from the LogFile's goroutine, PostRotate from the
+	// compacting goroutine with CompactFunc, so never call any of the
+	// LogFile's methods from them.
+	PreRotate  func(oldName, newName string) error
+	PostRotate func(oldName, newName string) error
+
 	// When the default RotateFile is called this is the number of old versions
 	// to keep.
 	// See also the -logversions command line flag
 	OldVersions int
 
-	// FlushSeconds is how often the log file is writen out. Note that the log
+	// CompactFunc, if not nil, is used by the default RotateFile to filter
+	// each file as it is rotated (for example to drop debug lines from old
+	// versions while keeping them in the live file). It is passed the newly
+	// rotated file as src and should write what is to be kept to dst.
+	// It runs in the background so doesn't hold up logging. If it returns an
+	// error the rotated file is kept as it was.
+	CompactFunc func(src io.Reader, dst io.Writer) error
+
+	// VerifyFunc, if not nil, is used with the VerifyArchives flag to check
+	// the output of CompactFunc. gzip output is always checked.
+	VerifyFunc func(r io.Reader) error
+
+	// Dictionary, if not nil, is used with the GzipFile flag to compress the
+	// log file as it is written with a dictionary from TrainDictionary. The
+	// file is then in FormatDictionary rather than gzip, read it with
+	// NewReader given the same dictionary.
+	Dictionary []byte
+
+	// DeleteGrace, if greater than zero, is how long the default RotateFile
+	// waits before deleting the oldest version. Until then the file is
+	// renamed (log.N -> log.N.expired.<time>) giving anything still reading
+	// it, like a log shipper, time to finish.
+	DeleteGrace time.Duration
+
+	// CanDeleteFunc, if not nil, is asked before the default RotateFile
+	// deletes an old version (after it has been renamed as for DeleteGrace).
+	// If it returns false the file is kept and asked about again later.
+	CanDeleteFunc func(fileName string) bool
+
+	// RotateEvery, if greater than zero, rotates the file on a schedule as
+	// well as when MaxSize is reached: every hour, day, week... see
+	// nextRotation for how the times are worked out. RotateAt moves the
+	// schedule on, so RotateEvery of 24 hours with RotateAt of 2 hours
+	// rotates at 2am each day and a week with a day rotates each Monday.
+	// An empty file isn't rotated. Unlike RotateDaily a quiet LogFile is
+	// still rotated on time, though a write also rotates if its timer was
+	// held up (by the system being suspended). Periods of seconds, down to
+	// MinRotateEvery, are meant for tests that need many rotations quickly.
+	RotateEvery time.Duration
+	RotateAt    time.Duration
+
+	// ShouldRotate, if not nil, is asked before each write to a non empty
+	// file whether to rotate it first, with the file as it is and the entry
+	// about to be written (for example to start a new file at each "=== RUN"
+	// marker). It is called from the LogFile's goroutine so keep it quick
+	// and never call any of the LogFile's methods from it.
+	ShouldRotate func(current SizeInfo, next []byte) bool
+
+	// MaxAge, if greater than zero, deletes old versions last written more
+	// than MaxAge ago when the file is rotated, even if there are fewer than
+	// OldVersions of them. For example to keep no more than 30 days of logs.
+	// MaxAge, MaxTotalSize and ErrMaxAge are applied by RotateFileFuncDefault
+	// so do nothing with a RotateFileFunc that doesn't call it.
+	MaxAge time.Duration
+
+	// MaxTotalSize, if greater than zero, is the most the log file and all
+	// its old versions may take up together. When the file is rotated the
+	// oldest versions are deleted until they fit. Rotating at MaxSize no
+	// bigger than MaxTotalSize/(OldVersions+1) keeps total usage within it
+	// between rotations too. Old versions set aside but not yet deleted
+	// (see DeleteGrace, Pin and ErrMaxAge) count towards it, so while there
+	// are any fewer versions are kept.
+	MaxTotalSize int64
+
+	// ErrMaxAge, if greater than zero, keeps old versions that contain an
+	// error until they are ErrMaxAge old (by when they were last written)
+	// even once OldVersions would have removed them. Until then they are
+	// renamed log.N.errors.expired.<time>. An error is an entry with a
+	// level of LevelError or above, or one written by WriteCritical. Which
+	// files contain errors is kept in the state file.
+	ErrMaxAge time.Duration
+
+	// FlushInterval is how often the log file is writen out. Note that the log
 	// file will be writen to immdiately if the buffer gets full or on the log
-	// file being closed.
-	// If FlushSeconds is zero the default value is used. If less than zero
+	// file being closed, or (with the SyncCritical flag) on a critical entry.
+	// If FlushInterval is zero the default value is used. If less than zero
 	// the log file will be flushed after every write
 	// CAUTION: If not the default (-1) then writes are buffered and may not be
 	// writen out if the program exits/panics
+	// See also the -logflush command line flag, which like -logcheck beats
+	// its older seconds flag
+	FlushInterval time.Duration
+
+	// Entries matching FlushOnPattern, or containing any of FlushOnContains
+	// (such as "FATAL" or "AUDIT"), are flushed and synced to disk, along
+	// with everything before them, before Write returns even when buffering.
+	FlushOnPattern  *regexp.Regexp
+	FlushOnContains []string
+
+	// FlushSeconds is FlushInterval in whole seconds, used if FlushInterval
+	// is zero.
+	//
+	// Deprecated: Use FlushInterval.
 	FlushSeconds int
 
+	// MaxLifetimeBytes, if greater than zero, is the most that will ever be
+	// written to the file (including rotated versions). Once reached entries
+	// only go to stderr, with a warning, until ResetLifetime is called.
+	// This is for devices with a fixed budget of flash memory writes.
+	MaxLifetimeBytes int64
+
+	// PreviousLifetimeBytes is added to the bytes written when checking
+	// MaxLifetimeBytes. To count across restarts save Stats().LifetimeBytes
+	// on Close and pass it back in here on New.
+	PreviousLifetimeBytes int64
+
+	// Formatter, if not nil, is passed every entry before it is written and
+	// returns what is actually written. meta is what was passed to
+	// WriteWithMeta, nil for plain Writes. Formatter is called from the
+	// LogFile's goroutine, one entry at a time.
+	Formatter func(p []byte, meta map[string]string) []byte
+
+	// Tees are also sent every entry, after any Formatter, as it is written
+	// to the file (for example a GELFWriter). A failing tee is reported but
+	// doesn't stop the entry reaching the file. Tees are written to from
+	// the LogFile's goroutine so should not block for long.
+	Tees []io.Writer
+
+	// Tracer, if not nil, is passed an event for each step an entry takes
+	// from Write to the file, or being dropped, with the entries numbered so
+	// one can be followed. Use it to find out where "missing" lines went. It
+	// is only called when the package is built with -tags logfiledebug.
+	// Tracer is called from both the writers' goroutines and the LogFile's
+	// so must be safe for concurrent use, and must not write to the LogFile.
+	Tracer func(TraceEvent)
+
+	// MultiLine decides how entries of several lines, like stack traces,
+	// are written to the file and Tees so that line oriented log shippers
+	// don't split them into many unrelated events. stderr always gets them
+	// as written.
+	MultiLine MultiLinePolicy
+
+	// StderrMaxSize, if greater than zero, limits how much of each entry is
+	// copied to stderr. The rest is replaced by a short note but the whole
+	// entry is still written to the file. This keeps the console usable when
+	// something dumps a lot of output to the log.
+	StderrMaxSize int64
+
+	// CallerSkip is the number of extra stack frames to skip when the
+	// CallerInfo flag is set. Use it when WriteEntry is called from within
+	// your own logging helpers so that their callers are reported instead.
+	CallerSkip int
+
+	// StderrTimeout, if greater than zero, is the longest writing an entry
+	// to stderr may hold up logging. Entries that would take longer (because
+	// a terminal has been stopped or a pipe is full) don't go to stderr, they
+	// are counted in Stats().StderrDrops instead.
+	StderrTimeout time.Duration
+
+	// AlsoWrite, if not nil, is where entries are copied instead of stderr,
+	// for example a GUI widget or a test's buffer, with everything said
+	// about stderr (FileOnly, StderrOnly, StderrMaxSize, StderrTimeout and
+	// the Stderr stats) applying to it instead. It is only written to by
+	// one goroutine at a time.
+	AlsoWrite io.Writer
+
+	// ErrorRepeatWindow, if greater than zero, stops the same internal error
+	// being reported over and over (a failing disk can produce hundreds a
+	// second). Repeats of an error within the window are counted and
+	// reported as a single line once the window has passed.
+	ErrorRepeatWindow time.Duration
+
+	// Thresholds are logging budgets, see Thresholds. OnThreshold, if not
+	// nil, is called the first time in a day or hour one is gone over. It is
+	// called from the LogFile's goroutine so keep it quick and never call
+	// any of the LogFile's methods from it.
+	Thresholds  Thresholds
+	OnThreshold func(event ThresholdEvent)
+
+	// ReplicateTo, if not empty, is the host:port of a Receiver the log file
+	// and its old versions are copied to as they are written, using TLS if
+	// ReplicateTLS is not nil. See Receiver.
+	ReplicateTo  string
+	ReplicateTLS *tls.Config
+
+	// TailBufferSize, if greater than zero, is how many of the most
+	// recently written bytes are kept in memory for TailBytes and TailLines.
+	TailBufferSize int
+
+	// KeepRuns is the number of per run log files, see NewPerRun, to keep.
+	// Zero keeps them all.
+	KeepRuns int
+
+	// KeepBuckets is the number of earlier buckets, see NewBucketed, whose
+	// files are kept. Zero keeps them all.
+	KeepBuckets int
+
+	// OnError, if not nil, is called with every internal error. Unlike
+	// PrintError it is not affected by the NoErrors flag and is also told
+	// about failures to write to stderr.
+	// It is usually called from the LogFile's goroutine so keep it quick and
+	// never call any of the LogFile's methods from it.
+	OnError func(err error)
+
+	// SharedIdentity is added to the start of every line, with the
+	// SharedFile flag, to show which process wrote it. It defaults to the
+	// program's name and process id, like "app[1234]".
+	SharedIdentity string
+
+	// ErrorWriter, if not nil, is where PrintError prints internal errors
+	// instead of stderr, for example a second small log file when stderr is
+	// captured or thrown away. The NoErrors flag still turns them off.
+	ErrorWriter io.Writer
+
+	// RetryMaxBytes limits how much is held in memory, waiting to be retried,
+	// after a write to the file fails. Entries are retried in order, after
+	// reopening the file, with a growing delay between attempts. Entries
+	// beyond the limit are dropped. Zero means 1MB.
+	RetryMaxBytes int64
+
+	// MaxPendingBytes, if greater than zero, limits the bytes of entries
+	// waiting to reach the file: those queued for the LogFile's goroutine,
+	// in its buffer and waiting to be retried. What happens to writes that
+	// would go over it is decided by OverflowPolicy.
+	MaxPendingBytes int64
+	OverflowPolicy  OverflowPolicy
+
+	// QueueSize is how many writes (and other requests) can be queued for
+	// the LogFile's goroutine before Write waits or, with DropWhenFull,
+	// drops the entry. Zero means 100.
+	QueueSize int
+
+	// MaxEntryBytes, if greater than zero, is the biggest entry that may be
+	// written, so one accidental huge Write can't hold everything else up
+	// or make a file far bigger than MaxSize. Bigger entries are rejected,
+	// or split into chunks, as OversizePolicy says. Chunks each go through
+	// Formatter separately but are queued together, so other entries never
+	// come between them.
+	MaxEntryBytes  int64
+	OversizePolicy OversizePolicy
+
+	// DeferredMaxBytes limits how much a LogFile created by NewDeferred
+	// holds in memory before Attach. Entries beyond it are dropped. Zero
+	// means 1MB.
+	DeferredMaxBytes int64
+
+	// RateLimit, if greater than zero, is how many entries a second each
+	// call site may write; more than that are dropped and counted in
+	// Stats().Suppressed. So one chatty loop can't drown out everything
+	// else. Call sites are only known with the CallerInfo flag, WriteKeyed
+	// is limited by its key instead. Entries written through the log
+	// package or a Component count as coming from their caller. RateBurst is how many entries a call
+	// site can write at once before being limited, zero means RateLimit
+	// rounded up. Critical entries are never limited.
+	RateLimit float64
+	RateBurst int
+
 	file        *os.File
-	lastChecked time.Time
+	fileInfo    os.FileInfo // of file when opened, identifies the file (inode/dev)
+	lastChecked time.Time   // see syncChecks
+	lastFlush   time.Time   // see syncChecks
+	lastTick    time.Time   // see resumedLog
+	fileDay     int         // see newDay
+	fileOpened  time.Time   // see SizeInfo
+	rotated     []string    // see RotateNow
+	closedStats Stats       // see Stats
+	recent      *recentRing // see TailBufferSize
+	openErr     error       // why the log file last failed to open
+	rotateAt    time.Time   // see RotateEvery
+	watcher     fileWatcher // see the WatchFile flag
+	lock        *os.File    // see the SharedFile flag
+	lockDepth   int
 	size        int64
 	messages    chan logMessage
 	buf         *bufio.Writer
+	stats       Stats
+	unflushed   []bufferedEntry // the entries in buf
+
+	// See reportDegraded
+	degradedStderr   int64
+	degradedDrops    int64
+	degradedReported time.Time
+
+	// See NewDeferred. deferred never changes, the others are only used by
+	// the LogFile's goroutine.
+	deferred       bool
+	pending        bool
+	pendingEntries []logMessage
+	pendingBytes   int64
+	pendingDrops   int64
+
+	// sinkOpen is true while the Sink is open, see isOpen
+	sinkOpen bool
+
+	// See Thresholds
+	budgetBytes     budgetCount
+	budgetRotations budgetCount
+	budgetErrors    budgetCount
+	budgetNotices   []string
+
+	// See NewBucketed. Only the LogFile's goroutine changes bucketID.
+	bucketPrefix string
+	bucketSuffix string
+	bucketLayout string
+	bucketID     string
+
+	// See RetryMaxBytes
+	retries      []bufferedEntry
+	retryBytes   int64
+	retryBackoff time.Duration
+	retryAt      time.Time
+
+	// See MaxPendingBytes. queuedBytes is updated by writers and heldBytes
+	// by the LogFile's goroutine; both use atomic, as do the overflow
+	// counts. overflowEntries and overflowBytes are those dropped since the
+	// last summary.
+	queuedBytes     int64
+	heldBytes       int64
+	overflowDrops   int64
+	overflowEntries int64
+	overflowBytes   int64
+	overflowMutex   sync.Mutex
+	overflowCond    sync.Cond
+
+	// See MaxEntryBytes, updated by writers so use atomic
+	oversizeDrops   int64
+	oversizeChunked int64
+
+	// See the DropWhenFull flag, updated by writers so use atomic
+	fullDrops int64
+
+	// See the GzipFile flag
+	gzip           compressor
+	compressedSize int64
+
+	// See the Checksum flag
+	checksum      hash.Hash
+	checksumValid bool
+
+	// See RateLimit
+	rateMutex   sync.Mutex
+	rateBuckets map[string]*rateBucket
+	suppressed  map[string]int64
+
+	componentMutex sync.Mutex
+	components     map[string]*Component
+
+	synchronous bool       // see the Synchronous flag
+	syncMutex   sync.Mutex // serialises handle when synchronous
+
+	// Held by changeFileName, see CurrentFileName
+	nameMutex sync.RWMutex
+
+	closeMutex sync.RWMutex  // held while queuing writes, see Close
+	closed     bool          // set by each way the goroutine can stop
+	closeDone  chan struct{} // closed once Close has finished
+	stopping   int32         // set atomically by Close, see reservePending
+	path       string        // absolute FileName, see claimPath
+	refs       int           // (see claimPath) guarded by registry
+	openedBy   string        // stack of New, see CheckLeaks
+
+	// defaultRotate is set when RotateFileFunc is RotateFileFuncDefault
+	// because none was given
+	defaultRotate bool
+
+	// See Reset. used is set, atomically, by New
+	used          int32
+	givenFileName string
+	defaulted     []defaultedSetting
+
+	// stderrBytes and stderrErrors can be updated by the stderr goroutine so
+	// use atomic
+	stderrBytes   int64
+	stderrErrors  int64
+	stderrChan    chan []byte
+	stderrDone    chan bool
+	stderrBlocked bool
+
+	lifetimeBytes  int64
+	lifetimeWarned bool
+	compacting     sync.WaitGroup
+	// archiveErrors is updated by compactFile, so use atomic
+	archiveErrors int64
+	// See ReplicateTo. replicaErrors and replicaDrops are updated by the
+	// replicator so use atomic, replicaLive and replicaFailures are guarded
+	// by replicaMutex.
+	replica         *replicator
+	replicaErrors   int64
+	replicaDrops    int64
+	replicaMutex    sync.Mutex
+	replicaLive     string
+	replicaFailures []error
+	// traceSeq numbers entries for Tracer, updated atomically
+	traceSeq      uint64
+	expired       []expiredFile
+	pinMutex      sync.Mutex
+	pins          []pin
+	stateMutex    sync.Mutex
+	fileHasErrors bool // see ErrMaxAge
+
+	errorMutex    sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+	errorRepeats  int
+
+	// See noteError. Once closing is set every error is kept, in
+	// closeErrors, for Close.
+	unreportedMutex sync.Mutex
+	unreported      error
+	closing         bool
+	closeErrors     []error
+
+	// See rotateFailed. While startRotate is set the errors are only kept
+	// in rotateErr.
+	rotateErr   error
+	startRotate bool
 }
 
 // New creates, if necessary, and opens a log file.
 // If a LogFile is passed any empty fields are filled with suitable defaults.
 // If nil is passed an empty LogFile is created and then filled in.
+// If FileName is unusable, or already open by another LogFile, a
+// *FileNameError is returned. With the ReuseDuplicate flag the LogFile
+// already open is returned instead, each New needs its own Close.
+// Any other problem with the settings is returned as a *ConfigError (see
+// Validate).
+// A LogFile can only be passed to New once, ErrInUse is returned if it is
+// passed again (see Reset).
 // Once finished with the LogFile call Close()
 func New(lp *LogFile) (*LogFile, error) {
 	if lp == nil {
@@ -203,6 +699,18 @@ func New(lp *LogFile) (*LogFile, error) {
 			return nil, fmt.Errorf("failed to create LogFile (out of memory?)")
 		}
 	}
+	if !lp.claim() {
+		return lp, ErrInUse
+	}
+	opened, err := lp.open()
+	if err != nil || opened != lp {
+		lp.release()
+	}
+	return opened, err
+}
+
+// open does the work of New
+func (lp *LogFile) open() (*LogFile, error) {
 	if lp.FileName == "" {
 		if !defaultFileNameUsed {
 			lp.FileName = Defaults.FileName
@@ -211,139 +719,427 @@ func New(lp *LogFile) (*LogFile, error) {
 		}
 	}
 	if lp.FileName == "" {
-		return lp, fmt.Errorf("LogFile no file name")
+		return lp, ErrNoFileName
+	}
+	lp.givenFileName = lp.FileName
+	if lp.Flags&AutoUniqueName == AutoUniqueName {
+		lp.FileName = uniqueFileName(lp.FileName, time.Now())
+	}
+	if err := validateFileName(lp.FileName, lp.AllowedDir); err != nil {
+		return lp, err
+	}
+	lp.setDefaults()
+	if err := lp.Validate(); err != nil {
+		return lp, err
+	}
+
+	// Two LogFiles writing to the same file would get in each other's way
+	existing, err := claimPath(lp)
+	if err != nil {
+		return lp, err
 	}
+	if existing != nil {
+		return existing, nil
+	}
+
+	lp.lifetimeBytes = lp.PreviousLifetimeBytes
+	lp.overflowCond.L = &lp.overflowMutex
+	if lp.TailBufferSize > 0 {
+		lp.recent = newRecentRing(lp.TailBufferSize)
+	}
+	lp.synchronous = lp.Flags&Synchronous == Synchronous || forceSynchronous
+	if lp.synchronous {
+		if !lp.startLog() {
+			unregister(lp)
+			return lp, lp.createError(lp.FileName)
+		}
+		register(lp)
+		return lp, nil
+	}
+
+	lp.messages = make(chan logMessage, lp.QueueSize)
+	if lp.messages == nil {
+		unregister(lp)
+		return nil, fmt.Errorf("LogFile failed to create channel (out of memory?)")
+	}
+	ready := make(chan (bool))
+	goroutineStarted()
+	go logger(lp, ready)
+	if !<-ready {
+		// The goroutine has finished, marking lp closed
+		unregister(lp)
+		return lp, lp.createError(lp.FileName)
+	}
+	register(lp)
+
+	return lp, nil
+}
+
+// interval returns seconds, from CheckSeconds or FlushSeconds, as a Duration
+func interval(seconds int) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// setDefaults fills in any settings not given from Defaults
+func (lp *LogFile) setDefaults() {
+	defer lp.noteDefaults(lp.zeroSettings())
 	if lp.FileMode == 0 {
 		lp.FileMode = Defaults.FileMode
 	}
 	if lp.MaxSize == 0 {
 		lp.MaxSize = Defaults.MaxSize
 	}
+	if lp.QueueSize == 0 {
+		lp.QueueSize = logMessages
+	}
+	if lp.Sink == nil && isFIFO(lp.FileName) {
+		lp.Sink = &fifoSink{name: lp.FileName}
+	}
+	if lp.RotateFileFunc == nil && lp.Sink != nil {
+		lp.RotateFileFunc = lp.rotateSink
+	}
 	if lp.RotateFileFunc == nil {
 		lp.RotateFileFunc = lp.RotateFileFuncDefault
+		lp.defaultRotate = true
+	}
+	if lp.CheckInterval == 0 {
+		lp.CheckInterval = interval(lp.CheckSeconds)
+	}
+	if lp.CheckInterval == 0 {
+		lp.CheckInterval = Defaults.CheckInterval
+	}
+	if lp.CheckInterval == 0 {
+		lp.CheckInterval = interval(Defaults.CheckSeconds)
 	}
-	if lp.CheckSeconds == 0 {
-		lp.CheckSeconds = Defaults.CheckSeconds
+	if lp.FlushInterval == 0 {
+		lp.FlushInterval = interval(lp.FlushSeconds)
 	}
-	if lp.FlushSeconds == 0 {
-		lp.FlushSeconds = Defaults.FlushSeconds
+	if lp.FlushInterval == 0 {
+		lp.FlushInterval = Defaults.FlushInterval
+	}
+	if lp.FlushInterval == 0 {
+		lp.FlushInterval = interval(Defaults.FlushSeconds)
 	}
 	if lp.Flags == 0 {
 		if NoStderr {
 			lp.Flags = FileOnly
 		}
 	}
-	lp.messages = make(chan logMessage, logMessages)
-	if lp.messages == nil {
-		return nil, fmt.Errorf("LogFile failed to create channel (out of memory?)")
-	}
-	lp.messages <- logMessage{action: openLog}
-	ready := make(chan (bool))
-	go logger(lp, ready)
-	if !<-ready {
-		return lp, fmt.Errorf("LogFile failed to create file %s", lp.FileName)
+	if lp.SharedIdentity == "" && lp.shared() {
+		lp.SharedIdentity = sharedIdentity()
 	}
-
-	return lp, nil
 }
 
 // Messages sent to the log handling goroutine: logger
 type logMessage struct {
-	action   logAction
-	data     []byte
-	complete chan<- bool
+	action     logAction
+	data       []byte
+	chunks     [][]byte // of data, see OversizeChunk
+	meta       map[string]string
+	critical   bool // also for flushLog, see Sync
+	errorLevel bool // see ErrMaxAge
+	queued     time.Time
+	seq        uint64          // see Tracer
+	fileName   string          // for attachLog and setFileNameLog
+	settings   *LogFile        // for attachLog, see AttachFile
+	flags      int             // see WriteWithFlags
+	move       bool            // for setFileNameLog, see SetFileNameMoving
+	rotated    chan<- []string // for rotateLog, see RotateNow
+	complete   chan<- error
+	stats      chan<- Stats
 }
 
 type logAction int
 
 const (
-	openLog logAction = iota
-	writeLog
+	writeLog logAction = iota
 	rotateLog
 	flushLog
+	statsLog
+	resetLifetimeLog
+	attachLog
+	checkLog
+	hangupLog
+	setFileNameLog
+	replicaFailedLog
 	closeLog
 
-	logMessages = 100
+	// logMessages is the default QueueSize and maxQueueSize the largest
+	logMessages  = 100
+	maxQueueSize = 1 << 20
+
+	// clockJump is how far the clocks may disagree before clockJumped
+	// decides the system was suspended
+	clockJump = 10 * time.Second
 )
 
-// logger loops until closeLog or an error happens handling log related actions.
-// Once the log file is opened true is sent to the ready channel. If there
-// if a problem opening the log file false is sent.
+// logger loops until closeLog handling log related actions.
+// Unless ready is nil the log file is opened first and true sent to the
+// ready channel, or false if there was a problem opening it.
 func logger(lp *LogFile, ready chan (bool)) {
-	// flushChan will be nil unless FlushSeconds > 0
-	// Note that a negative FlushSeconds is handled in writeLog
-	var flushChan <-chan time.Time
-	if lp.FlushSeconds > 0 {
-		flushTicker := time.NewTicker(time.Second * time.Duration(lp.FlushSeconds))
-		defer flushTicker.Stop()
-		flushChan = flushTicker.C
-	}
+	// Close is only told the LogFile is closed, or New that it failed to
+	// open, once everything else here has been stopped
+	var closed chan<- error
+	var failed chan<- bool
+	defer func() {
+		if closed != nil {
+			closed <- nil
+		}
+		if failed != nil {
+			lp.closeMutex.Lock()
+			lp.closed = true
+			lp.closeMutex.Unlock()
+			failed <- false
+		}
+	}()
+	defer goroutineStopped()
 
-	// vanishChan will be nil unless CheckSeconds > 0
-	var vanishChan <-chan time.Time
-	if lp.CheckSeconds > 0 {
-		vanishTicker := time.NewTicker(time.Second * time.Duration(lp.CheckSeconds))
-		defer vanishTicker.Stop()
-		vanishChan = vanishTicker.C
+	// With StderrTimeout stderr is written to by its own goroutine
+	if lp.StderrTimeout > 0 {
+		lp.startStderr()
+		defer lp.stopStderr()
 	}
 
-	// Just in case... regularly check that this goroutine is still needed
-	errorTicker := time.NewTicker(time.Second * time.Duration(errorSeconds))
-	defer errorTicker.Stop()
+	// Flushing, checking, rotating, retrying and housekeeping are all
+	// driven by one timer
+	timers := lp.startTimers(time.Now())
+	defer timers.stop()
+
+	// lastTick is used to spot the clock jumping, as it will after suspend
+	lp.lastTick = time.Now()
+
+	if ready != nil {
+		if !lp.startLog() {
+			failed = ready
+			return
+		}
+		ready <- true
+	}
 
 	for {
+		// watchChan will be nil unless the file is being watched
+		watchChan := lp.watchEvents()
+
 		select {
 		case message := <-lp.messages:
-			switch message.action {
-			case openLog:
-				ready <- lp.startLog()
-			case writeLog:
-				lp.writeLog(message.data)
-			case flushLog:
-				lp.flushLog()
-				message.complete <- true
-			case rotateLog:
-				lp.rotateLog()
-			case closeLog:
-				lp.closeLog()
-				message.complete <- true
+			if lp.handle(message) {
+				closed = message.complete
 				return
 			}
-		case <-flushChan:
-			lp.flushLog()
-		case <-vanishChan:
-			lp.vanishedLog()
-		case <-errorTicker.C:
-			if lp.file == nil {
-				return
+		case <-timers.wait(lp):
+			lp.runTimers(timers)
+		case <-watchChan:
+			lp.checkLog()
+		}
+		lp.releasePending()
+	}
+}
+
+// handle carries out a single message. It returns true once the LogFile
+// has been closed, in which case the caller must tell message.complete.
+func (lp *LogFile) handle(message logMessage) bool {
+	switch message.action {
+	case writeLog:
+		atomic.AddInt64(&lp.queuedBytes, -int64(len(message.data)))
+		lp.trace(TraceDequeue, message.seq, len(message.data), "")
+		// Until a NewDeferred LogFile is attached entries are kept
+		if lp.pending {
+			lp.deferLog(message)
+			if message.complete != nil {
+				message.complete <- nil
+			}
+			break
+		}
+		// Synchronous writes are written, flushed (and synced for
+		// critical ones) before the writer is told the result
+		written := lp.stats.FileBytes
+		err := lp.writeMessage(message)
+		if message.errorLevel {
+			lp.markErrors()
+		}
+		lp.budgetWritten(lp.stats.FileBytes-written, message.errorLevel)
+		if message.critical {
+			if syncErr := lp.syncLog(); err == nil {
+				err = syncErr
 			}
 		}
+		if message.complete != nil {
+			message.complete <- err
+		}
+	case flushLog:
+		if message.critical {
+			message.complete <- lp.syncLog()
+		} else {
+			message.complete <- lp.flushLog()
+		}
+	case rotateLog:
+		lp.rotated = nil
+		lp.rotateLog()
+		if message.rotated != nil {
+			message.rotated <- lp.rotated
+		}
+	case statsLog:
+		message.stats <- lp.currentStats()
+	case resetLifetimeLog:
+		lp.lifetimeBytes = 0
+		lp.lifetimeWarned = false
+	case attachLog:
+		message.complete <- lp.attachLog(message.fileName, message.settings)
+	case setFileNameLog:
+		message.complete <- lp.setFileNameLog(message.fileName, message.move)
+	case hangupLog:
+		lp.hangupLog()
+	case replicaFailedLog:
+		lp.reportReplicaFailures()
+	case checkLog:
+		lp.checkLog()
+		lp.housekeepLog()
+		message.complete <- nil
+	case closeLog:
+		lp.collectErrors()
+		lp.stderrPending()
+		lp.writeBudgetNotices()
+		// Flushed first so entries that fail are retried and, if they
+		// still fail, counted as dropped
+		lp.flushLog()
+		lp.dropRetries()
+		lp.closeLog()
+		lp.stopReplica()
+		lp.reportReplicaFailures()
+		lp.closeShared()
+		lp.compacting.Wait()
+		lp.reportDegraded(true)
+		lp.printErrorRepeats(true)
+		lp.closedStats = lp.currentStats()
+		return true
 	}
+	lp.writeBudgetNotices()
+	return false
+}
+
+// checkLog checks that the file is still there and still usable
+func (lp *LogFile) checkLog() {
+	lp.lastTick = lp.resumedLog(lp.lastTick)
+	lp.lastChecked = time.Now()
+	lp.vanishedLog()
+	lp.truncatedLog()
+}
+
+// housekeepLog does the once a minute jobs
+func (lp *LogFile) housekeepLog() {
+	lp.lastTick = lp.resumedLog(lp.lastTick)
+	lp.printErrorRepeats(false)
+	lp.removeExpired()
+	lp.reportDegraded(false)
+	lp.reportReplicaFailures()
+}
+
+// send passes message to the LogFile's goroutine or, with the Synchronous
+// flag, handles it in the caller's goroutine. Messages with replies must
+// have buffered channels so a synchronous handle doesn't block.
+func (lp *LogFile) send(message logMessage) {
+	if !lp.synchronous {
+		lp.messages <- message
+		return
+	}
+
+	lp.syncMutex.Lock()
+	defer lp.syncMutex.Unlock()
+	lp.syncChecks()
+	if lp.handle(message) {
+		message.complete <- nil
+		return
+	}
+	lp.releasePending()
+}
+
+// trySend sends message, as send does, unless the LogFile's goroutine is
+// too far behind to take it at once when it returns false instead
+func (lp *LogFile) trySend(message logMessage) bool {
+	if lp.synchronous {
+		lp.send(message)
+		return true
+	}
+	select {
+	case lp.messages <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendOpen sends message, as send does, unless Close has been called when
+// it returns false instead as there is nothing to handle it
+func (lp *LogFile) sendOpen(message logMessage) bool {
+	lp.closeMutex.RLock()
+	defer lp.closeMutex.RUnlock()
+	if lp.closed {
+		return false
+	}
+	lp.send(message)
+	return true
 }
 
 // startLog creates or opens the log file. Depending on Flags the logfile may
 // be rotated first. If all goes well startLog returns true.
 // On a problem an error is printed to stderr (subject to the NoErrors flag)
 // and false returned.
-func (lp *LogFile) startLog() bool {
-	if (lp.Flags&RotateOnStart) == RotateOnStart && lp.RotateFileFunc != nil {
-		lp.RotateFileFunc()
+func (lp *LogFile) startLog() (started bool) {
+	if lp.ReplicateTo != "" && lp.replica == nil {
+		lp.startReplica()
+		defer func() {
+			if !started {
+				lp.stopReplica()
+			}
+		}()
+	}
+	lp.loadPins()
+	lp.findExpired()
+
+	flags := lp.startFlags()
+	if (flags&RotateOnStart) == RotateOnStart && lp.RotateFileFunc != nil {
+		if err := lp.rotateOnStart(); err != nil && flags&StrictStart == StrictStart {
+			lp.openErr = err
+			return false
+		}
+	}
+
+	// Check no one else got there first. Note this is only done on start, once
+	// the file exists it is ours to reopen.
+	if flags&ExclusiveCreate == ExclusiveCreate {
+		f, err := os.OpenFile(lp.FileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, lp.FileMode)
+		if err != nil {
+			lp.PrintError("LogFile failed to exclusively create %s: %s\n", lp.FileName, err)
+			lp.openErr = err
+			return false
+		}
+		f.Close()
 	}
 
-	truncated := lp.Flags&OverWriteOnStart == OverWriteOnStart
+	truncated := flags&OverWriteOnStart == OverWriteOnStart
 
 	return lp.openLogFile(truncated)
 }
 
+// uniqueFileName returns fileName with the time t and the process id added
+// to the end so different runs of a program use different log files
+func uniqueFileName(fileName string, t time.Time) string {
+	return fmt.Sprintf("%s.%s.%d", fileName, t.Format("20060102T150405"), os.Getpid())
+}
+
 // openLogFile returns true if the file successfully opened and buffered.
 // The truncated option will cause the file to be truncated on opening.
 func (lp *LogFile) openLogFile(truncated bool) bool {
 	lp.closeLog()
+	lp.openErr = nil
+	if lp.Sink != nil {
+		return lp.openSink(truncated)
+	}
 
 	var err error
 
 	flags := os.O_RDWR | os.O_CREATE
-	if truncated {
+	if truncated && !lp.shared() {
 		flags = flags | os.O_TRUNC
 	} else {
 		flags = flags | os.O_APPEND
@@ -352,110 +1148,326 @@ func (lp *LogFile) openLogFile(truncated bool) bool {
 	lp.file, err = os.OpenFile(lp.FileName, flags, lp.FileMode)
 	if err != nil {
 		lp.PrintError("LogFile failed to create %s: %s\n", lp.FileName, err)
+		lp.openErr = err
 		lp.file = nil
 		return false
 	}
 
-	// Find the file size
-	if truncated {
-		lp.size = 0
-	} else {
-		fi, err := os.Stat(lp.FileName)
-		if err == nil {
-			lp.size = fi.Size()
-		} else {
-			lp.PrintError("LogFile unable to find initial filesize for %s: %s\n", lp.FileName, err)
-			lp.size = 0
-			// Hmmm... should I stop logging... no better to try and continue
-			err = nil
-		}
+	// Find the file size. Stat the open file rather than the file name as
+	// the file may have already been moved aside.
+	lp.size = 0
+	lp.fileInfo, err = lp.file.Stat()
+	if err != nil {
+		lp.PrintError("LogFile unable to find initial filesize for %s: %s\n", lp.FileName, err)
+		lp.fileInfo = nil
+		// Hmmm... should I stop logging... no better to try and continue
+		err = nil
+	} else if !truncated {
+		lp.size = lp.fileInfo.Size()
+	}
+
+	lp.startGzip()
+	lp.startChecksum()
+	lp.openErrors(truncated)
+
+	// An existing file belongs to the day it was last written
+	opened := time.Now()
+	if lp.size > 0 && lp.fileInfo != nil {
+		opened = lp.fileInfo.ModTime()
+	}
+	lp.fileDay = dayOf(opened)
+	lp.fileOpened = opened
+	if lp.RotateEvery > 0 {
+		lp.rotateAt = lp.nextRotation(opened)
 	}
 
-	lp.buf = bufio.NewWriter(lp.file)
+	lp.buf = bufio.NewWriter(lp.bufTarget())
 	if lp.buf == nil {
 		lp.PrintError("LogFile error cannot create buffer for %s (out of memory?)\n", lp.FileName)
 		lp.file.Close()
 		lp.file = nil
 		return false
 	}
+	lp.startWatch()
+	lp.replicaOpened()
 
 	return true
 }
 
-// writeLog writes p to stderr if required then writes it to the file.
-// If writing to the file would cause the file to go over its size limit the file
-// is closed, rotated (which may do nothing) and the opened with truncation.
-func (lp *LogFile) writeLog(p []byte) {
-	fileOnly := lp.Flags&FileOnly == FileOnly
+// writeLog writes p, after passing it and meta through any Formatter, to
+// stderr if required then writes it to the file.
+// A failure to write to stderr does not stop the write to the file.
+// If writing to the file would cause the file to go over its size limit (or,
+// with RotateDaily, the day has changed) the file is closed, rotated (which
+// may do nothing) and the opened with truncation.
+// Any error writing to (or, if not buffering, flushing) the file is returned.
+// queued is when the entry was passed to Write, see Stats.FlushLatency, and
+// seq numbers it for Tracer. flags are those passed to WriteWithFlags.
+func (lp *LogFile) writeLog(p []byte, meta map[string]string, queued time.Time, seq uint64, flags int) error {
+	fileOnly := lp.Flags&FileOnly == FileOnly || flags&FileOnly == FileOnly
+	stderrOnly := flags&StderrOnly == StderrOnly
+
+	lp.stats.Writes++
+
+	if lp.Formatter != nil {
+		p = lp.Formatter(p, meta)
+	}
+
+	stderr := p
+	if lp.Flags&DevMode == DevMode {
+		p, stderr = devFormat(p)
+	}
+	if !fileOnly || stderrOnly {
+		lp.writeStderr(stderr)
+	}
+	if stderrOnly {
+		return nil
+	}
+	p = foldLines(p, lp.MultiLine)
 
-	if !fileOnly {
-		_, err := os.Stderr.Write(p)
+	for _, tee := range lp.Tees {
+		_, err := tee.Write(p)
 		if err != nil {
-			// Well I can't write to stderr to report it... so just return
-			return
+			lp.stats.TeeErrors++
+			lp.PrintError("LogFile error writing to tee for %s: %s\n", lp.FileName, err)
 		}
 	}
+	lp.keepRecent(p)
 
-	if lp.file == nil {
-		return
+	if lp.shared() {
+		p = lp.sharedPrefix(p)
 	}
 
-	// Am I about to go over my file size limit?
-	if lp.MaxSize > 0 && (lp.size+int64(len(p))) >= lp.MaxSize {
-		lp.closeLog()
+	// Later entries wait behind any that are being retried
+	if len(lp.retries) > 0 {
+		lp.queueRetry(bufferedEntry{data: p, queued: queued, seq: seq})
+		return ErrRetrying
+	}
 
-		if lp.RotateFileFunc != nil {
-			lp.RotateFileFunc()
+	if !lp.isOpen() {
+		lp.noteDegraded(!fileOnly)
+		lp.trace(TraceDrop, seq, len(p), "file not open")
+		return nil
+	}
+
+	// Once the lifetime limit is reached entries only go to stderr
+	if lp.lifetimeExceeded(int64(len(p))) {
+		if fileOnly {
+			lp.writeStderr(stderr)
 		}
+		lp.trace(TraceDrop, seq, len(p), "MaxLifetimeBytes reached")
+		return nil
+	}
 
-		// Recreate the logfile truncating it (in case it wasn't rotated)
-		if !lp.openLogFile(truncateLog) {
-			return
+	// Bucketed files move on to the next file rather than rotating
+	if lp.bucketDue() && !lp.switchBucket() {
+		lp.trace(TraceDrop, seq, len(p), "switching bucket failed")
+		err := lp.createError(lp.bucketPrefix + lp.bucketOf(time.Now()) + lp.bucketSuffix)
+		lp.noteError(err)
+		return err
+	}
+
+	// Am I about to go over my file size limit or is it a new day?
+	size := lp.size + int64(len(p))
+	if lp.gzip != nil {
+		// How well p compresses isn't known until it has been
+		size = lp.compressedSize
+	}
+	if !lp.fifo() && ((lp.MaxSize > 0 && size >= lp.MaxSize) || lp.newDay() || lp.rotateDue() || lp.shouldRotate(p)) {
+		lp.lockShared()
+		var reopened bool
+		if lp.sharedMoved() {
+			// Another process sharing the file has already rotated it
+			reopened = lp.openLogFile(noTruncateLog)
+		} else {
+			lp.closeLog()
+
+			if lp.RotateFileFunc != nil {
+				lp.RotateFileFunc()
+			}
+
+			// Recreate the logfile truncating it (in case it wasn't rotated)
+			reopened = lp.openLogFile(truncateLog)
+			if lp.RotateFileFunc != nil {
+				lp.budgetRotated()
+			}
+		}
+		lp.unlockShared()
+		if !reopened {
+			lp.trace(TraceDrop, seq, len(p), "reopening after rotating failed")
+			err := lp.reopenError()
+			lp.noteError(err)
+			return err
 		}
 	}
 
-	n, err := lp.buf.Write(p)
+	lp.unflushed = append(lp.unflushed, bufferedEntry{data: p, queued: queued, seq: seq})
+	var n int
+	var err error
+	if lp.shared() && len(p) > lp.buf.Available() {
+		// A shared file's entries must each reach it in a single write,
+		// under the lock. Once buf is empty one too big for it is written
+		// straight to the file.
+		err = lp.flushLog()
+		if err == nil {
+			lp.lockShared()
+			n, err = lp.buf.Write(p)
+			lp.unlockShared()
+		}
+	} else {
+		n, err = lp.buf.Write(p)
+	}
+	lp.stats.FileBytes += int64(n)
+	lp.lifetimeBytes += int64(n)
+	lp.size += int64(n)
 	if err != nil {
+		err = fileError(err)
+		lp.stats.FileErrors++
 		lp.PrintError("Logfile error writing to %s: %s\n", lp.FileName, err)
+		lp.noteError(err)
+		lp.retryUnwritten(len(p) - n)
+		return err
 	}
-	if lp.FlushSeconds <= 0 {
-		lp.flushLog()
+	if lp.FlushInterval <= 0 {
+		err = lp.flushLog()
 	}
 
-	lp.size += int64(n)
+	return err
+}
+
+// newDay returns true, with the RotateDaily flag, if today is not the day
+// the file was opened. Checking at each write, rather than with a timer,
+// means a process that sleeps (or is suspended) through midnight still
+// starts the day in a new file.
+func (lp *LogFile) newDay() bool {
+	return lp.Flags&RotateDaily == RotateDaily && dayOf(time.Now()) != lp.fileDay
+}
+
+// SizeInfo describes the open log file, for ShouldRotate
+type SizeInfo struct {
+	FileName string
+
+	// Size is how big the file is, with GzipFile compressed
+	Size int64
+
+	// Opened is when the file was opened, or last written if it already
+	// existed
+	Opened time.Time
+}
+
+// shouldRotate returns true if ShouldRotate wants the file rotated before p
+// is written to it
+func (lp *LogFile) shouldRotate(p []byte) bool {
+	if lp.ShouldRotate == nil || lp.size == 0 {
+		return false
+	}
+	size := lp.size
+	if lp.gzip != nil {
+		size = lp.compressedSize
+	}
+	return lp.ShouldRotate(SizeInfo{FileName: lp.FileName, Size: size, Opened: lp.fileOpened}, p)
+}
 
-	return
+// dayOf returns t's local date as a single comparable number
+func dayOf(t time.Time) int {
+	year, month, day := t.Local().Date()
+	return year*10000 + int(month)*100 + day
+}
+
+// lifetimeExceeded returns true if writing n more bytes to the file would go
+// over MaxLifetimeBytes. The first time it does a warning is printed.
+func (lp *LogFile) lifetimeExceeded(n int64) bool {
+	if lp.MaxLifetimeBytes <= 0 {
+		return false
+	}
+	if lp.lifetimeBytes+n <= lp.MaxLifetimeBytes {
+		return false
+	}
+	if !lp.lifetimeWarned {
+		lp.PrintError("LogFile %s has reached its lifetime limit of %d bytes, no longer writing to it\n", lp.FileName, lp.MaxLifetimeBytes)
+		lp.lifetimeWarned = true
+	}
+	return true
 }
 
 // rotateLog closes the log file, calls the (possibly user) RotateFileFunc and
 // reopens the log file
 func (lp *LogFile) rotateLog() {
-	if lp.RotateFileFunc == nil {
+	if lp.RotateFileFunc == nil || lp.pending || lp.fifo() {
+		return
+	}
+	lp.lockShared()
+	defer lp.unlockShared()
+	if lp.sharedMoved() {
+		// Another process sharing the file has already rotated it
+		lp.openLogFile(noTruncateLog)
 		return
 	}
 	lp.closeLog()
 	lp.RotateFileFunc()
-	lp.openLogFile(noTruncateLog)
+	if !lp.openLogFile(noTruncateLog) {
+		lp.noteError(lp.reopenError())
+	}
+	lp.budgetRotated()
 }
 
 // flushLog flushes out any pending writes to the log file
-func (lp *LogFile) flushLog() {
-	if lp.file == nil {
-		return
+func (lp *LogFile) flushLog() error {
+	if !lp.isOpen() {
+		return nil
 	}
 
+	lp.lockShared()
 	err := lp.buf.Flush()
+	lp.sharedSize()
+	lp.unlockShared()
 	if err != nil {
+		err = fileError(err)
 		lp.PrintError("LogFile error flushing %s: %s\n", lp.FileName, err)
+		lp.noteError(err)
+		lp.retryUnwritten(0)
+		return err
+	}
+	if err := lp.flushGzip(); err != nil {
+		return err
 	}
+	now := time.Now()
+	for _, e := range lp.unflushed {
+		lp.stats.FlushLatency.observe(now.Sub(e.queued))
+	}
+	lp.addChecksum(lp.unflushed)
+	lp.traceEntries(TraceFlush, lp.unflushed, "")
+	lp.lastFlush = now
+	lp.unflushed = lp.unflushed[:0]
+	return nil
+}
+
+// syncLog flushes pending writes and then waits for them to reach the disk
+func (lp *LogFile) syncLog() error {
+	if !lp.isOpen() {
+		return nil
+	}
+
+	if err := lp.flushLog(); err != nil {
+		return err
+	}
+	err := lp.syncOutput()
+	if err != nil {
+		lp.PrintError("LogFile error syncing %s: %s\n", lp.FileName, err)
+		lp.noteError(err)
+	}
+	return err
 }
 
 // vanishLog checks that the log file hasn't vanished.
-// Perhaps it has been moved aside by something like Linux logrotate.
+// Perhaps it has been moved aside by something like Linux logrotate, which
+// in its create mode also puts a new file in its place.
 // If it has vanished then the log file is closed and reopened
 func (lp *LogFile) vanishedLog() {
-	_, err := os.Stat(lp.FileName)
-	if err == nil {
+	if lp.pending || lp.Sink != nil {
+		return
+	}
+	if !lp.replaced() && !lp.sharedMoved() {
 		return
 	}
 	// Close and reopen the file
@@ -463,28 +1475,160 @@ func (lp *LogFile) vanishedLog() {
 	lp.openLogFile(noTruncateLog)
 }
 
+// truncatedLog checks the open file hasn't shrunk, as it does when another
+// process truncates it (like logrotate's copytruncate). Otherwise size would
+// be wrong, rotating at the wrong point, and writes would carry on at the old
+// offset leaving a hole of NULs. If it has the file is reopened, at its end.
+// SharedFile files are left alone, their size is taken from the file anyway.
+func (lp *LogFile) truncatedLog() {
+	if lp.pending || lp.file == nil || lp.shared() {
+		return
+	}
+	fi, err := lp.file.Stat()
+	if err != nil {
+		return
+	}
+	written := lp.size - int64(lp.buf.Buffered())
+	if lp.gzip != nil {
+		written = lp.compressedSize
+	}
+	if fi.Size() >= written {
+		return
+	}
+	lp.PrintError("LogFile %s has been truncated by something else, reopening\n", lp.FileName)
+	lp.checksumValid = false
+	lp.file.Seek(0, io.SeekEnd)
+	lp.closeLog()
+	lp.openLogFile(noTruncateLog)
+}
+
+// replaced returns true if FileName no longer exists or, when the file is
+// open, is no longer the open file. Files are compared by device and inode
+// (the file ID on Windows), see os.SameFile.
+func (lp *LogFile) replaced() bool {
+	fi, err := os.Stat(lp.FileName)
+	if err != nil {
+		return true
+	}
+	return lp.file != nil && lp.fileInfo != nil && !os.SameFile(fi, lp.fileInfo)
+}
+
+// resumedLog checks if the clock jumped since lastTick, which happens when
+// the system is suspended and resumed. Files on NFS, FUSE etc may be stale
+// after a resume so the open file is checked and reopened if it has a
+// problem. resumedLog returns the time now for use as the next lastTick.
+func (lp *LogFile) resumedLog(lastTick time.Time) time.Time {
+	now := time.Now()
+	if !clockJumped(lastTick, now) || lp.file == nil {
+		return now
+	}
+
+	_, err := lp.file.Stat()
+	if err == nil {
+		return now
+	}
+	lp.PrintError("LogFile %s is stale after a clock jump, reopening: %s\n", lp.FileName, err)
+	lp.closeLog()
+	lp.openLogFile(noTruncateLog)
+	return now
+}
+
+// clockJumped returns true if the wall clock and monotonic clock disagree
+// about the time between then and now, or if much longer than any ticker
+// period has passed (on some systems the monotonic clock keeps counting
+// while suspended).
+func clockJumped(then, now time.Time) bool {
+	monotonic := now.Sub(then)
+	wall := now.Round(0).Sub(then.Round(0))
+	difference := wall - monotonic
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference > clockJump || monotonic > 2*time.Second*time.Duration(errorSeconds)+clockJump
+}
+
 // closeLog flushes and closes a log file
 func (lp *LogFile) closeLog() {
-	if lp.file == nil {
+	if !lp.isOpen() {
 		return
 	}
 
 	lp.flushLog()
+	lp.closeGzip()
+	lp.stopWatch()
 
-	err := lp.file.Close()
+	err := lp.closeOutput()
 	if err != nil {
 		lp.PrintError("LogFile error closing %s: %s\n", lp.FileName, err)
+		lp.noteError(err)
 	}
 
-	lp.file = nil
+	lp.fileInfo = nil
 }
 
-// PrintError prints out internal errors to standard error (if not turned off by the NoErrors flag)
+// PrintError prints out internal errors to ErrorWriter, standard error by default, (if not turned off by the NoErrors flag)
+// The error is also passed to OnError, if set.
+// If ErrorRepeatWindow is set identical errors within the window are counted
+// rather than printed.
 func (lp *LogFile) PrintError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	if lp.ErrorRepeatWindow > 0 {
+		now := time.Now()
+		lp.errorMutex.Lock()
+		if msg == lp.lastError && now.Sub(lp.lastErrorTime) < lp.ErrorRepeatWindow {
+			lp.errorRepeats++
+			lp.errorMutex.Unlock()
+			return
+		}
+		repeats, lastError := lp.errorRepeats, lp.lastError
+		lp.lastError, lp.lastErrorTime, lp.errorRepeats = msg, now, 0
+		lp.errorMutex.Unlock()
+
+		if repeats > 0 {
+			lp.printError(repeatedError(lastError, repeats))
+		}
+	}
+
+	lp.printError(msg)
+}
+
+// printError does the work of PrintError once msg is known to need printing
+func (lp *LogFile) printError(msg string) {
+	if lp.OnError != nil {
+		lp.OnError(errors.New(strings.TrimSuffix(msg, "\n")))
+	}
 	if lp.Flags&NoErrors == NoErrors {
 		return
 	}
-	fmt.Fprintf(os.Stderr, format, args...)
+	if lp.ErrorWriter == nil {
+		fmt.Fprint(os.Stderr, msg)
+		return
+	}
+	// Errors can come from more than one goroutine
+	lp.errorMutex.Lock()
+	fmt.Fprint(lp.ErrorWriter, msg)
+	lp.errorMutex.Unlock()
+}
+
+// printErrorRepeats prints how often the last error was repeated if its
+// ErrorRepeatWindow has passed, or always if force is set.
+func (lp *LogFile) printErrorRepeats(force bool) {
+	lp.errorMutex.Lock()
+	repeats, lastError := lp.errorRepeats, lp.lastError
+	if repeats == 0 || (!force && time.Since(lp.lastErrorTime) < lp.ErrorRepeatWindow) {
+		lp.errorMutex.Unlock()
+		return
+	}
+	lp.lastError, lp.errorRepeats = "", 0
+	lp.errorMutex.Unlock()
+
+	lp.printError(repeatedError(lastError, repeats))
+}
+
+// repeatedError returns the message used to report repeats of msg
+func repeatedError(msg string, repeats int) string {
+	return fmt.Sprintf("LogFile previous error repeated %d times: %s\n", repeats, strings.TrimSuffix(msg, "\n"))
 }
 
 // FileNameVersion returns a versioned log file name for rotating.
@@ -499,68 +1643,375 @@ func FileNameVersion(fileName string, v int) string {
 
 // RotateFileFuncDefault only rotates if OldVersions non zero.
 // It deletes the oldest version and renames the others log -> log.1, log.1 -> log.2...
+// With the CopyTruncate flag log is copied to log.1 and truncated instead.
+// With the TimestampVersions flag log is instead renamed with the time
+// added (see TimestampVersionFormat) and all but the newest OldVersions of
+// those are deleted.
+// If CompactFunc is set it is then run, in the background, on log.1
 func (lp *LogFile) RotateFileFuncDefault() {
 	if lp.OldVersions <= 0 {
 		return
 	}
 
-	// Delete the oldest
-	oldFileName := FileNameVersion(lp.FileName, lp.OldVersions)
-	_, err := os.Stat(oldFileName)
-	if err == nil {
-		err := os.Remove(oldFileName)
-		if err != nil {
-			lp.PrintError("LogFile error removing old file %s: %s\n", oldFileName, err)
+	// Don't move files while they are being compacted
+	lp.compacting.Wait()
+
+	rotated := FileNameVersion(lp.FileName, 1)
+	if lp.Flags&TimestampVersions == TimestampVersions {
+		rotated = lp.rotateTimestamped()
+	} else {
+		// Delete the oldest
+		lp.removeOldFile(FileNameVersion(lp.FileName, lp.OldVersions))
+		lp.removeExpired()
+
+		// Rename the others log -> log.1, log.1 -> log.2...
+		for v := lp.OldVersions - 1; v >= 0; v-- {
+			oldFilename := FileNameVersion(lp.FileName, v)
+			olderFileName := FileNameVersion(lp.FileName, v+1)
+			_, err := os.Stat(oldFilename)
+			if err != nil {
+				// Old file does not exist
+				continue
+			}
+			if v == 0 {
+				err = lp.moveLive(olderFileName)
+			} else {
+				err = os.Rename(oldFilename, olderFileName)
+				if err == nil {
+					lp.replicateRename(oldFilename, olderFileName)
+				}
+			}
+			if err != nil {
+				lp.PrintError("LogFile error renaming old file %s to %s: %s\n", oldFilename, olderFileName, err)
+				lp.rotateFailed(fmt.Errorf("%w: renaming old file %s to %s: %w", ErrRotateFailed, oldFilename, olderFileName, err))
+			}
 		}
 	}
 
-	// Rename the others log -> log.1, log.1 -> log.2...
-	for v := lp.OldVersions - 1; v >= 0; v-- {
-		oldFilename := FileNameVersion(lp.FileName, v)
-		olderFileName := FileNameVersion(lp.FileName, v+1)
-		_, err = os.Stat(oldFilename)
-		if err != nil {
-			// Old file does not exist
-			continue
+	lp.removeAged()
+	lp.removeOverBudget()
+
+	// The pinned files and checksums have moved
+	lp.rotateChecksums(rotated)
+	lp.rotateErrors(rotated)
+	lp.pinMutex.Lock()
+	if len(lp.pins) > 0 {
+		lp.savePins()
+	}
+	lp.pinMutex.Unlock()
+
+	if lp.CompactFunc != nil && rotated != "" {
+		lp.compacting.Add(1)
+		goroutineStarted()
+		if lp.synchronous {
+			lp.compactFile(lp.FileName, rotated)
+		} else {
+			go lp.compactFile(lp.FileName, rotated)
 		}
-		err := os.Rename(oldFilename, olderFileName)
+	}
+}
+
+// compactFile replaces fileName, rotated from live, with the output of
+// CompactFunc run on it. If CompactFunc fails fileName is left unchanged.
+// Either way PostRotate is then called.
+func (lp *LogFile) compactFile(live, fileName string) {
+	defer lp.compacting.Done()
+	defer goroutineStopped()
+
+	src, err := os.Open(fileName)
+	if err != nil {
+		// Nothing was rotated
+		return
+	}
+	defer lp.rotateHook("PostRotate", lp.PostRotate, live, fileName)
+	defer src.Close()
+
+	tmpFileName := fileName + ".compact"
+	dst, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, lp.FileMode)
+	if err != nil {
+		lp.PrintError("LogFile error creating %s: %s\n", tmpFileName, err)
+		return
+	}
+
+	err = lp.CompactFunc(src, dst)
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		lp.PrintError("LogFile error compacting %s: %s\n", fileName, err)
+		os.Remove(tmpFileName)
+		return
+	}
+
+	// Only replace the original once the new version is known to be good
+	if lp.Flags&VerifyArchives == VerifyArchives {
+		err = lp.verifyArchive(tmpFileName)
 		if err != nil {
-			lp.PrintError("LogFile error renaming old file %s to %s: %s\n", oldFilename, olderFileName, err)
+			atomic.AddInt64(&lp.archiveErrors, 1)
+			lp.PrintError("LogFile compacted %s is corrupt, keeping the original: %s\n", fileName, err)
+			os.Remove(tmpFileName)
+			return
 		}
 	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		lp.PrintError("LogFile error renaming %s to %s: %s\n", tmpFileName, fileName, err)
+		os.Remove(tmpFileName)
+	}
 }
 
-// RotateFile requests an immediate file rotation.
+// RotateFile requests an immediate file rotation. Once the LogFile has been
+// closed it does nothing.
 func (lp *LogFile) RotateFile() {
-	lp.messages <- logMessage{action: rotateLog}
+	lp.sendOpen(logMessage{action: rotateLog})
 }
 
-// Flush writes any pending log entries out
-func (lp *LogFile) Flush() {
-	complete := make(chan bool)
-	lp.messages <- logMessage{action: flushLog, complete: complete}
-	<-complete
+// RotateNow rotates the file, like RotateFile, but only returns once it has
+// been rotated. It returns the names of the old versions the default
+// RotateFile created, log.1 or the timestamped name, so they can be shipped
+// straight away (with CompactFunc set it may still be compacting them), and
+// the first error rotating, or since the last Write or Flush to return one.
+// Nothing is returned for a RotateFileFunc of your own, and ErrClosed once
+// the LogFile has been closed.
+func (lp *LogFile) RotateNow() ([]string, error) {
+	rotated := make(chan []string, 1)
+	if !lp.sendOpen(logMessage{action: rotateLog, rotated: rotated}) {
+		return nil, ErrClosed
+	}
+	names := <-rotated
+	return names, lp.takeError()
+}
+
+// ResetLifetime restarts the count of bytes checked against MaxLifetimeBytes
+// from zero, allowing writes to the file again.
+func (lp *LogFile) ResetLifetime() {
+	lp.sendOpen(logMessage{action: resetLifetimeLog})
+}
+
+// Flush writes any pending log entries out. It returns the first error
+// writing to the file since the last Write or Flush to return one, or
+// ErrClosed once Close has been called.
+func (lp *LogFile) Flush() error {
+	complete := make(chan error, 1)
+	if !lp.sendOpen(logMessage{action: flushLog, complete: complete}) {
+		return ErrClosed
+	}
+	err := <-complete
+	if unreported := lp.takeError(); unreported != nil {
+		err = unreported
+	}
+	return err
+}
+
+// Sync is Flush and then waits for the file to reach the disk, as the
+// SyncCritical flag does for critical entries.
+func (lp *LogFile) Sync() error {
+	complete := make(chan error, 1)
+	if !lp.sendOpen(logMessage{action: flushLog, critical: true, complete: complete}) {
+		return ErrClosed
+	}
+	err := <-complete
+	if unreported := lp.takeError(); unreported != nil {
+		err = unreported
+	}
+	return err
 }
 
 // Write is called by Log to write log entries.
+// If not buffering (FlushInterval <= 0) Write only returns once p has been
+// written to the file, along with any error in doing so. Otherwise the
+// error returned is the first in writing earlier entries, rotating or
+// flushing the file not yet returned by a Write or Flush, so a full disk
+// is still noticed.
 func (lp *LogFile) Write(p []byte) (n int, err error) {
+	if lp.rateLimited(0) {
+		return len(p), nil
+	}
+	return lp.write(p, nil, false, 0)
+}
+
+// WriteWithMeta writes p, like Write, passing meta along with it to
+// Formatter. Use it to pass details (component, tenant, level...) a
+// Formatter needs without them having to be parsed back out of p.
+// An entry with a level in meta of LevelError or above is critical, see
+// SyncCritical, and so is never rate limited.
+func (lp *LogFile) WriteWithMeta(p []byte, meta map[string]string) (n int, err error) {
+	level, ok := ParseLevel(meta[LevelKey])
+	critical := ok && level >= LevelError
+	if !critical && lp.rateLimited(0) {
+		return len(p), nil
+	}
+	return lp.write(p, meta, critical, 0)
+}
+
+// WriteCritical writes p, like Write, as a critical entry. With the
+// SyncCritical flag set it is on disk before WriteCritical returns.
+func (lp *LogFile) WriteCritical(p []byte) (n int, err error) {
+	return lp.write(p, nil, true, 0)
+}
+
+// WriteWithFlags writes p, like Write, with flags deciding where this one
+// entry goes. FileOnly sends it only to the file and StderrOnly only to
+// stderr (even if the LogFile has the FileOnly flag); other flags are
+// ignored. Use it, for example, for console notices that would clutter the
+// file.
+func (lp *LogFile) WriteWithFlags(p []byte, flags int) (n int, err error) {
+	if lp.rateLimited(0) {
+		return len(p), nil
+	}
+	return lp.write(p, nil, false, flags&(FileOnly|StderrOnly))
+}
+
+// flushOnPattern returns true if p matches FlushOnPattern or contains one of
+// FlushOnContains
+func (lp *LogFile) flushOnPattern(p []byte) bool {
+	if lp.FlushOnPattern != nil && lp.FlushOnPattern.Match(p) {
+		return true
+	}
+	for _, s := range lp.FlushOnContains {
+		if bytes.Contains(p, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// write does the work of the Write methods
+func (lp *LogFile) write(p []byte, meta map[string]string, critical bool, flags int) (n int, err error) {
+	if lp.oversized(p) {
+		return lp.writeOversized(p, meta, critical, flags)
+	}
+
 	// LogFile cannot guarantee that it will have finished with p before this
-	// function returns. To prevent corruption use a copy of p.
-	pLen := len(p)
-	buf := make([]byte, pLen)
+	// function returns. To prevent corruption use a copy of p (and meta).
+	buf := make([]byte, len(p))
 	copy(buf, p)
+	return lp.queue(buf, nil, meta, critical, flags)
+}
+
+// queue does the work of write once buf, a copy of the entry, is ready.
+// chunks, if not nil, are the pieces of buf to write as separate entries
+// (see OversizeChunk).
+func (lp *LogFile) queue(buf []byte, chunks [][]byte, meta map[string]string, critical bool, flags int) (n int, err error) {
+	pLen := len(buf)
+	var metaCopy map[string]string
+	if meta != nil {
+		metaCopy = make(map[string]string, len(meta))
+		for k, v := range meta {
+			metaCopy[k] = v
+		}
+	}
 
-	lp.messages <- logMessage{action: writeLog, data: buf}
-	if lp.FlushSeconds <= 0 {
-		lp.Flush()
+	seq := lp.nextSeq()
+	if !lp.reservePending(pLen) {
+		lp.trace(TraceDrop, seq, pLen, "MaxPendingBytes reached")
+		return 0, ErrOverflow
 	}
-	return pLen, nil
+
+	message := logMessage{action: writeLog, data: buf, chunks: chunks, meta: metaCopy, errorLevel: critical, queued: time.Now(), seq: seq, flags: flags}
+	critical = (critical && lp.Flags&SyncCritical == SyncCritical) || lp.flushOnPattern(buf)
+	message.critical = critical
+
+	// If not buffering wait for the entry to be written
+	var complete chan error
+	if lp.FlushInterval <= 0 || critical {
+		complete = make(chan error, 1)
+		message.complete = complete
+	}
+
+	// Once Close has started nothing more can be queued
+	lp.closeMutex.RLock()
+	if lp.closed {
+		lp.closeMutex.RUnlock()
+		atomic.AddInt64(&lp.queuedBytes, -int64(pLen))
+		lp.trace(TraceDrop, seq, pLen, "closed")
+		return 0, ErrClosed
+	}
+	lp.summarizeOverflow()
+	lp.trace(TraceEnqueue, seq, pLen, "")
+	if lp.Flags&DropWhenFull == DropWhenFull {
+		if !lp.trySend(message) {
+			lp.closeMutex.RUnlock()
+			atomic.AddInt64(&lp.queuedBytes, -int64(pLen))
+			atomic.AddInt64(&lp.fullDrops, 1)
+			lp.trace(TraceDrop, seq, pLen, "queue full")
+			return 0, ErrQueueFull
+		}
+	} else {
+		lp.send(message)
+	}
+	lp.closeMutex.RUnlock()
+
+	if complete != nil {
+		err = <-complete
+	}
+	if unreported := lp.takeError(); unreported != nil {
+		err = unreported
+	}
+	return pLen, err
 }
 
 // Close flushs any pending data out and then closes a log file opened by calling New()
-func (lp *LogFile) Close() {
-	complete := make(chan bool)
-	lp.messages <- logMessage{action: closeLog, complete: complete}
+// Entries written before Close is called are all written out. Writes made
+// once Close has started return ErrClosed. If anything went wrong, the first
+// error writing earlier entries not already returned by a Write or Flush and
+// every failure while closing (flushing, closing the file, a final rotation,
+// entries that had to be dropped...), a *CloseError listing them all is
+// returned.
+// Calling Close again, even at the same time, only waits for the first call
+// to finish and returns nil. So does Close on a LogFile New failed to open.
+func (lp *LogFile) Close() error {
+	// Closed already, or New failed and the goroutine has stopped, so there
+	// is nothing to tell
+	lp.closeMutex.RLock()
+	closed := lp.closed
+	lp.closeMutex.RUnlock()
+	if closed {
+		lp.waitClosed()
+		return nil
+	}
+
+	// Only really close once every New that returned lp has been matched
+	if !unregister(lp) {
+		return nil
+	}
+
+	// Stop any more writes being queued. Those already queued are written
+	// before the close as messages are handled in order.
+	complete := make(chan error, 1)
+	lp.closeMutex.Lock()
+	if lp.closed {
+		lp.closeMutex.Unlock()
+		lp.waitClosed()
+		return nil
+	}
+	lp.closed = true
+	done := make(chan struct{})
+	lp.closeDone = done
+	defer close(done)
+	lp.send(logMessage{action: closeLog, complete: complete})
+	lp.closeMutex.Unlock()
+
+	// Writers waiting for room are let go so they find the LogFile closed
+	atomic.StoreInt32(&lp.stopping, 1)
+	lp.overflowMutex.Lock()
+	lp.overflowCond.Broadcast()
+	lp.overflowMutex.Unlock()
+
 	// wait for the logfile to close
 	<-complete
+	return lp.takeCloseError()
+}
+
+// waitClosed waits for Close, once it has been called, to finish
+func (lp *LogFile) waitClosed() {
+	lp.closeMutex.RLock()
+	done := lp.closeDone
+	lp.closeMutex.RUnlock()
+	if done != nil {
+		<-done
+	}
 }
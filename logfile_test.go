@@ -21,12 +21,33 @@ limitations under the License.
 package logfile
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/slogtest"
 	"time"
 )
 
@@ -375,9 +396,9 @@ func Test_LogVanish(t *testing.T) {
 	}
 
 	logFile, err := New(&LogFile{
-		FileName:     logFileName,
-		CheckSeconds: 1,
-		Flags:        OverWriteOnStart})
+		FileName:      logFileName,
+		CheckInterval: 100 * time.Millisecond,
+		Flags:         OverWriteOnStart})
 	if err != nil {
 		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
 		return
@@ -386,9 +407,9 @@ func Test_LogVanish(t *testing.T) {
 	log.SetOutput(logFile)
 	log.Print("testing")
 
-	// Remove the logfile and wait long enough for LogFile to notice (CheckSeconds is 1)
+	// Remove the logfile and wait long enough for LogFile to notice (CheckInterval is 100ms)
 	os.Remove(logFileName)
-	time.Sleep(time.Second * 2)
+	time.Sleep(500 * time.Millisecond)
 
 	// This is all that should appear in the logfile
 	msg := "testing again\n"
@@ -490,3 +511,5236 @@ func ExampleLogFile() {
 
 	os.Remove(logFileName)
 }
+
+func Test_StderrFailure(t *testing.T) {
+	debug("Test_StderrFailure start")
+	defer debug("Test_StderrFailure end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	// Replace stderr with a file that cannot be written to
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Errorf("Failed to create pipe: %s\n", err)
+		return
+	}
+	r.Close()
+	w.Close()
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	var errs []error
+	logFile, err := New(&LogFile{
+		FileName: logFileName,
+		Flags:    OverWriteOnStart | NoErrors,
+		OnError:  func(err error) { errs = append(errs, err) }})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	msg := "still in the file\n"
+	logFile.Write([]byte(msg))
+	stats := logFile.Stats()
+	logFile.Close()
+	os.Stderr = stderr
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	if string(contents) != msg {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, msg, contents)
+	}
+	if stats.Writes != 1 || stats.StderrErrors != 1 || stats.FileBytes != int64(len(msg)) {
+		t.Errorf("Wrong stats %+v\n", stats)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Expected 1 error passed to OnError got %d\n", len(errs))
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_AppendSizeCounted(t *testing.T) {
+	debug("Test_AppendSizeCounted start")
+	defer debug("Test_AppendSizeCounted end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	// The existing contents should count towards MaxSize
+	contents := strings.Repeat("a", 60) + "\n"
+	err = ioutil.WriteFile(logFileName, []byte(contents), 0644)
+	if err != nil {
+		t.Errorf("Failed to write file %s: %s\n", logFileName, err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName:    logFileName,
+		MaxSize:     71,
+		OldVersions: 1,
+		Flags:       FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	line := strings.Repeat("b", 19) + "\n"
+	logFile.Write([]byte(line))
+	logFile.Close()
+
+	for i, expected := range []string{line, contents} {
+		lf := FileNameVersion(logFileName, i)
+		got, err := ioutil.ReadFile(lf)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", lf, err)
+			continue
+		}
+		if string(got) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", lf, expected, got)
+		}
+		os.Remove(lf)
+	}
+}
+
+func Test_StderrMaxSize(t *testing.T) {
+	debug("Test_StderrMaxSize start")
+	defer debug("Test_StderrMaxSize end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	stderrName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(stderrName)
+	f, err := os.Create(stderrName)
+	if err != nil {
+		t.Errorf("Failed to create file %s: %s\n", stderrName, err)
+		return
+	}
+	stderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = stderr }()
+
+	logFile, err := New(&LogFile{
+		FileName:      logFileName,
+		StderrMaxSize: 10,
+		Flags:         OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	msg := strings.Repeat("x", 100) + "\n"
+	logFile.Write([]byte(msg))
+	logFile.Close()
+	os.Stderr = stderr
+	f.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	if string(contents) != msg {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, msg, contents)
+	}
+
+	console, err := ioutil.ReadFile(stderrName)
+	if err != nil {
+		t.Errorf("Failed to read file %s: %s\n", stderrName, err)
+		return
+	}
+	if !strings.HasPrefix(string(console), strings.Repeat("x", 10)+"...") || strings.Contains(string(console), strings.Repeat("x", 11)) {
+		t.Errorf("Wrong stderr contents got %s\n", console)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_DevMode(t *testing.T) {
+	debug("Test_DevMode start")
+	defer debug("Test_DevMode end")
+
+	entry := []byte(`{ "level": "ERROR", "msg": "hello",  "n": {"a": 1} }` + "\n")
+	compact, pretty := devFormat(entry)
+	expected := `{"level":"ERROR","msg":"hello","n":{"a":1}}` + "\n"
+	if string(compact) != expected {
+		t.Errorf("Wrong compact JSON expected %s got %s\n", expected, compact)
+	}
+	if !strings.Contains(string(pretty), colourError+`"ERROR"`) || strings.Count(string(pretty), "\n") != 7 {
+		t.Errorf("Wrong pretty JSON got %s\n", pretty)
+	}
+
+	plain := []byte("not json\n")
+	compact, pretty = devFormat(plain)
+	if string(compact) != string(plain) || string(pretty) != string(plain) {
+		t.Errorf("Plain text changed, got %s and %s\n", compact, pretty)
+	}
+}
+
+func Test_WriteEntry(t *testing.T) {
+	debug("Test_WriteEntry start")
+	defer debug("Test_WriteEntry end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName: logFileName,
+		Flags:    FileOnly | OverWriteOnStart | CallerInfo})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	err = logFile.WriteEntry(Entry{"msg": "hello", TimeKey: "now"})
+	if err != nil {
+		t.Errorf("Failed to write entry: %s\n", err)
+	}
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	if !strings.HasPrefix(string(contents), `{"msg":"hello","source":"`) ||
+		!strings.Contains(string(contents), `logfile_test.go:`) ||
+		!strings.HasSuffix(string(contents), `","time":"now"}`+"\n") {
+		t.Errorf("Wrong logfile contents for %s got %s\n", logFileName, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_ErrorRepeatWindow(t *testing.T) {
+	debug("Test_ErrorRepeatWindow start")
+	defer debug("Test_ErrorRepeatWindow end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	var errs []error
+	logFile, err := New(&LogFile{
+		FileName:          logFileName,
+		ErrorRepeatWindow: time.Hour,
+		Flags:             FileOnly | NoErrors,
+		OnError:           func(err error) { errs = append(errs, err) }})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		logFile.PrintError("LogFile test error %d\n", 1)
+	}
+	logFile.PrintError("LogFile test error %d\n", 2)
+	logFile.Close()
+
+	expected := []string{
+		"LogFile test error 1",
+		"LogFile previous error repeated 9 times: LogFile test error 1",
+		"LogFile test error 2",
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("Expected %d errors got %d: %v\n", len(expected), len(errs), errs)
+		return
+	}
+	for i, e := range expected {
+		if errs[i].Error() != e {
+			t.Errorf("Wrong error expected %s got %s\n", e, errs[i])
+		}
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_Discard(t *testing.T) {
+	debug("Test_Discard start")
+	defer debug("Test_Discard end")
+
+	msg := []byte("gone\n")
+	n, err := Discard.Write(msg)
+	if n != len(msg) || err != nil {
+		t.Errorf("Discard.Write expected %d, nil got %d, %v\n", len(msg), n, err)
+	}
+	Discard.Flush()
+	Discard.RotateFile()
+	Discard.Close()
+	if !reflect.DeepEqual(Discard.Stats(), Stats{}) {
+		t.Errorf("Discard.Stats not zero\n")
+	}
+}
+
+func Test_ExclusiveCreate(t *testing.T) {
+	debug("Test_ExclusiveCreate start")
+	defer debug("Test_ExclusiveCreate end")
+
+	// tempFileName leaves an empty file behind
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: ExclusiveCreate | NoErrors})
+	if err == nil {
+		logFile.Close()
+		t.Errorf("Opened existing log file %s despite ExclusiveCreate\n", logFileName)
+		return
+	}
+
+	logFile, err = New(&LogFile{FileName: logFileName, Flags: ExclusiveCreate | AutoUniqueName})
+	if err != nil {
+		t.Errorf("Failed to create unique log file from %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Close()
+	os.Remove(logFile.FileName)
+
+	if !strings.HasPrefix(logFile.FileName, logFileName+".") || logFile.FileName == logFileName {
+		t.Errorf("Wrong unique name for %s got %s\n", logFileName, logFile.FileName)
+	}
+}
+
+func Test_NewPerRun(t *testing.T) {
+	debug("Test_NewPerRun start")
+	defer debug("Test_NewPerRun end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	template := dir + "/run-*.log"
+	var names []string
+	for i := 0; i < 3; i++ {
+		logFile, err := NewPerRun(template, &LogFile{KeepRuns: 2, Flags: FileOnly})
+		if err != nil {
+			t.Errorf("Failed to create per run log file %s: %s\n", template, err)
+			return
+		}
+		logFile.Write([]byte("run\n"))
+		logFile.Close()
+		names = append(names, logFile.FileName)
+	}
+
+	if names[0] == names[1] {
+		t.Errorf("Per run log file names not unique: %s\n", names[0])
+	}
+	if _, err := os.Stat(names[0]); err == nil {
+		t.Errorf("Oldest per run log file %s not removed\n", names[0])
+	}
+	for _, name := range names[1:] {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Per run log file %s missing: %s\n", name, err)
+		}
+	}
+
+	// A run that fails to start removes nothing
+	if _, err := NewPerRun(template, &LogFile{KeepRuns: 1, Flags: FileOnly | NoErrors, MaxSize: -1}); err == nil {
+		t.Errorf("Expected NewPerRun with a negative MaxSize to fail\n")
+	}
+	for _, name := range names[1:] {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("Per run log file %s removed by a failed NewPerRun: %s\n", name, err)
+		}
+	}
+}
+
+func Test_SplitRun(t *testing.T) {
+	debug("Test_SplitRun start")
+	defer debug("Test_SplitRun end")
+
+	id := "20150102T150405.1234.1"
+	tests := []struct {
+		rest, suffix, id, version string
+	}{
+		{id + ".log", ".log", id, ""},
+		{id + ".log.2", ".log", id, ".2"},
+		{id, "", id, ""},
+		{id + ".2", "", id, ".2"},
+	}
+	for _, test := range tests {
+		gotID, gotVersion := splitRun(test.rest, test.suffix)
+		if gotID != test.id || gotVersion != test.version {
+			t.Errorf("splitRun(%s, %s) expected %s, %s got %s, %s\n", test.rest, test.suffix, test.id, test.version, gotID, gotVersion)
+		}
+	}
+
+	// Counters and process ids are numbers, not strings
+	for _, ids := range [][2]string{
+		{"20150102T150405.1234.9", "20150102T150405.1234.10"},
+		{"20150102T150405.999.1", "20150102T150405.1234.1"},
+		{"20150102T150405.1234.10", "20150102T150406.1234.1"},
+	} {
+		if !runIDLess(ids[0], ids[1]) || runIDLess(ids[1], ids[0]) {
+			t.Errorf("Expected run %s before %s\n", ids[0], ids[1])
+		}
+	}
+}
+
+func Test_ClockJumped(t *testing.T) {
+	debug("Test_ClockJumped start")
+	defer debug("Test_ClockJumped end")
+
+	now := time.Now()
+	if clockJumped(now.Add(-time.Second), now) {
+		t.Errorf("Clock jump seen after a second\n")
+	}
+	if !clockJumped(now.Add(-time.Hour), now) {
+		t.Errorf("Clock jump not seen after an hour\n")
+	}
+}
+
+func Test_CompactFunc(t *testing.T) {
+	debug("Test_CompactFunc start")
+	defer debug("Test_CompactFunc end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	// Drop the DEBUG lines from rotated files
+	dropDebug := func(src io.Reader, dst io.Writer) error {
+		scanner := bufio.NewScanner(src)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "DEBUG") {
+				fmt.Fprintln(dst, scanner.Text())
+			}
+		}
+		return scanner.Err()
+	}
+
+	logFile, err := New(&LogFile{
+		FileName:    logFileName,
+		OldVersions: 1,
+		CompactFunc: dropDebug,
+		Flags:       FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	logFile.Write([]byte("DEBUG noise\nINFO keep\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("DEBUG live\n"))
+	logFile.Close()
+
+	for i, expected := range []string{"DEBUG live\n", "INFO keep\n"} {
+		lf := FileNameVersion(logFileName, i)
+		got, err := ioutil.ReadFile(lf)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", lf, err)
+			continue
+		}
+		if string(got) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", lf, expected, got)
+		}
+		os.Remove(lf)
+	}
+}
+
+func Test_ValidateFileName(t *testing.T) {
+	debug("Test_ValidateFileName start")
+	defer debug("Test_ValidateFileName end")
+
+	tests := []struct {
+		fileName, allowedDir string
+		ok                   bool
+	}{
+		{"/var/log/app.log", "", true},
+		{"/var/log/app\x00.log", "", false},
+		{"/var/log/", "", false},
+		{"/var/log/app.log", "/var/log", true},
+		{"/var/log/sub/app.log", "/var/log", true},
+		{"/var/log/../../etc/passwd", "/var/log", false},
+		{"/var/logs/app.log", "/var/log", false},
+	}
+	for _, test := range tests {
+		err := validateFileName(test.fileName, test.allowedDir)
+		if test.ok && err != nil {
+			t.Errorf("validateFileName(%q, %q) unexpected error %s\n", test.fileName, test.allowedDir, err)
+		} else if !test.ok {
+			if _, isFileNameError := err.(*FileNameError); !isFileNameError {
+				t.Errorf("validateFileName(%q, %q) expected FileNameError got %v\n", test.fileName, test.allowedDir, err)
+			}
+		}
+	}
+}
+
+func Test_FromLumberjack(t *testing.T) {
+	debug("Test_FromLumberjack start")
+	defer debug("Test_FromLumberjack end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	_, err = FromLumberjack(LumberjackConfig{Filename: logFileName, MaxBackups: 3, Compress: true})
+	if err == nil {
+		t.Errorf("FromLumberjack accepted Compress\n")
+	}
+
+	logFile, err := FromLumberjack(LumberjackConfig{Filename: logFileName, MaxSize: 2, MaxBackups: 3, MaxAge: 30})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Close()
+
+	if logFile.MaxSize != 2*1024*1024 || logFile.OldVersions != 3 || logFile.MaxAge != 30*24*time.Hour || logFile.Flags&FileOnly != FileOnly {
+		t.Errorf("Wrong LogFile from lumberjack config: MaxSize %d OldVersions %d MaxAge %s Flags %d\n", logFile.MaxSize, logFile.OldVersions, logFile.MaxAge, logFile.Flags)
+	}
+}
+
+func Test_Lumberjack(t *testing.T) {
+	debug("Test_Lumberjack start")
+	defer debug("Test_Lumberjack end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := FromLumberjack(LumberjackConfig{Filename: logFileName, MaxBackups: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	var lj interface {
+		Write(p []byte) (int, error)
+		Rotate() error
+		Close() error
+	} = Lumberjack{logFile}
+
+	lj.Write([]byte("old\n"))
+	if err := lj.Rotate(); err != nil {
+		t.Errorf("Rotate failed: %s\n", err)
+	}
+	if _, err := os.Stat(FileNameVersion(logFileName, 1)); err != nil {
+		t.Errorf("Rotate did not finish before returning: %s\n", err)
+	}
+	if err := lj.Close(); err != nil {
+		t.Errorf("Close failed: %s\n", err)
+	}
+
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+}
+
+func Test_MaxLifetimeBytes(t *testing.T) {
+	debug("Test_MaxLifetimeBytes start")
+	defer debug("Test_MaxLifetimeBytes end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName:              logFileName,
+		MaxLifetimeBytes:      20,
+		PreviousLifetimeBytes: 10,
+		Flags:                 FileOnly | OverWriteOnStart | NoErrors})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	fmt.Fprint(logFile, "12345\n")
+	fmt.Fprint(logFile, "over the limit\n")
+	stats := logFile.Stats()
+	logFile.ResetLifetime()
+	fmt.Fprint(logFile, "reset\n")
+	logFile.Close()
+
+	if stats.LifetimeBytes != 16 {
+		t.Errorf("Wrong LifetimeBytes expected 16 got %d\n", stats.LifetimeBytes)
+	}
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "12345\nreset\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_DetectFormat(t *testing.T) {
+	debug("Test_DetectFormat start")
+	defer debug("Test_DetectFormat end")
+
+	tests := []struct {
+		contents string
+		format   Format
+		version  int
+		rest     string
+	}{
+		{"", FormatPlain, 0, ""},
+		{"plain text\n", FormatPlain, 0, "plain text\n"},
+		{"\x1f\x8bgzip", FormatGzip, 0, "\x1f\x8bgzip"},
+		{string(fileHeader(Format(7), 2)) + "data", Format(7), 2, "data"},
+	}
+	for _, test := range tests {
+		format, version, r, err := DetectFormat(strings.NewReader(test.contents))
+		if err != nil {
+			t.Errorf("DetectFormat(%q) unexpected error %s\n", test.contents, err)
+			continue
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if format != test.format || version != test.version || string(rest) != test.rest {
+			t.Errorf("DetectFormat(%q) expected %d, %d, %q got %d, %d, %q\n", test.contents, test.format, test.version, test.rest, format, version, rest)
+		}
+	}
+}
+
+func Test_CanDeleteFunc(t *testing.T) {
+	debug("Test_CanDeleteFunc start")
+	defer debug("Test_CanDeleteFunc end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	var canDelete int32
+	logFile, err := New(&LogFile{
+		FileName:      logFileName,
+		OldVersions:   1,
+		CanDeleteFunc: func(string) bool { return atomic.LoadInt32(&canDelete) == 1 },
+		Flags:         FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	expired := func() []string {
+		names, _ := filepath.Glob(logFileName + ".1" + expiredSuffix + "*")
+		return names
+	}
+
+	for i := 0; i < 2; i++ {
+		fmt.Fprintf(logFile, "line %d\n", i)
+		logFile.RotateFile()
+	}
+	logFile.Flush()
+	if len(expired()) != 1 {
+		t.Errorf("Expected 1 old version waiting to be deleted got %v\n", expired())
+	}
+
+	atomic.StoreInt32(&canDelete, 1)
+	logFile.RotateFile()
+	logFile.Close()
+	if len(expired()) != 0 {
+		t.Errorf("Expected no old versions waiting to be deleted got %v\n", expired())
+	}
+
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+}
+
+func Test_Pin(t *testing.T) {
+	debug("Test_Pin start")
+	defer debug("Test_Pin end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	logFileName := filepath.Join(dir, "pin.log")
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 1, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	fmt.Fprint(logFile, "incident\n")
+	logFile.RotateFile()
+	logFile.Flush()
+	if err := logFile.Pin(1); err != nil {
+		t.Errorf("Failed to pin: %s\n", err)
+	}
+	logFile.RotateFile()
+	logFile.RotateFile()
+	logFile.Close()
+
+	// Start again to check the pin was remembered
+	logFile, err = New(&LogFile{FileName: logFileName, OldVersions: 1, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	pinned := logFile.PinnedFiles()
+	if len(pinned) != 1 {
+		t.Errorf("Expected 1 pinned file got %v\n", pinned)
+		logFile.Close()
+		return
+	}
+	contents, err := ioutil.ReadFile(pinned[0])
+	if err != nil || string(contents) != "incident\n" {
+		t.Errorf("Wrong pinned file contents for %s got %s %v\n", pinned[0], contents, err)
+	}
+
+	if err := logFile.UnpinFile(pinned[0]); err != nil {
+		t.Errorf("Failed to unpin %s: %s\n", pinned[0], err)
+	}
+	logFile.RotateFile()
+	logFile.Close()
+
+	if _, err := os.Stat(pinned[0]); err == nil {
+		t.Errorf("Unpinned file %s not deleted\n", pinned[0])
+	}
+	if _, err := os.Stat(stateFileName(logFileName)); err == nil {
+		t.Errorf("State file not removed once nothing is pinned\n")
+	}
+}
+
+func Test_WriteWithMeta(t *testing.T) {
+	debug("Test_WriteWithMeta start")
+	defer debug("Test_WriteWithMeta end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName: logFileName,
+		Flags:    FileOnly | OverWriteOnStart,
+		Formatter: func(p []byte, meta map[string]string) []byte {
+			if component, ok := meta["component"]; ok {
+				return append([]byte(component+": "), p...)
+			}
+			return p
+		}})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	logFile.WriteWithMeta([]byte("connected\n"), map[string]string{"component": "db"})
+	logFile.Write([]byte("plain\n"))
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "db: connected\nplain\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_SyncCritical(t *testing.T) {
+	debug("Test_SyncCritical start")
+	defer debug("Test_SyncCritical end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName:     logFileName,
+		FlushSeconds: 60,
+		Flags:        FileOnly | OverWriteOnStart | SyncCritical})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer logFile.Close()
+
+	fileContents := func() string {
+		contents, _ := ioutil.ReadFile(logFileName)
+		return string(contents)
+	}
+
+	fmt.Fprint(logFile, "buffered\n")
+	if fileContents() != "" {
+		t.Errorf("Non critical entry written at once\n")
+	}
+	logFile.WriteEntry(Entry{LevelKey: "ERROR", TimeKey: "now"})
+	expected := "buffered\n" + `{"level":"ERROR","time":"now"}` + "\n"
+	if fileContents() != expected {
+		t.Errorf("Wrong logfile contents after critical entry expected %s got %s\n", expected, fileContents())
+	}
+}
+
+func Test_VerifyArchives(t *testing.T) {
+	debug("Test_VerifyArchives start")
+	defer debug("Test_VerifyArchives end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	// Write gzip output missing its end (and so its CRC)
+	brokenGzip := func(src io.Reader, dst io.Writer) error {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		io.Copy(zw, src)
+		zw.Close()
+		_, err := dst.Write(buf.Bytes()[:buf.Len()-4])
+		return err
+	}
+
+	var errs int32
+	logFile, err := New(&LogFile{
+		FileName:    logFileName,
+		OldVersions: 1,
+		CompactFunc: brokenGzip,
+		OnError:     func(error) { atomic.AddInt32(&errs, 1) },
+		Flags:       FileOnly | OverWriteOnStart | VerifyArchives | NoErrors})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	msg := "keep me\n"
+	fmt.Fprint(logFile, msg)
+	logFile.RotateFile()
+	logFile.Close()
+
+	lf := FileNameVersion(logFileName, 1)
+	contents, err := ioutil.ReadFile(lf)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", lf, err)
+	} else if string(contents) != msg {
+		t.Errorf("Original not kept for %s got %q\n", lf, contents)
+	}
+	if atomic.LoadInt32(&errs) != 1 {
+		t.Errorf("Expected 1 error got %d\n", errs)
+	}
+
+	os.Remove(logFileName)
+	os.Remove(lf)
+}
+
+func Test_Registry(t *testing.T) {
+	debug("Test_Registry start")
+	defer debug("Test_Registry end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	registered := func(lp *LogFile) bool {
+		for _, open := range ListOpenLogFiles() {
+			if open == lp {
+				return true
+			}
+		}
+		return false
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	unregisteredName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(unregisteredName)
+	unregistered, err := New(&LogFile{FileName: unregisteredName, Flags: FileOnly | Unregistered})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", unregisteredName, err)
+		return
+	}
+	defer unregistered.Close()
+
+	if !registered(logFile) {
+		t.Errorf("Open log file not in ListOpenLogFiles\n")
+	}
+	if registered(unregistered) {
+		t.Errorf("Unregistered log file in ListOpenLogFiles\n")
+	}
+	FlushAll()
+	logFile.Close()
+	if registered(logFile) {
+		t.Errorf("Closed log file still in ListOpenLogFiles\n")
+	}
+}
+
+func Test_StderrTimeout(t *testing.T) {
+	debug("Test_StderrTimeout start")
+	defer debug("Test_StderrTimeout end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	// Replace stderr with a pipe no one reads from so it fills and blocks
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Errorf("Failed to create pipe: %s\n", err)
+		return
+	}
+	defer r.Close()
+	defer w.Close()
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	logFile, err := New(&LogFile{
+		FileName:      logFileName,
+		StderrTimeout: 10 * time.Millisecond,
+		Flags:         OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	line := strings.Repeat("x", 2047) + "\n"
+	entries := 300
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < entries; i++ {
+			logFile.Write([]byte(line))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Errorf("Writes held up by blocked stderr\n")
+		return
+	}
+
+	stats := logFile.Stats()
+	logFile.Close()
+	os.Stderr = stderr
+
+	if stats.StderrDrops == 0 {
+		t.Errorf("Expected entries to be dropped from stderr, stats %+v\n", stats)
+	}
+	if stats.FileBytes != int64(entries*len(line)) {
+		t.Errorf("Wrong FileBytes expected %d got %d\n", entries*len(line), stats.FileBytes)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_Duplicate(t *testing.T) {
+	debug("Test_Duplicate start")
+	defer debug("Test_Duplicate end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	// Same file by another name
+	otherName := filepath.Join(filepath.Dir(logFileName), ".", filepath.Base(logFileName))
+	_, err = New(&LogFile{FileName: otherName, Flags: FileOnly})
+	if _, isFileNameError := err.(*FileNameError); !isFileNameError {
+		t.Errorf("Expected FileNameError opening %s twice got %v\n", logFileName, err)
+	}
+
+	reused, err := New(&LogFile{FileName: otherName, Flags: FileOnly | ReuseDuplicate})
+	if err != nil {
+		t.Errorf("Failed to reuse log file %s: %s\n", logFileName, err)
+		return
+	}
+	if reused != logFile {
+		t.Errorf("ReuseDuplicate did not return the open LogFile\n")
+	}
+
+	// The first Close must leave it open for the second user
+	logFile.Close()
+	fmt.Fprint(reused, "still open\n")
+	reused.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil || string(contents) != "still open\n" {
+		t.Errorf("Wrong logfile contents for %s got %q %v\n", logFileName, contents, err)
+	}
+
+	// CloseAll closes it however many times it was reused
+	logFile, err = New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	New(&LogFile{FileName: logFileName, Flags: FileOnly | ReuseDuplicate})
+	New(&LogFile{FileName: logFileName, Flags: FileOnly | ReuseDuplicate})
+	CloseAll()
+	if _, err := logFile.Write([]byte("closed\n")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after CloseAll got %v\n", err)
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	debug("Test_Validate start")
+	defer debug("Test_Validate end")
+
+	lp := &LogFile{
+		FileName:    os.DevNull,
+		MaxSize:     -1,
+		OldVersions: -2,
+		Flags:       RotateOnStart | VerifyArchives}
+	err := lp.Validate()
+	configError, ok := err.(*ConfigError)
+	if !ok {
+		t.Errorf("Expected ConfigError got %v\n", err)
+		return
+	}
+	// MaxSize, OldVersions, VerifyArchives without CompactFunc, RotateOnStart on a device
+	if len(configError.Problems) != 4 {
+		t.Errorf("Expected 4 problems got %s\n", err)
+	}
+
+	lp = &LogFile{FileName: "ok.log", OldVersions: 2}
+	if err := lp.Validate(); err != nil {
+		t.Errorf("Unexpected problem %s\n", err)
+	}
+
+	// New fills in RotateFileFunc but that doesn't make CompactFunc useful
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	_, err = New(&LogFile{FileName: logFileName, CompactFunc: DictionaryCompactFunc(nil), Flags: FileOnly})
+	if configError, ok := err.(*ConfigError); !ok || !strings.Contains(configError.Error(), "CompactFunc is never used") {
+		t.Errorf("Expected CompactFunc without OldVersions to be rejected got %v\n", err)
+	}
+}
+
+func Test_WriteOrder(t *testing.T) {
+	debug("Test_WriteOrder start")
+	defer debug("Test_WriteOrder end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	// Each writer must find its own entry in the file as soon as Write returns
+	missing := int32(0)
+	done := make(chan bool)
+	for w := 0; w < 10; w++ {
+		go func(w int) {
+			for i := 0; i < 20; i++ {
+				line := fmt.Sprintf("writer %d line %d\n", w, i)
+				logFile.Write([]byte(line))
+				contents, _ := ioutil.ReadFile(logFileName)
+				if !strings.Contains(string(contents), line) {
+					atomic.AddInt32(&missing, 1)
+				}
+			}
+			done <- true
+		}(w)
+	}
+	for w := 0; w < 10; w++ {
+		<-done
+	}
+	logFile.Close()
+
+	if missing != 0 {
+		t.Errorf("%d entries not in the file when Write returned\n", missing)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_CloseDrains(t *testing.T) {
+	debug("Test_CloseDrains start")
+	defer debug("Test_CloseDrains end")
+
+	for _, flushSeconds := range []int{-1, 60} {
+		logFileName, err := tempFileName()
+		if err != nil {
+			t.Errorf("Failed to create temporary file: %s\n", err)
+			return
+		}
+
+		logFile, err := New(&LogFile{
+			FileName:     logFileName,
+			FlushSeconds: flushSeconds,
+			Flags:        FileOnly | OverWriteOnStart})
+		if err != nil {
+			t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+			return
+		}
+
+		// Producers keep writing while the LogFile is closed under them.
+		// Every write that succeeded must be in the file.
+		written := int32(0)
+		done := make(chan bool)
+		for w := 0; w < 5; w++ {
+			go func() {
+				for {
+					_, err := logFile.Write([]byte("entry\n"))
+					if err == ErrClosed {
+						break
+					}
+					atomic.AddInt32(&written, 1)
+				}
+				done <- true
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		logFile.Close()
+		for w := 0; w < 5; w++ {
+			<-done
+		}
+
+		contents, err := ioutil.ReadFile(logFileName)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+			return
+		}
+		lines := int32(strings.Count(string(contents), "entry\n"))
+		if lines != written {
+			t.Errorf("FlushSeconds %d: %d writes succeeded but %d in the file\n", flushSeconds, written, lines)
+		}
+
+		os.Remove(logFileName)
+	}
+}
+
+func Test_Component(t *testing.T) {
+	debug("Test_Component start")
+	defer debug("Test_Component end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	db := logFile.Component("db")
+	if logFile.Component("db") != db {
+		t.Errorf("Component did not return the same Component for the same name\n")
+	}
+	db.SetLevel(LevelWarn)
+	l := log.New(db, "", 0)
+	l.Print("dropped")
+	db.WriteLevel(LevelError, []byte("kept\n"))
+	db.WriteEntry(Entry{LevelKey: "DEBUG", TimeKey: "now"})
+	db.WriteEntry(Entry{LevelKey: "WARN", TimeKey: "now"})
+	logFile.Component("http").Write([]byte("other\n"))
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "db: kept\n" + `{"component":"db","level":"WARN","time":"now"}` + "\nhttp: other\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_LevelHandler(t *testing.T) {
+	debug("Test_LevelHandler start")
+	defer debug("Test_LevelHandler end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer logFile.Close()
+
+	if err := logFile.SetComponentLevels("db=warn, http=error"); err != nil {
+		t.Errorf("SetComponentLevels failed: %s\n", err)
+	}
+	if _, err := ParseComponentLevels("db=loud"); err == nil {
+		t.Errorf("ParseComponentLevels accepted an unknown level\n")
+	}
+
+	handler := logFile.LevelHandler()
+	req := httptest.NewRequest("POST", "/loglevels", strings.NewReader("component=db&level=debug"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	expected := `{"db":"DEBUG","http":"ERROR"}` + "\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Wrong response expected %s got %d %s\n", expected, rec.Code, rec.Body)
+	}
+	if logFile.Component("db").Level() != LevelDebug {
+		t.Errorf("Level not changed by LevelHandler\n")
+	}
+}
+
+func Test_GELF(t *testing.T) {
+	debug("Test_GELF start")
+	defer debug("Test_GELF end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Failed to listen for GELF: %s\n", err)
+		return
+	}
+	defer server.Close()
+
+	gelf, err := NewGELFWriter(server.LocalAddr().String())
+	if err != nil {
+		t.Errorf("NewGELFWriter failed: %s\n", err)
+		return
+	}
+	defer gelf.Close()
+	gelf.ChunkSize = 100
+
+	logFile, err := New(&LogFile{
+		FileName:  logFileName,
+		Flags:     FileOnly,
+		Formatter: GELFFormatter("testhost"),
+		Tees:      []io.Writer{gelf},
+	})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.WriteWithMeta([]byte(strings.Repeat("x", 300)+"\n"), map[string]string{LevelKey: "WARN", "user": "fred"})
+	logFile.Close()
+
+	var message []byte
+	packet := make([]byte, 200)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := server.ReadFrom(packet)
+		if err != nil {
+			t.Errorf("Failed to read GELF chunk: %s\n", err)
+			return
+		}
+		if n > 100 || !bytes.HasPrefix(packet, gelfChunkMagic) {
+			t.Errorf("Bad GELF chunk %q\n", packet[:n])
+			return
+		}
+		message = append(message, packet[gelfChunkHeader:n]...)
+		if packet[10] == packet[11]-1 {
+			break
+		}
+	}
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	if string(contents) != string(message)+"\n" {
+		t.Errorf("GELF sent %s but file has %s\n", message, contents)
+	}
+	if !bytes.Contains(message, []byte(`"level":4`)) || !bytes.Contains(message, []byte(`"_user":"fred"`)) ||
+		!bytes.Contains(message, []byte(`"host":"testhost"`)) {
+		t.Errorf("Wrong GELF message %s\n", message)
+	}
+
+	// Too many chunks is dropped, not sent cut short
+	if _, err := gelf.Write([]byte(strings.Repeat("x", 200*gelf.ChunkSize))); err != ErrGELFTooBig {
+		t.Errorf("Expected ErrGELFTooBig got %v\n", err)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_SIEMFormatters(t *testing.T) {
+	debug("Test_SIEMFormatters start")
+	defer debug("Test_SIEMFormatters end")
+
+	entry := []byte(`{"event_id":"42","level":"ERROR","msg":"login failed","time":"2015-06-01T12:00:00Z","user":"a=b|c"}` + "\n")
+	meta := map[string]string{"component": "auth"}
+
+	cef := string(CEFFormatter("LMMR", "app|x", "1.0")(entry, meta))
+	expected := `CEF:0|LMMR|app\|x|1.0|42|login failed|8|rt=1433160000000 component=auth user=a\=b|c` + "\n"
+	if cef != expected {
+		t.Errorf("Wrong CEF expected %s got %s\n", expected, cef)
+	}
+
+	leef := string(LEEFFormatter("LMMR", "app", "1.0")([]byte("plain text\n"), nil))
+	if !strings.HasPrefix(leef, "LEEF:1.0|LMMR|app|1.0|log|devTime=") ||
+		!strings.HasSuffix(leef, "\tsev=3\tmsg=plain text\n") {
+		t.Errorf("Wrong LEEF got %s\n", leef)
+	}
+}
+
+func Test_AccessLogWriter(t *testing.T) {
+	debug("Test_AccessLogWriter start")
+	defer debug("Test_AccessLogWriter end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	if _, err := NewAccessLogWriter(logFile, "%h %Z"); err == nil {
+		t.Errorf("NewAccessLogWriter accepted an unknown directive\n")
+	}
+	access, err := NewAccessLogWriter(logFile, CombinedLogFormat+" %D")
+	if err != nil {
+		t.Errorf("NewAccessLogWriter failed: %s\n", err)
+		return
+	}
+
+	when := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	access.Log(&AccessLogEntry{
+		Time:       when,
+		RemoteHost: "10.0.0.1",
+		Method:     "GET",
+		URI:        "/index.html?q=1",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      1234,
+		Latency:    1500 * time.Microsecond,
+		Header:     http.Header{"User-Agent": []string{`curl "7"`}},
+	})
+	req := httptest.NewRequest("POST", "/form", nil)
+	req.SetBasicAuth("fred", "secret")
+	access.LogRequest(req, 404, 0, 0)
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	lines := strings.Split(string(contents), "\n")
+	expected := `10.0.0.1 - - [01/Jun/2015:12:00:00 +0000] "GET /index.html?q=1 HTTP/1.1" 200 1234 "-" "curl \"7\"" 1500`
+	if len(lines) != 3 || lines[0] != expected {
+		t.Errorf("Wrong access log expected %s got %s\n", expected, contents)
+		return
+	}
+	if !strings.HasPrefix(lines[1], "192.0.2.1 - fred [") || !strings.Contains(lines[1], `"POST /form HTTP/1.1" 404 - "-" "-" 0`) {
+		t.Errorf("Wrong access log for request got %s\n", lines[1])
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_HTTPMiddleware(t *testing.T) {
+	debug("Test_HTTPMiddleware start")
+	defer debug("Test_HTTPMiddleware end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	var requestID string
+	handler := HTTPMiddleware(logFile, `%h "%r" %>s %b %{X-Request-Id}i`)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = RequestID(r.Context())
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest("PUT", "/thing", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	// A client can put anything first, only what the proxies added counts
+	req = httptest.NewRequest("GET", "/spoofed", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.8, 10.0.0.1")
+	req.Header.Set(RequestIDHeader, "def")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header.Set(RequestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	logFile.Close()
+
+	if requestID != "abc" || rec.Header().Get(RequestIDHeader) == "" {
+		t.Errorf("Request ID not propagated got %q and %q\n", requestID, rec.Header().Get(RequestIDHeader))
+	}
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := `203.0.113.9 "PUT /thing HTTP/1.1" 201 5 ` + rec.Header().Get(RequestIDHeader) + "\n" +
+		`198.51.100.8 "GET /spoofed HTTP/1.1" 201 5 def` + "\n" +
+		`198.51.100.7 "GET / HTTP/1.1" 201 5 abc` + "\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong access log expected %s got %s\n", expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_RPCLogger(t *testing.T) {
+	debug("Test_RPCLogger start")
+	defer debug("Test_RPCLogger end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	rpcLog := NewRPCLogger(logFile)
+	rpcLog.Payloads = true
+	rpcLog.Redact = func(method string, payload interface{}) interface{} {
+		if payload == "secret" {
+			return "REDACTED"
+		}
+		return payload
+	}
+	rpcLog.Log(&RPCCall{Method: "/pkg.Svc/Login", Peer: "10.0.0.1:5", Latency: time.Millisecond, Request: "secret", Response: "ok"})
+	rpcLog.JSON = true
+	rpcLog.Log(&RPCCall{Method: "/pkg.Svc/Get", Peer: "10.0.0.1:5", Code: "Internal", Latency: 2 * time.Millisecond, Err: fmt.Errorf("broken")})
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	lines := strings.Split(string(contents), "\n")
+	expected := "rpc /pkg.Svc/Login peer=10.0.0.1:5 code=OK latency=1ms request=REDACTED response=ok"
+	if len(lines) != 3 || lines[0] != expected {
+		t.Errorf("Wrong RPC log expected %s got %s\n", expected, contents)
+		return
+	}
+	if !strings.Contains(lines[1], `"code":"Internal"`) || !strings.Contains(lines[1], `"level":"ERROR"`) ||
+		!strings.Contains(lines[1], `"error":"broken"`) || !strings.Contains(lines[1], `"latency_ms":2`) {
+		t.Errorf("Wrong RPC entry got %s\n", lines[1])
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_FlushLatency(t *testing.T) {
+	debug("Test_FlushLatency start")
+	defer debug("Test_FlushLatency end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, FlushSeconds: 60})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer logFile.Close()
+
+	logFile.Write([]byte("one\n"))
+	logFile.Write([]byte("two\n"))
+	time.Sleep(20 * time.Millisecond)
+	logFile.Flush()
+
+	h := logFile.Stats().FlushLatency
+	if h.Count != 2 || h.Sum < 40*time.Millisecond || h.Quantile(0.5) < 50*time.Millisecond {
+		t.Errorf("Wrong flush latency got %+v\n", h)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	file := metricLabel(logFileName)
+	for _, expected := range []string{
+		"logfile_writes_total{file=" + file + "} 2\n",
+		"logfile_flush_latency_seconds_bucket{file=" + file + ",le=\"0.01\"} 0\n",
+		"logfile_flush_latency_seconds_bucket{file=" + file + ",le=\"+Inf\"} 2\n",
+		"logfile_flush_latency_seconds_count{file=" + file + "} 2\n",
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Metrics missing %s got %s\n", expected, rec.Body)
+		}
+	}
+}
+
+func Test_NewDeferred(t *testing.T) {
+	debug("Test_NewDeferred start")
+	defer debug("Test_NewDeferred end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	var errs []string
+	logFile, err := NewDeferred(&LogFile{
+		Flags:            FileOnly | NoErrors,
+		DeferredMaxBytes: 12,
+		OnError:          func(err error) { errs = append(errs, err.Error()) },
+	})
+	if err != nil {
+		t.Errorf("NewDeferred failed: %s\n", err)
+		return
+	}
+	logFile.Write([]byte("early\n"))
+	logFile.Write([]byte("start\n"))
+	logFile.Write([]byte("dropped\n"))
+	logFile.Flush()
+
+	if err := logFile.Attach(filepath.Join(logFileName, "missing", "dir")); err == nil {
+		t.Errorf("Attach to an impossible file succeeded\n")
+	}
+	if err := logFile.Attach(logFileName); err != nil {
+		t.Errorf("Attach failed: %s\n", err)
+		return
+	}
+	if err := logFile.Attach(logFileName); err == nil {
+		t.Errorf("Second Attach succeeded\n")
+	}
+	logFile.Write([]byte("later\n"))
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "early\nstart\nlater\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+	if len(errs) == 0 || !strings.Contains(errs[len(errs)-1], "dropped 1 entries") {
+		t.Errorf("Dropped entry not reported got %q\n", errs)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_GoroutineCount(t *testing.T) {
+	debug("Test_GoroutineCount start")
+	defer debug("Test_GoroutineCount end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	before := GoroutineCount()
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, StderrTimeout: time.Second})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if GoroutineCount() != before+2 {
+		t.Errorf("Expected %d goroutines got %d\n", before+2, GoroutineCount())
+	}
+	if err := CheckLeaks(); err == nil || !strings.Contains(err.Error(), logFileName) {
+		t.Errorf("CheckLeaks did not report %s got %v\n", logFileName, err)
+	}
+
+	logFile.Close()
+	if GoroutineCount() != before {
+		t.Errorf("Expected %d goroutines after Close got %d\n", before, GoroutineCount())
+	}
+	if err := CheckLeaks(); err != nil && strings.Contains(err.Error(), logFileName) {
+		t.Errorf("CheckLeaks reported closed %s\n", logFileName)
+	}
+}
+
+func Test_RotateDaily(t *testing.T) {
+	debug("Test_RotateDaily start")
+	defer debug("Test_RotateDaily end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	rotatedName := FileNameVersion(logFileName, 1)
+
+	err = ioutil.WriteFile(logFileName, []byte("yesterday\n"), 0644)
+	if err != nil {
+		t.Errorf("Failed to write %s: %s\n", logFileName, err)
+		return
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(logFileName, yesterday, yesterday)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | RotateDaily, OldVersions: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("today\n"))
+	logFile.Write([]byte("still today\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{logFileName: "today\nstill today\n", rotatedName: "yesterday\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", name, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+	os.Remove(rotatedName)
+}
+
+func Test_Retry(t *testing.T) {
+	debug("Test_Retry start")
+	defer debug("Test_Retry end")
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full to make writes fail")
+	}
+	targetName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(targetName)
+	logFileName := targetName + ".link"
+	if err := os.Symlink("/dev/full", logFileName); err != nil {
+		t.Errorf("Failed to create symlink %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors, RetryMaxBytes: 10})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if _, err := logFile.Write([]byte("one\n")); err == nil {
+		t.Errorf("Write to /dev/full succeeded\n")
+	}
+	if _, err := logFile.Write([]byte("two\n")); err != ErrRetrying {
+		t.Errorf("Expected ErrRetrying got %v\n", err)
+	}
+	logFile.Write([]byte("dropped\n"))
+
+	// Point the file somewhere that works, the retry reopens it
+	os.Remove(logFileName)
+	os.Symlink(targetName, logFileName)
+	time.Sleep(500 * time.Millisecond)
+	logFile.Write([]byte("three\n"))
+	stats := logFile.Stats()
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(targetName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", targetName, err)
+		return
+	}
+	expected := "one\ntwo\nthree\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", targetName, expected, contents)
+	}
+	if stats.Retries != 2 || stats.RetryDrops != 1 {
+		t.Errorf("Expected 2 retries and 1 drop got %d and %d\n", stats.Retries, stats.RetryDrops)
+	}
+}
+
+func Test_WriteWithFlags(t *testing.T) {
+	debug("Test_WriteWithFlags start")
+	defer debug("Test_WriteWithFlags end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	stderrName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(stderrName)
+	f, err := os.Create(stderrName)
+	if err != nil {
+		t.Errorf("Failed to create file %s: %s\n", stderrName, err)
+		return
+	}
+	stderr := os.Stderr
+	os.Stderr = f
+	defer func() { os.Stderr = stderr }()
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("both\n"))
+	logFile.WriteWithFlags([]byte("console\n"), StderrOnly)
+	logFile.WriteWithFlags([]byte("file\n"), FileOnly)
+	logFile.Close()
+	os.Stderr = stderr
+	f.Close()
+
+	for name, expected := range map[string]string{logFileName: "both\nfile\n", stderrName: "both\nconsole\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong contents for %s expected %s got %s\n", name, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_Checksum(t *testing.T) {
+	debug("Test_Checksum start")
+	defer debug("Test_Checksum end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(FileNameVersion(logFileName, 1))
+	defer os.Remove(FileNameVersion(logFileName, 2))
+	defer os.Remove(stateFileName(logFileName))
+
+	ioutil.WriteFile(logFileName, []byte("from before\n"), 0644)
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | Checksum, OldVersions: 2})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("two\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("three\n"))
+	logFile.Close()
+
+	bad, err := logFile.VerifyChecksums()
+	if err != nil || len(bad) != 0 {
+		t.Errorf("Unexpected bad checksums %q: %v\n", bad, err)
+	}
+	state := logFile.loadState()
+	if len(state.Checksums) != 2 {
+		t.Errorf("Expected 2 checksums got %v\n", state.Checksums)
+	}
+
+	ioutil.WriteFile(FileNameVersion(logFileName, 2), []byte("from before\nonE\n"), 0644)
+	bad, err = logFile.VerifyChecksums()
+	if err != nil || len(bad) != 1 || bad[0] != FileNameVersion(logFileName, 2) {
+		t.Errorf("Expected %s to be bad got %q: %v\n", FileNameVersion(logFileName, 2), bad, err)
+	}
+}
+
+func Test_MaxPendingBytes(t *testing.T) {
+	debug("Test_MaxPendingBytes start")
+	defer debug("Test_MaxPendingBytes end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{
+		FileName:        logFileName,
+		Flags:           FileOnly,
+		FlushSeconds:    60,
+		MaxPendingBytes: 10,
+		OverflowPolicy:  OverflowSummarize,
+	})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("12345\n"))
+	logFile.Stats()
+	for _, dropped := range []string{"abcdef\n", "ghijk\n"} {
+		if _, err := logFile.Write([]byte(dropped)); err != ErrOverflow {
+			t.Errorf("Expected ErrOverflow got %v\n", err)
+		}
+	}
+	logFile.Flush()
+	stats := logFile.Stats()
+	if _, err := logFile.Write([]byte("xyz\n")); err != nil {
+		t.Errorf("Write after Flush failed: %s\n", err)
+	}
+	logFile.Close()
+
+	if stats.OverflowDrops != 2 {
+		t.Errorf("Expected 2 overflow drops got %d\n", stats.OverflowDrops)
+	}
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "12345\nLogFile dropped 2 entries (13 bytes) as more than 10 bytes were waiting to be written\nxyz\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_Synchronous(t *testing.T) {
+	debug("Test_Synchronous start")
+	defer debug("Test_Synchronous end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	movedName := logFileName + ".moved"
+	defer os.Remove(movedName)
+
+	before := GoroutineCount()
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | Synchronous, FlushSeconds: 60, CheckSeconds: 60})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if GoroutineCount() != before {
+		t.Errorf("Synchronous LogFile started a goroutine\n")
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+	if stats := logFile.Stats(); stats.Writes != 1 || stats.FileBytes != 4 {
+		t.Errorf("Wrong stats %+v\n", stats)
+	}
+
+	os.Rename(logFileName, movedName)
+	logFile.CheckVanished()
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{movedName: "one\n", logFileName: "two\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", name, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_GzipFile(t *testing.T) {
+	debug("Test_GzipFile start")
+	defer debug("Test_GzipFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	gunzip := func(name string) (string, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		// A file still being written has no gzip trailer yet
+		contents, err := ioutil.ReadAll(r)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return string(contents), err
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | GzipFile, FlushSeconds: 60})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+	contents, err := gunzip(logFileName)
+	if err != nil {
+		t.Errorf("Failed to gunzip open log file %s: %s\n", logFileName, err)
+	} else if contents != "one\n" {
+		t.Errorf("Wrong open logfile contents for %s expected one got %s\n", logFileName, contents)
+	}
+	logFile.Close()
+
+	// Reopening appends a new gzip member
+	logFile, err = New(&LogFile{FileName: logFileName, Flags: FileOnly | GzipFile})
+	if err != nil {
+		t.Errorf("Failed to reopen log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	contents, err = gunzip(logFileName)
+	if err != nil {
+		t.Errorf("Failed to gunzip log file %s: %s\n", logFileName, err)
+	} else if contents != "one\ntwo\n" {
+		t.Errorf("Wrong logfile contents for %s expected one two got %s\n", logFileName, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_RateLimit(t *testing.T) {
+	debug("Test_RateLimit start")
+	defer debug("Test_RateLimit end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | CallerInfo, RateLimit: 0.001, RateBurst: 2})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// The chatty call site is limited without affecting the other
+	for i := 0; i < 5; i++ {
+		logFile.Write([]byte("chatty\n"))
+	}
+	logFile.Write([]byte("quiet\n"))
+	for i := 0; i < 3; i++ {
+		logFile.WriteKeyed("retry", []byte("keyed\n"))
+	}
+	logFile.WriteCritical([]byte("critical\n"))
+	// Errors from one call site are all kept, warnings are limited
+	for _, level := range []Level{LevelError, LevelError, LevelError, LevelWarn, LevelWarn, LevelWarn} {
+		logFile.WriteWithMeta([]byte(level.String()+"\n"), map[string]string{LevelKey: level.String()})
+	}
+
+	stats := logFile.Stats()
+	logFile.Close()
+	if stats.RateLimited != 5 || len(stats.Suppressed) != 3 || stats.Suppressed["retry"] != 1 {
+		t.Errorf("Wrong rate limiting stats %d %v\n", stats.RateLimited, stats.Suppressed)
+	}
+	for key, n := range stats.Suppressed {
+		if key != "retry" && (n != 3 && n != 1 || !strings.Contains(key, "logfile_test.go:")) {
+			t.Errorf("Wrong suppression count for %s: %d\n", key, n)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	expected := "chatty\nchatty\nquiet\nkeyed\nkeyed\ncritical\nERROR\nERROR\nERROR\nWARN\nWARN\n"
+	if string(contents) != expected {
+		t.Errorf("Wrong logfile contents for %s expected %s got %s\n", logFileName, expected, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_RateLimitCallSites(t *testing.T) {
+	debug("Test_RateLimitCallSites start")
+	defer debug("Test_RateLimitCallSites end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | CallerInfo, RateLimit: 0.001, RateBurst: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// Each line using the logger or the component is a call site of its own
+	logger := log.New(logFile, "", 0)
+	component := logFile.Component("db")
+	for i := 0; i < 3; i++ {
+		logger.Printf("chatty logger")
+		component.Write([]byte("chatty component\n"))
+	}
+	logger.Printf("quiet logger")
+	component.Write([]byte("quiet component\n"))
+
+	stats := logFile.Stats()
+	logFile.Close()
+	if stats.RateLimited != 4 || len(stats.Suppressed) != 2 {
+		t.Errorf("Wrong rate limiting stats %d %v\n", stats.RateLimited, stats.Suppressed)
+	}
+	for key := range stats.Suppressed {
+		if !strings.Contains(key, "logfile_test.go:") {
+			t.Errorf("Expected the call site in the test got %s\n", key)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		return
+	}
+	for _, expected := range []string{"quiet logger", "quiet component"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("Expected %q in the log file got %s\n", expected, contents)
+		}
+	}
+}
+
+func Test_MultiLine(t *testing.T) {
+	debug("Test_MultiLine start")
+	defer debug("Test_MultiLine end")
+
+	trace := "panic: oops\n\ngoroutine 1 [running]:\nmain.main()\n\t/src/main.go:5 +0x25\n"
+	tests := []struct {
+		policy   MultiLinePolicy
+		expected string
+	}{
+		{MultiLineAsIs, "one\n" + trace},
+		{MultiLineEscape, "one\npanic: oops\\n\\ngoroutine 1 [running]:\\nmain.main()\\n\t/src/main.go:5 +0x25\n"},
+		{MultiLineIndent, "one\npanic: oops\n\t\n\tgoroutine 1 [running]:\n\tmain.main()\n\t\t/src/main.go:5 +0x25\n"},
+	}
+	for _, test := range tests {
+		logFileName, err := tempFileName()
+		if err != nil {
+			t.Errorf("Failed to create temporary file: %s\n", err)
+			return
+		}
+		logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, MultiLine: test.policy})
+		if err != nil {
+			t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+			return
+		}
+		logFile.Write([]byte("one\n"))
+		logFile.Write([]byte(trace))
+		logFile.Close()
+
+		contents, err := ioutil.ReadFile(logFileName)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+		} else if string(contents) != test.expected {
+			t.Errorf("Wrong logfile contents for policy %d expected %q got %q\n", test.policy, test.expected, contents)
+		}
+		os.Remove(logFileName)
+	}
+}
+
+func Test_ErrMaxAge(t *testing.T) {
+	debug("Test_ErrMaxAge start")
+	defer debug("Test_ErrMaxAge end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 1, ErrMaxAge: time.Hour, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	kept := func() []string {
+		names, _ := filepath.Glob(logFileName + ".1" + errorsSuffix + expiredSuffix + "*")
+		return names
+	}
+
+	// The version with an error outlives OldVersions, the clean one doesn't
+	logFile.WriteCritical([]byte("failed\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("clean\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("clean again\n"))
+	logFile.RotateFile()
+	logFile.Close()
+
+	names := kept()
+	if len(names) != 1 {
+		t.Errorf("Expected 1 old version with errors kept got %v\n", names)
+	} else if contents, _ := ioutil.ReadFile(names[0]); string(contents) != "failed\n" {
+		t.Errorf("Wrong old version with errors kept, contents %s\n", contents)
+	}
+	if contents, _ := ioutil.ReadFile(FileNameVersion(logFileName, 1)); string(contents) != "clean again\n" {
+		t.Errorf("Wrong contents for %s got %s\n", FileNameVersion(logFileName, 1), contents)
+	}
+
+	for _, name := range names {
+		os.Remove(name)
+	}
+	os.Remove(stateFileName(logFileName))
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+}
+
+func Test_Reset(t *testing.T) {
+	debug("Test_Reset start")
+	defer debug("Test_Reset end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	lf := &LogFile{FileName: logFileName, Flags: FileOnly}
+	logFile, err := New(lf)
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if _, err := New(lf); err != ErrInUse {
+		t.Errorf("Second New expected ErrInUse got %v\n", err)
+	}
+	if err := logFile.Reset(); err != ErrInUse {
+		t.Errorf("Reset while open expected ErrInUse got %v\n", err)
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Close()
+
+	if _, err := New(lf); err != ErrInUse {
+		t.Errorf("New after Close expected ErrInUse got %v\n", err)
+	}
+	if err := logFile.Reset(); err != nil {
+		t.Errorf("Reset after Close failed: %s\n", err)
+	}
+	if lf.RotateFileFunc != nil || lf.MaxSize != 0 {
+		t.Errorf("Expected Reset to clear the defaults New filled in\n")
+	}
+	if lf.Flags != FileOnly {
+		t.Errorf("Expected Reset to keep Flags got %v\n", lf.Flags)
+	}
+	logFile, err = New(lf)
+	if err != nil {
+		t.Errorf("Failed to reopen log file %s after Reset: %s\n", logFileName, err)
+		return
+	}
+	if stats := logFile.Stats(); stats.Writes != 0 {
+		t.Errorf("Expected Stats to be cleared by Reset got %d writes\n", stats.Writes)
+	}
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read log file %s: %s\n", logFileName, err)
+	} else if string(contents) != "one\ntwo\n" {
+		t.Errorf("Wrong logfile contents for %s expected one two got %s\n", logFileName, contents)
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_ErrorWriter(t *testing.T) {
+	debug("Test_ErrorWriter start")
+	defer debug("Test_ErrorWriter end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	var errs bytes.Buffer
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, ErrorWriter: &errs})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.PrintError("LogFile test error %d\n", 1)
+	logFile.Close()
+	quiet := &LogFile{Flags: NoErrors, ErrorWriter: &errs}
+	quiet.PrintError("LogFile test error %d\n", 2)
+
+	if errs.String() != "LogFile test error 1\n" {
+		t.Errorf("Wrong errors written to ErrorWriter got %q\n", errs.String())
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_RotateEvery(t *testing.T) {
+	debug("Test_RotateEvery start")
+	defer debug("Test_RotateEvery end")
+
+	// Wednesday 15th March 2023
+	now := time.Date(2023, 3, 15, 10, 30, 0, 0, time.Local)
+	tests := []struct {
+		every, at time.Duration
+		expected  time.Time
+	}{
+		{time.Hour, 0, time.Date(2023, 3, 15, 11, 0, 0, 0, time.Local)},
+		{time.Hour, 45 * time.Minute, time.Date(2023, 3, 15, 10, 45, 0, 0, time.Local)},
+		{24 * time.Hour, 0, time.Date(2023, 3, 16, 0, 0, 0, 0, time.Local)},
+		{24 * time.Hour, 11 * time.Hour, time.Date(2023, 3, 15, 11, 0, 0, 0, time.Local)},
+		{7 * 24 * time.Hour, 0, time.Date(2023, 3, 19, 0, 0, 0, 0, time.Local)},
+		{7 * 24 * time.Hour, 24 * time.Hour, time.Date(2023, 3, 20, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		lp := &LogFile{RotateEvery: test.every, RotateAt: test.at}
+		if next := lp.nextRotation(now); !next.Equal(test.expected) {
+			t.Errorf("RotateEvery %s RotateAt %s expected %s got %s\n", test.every, test.at, test.expected, next)
+		}
+	}
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 1, RotateEvery: time.Second, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	time.Sleep(1500 * time.Millisecond)
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	for i, expected := range []string{"two\n", "one\n"} {
+		lf := FileNameVersion(logFileName, i)
+		contents, err := ioutil.ReadFile(lf)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", lf, err)
+		} else if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", lf, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+}
+
+// fakeWatcher is a fileWatcher the test tells when the file has vanished
+type fakeWatcher struct {
+	events chan struct{}
+}
+
+func (fw *fakeWatcher) Events() <-chan struct{} {
+	return fw.events
+}
+
+func (fw *fakeWatcher) Close() error {
+	return nil
+}
+
+func Test_WatchFile(t *testing.T) {
+	debug("Test_WatchFile start")
+	defer debug("Test_WatchFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	movedName := logFileName + ".moved"
+	defer os.Remove(movedName)
+
+	watchers := make(chan *fakeWatcher, 2)
+	newWatcher = func(f *os.File) (fileWatcher, error) {
+		fw := &fakeWatcher{events: make(chan struct{}, 1)}
+		watchers <- fw
+		return fw, nil
+	}
+	defer func() { newWatcher = platformWatcher }()
+
+	// Only the watcher can notice the move, CheckSeconds is too long
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | WatchFile, CheckSeconds: 3600})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+	os.Rename(logFileName, movedName)
+	(<-watchers).events <- struct{}{}
+
+	// The reopened file gets a new watcher
+	select {
+	case <-watchers:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Log file %s was not reopened after the watcher fired\n", logFileName)
+	}
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{movedName: "one\n", logFileName: "two\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", name, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+}
+
+func Test_NoFile(t *testing.T) {
+	debug("Test_NoFile start")
+	defer debug("Test_NoFile end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	logFileName := filepath.Join(dir, "log")
+
+	var errs bytes.Buffer
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | Synchronous, ErrorWriter: &errs})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// With its directory gone the file can't be reopened
+	os.RemoveAll(dir)
+	logFile.CheckVanished()
+	logFile.Write([]byte("one\n"))
+	logFile.Write([]byte("two\n"))
+	stats := logFile.Stats()
+	logFile.Close()
+
+	if stats.NoFileDrops != 2 || stats.NoFileStderr != 0 {
+		t.Errorf("Expected 2 entries lost got %d lost %d to stderr\n", stats.NoFileDrops, stats.NoFileStderr)
+	}
+	// The first is reported at once, the second when closing
+	if strings.Count(errs.String(), "is not open: 0 entries went only to stderr and 1 were lost\n") != 2 {
+		t.Errorf("Running without a file not reported, errors %q\n", errs.String())
+	}
+}
+
+func Test_TimestampVersions(t *testing.T) {
+	debug("Test_TimestampVersions start")
+	defer debug("Test_TimestampVersions end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	logFileName := filepath.Join(dir, "log")
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 2, Flags: FileOnly | TimestampVersions})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// Rotations within the same second have -1, -2... added
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		logFile.Write([]byte(line))
+		logFile.RotateFile()
+	}
+	logFile.Write([]byte("four\n"))
+	logFile.Flush()
+	versions := logFile.timestampVersions()
+	logFile.Close()
+
+	if len(versions) != 2 {
+		t.Errorf("Expected 2 old versions got %v\n", versions)
+		return
+	}
+	for i, expected := range []string{"three\n", "two\n"} {
+		if !timestampVersionRegexp.MatchString(versions[i][len(logFileName):]) {
+			t.Errorf("Old version %s is not named with a timestamp\n", versions[i])
+		}
+		contents, err := ioutil.ReadFile(versions[i])
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", versions[i], err)
+		} else if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", versions[i], expected, contents)
+		}
+	}
+
+	// Glob characters in the name don't matter and versions named in local
+	// time, before they were in UTC, go in order with the rest
+	oddDir := filepath.Join(dir, "a[b]*?")
+	if err := os.Mkdir(oddDir, 0777); err != nil {
+		t.Errorf("Failed to create %s: %s\n", oddDir, err)
+		return
+	}
+	lp := &LogFile{FileName: filepath.Join(oddDir, "log"), Flags: TimestampVersions}
+	expected := []string{".2015-05-02T120000", ".2015-05-01T130000Z", ".2015-05-01T110000Z", ".2015-04-30T120000"}
+	for _, suffix := range append(expected, ".other") {
+		ioutil.WriteFile(lp.FileName+suffix, nil, 0644)
+	}
+	versions = lp.timestampVersions()
+	for i := range expected {
+		expected[i] = lp.FileName + expected[i]
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("Expected versions %v got %v\n", expected, versions)
+	}
+	if err := lp.Pin(5); err == nil || !strings.Contains(err.Error(), "not that many") {
+		t.Errorf("Expected pinning a missing version to say so got %v\n", err)
+	}
+}
+
+func Test_MaxAge(t *testing.T) {
+	debug("Test_MaxAge start")
+	defer debug("Test_MaxAge end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 5, MaxAge: time.Hour, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("old\n"))
+	logFile.RotateFile()
+	logFile.Flush()
+	// Make version 1 look two hours old, next rotation it becomes 2 and goes
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(FileNameVersion(logFileName, 1), old, old)
+	logFile.Write([]byte("new\n"))
+	logFile.RotateFile()
+	logFile.Close()
+
+	if _, err := os.Stat(FileNameVersion(logFileName, 2)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s older than MaxAge to be deleted\n", FileNameVersion(logFileName, 2))
+	}
+	if contents, _ := ioutil.ReadFile(FileNameVersion(logFileName, 1)); string(contents) != "new\n" {
+		t.Errorf("Wrong contents for %s got %s\n", FileNameVersion(logFileName, 1), contents)
+	}
+
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+	os.Remove(FileNameVersion(logFileName, 2))
+}
+
+func Test_SharedFile(t *testing.T) {
+	debug("Test_SharedFile start")
+	defer debug("Test_SharedFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName + lockSuffix)
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 1, SharedIdentity: "test[1]", Flags: FileOnly | SharedFile})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\ntwo\n"))
+
+	// Another process rotates the file and writes to the new one, this one
+	// must not rotate it again
+	os.Rename(logFileName, FileNameVersion(logFileName, 1))
+	ioutil.WriteFile(logFileName, []byte("other[2] three\n"), 0644)
+	logFile.RotateFile()
+	logFile.Write([]byte("four\n"))
+	logFile.Close()
+
+	for i, expected := range []string{"other[2] three\ntest[1] four\n", "test[1] one\ntest[1] two\n"} {
+		lf := FileNameVersion(logFileName, i)
+		contents, err := ioutil.ReadFile(lf)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", lf, err)
+		} else if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", lf, expected, contents)
+		}
+	}
+
+	os.Remove(logFileName)
+	os.Remove(FileNameVersion(logFileName, 1))
+}
+
+func Test_MaxTotalSize(t *testing.T) {
+	debug("Test_MaxTotalSize start")
+	defer debug("Test_MaxTotalSize end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 5, MaxTotalSize: 25, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// Each version is 10 bytes so only 2 fit with the live file (empty at
+	// rotation)
+	for _, line := range []string{"version 4\n", "version 3\n", "version 2\n", "version 1\n"} {
+		logFile.Write([]byte(line))
+		logFile.RotateFile()
+	}
+	logFile.Close()
+
+	for v := 1; v <= 4; v++ {
+		lf := FileNameVersion(logFileName, v)
+		_, err := os.Stat(lf)
+		if v <= 2 && err != nil {
+			t.Errorf("Expected %s to be kept: %s\n", lf, err)
+		}
+		if v > 2 && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted to keep under MaxTotalSize\n", lf)
+		}
+		os.Remove(lf)
+	}
+
+	// Versions set aside for DeleteGrace still take up room
+	logFile, err = New(&LogFile{FileName: logFileName, OldVersions: 5, MaxTotalSize: 25, DeleteGrace: time.Hour, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	for _, line := range []string{"version 4\n", "version 3\n", "version 2\n", "version 1\n"} {
+		logFile.Write([]byte(line))
+		logFile.RotateFile()
+	}
+	logFile.Close()
+	for v := 1; v <= 4; v++ {
+		lf := FileNameVersion(logFileName, v)
+		if _, err := os.Stat(lf); (err == nil) != (v == 1) {
+			t.Errorf("Expected only version 1 kept with one set aside, %s: %v\n", lf, err)
+		}
+		os.Remove(lf)
+	}
+	expired, _ := filepath.Glob(logFileName + ".*" + expiredSuffix + "*")
+	if len(expired) != 3 {
+		t.Errorf("Expected 3 versions set aside got %v\n", expired)
+	}
+	for _, name := range expired {
+		os.Remove(name)
+	}
+	os.Remove(logFileName)
+}
+
+func Test_Tracer(t *testing.T) {
+	debug("Test_Tracer start")
+	defer debug("Test_Tracer end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	var eventsMutex sync.Mutex
+	var events []TraceEvent
+	tracer := func(e TraceEvent) {
+		eventsMutex.Lock()
+		events = append(events, e)
+		eventsMutex.Unlock()
+	}
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | OverWriteOnStart, Tracer: tracer})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("line 1\n"))
+	logFile.Write([]byte("line 2\n"))
+	logFile.Close()
+
+	// Tracer is only called in -tags logfiledebug builds. Another entry's
+	// events can come between one's own so only check the order of each.
+	want := map[uint64]string{}
+	if tracing {
+		want = map[uint64]string{1: "enqueue dequeue flush", 2: "enqueue dequeue flush"}
+	}
+	got := map[uint64]string{}
+	for _, e := range events {
+		got[e.Seq] = strings.TrimSpace(got[e.Seq] + " " + e.Action.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected trace %v got %v\n", want, got)
+	}
+}
+
+func Test_MaxEntryBytes(t *testing.T) {
+	debug("Test_MaxEntryBytes start")
+	defer debug("Test_MaxEntryBytes end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, MaxEntryBytes: 12, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if n, err := logFile.Write([]byte("far too long an entry\n")); n != 0 || err != ErrEntryTooBig {
+		t.Errorf("Expected oversize entry to be rejected got %d, %v\n", n, err)
+	}
+	logFile.Write([]byte("short\n"))
+	stats := logFile.Stats()
+	logFile.Close()
+	if stats.OversizeDrops != 1 {
+		t.Errorf("Expected 1 OversizeDrops got %d\n", stats.OversizeDrops)
+	}
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != "short\n" {
+		t.Errorf("Expected only the short entry written got %q\n", contents)
+	}
+
+	logFile, err = New(&LogFile{FileName: logFileName, MaxEntryBytes: 12, OversizePolicy: OversizeChunk, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	entry := "line one\nabcdefghijklmnop\n"
+	if n, err := logFile.Write([]byte(entry)); n != len(entry) || err != nil {
+		t.Errorf("Expected chunked entry to be written got %d, %v\n", n, err)
+	}
+	stats = logFile.Stats()
+	logFile.Close()
+	if stats.OversizeChunked != 1 {
+		t.Errorf("Expected 1 OversizeChunked got %d\n", stats.OversizeChunked)
+	}
+	expected := "line one\n... abcdefg\n... hijklmn\n... op\n"
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != expected {
+		t.Errorf("Expected chunks %q got %q\n", expected, contents)
+	}
+	for _, line := range strings.SplitAfter(expected, "\n") {
+		if len(line) > 12 {
+			t.Errorf("Chunk %q bigger than MaxEntryBytes\n", line)
+		}
+	}
+
+	// No newline is added to the last chunk and no other entry comes
+	// between the chunks
+	logFile, err = New(&LogFile{FileName: logFileName, MaxEntryBytes: 12, OversizePolicy: OversizeChunk, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			logFile.Write([]byte("b\n"))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		logFile.Write([]byte("AAAAAAAAAAAAAAAAAAAAAA\n"))
+	}
+	wg.Wait()
+	logFile.Write([]byte("abcdefghijklmnopqrstu"))
+	logFile.Close()
+	contents, _ := ioutil.ReadFile(logFileName)
+	if !bytes.HasSuffix(contents, []byte("\nabcdefghijk\n... lmnopqr\n... stu")) {
+		t.Errorf("Expected the last chunk without a newline got %q\n", contents)
+	}
+	lines := strings.Split(string(contents), "\n")
+	for i, line := range lines {
+		if line == "... AAAAAAA" && lines[i-1] != "AAAAAAAAAAA" || line == "... AAAA" && lines[i-1] != "... AAAAAAA" {
+			t.Errorf("Chunks interleaved with other entries at line %d of %q\n", i, contents)
+			break
+		}
+	}
+}
+
+func Test_SlogHandler(t *testing.T) {
+	debug("Test_SlogHandler start")
+	defer debug("Test_SlogHandler end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+
+	// Each call returns the records written since the last
+	read := 0
+	results := func() []map[string]interface{} {
+		logFile.Flush()
+		contents, _ := ioutil.ReadFile(logFileName)
+		lines := strings.SplitAfter(string(contents), "\n")
+		lines = lines[read : len(lines)-1]
+		read += len(lines)
+		var entries []map[string]interface{}
+		for _, line := range lines {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Errorf("Failed to decode %q: %s\n", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+	if err := slogtest.TestHandler(NewSlogHandler(logFile, nil), results); err != nil {
+		t.Errorf("SlogHandler failed slogtest: %s\n", err)
+	}
+
+	logger := slog.New(NewSlogHandler(logFile, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	logger.Info("not written")
+	logger.With("user", "lee").WithGroup("req").Warn("slow", "took", 2*time.Second)
+	entries := results()
+	if len(entries) != 1 {
+		t.Errorf("Expected only the Warn record got %v\n", entries)
+		return
+	}
+	e := entries[0]
+	if e["msg"] != "slow" || e["level"] != "WARN" || e["user"] != "lee" || !reflect.DeepEqual(e["req"], map[string]interface{}{"took": "2s"}) {
+		t.Errorf("Unexpected record %v\n", e)
+	}
+}
+
+func Test_UnreportedErrors(t *testing.T) {
+	debug("Test_UnreportedErrors start")
+	defer debug("Test_UnreportedErrors end")
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full to make writes fail")
+	}
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	os.Remove(logFileName)
+	logFileName += ".link"
+	if err := os.Symlink("/dev/full", logFileName); err != nil {
+		t.Errorf("Failed to create symlink %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors, FlushSeconds: 60})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	// Buffered writes only fail when flushed
+	if _, err := logFile.Write([]byte("one\n")); err != nil {
+		t.Errorf("Expected buffered Write to succeed got %s\n", err)
+	}
+	if err := logFile.Flush(); err == nil {
+		t.Errorf("Flush to /dev/full succeeded\n")
+	}
+	if err := logFile.Flush(); err != nil {
+		t.Errorf("Expected error to be reported once got %s again\n", err)
+	}
+
+	// The retry fails in the background then the next Write reports it
+	time.Sleep(300 * time.Millisecond)
+	if _, err := logFile.Write([]byte("two\n")); err == nil {
+		t.Errorf("Expected Write to report the failed retry\n")
+	}
+
+	// Close reports the entries it had to drop
+	if err := logFile.Close(); err == nil {
+		t.Errorf("Expected Close to report dropped entries\n")
+	}
+}
+
+func Test_RotateEveryShort(t *testing.T) {
+	debug("Test_RotateEveryShort start")
+	defer debug("Test_RotateEveryShort end")
+
+	if err := (&LogFile{FileName: "log", RotateEvery: time.Millisecond}).Validate(); err == nil {
+		t.Errorf("Expected RotateEvery below MinRotateEvery to be a problem\n")
+	}
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	const versions = 20
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: versions, RotateEvery: 200 * time.Millisecond, FlushSeconds: 60, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	const lines = 30
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(logFile, "line %d\n", i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	logFile.Close()
+
+	// Every line is in exactly one file, in order, and there were several
+	// rotations
+	var all string
+	rotations := 0
+	for v := versions; v >= 0; v-- {
+		lf := FileNameVersion(logFileName, v)
+		contents, err := ioutil.ReadFile(lf)
+		if err != nil {
+			continue
+		}
+		if v > 0 {
+			rotations++
+		}
+		all += string(contents)
+		os.Remove(lf)
+	}
+	var expected string
+	for i := 0; i < lines; i++ {
+		expected += fmt.Sprintf("line %d\n", i)
+	}
+	if all != expected {
+		t.Errorf("Expected every line once in order got %q\n", all)
+	}
+	if rotations < 4 {
+		t.Errorf("Expected at least 4 rotations in 1.5s got %d\n", rotations)
+	}
+}
+
+func Test_Tail(t *testing.T) {
+	debug("Test_Tail start")
+	defer debug("Test_Tail end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(FileNameVersion(logFileName, 1))
+
+	logFile, err := New(&LogFile{FileName: logFileName, OldVersions: 1, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+	logFile.Write([]byte("before\n"))
+
+	tail, err := NewTail(logFileName, false)
+	if err != nil {
+		t.Errorf("Failed to tail %s: %s\n", logFileName, err)
+		return
+	}
+	defer tail.Close()
+	tail.PollInterval = 10 * time.Millisecond
+	expect := func(expected string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if line, err := tail.ReadLine(ctx); line != expected || err != nil {
+			t.Errorf("Expected line %q got %q, %v\n", expected, line, err)
+		}
+	}
+
+	logFile.Write([]byte("one\n"))
+	expect("one")
+
+	// Lines written just before rotating are still read from the old file
+	logFile.Write([]byte("two\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("three\n"))
+	expect("two")
+	expect("three")
+
+	// Truncated then written to, like copytruncate
+	logFile.Flush()
+	os.Truncate(logFileName, 0)
+	f, _ := os.OpenFile(logFileName, os.O_WRONLY, 0644)
+	f.Write([]byte("x\n"))
+	f.Close()
+	expect("x")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := tail.ReadLine(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected ReadLine to wait until ctx was done got %v\n", err)
+	}
+}
+
+// blockingWriter is a tee that holds up its LogFile until released
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	<-bw.release
+	return len(p), nil
+}
+
+func Test_KeyedLogs(t *testing.T) {
+	debug("Test_KeyedLogs start")
+	defer debug("Test_KeyedLogs end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	stalled := &blockingWriter{release: make(chan struct{})}
+	logs := NewKeyedLogs(func(key string) *LogFile {
+		lp := &LogFile{FileName: filepath.Join(dir, key+".log"), Flags: FileOnly | Unregistered}
+		if key == "stalled" {
+			lp.Tees = []io.Writer{stalled}
+		}
+		return lp
+	})
+	logs.Workers = 1
+
+	// The stalled log's goroutine is stuck on its tee
+	if _, err := logs.Get("stalled"); err != nil {
+		t.Errorf("Failed to open stalled log: %s\n", err)
+		return
+	}
+	stuck := make(chan struct{})
+	go func() {
+		logs.Write("stalled", []byte("stuck\n"))
+		close(stuck)
+	}()
+	done := make(chan struct{})
+	go func() {
+		logs.Write("fast", []byte("one\n"))
+		logs.Write("fast", []byte("two\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Writes to one log were held up by another\n")
+	}
+	if keys := logs.Keys(); !reflect.DeepEqual(keys, []string{"fast", "stalled"}) {
+		t.Errorf("Expected keys fast and stalled got %v\n", keys)
+	}
+
+	close(stalled.release)
+	<-stuck
+	if err := logs.Close(); err != nil {
+		t.Errorf("Close failed: %s\n", err)
+	}
+	for key, expected := range map[string]string{"fast": "one\ntwo\n", "stalled": "stuck\n"} {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, key+".log"))
+		if string(contents) != expected {
+			t.Errorf("Wrong contents for %s expected %q got %q\n", key, expected, contents)
+		}
+	}
+	if keys := logs.Keys(); len(keys) != 0 {
+		t.Errorf("Expected no keys after Close got %v\n", keys)
+	}
+
+	// A newFunc that panics doesn't leave others getting the key waiting
+	entered, proceed := make(chan struct{}), make(chan struct{})
+	var calls int32
+	logs = NewKeyedLogs(func(key string) *LogFile {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+			<-proceed
+		}
+		panic("newFunc failed")
+	})
+	get := func(result chan<- error) {
+		defer func() {
+			if recover() != nil {
+				result <- errors.New("panicked")
+			}
+		}()
+		_, err := logs.Get("panics")
+		result <- err
+	}
+	first, second := make(chan error, 1), make(chan error, 1)
+	go get(first)
+	<-entered
+	go get(second)
+	time.Sleep(50 * time.Millisecond)
+	close(proceed)
+	for _, result := range []chan error{first, second} {
+		select {
+		case err := <-result:
+			if err == nil {
+				t.Errorf("Expected an error getting a key whose newFunc panicked\n")
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Get waited forever for a key whose newFunc panicked\n")
+		}
+	}
+}
+
+func Test_FlushInterval(t *testing.T) {
+	debug("Test_FlushInterval start")
+	defer debug("Test_FlushInterval end")
+
+	// The deprecated seconds are used when there is no interval
+	lp := &LogFile{FlushSeconds: 5, CheckSeconds: -1}
+	lp.setDefaults()
+	if lp.FlushInterval != 5*time.Second || lp.CheckInterval != -time.Second {
+		t.Errorf("Expected FlushInterval 5s and CheckInterval -1s got %s and %s\n", lp.FlushInterval, lp.CheckInterval)
+	}
+	lp = &LogFile{FlushInterval: time.Millisecond, FlushSeconds: 5}
+	lp.setDefaults()
+	if lp.FlushInterval != time.Millisecond || lp.CheckInterval != time.Minute {
+		t.Errorf("Expected FlushInterval 1ms and the default CheckInterval got %s and %s\n", lp.FlushInterval, lp.CheckInterval)
+	}
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, FlushInterval: 50 * time.Millisecond, Flags: FileOnly | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+	logFile.Write([]byte("buffered\n"))
+	if contents, _ := ioutil.ReadFile(logFileName); len(contents) != 0 {
+		t.Errorf("Expected the entry to be buffered got %q\n", contents)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != "buffered\n" {
+		t.Errorf("Expected the entry to be flushed within FlushInterval got %q\n", contents)
+	}
+}
+
+func Test_DurationFlags(t *testing.T) {
+	debug("Test_DurationFlags start")
+	defer debug("Test_DurationFlags end")
+
+	// Put back what the flags change
+	checkSeconds, flushSeconds := Defaults.CheckSeconds, Defaults.FlushSeconds
+	reset := func() {
+		Defaults.CheckSeconds, Defaults.FlushSeconds = checkSeconds, flushSeconds
+		Defaults.CheckInterval, Defaults.FlushInterval = 0, 0
+	}
+	defer reset()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+
+	// The duration flags beat the seconds ones, whatever the order
+	for _, args := range [][]string{{"logflush", "500ms", "logflushseconds", "7"}, {"logflushseconds", "7", "logflush", "500ms"}} {
+		reset()
+		for i := 0; i < len(args); i += 2 {
+			if err := fs.Set(args[i], args[i+1]); err != nil {
+				t.Errorf("Failed to set -%s: %s\n", args[i], err)
+			}
+		}
+		lp := &LogFile{}
+		lp.setDefaults()
+		if lp.FlushInterval != 500*time.Millisecond {
+			t.Errorf("Expected -logflush to set FlushInterval 500ms got %s\n", lp.FlushInterval)
+		}
+	}
+
+	// On its own the seconds flag still works
+	reset()
+	fs.Set("logcheckseconds", "7")
+	lp := &LogFile{}
+	lp.setDefaults()
+	if lp.CheckInterval != 7*time.Second {
+		t.Errorf("Expected -logcheckseconds to set CheckInterval 7s got %s\n", lp.CheckInterval)
+	}
+	fs.Set("logcheck", "2m")
+	lp = &LogFile{}
+	lp.setDefaults()
+	if lp.CheckInterval != 2*time.Minute {
+		t.Errorf("Expected -logcheck to set CheckInterval 2m got %s\n", lp.CheckInterval)
+	}
+}
+
+func Test_NewMemoryFirst(t *testing.T) {
+	debug("Test_NewMemoryFirst start")
+	defer debug("Test_NewMemoryFirst end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(FileNameVersion(logFileName, 1))
+
+	logFile, err := NewMemoryFirst(12)
+	if err != nil {
+		t.Errorf("NewMemoryFirst failed: %s\n", err)
+		return
+	}
+	logFile.Write([]byte("boot 1\n"))
+	logFile.Write([]byte("too much\n"))
+
+	// The settings for the file arrive with it
+	if err := logFile.AttachFile(&LogFile{FileName: logFileName, MaxSize: 16, OldVersions: 1}); err != nil {
+		t.Errorf("AttachFile failed: %s\n", err)
+		return
+	}
+	logFile.Write([]byte("running\n"))
+	logFile.Write([]byte("rotated\n"))
+	logFile.Close()
+
+	for v, expected := range []string{"rotated\n", "boot 1\nrunning\n"} {
+		lf := FileNameVersion(logFileName, v)
+		if contents, _ := ioutil.ReadFile(lf); string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", lf, expected, contents)
+		}
+	}
+
+	// Settings from a failed AttachFile are not kept
+	logFile, err = NewMemoryFirst(0)
+	if err != nil {
+		t.Errorf("NewMemoryFirst failed: %s\n", err)
+		return
+	}
+	if err := logFile.AttachFile(&LogFile{FileName: logFileName, MaxSize: 16, OldVersions: -1}); err == nil {
+		t.Errorf("Expected AttachFile with negative OldVersions to fail\n")
+	}
+	if err := logFile.Attach(logFileName); err != nil {
+		t.Errorf("Attach failed: %s\n", err)
+		return
+	}
+	logFile.Close()
+	if logFile.MaxSize != Defaults.MaxSize || logFile.OldVersions != 0 {
+		t.Errorf("Expected the failed AttachFile's settings gone got MaxSize %d OldVersions %d\n", logFile.MaxSize, logFile.OldVersions)
+	}
+}
+
+func Test_RegisterFlags(t *testing.T) {
+	debug("Test_RegisterFlags start")
+	defer debug("Test_RegisterFlags end")
+
+	// Importing the package mustn't take the program's flag names
+	if f := flag.Lookup("logfile"); f != nil {
+		t.Errorf("Expected no -logfile flag until RegisterFlags\n")
+	}
+
+	fileName, maxSize := Defaults.FileName, Defaults.MaxSize
+	defer func() { Defaults.FileName, Defaults.MaxSize = fileName, maxSize }()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-logfile", "app.log", "-logmax", "1000"}); err != nil {
+		t.Errorf("Failed to parse flags: %s\n", err)
+	}
+	if Defaults.FileName != "app.log" || Defaults.MaxSize != 1000 {
+		t.Errorf("Expected flags to set Defaults got %q and %d\n", Defaults.FileName, Defaults.MaxSize)
+	}
+}
+
+func Test_VerifyWrites(t *testing.T) {
+	debug("Test_VerifyWrites start")
+	defer debug("Test_VerifyWrites end")
+
+	// Simulate storage that silently loses writes by corrupting what is
+	// read back while corrupt is set
+	var corrupt int32
+	savedReadAt := verifyReadAt
+	verifyReadAt = func(f *os.File, b []byte, off int64) (int, error) {
+		n, err := f.ReadAt(b, off)
+		if n > 0 && atomic.LoadInt32(&corrupt) == 1 {
+			b[0] ^= 0xff
+		}
+		return n, err
+	}
+	defer func() { verifyReadAt = savedReadAt }()
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	var errs int32
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors | VerifyWrites,
+		OnError: func(error) { atomic.AddInt32(&errs, 1) }})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	fmt.Fprintf(logFile, "good\n")
+	if err := logFile.Flush(); err != nil {
+		t.Errorf("Flush of a good write failed: %s\n", err)
+	}
+	if n := logFile.Stats().VerifyErrors; n != 0 {
+		t.Errorf("Expected no VerifyErrors for a good write got %d\n", n)
+	}
+
+	atomic.StoreInt32(&corrupt, 1)
+	// Unbuffered the Write reports it, buffered the Flush
+	_, err = logFile.Write([]byte("lost\n"))
+	if err == nil {
+		err = logFile.Flush()
+	}
+	if err == nil {
+		t.Errorf("Expected the mismatched read back to be reported\n")
+	}
+	if n := logFile.Stats().VerifyErrors; n != 1 {
+		t.Errorf("Expected 1 VerifyErrors got %d\n", n)
+	}
+	if n := atomic.LoadInt32(&errs); n != 1 {
+		t.Errorf("Expected OnError to be called once got %d\n", n)
+	}
+	logFile.Close()
+}
+
+func Test_SignalHandling(t *testing.T) {
+	debug("Test_SignalHandling start")
+	defer debug("Test_SignalHandling end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(logFileName + ".1")
+	defer os.Remove(logFileName + ".moved")
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, OldVersions: 2, CheckInterval: -1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+
+	// The first default signal is SIGHUP where there is one
+	hup := defaultSignals[0]
+	if !isHangup(hup) {
+		t.Skip("there is no SIGHUP here")
+	}
+	stop := EnableSignalHandling(hup)
+	defer stop()
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Errorf("Failed to find own process: %s\n", err)
+		return
+	}
+	hangup := func() {
+		if err := self.Signal(hup); err != nil {
+			t.Errorf("Failed to send SIGHUP: %s\n", err)
+		}
+	}
+	waitFor := func(fileName, want string) {
+		var got []byte
+		for i := 0; i < 100; i++ {
+			got, err = ioutil.ReadFile(fileName)
+			if err == nil && string(got) == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("Expected %s to contain %q got %q\n", fileName, want, got)
+	}
+
+	// The file is still in place so it is rotated
+	logFile.Write([]byte("one\n"))
+	hangup()
+	waitFor(logFileName+".1", "one\n")
+
+	// Moved aside, as logrotate does, so it is reopened
+	logFile.Write([]byte("two\n"))
+	logFile.Flush()
+	if err := os.Rename(logFileName, logFileName+".moved"); err != nil {
+		t.Errorf("Failed to move %s aside: %s\n", logFileName, err)
+		return
+	}
+	hangup()
+	waitFor(logFileName, "")
+	logFile.Write([]byte("three\n"))
+	logFile.Flush()
+	waitFor(logFileName, "three\n")
+	waitFor(logFileName+".moved", "two\n")
+	waitFor(logFileName+".1", "one\n")
+
+	// Stopping again, as the deferred stop does, is harmless
+	stop()
+}
+
+func Test_NewBucketed(t *testing.T) {
+	debug("Test_NewBucketed start")
+	defer debug("Test_NewBucketed end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	template := filepath.Join(dir, "app-*.log")
+
+	if _, err := NewBucketed(template, time.Minute, nil); err == nil {
+		t.Errorf("Expected a bucket every minute to be refused\n")
+	}
+
+	// A restart in the same hour appends, despite OverWriteOnStart
+	for _, line := range []string{"first run\n", "second run\n"} {
+		logFile, err := NewBucketed(template, time.Hour, &LogFile{Flags: FileOnly | OverWriteOnStart})
+		if err != nil {
+			t.Errorf("Failed to create bucketed log file: %s\n", err)
+			return
+		}
+		logFile.Write([]byte(line))
+		logFile.Close()
+	}
+	fileName := strings.Replace(template, "*", time.Now().Format("2006010215"), 1)
+	if contents, err := ioutil.ReadFile(fileName); err != nil || string(contents) != "first run\nsecond run\n" {
+		t.Errorf("Expected %s to have both runs got %q (%v)\n", fileName, contents, err)
+	}
+	os.Remove(fileName)
+	os.Remove(stateFileName(fileName))
+
+	// Switching at the next bucket, made a second long to test it quickly
+	logFile, err := NewBucketed(template, time.Hour, &LogFile{Flags: FileOnly | Synchronous})
+	if err != nil {
+		t.Errorf("Failed to create bucketed log file: %s\n", err)
+		return
+	}
+	logFile.bucketLayout = "20060102150405"
+	logFile.Write([]byte("one\n"))
+	first := logFile.CurrentFileName()
+	time.Sleep(1100 * time.Millisecond)
+	logFile.Write([]byte("two\n"))
+	second := logFile.CurrentFileName()
+	logFile.Close()
+
+	if first == second {
+		t.Errorf("Expected a new file for the next bucket got %s again\n", first)
+	}
+	for name, expected := range map[string]string{first: "one\n", second: "two\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != expected {
+			t.Errorf("Expected %s to contain %q got %q (%v)\n", name, expected, contents, err)
+		}
+	}
+	if _, err := os.Stat(stateFileName(first)); err == nil {
+		t.Errorf("Expected the state of the last bucket %s to be removed\n", first)
+	}
+	if _, err := os.Stat(stateFileName(second)); err != nil {
+		t.Errorf("Expected a state file for the current bucket %s: %s\n", second, err)
+	}
+}
+
+func Test_LockFile(t *testing.T) {
+	debug("Test_LockFile start")
+	defer debug("Test_LockFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(logFileName + lockSuffix)
+
+	// Where nothing can be locked LockFile, and so SharedFile, must say so
+	if !lockSupported {
+		if _, err := LockFile(logFileName, time.Second); err != ErrLockUnsupported {
+			t.Errorf("Expected ErrLockUnsupported got %v\n", err)
+		}
+		if err := (&LogFile{FileName: logFileName, Flags: SharedFile}).Validate(); err == nil {
+			t.Errorf("Expected SharedFile without locking to be a problem\n")
+		}
+		return
+	}
+
+	lock, err := LockFile(logFileName, time.Second)
+	if err != nil {
+		t.Errorf("Failed to lock %s: %s\n", logFileName, err)
+		return
+	}
+
+	// flock locks conflict even within a process
+	start := time.Now()
+	if _, err := LockFile(logFileName, 50*time.Millisecond); err != ErrLockTimeout {
+		t.Errorf("Expected ErrLockTimeout while locked got %v\n", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected LockFile to wait for the timeout, waited %s\n", waited)
+	}
+
+	// A shared LogFile waits for the lock to write
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | SharedFile, SharedIdentity: "test"})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		UnlockFile(lock)
+		return
+	}
+	written := make(chan bool)
+	go func() {
+		logFile.Write([]byte("locked out\n"))
+		written <- true
+	}()
+	select {
+	case <-written:
+		t.Errorf("Expected Write to wait for the lock\n")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := UnlockFile(lock); err != nil {
+		t.Errorf("Failed to unlock %s: %s\n", logFileName, err)
+	}
+	<-written
+	logFile.Close()
+
+	lock, err = LockFile(logFileName, 0)
+	if err != nil {
+		t.Errorf("Failed to lock %s once free: %s\n", logFileName, err)
+		return
+	}
+	UnlockFile(lock)
+}
+
+func Test_PlatformWatcher(t *testing.T) {
+	debug("Test_PlatformWatcher start")
+	defer debug("Test_PlatformWatcher end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	movedName := logFileName + ".moved"
+	defer os.Remove(movedName)
+	defer os.Remove(logFileName)
+
+	f, err := os.Open(logFileName)
+	if err != nil {
+		t.Errorf("Failed to open %s: %s\n", logFileName, err)
+		return
+	}
+	w, err := platformWatcher(f)
+	f.Close()
+	if err != nil {
+		t.Errorf("Failed to watch %s: %s\n", logFileName, err)
+		return
+	}
+	if w == nil {
+		t.Skip("files cannot be watched here")
+	}
+	w.Close()
+
+	// Without the CheckInterval check only the watcher can notice the move
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | WatchFile, CheckInterval: -1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+	os.Rename(logFileName, movedName)
+	for i := 0; i < 500; i++ {
+		if _, err := os.Stat(logFileName); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{movedName: "one\n", logFileName: "two\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %s got %s\n", name, expected, contents)
+		}
+	}
+}
+
+func Test_ShouldRotate(t *testing.T) {
+	debug("Test_ShouldRotate start")
+	defer debug("Test_ShouldRotate end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	rotatedName := FileNameVersion(logFileName, 1)
+	defer os.Remove(logFileName)
+	defer os.Remove(rotatedName)
+
+	var sizes []int64
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, OldVersions: 1,
+		ShouldRotate: func(current SizeInfo, next []byte) bool {
+			if current.FileName != logFileName || current.Opened.IsZero() {
+				t.Errorf("Unexpected SizeInfo %+v\n", current)
+			}
+			sizes = append(sizes, current.Size)
+			return bytes.HasPrefix(next, []byte("=== RUN"))
+		}})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	for _, line := range []string{"=== RUN one\n", "ok\n", "=== RUN two\n", "ok\n"} {
+		logFile.Write([]byte(line))
+	}
+	logFile.Close()
+
+	// The empty file isn't asked about
+	if !reflect.DeepEqual(sizes, []int64{12, 15, 12}) {
+		t.Errorf("Expected ShouldRotate to be given sizes 12, 15 and 12 got %v\n", sizes)
+	}
+	for name, expected := range map[string]string{rotatedName: "=== RUN one\nok\n", logFileName: "=== RUN two\nok\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", name, expected, contents)
+		}
+	}
+}
+
+func Test_ReplacedFile(t *testing.T) {
+	debug("Test_ReplacedFile start")
+	defer debug("Test_ReplacedFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	movedName := logFileName + ".moved"
+	defer os.Remove(logFileName)
+	defer os.Remove(movedName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, CheckInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+
+	// As logrotate's create mode does, so FileName never stops existing
+	os.Rename(logFileName, movedName)
+	if err := ioutil.WriteFile(logFileName, nil, 0644); err != nil {
+		t.Errorf("Failed to create %s: %s\n", logFileName, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	logFile.Write([]byte("two\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{movedName: "one\n", logFileName: "two\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", name, expected, contents)
+		}
+	}
+}
+
+func Test_TruncatedFile(t *testing.T) {
+	debug("Test_TruncatedFile start")
+	defer debug("Test_TruncatedFile end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	rotatedName := FileNameVersion(logFileName, 1)
+	defer os.Remove(logFileName)
+	defer os.Remove(rotatedName)
+
+	// OverWriteOnStart opens the file without O_APPEND, so writing on at
+	// the old offset would leave a hole
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors | OverWriteOnStart,
+		MaxSize: 20, OldVersions: 1, CheckInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("first 15 bytes\n"))
+	logFile.Flush()
+
+	// As logrotate's copytruncate does
+	if err := os.Truncate(logFileName, 0); err != nil {
+		t.Errorf("Failed to truncate %s: %s\n", logFileName, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	logFile.Write([]byte("next 10..\n"))
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil || string(contents) != "next 10..\n" {
+		t.Errorf("Expected %s to contain only the write after truncation got %q (%v)\n", logFileName, contents, err)
+	}
+	if _, err := os.Stat(rotatedName); err == nil {
+		t.Errorf("Expected no rotation as the size was reset by truncation\n")
+	}
+}
+
+func Test_Dictionary(t *testing.T) {
+	debug("Test_Dictionary start")
+	defer debug("Test_Dictionary end")
+
+	trainName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(trainName)
+
+	entries := func(from, n int) []byte {
+		var b bytes.Buffer
+		for i := from; i < from+n; i++ {
+			fmt.Fprintf(&b, "2024-06-12T13:%02d:%02d INFO request handled path=/api/v1/items id=%d status=200\n", i/60%60, i%60, i)
+			if i%7 == 0 {
+				fmt.Fprintf(&b, "2024-06-12T13:%02d:%02d WARN slow upstream backend=cache-%d latency=%dms\n", i/60%60, i%60, i%3, i*13%900)
+			}
+		}
+		return b.Bytes()
+	}
+	if err := ioutil.WriteFile(trainName, entries(0, 500), 0644); err != nil {
+		t.Errorf("Failed to write %s: %s\n", trainName, err)
+		return
+	}
+	dict, err := TrainDictionary([]string{trainName}, 0)
+	if err != nil {
+		t.Errorf("Failed to train dictionary: %s\n", err)
+		return
+	}
+	if len(dict) == 0 || len(dict) > MaxDictionarySize {
+		t.Errorf("Expected a dictionary of up to %d bytes got %d\n", MaxDictionarySize, len(dict))
+	}
+
+	// A small old version, where a dictionary helps most
+	original := entries(1000, 20)
+	var withDict, without bytes.Buffer
+	if err := DictionaryCompactFunc(dict)(bytes.NewReader(original), &withDict); err != nil {
+		t.Errorf("Failed to compress with dictionary: %s\n", err)
+		return
+	}
+	zw, _ := flate.NewWriter(&without, flate.BestCompression)
+	zw.Write(original)
+	zw.Close()
+	if withDict.Len() >= without.Len() {
+		t.Errorf("Expected the dictionary to help, %d bytes with it %d without\n", withDict.Len(), without.Len())
+	}
+
+	r, err := NewDictionaryReader(bytes.NewReader(withDict.Bytes()), dict)
+	if err != nil {
+		t.Errorf("Failed to read dictionary compressed file: %s\n", err)
+		return
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(contents, original) {
+		t.Errorf("Expected the original contents back got %d bytes (%v)\n", len(contents), err)
+	}
+	if _, err := NewDictionaryReader(bytes.NewReader(withDict.Bytes()), []byte("other")); err == nil {
+		t.Errorf("Expected reading with the wrong dictionary to fail\n")
+	}
+
+	// Written with the dictionary, opened twice so holding two streams
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	var expected []byte
+	for _, from := range []int{2000, 3000} {
+		logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | GzipFile, Dictionary: dict})
+		if err != nil {
+			t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+			return
+		}
+		logFile.Write(entries(from, 20))
+		logFile.Close()
+		expected = append(expected, entries(from, 20)...)
+	}
+	f, err := os.Open(logFileName)
+	if err != nil {
+		t.Errorf("Failed to open %s: %s\n", logFileName, err)
+		return
+	}
+	defer f.Close()
+	if format, _, _, _ := DetectFormat(f); format != FormatDictionary {
+		t.Errorf("Expected %s in FormatDictionary got %d\n", logFileName, format)
+	}
+	f.Seek(0, io.SeekStart)
+	r, err = NewReader(f, dict)
+	if err != nil {
+		t.Errorf("Failed to read %s: %s\n", logFileName, err)
+		return
+	}
+	if contents, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(contents, expected) {
+		t.Errorf("Expected both streams of %s back got %q (%v)\n", logFileName, contents, err)
+	}
+	if err := (&LogFile{FileName: "log", Dictionary: dict}).Validate(); err == nil {
+		t.Errorf("Expected Dictionary without GzipFile to be a problem\n")
+	}
+}
+
+func Test_CopyTruncate(t *testing.T) {
+	debug("Test_CopyTruncate start")
+	defer debug("Test_CopyTruncate end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	rotatedName := FileNameVersion(logFileName, 1)
+	defer os.Remove(logFileName)
+	defer os.Remove(rotatedName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | CopyTruncate, OldVersions: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	before, err := os.Stat(logFileName)
+	if err != nil {
+		t.Errorf("Failed to stat %s: %s\n", logFileName, err)
+		return
+	}
+	// Another process with the file open
+	other, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Errorf("Failed to open %s: %s\n", logFileName, err)
+		return
+	}
+	defer other.Close()
+
+	logFile.Write([]byte("before\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("after\n"))
+	logFile.Flush()
+	other.Write([]byte("other\n"))
+	logFile.Close()
+
+	after, err := os.Stat(logFileName)
+	if err != nil || !os.SameFile(before, after) {
+		t.Errorf("Expected %s to still be the same file (%v)\n", logFileName, err)
+	}
+	for name, expected := range map[string]string{rotatedName: "before\n", logFileName: "after\nother\n"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", name, expected, contents)
+		}
+	}
+}
+
+func Test_Thresholds(t *testing.T) {
+	debug("Test_Thresholds start")
+	defer debug("Test_Thresholds end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(FileNameVersion(logFileName, 1))
+	defer os.Remove(FileNameVersion(logFileName, 2))
+
+	var events []ThresholdEvent
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, OldVersions: 2,
+		Thresholds:  Thresholds{BytesPerDay: 10, RotationsPerHour: 1, ErrorsPerHour: 1},
+		OnThreshold: func(event ThresholdEvent) { events = append(events, event) }})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("0123456789\n"))
+	logFile.Write([]byte("again\n"))
+	logFile.WriteEntry(Entry{"level": "error", "msg": "one"})
+	logFile.WriteEntry(Entry{"level": "error", "msg": "two"})
+	logFile.RotateFile()
+	logFile.RotateFile()
+	logFile.Close()
+
+	// Each is only told about once
+	var names []string
+	for _, event := range events {
+		names = append(names, event.Threshold)
+		if event.FileName != logFileName || event.Value <= event.Limit {
+			t.Errorf("Unexpected ThresholdEvent %+v\n", event)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"BytesPerDay", "ErrorsPerHour", "RotationsPerHour"}) {
+		t.Errorf("Expected BytesPerDay, ErrorsPerHour then RotationsPerHour got %v\n", names)
+	}
+
+	for name, expected := range map[string]string{FileNameVersion(logFileName, 2): "ErrorsPerHour", logFileName: "RotationsPerHour"} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil || !strings.Contains(string(contents), "over its "+expected+" threshold of 1") {
+			t.Errorf("Expected a %s notification line in %s got %q (%v)\n", expected, name, contents, err)
+		}
+	}
+	if err := (&LogFile{FileName: "log", Thresholds: Thresholds{BytesPerDay: -1}}).Validate(); err == nil {
+		t.Errorf("Expected a negative threshold to be a problem\n")
+	}
+}
+
+// memorySink is a Sink keeping what is written, and rotated, in memory
+type memorySink struct {
+	open     bool
+	current  bytes.Buffer
+	rotated  []string
+	flushes  int
+	reopened int
+}
+
+func (s *memorySink) Open(truncate bool) error {
+	if s.open {
+		return fmt.Errorf("already open")
+	}
+	if truncate {
+		s.current.Reset()
+	}
+	s.open = true
+	s.reopened++
+	return nil
+}
+
+func (s *memorySink) Write(p []byte) (int, error) {
+	if !s.open {
+		return 0, fmt.Errorf("not open")
+	}
+	return s.current.Write(p)
+}
+
+func (s *memorySink) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.open = false
+	return nil
+}
+
+func (s *memorySink) Size() (int64, error) {
+	return int64(s.current.Len()), nil
+}
+
+func (s *memorySink) Rotate() error {
+	if s.open {
+		return fmt.Errorf("rotated while open")
+	}
+	s.rotated = append(s.rotated, s.current.String())
+	s.current.Reset()
+	return nil
+}
+
+func Test_Sink(t *testing.T) {
+	debug("Test_Sink start")
+	defer debug("Test_Sink end")
+
+	if err := (&LogFile{FileName: "memory", Sink: &memorySink{}, Flags: SharedFile}).Validate(); err == nil {
+		t.Errorf("Expected SharedFile with a Sink to be a problem\n")
+	}
+
+	sink := &memorySink{}
+	logFile, err := New(&LogFile{FileName: "memory", Sink: sink, Flags: FileOnly | SyncCritical, MaxSize: 10})
+	if err != nil {
+		t.Errorf("Failed to create log file with a sink: %s\n", err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Write([]byte("two\n"))
+	logFile.Write([]byte("three\n"))
+	logFile.WriteEntry(Entry{"level": "error", "msg": "synced"})
+	logFile.RotateFile()
+	logFile.Write([]byte("four\n"))
+	if err := logFile.Close(); err != nil {
+		t.Errorf("Close of a sink failed: %s\n", err)
+	}
+
+	if sink.open {
+		t.Errorf("Expected the sink to be closed\n")
+	}
+	if sink.flushes == 0 {
+		t.Errorf("Expected the critical entry to flush the sink\n")
+	}
+	// The entry is bigger than MaxSize so goes in a sink of its own
+	if len(sink.rotated) != 3 || sink.rotated[0] != "one\ntwo\n" || sink.rotated[1] != "three\n" || !strings.Contains(sink.rotated[2], "synced") {
+		t.Errorf("Expected rotations at MaxSize and by RotateFile got %q\n", sink.rotated)
+	}
+	if sink.current.String() != "four\n" {
+		t.Errorf("Expected four in the sink got %q\n", sink.current.String())
+	}
+
+	failing := &unrotatableSink{}
+	logFile, err = New(&LogFile{FileName: "memory", Sink: failing, Flags: FileOnly | NoErrors})
+	if err != nil {
+		t.Errorf("Failed to create log file with a sink: %s\n", err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	if _, err := logFile.RotateNow(); !errors.Is(err, ErrRotateFailed) {
+		t.Errorf("Expected RotateNow to return ErrRotateFailed got %v\n", err)
+	}
+	if stats := logFile.Stats(); stats.RotateErrors != 1 {
+		t.Errorf("Expected 1 RotateErrors got %d\n", stats.RotateErrors)
+	}
+	logFile.Close()
+}
+
+// unrotatableSink is a memorySink that fails to rotate
+type unrotatableSink struct {
+	memorySink
+}
+
+func (s *unrotatableSink) Rotate() error {
+	return fmt.Errorf("cannot rotate")
+}
+
+func Test_SetFileName(t *testing.T) {
+	debug("Test_SetFileName start")
+	defer debug("Test_SetFileName end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	oldName := filepath.Join(dir, "old", "log")
+	movedName := filepath.Join(dir, "moved", "log")
+	newName := filepath.Join(dir, "new", "log")
+	os.Mkdir(filepath.Dir(oldName), 0755)
+
+	logFile, err := New(&LogFile{FileName: oldName, Flags: FileOnly, OldVersions: 2})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", oldName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("two\n"))
+
+	// The file and its old version go with it, creating the directory
+	if err := logFile.SetFileNameMoving(movedName); err != nil {
+		t.Errorf("Failed to move to %s: %s\n", movedName, err)
+	}
+	logFile.Write([]byte("three\n"))
+
+	// Only new entries go to the new file
+	if err := logFile.SetFileName(newName); err != nil {
+		t.Errorf("Failed to switch to %s: %s\n", newName, err)
+	}
+	logFile.Write([]byte("four\n"))
+	logFile.Close()
+
+	for name, expected := range map[string]string{
+		FileNameVersion(movedName, 1): "one\n",
+		movedName:                     "two\nthree\n",
+		newName:                       "four\n",
+	} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Errorf("Failed to read log file %s: %s\n", name, err)
+			continue
+		}
+		if string(contents) != expected {
+			t.Errorf("Wrong logfile contents for %s expected %q got %q\n", name, expected, contents)
+		}
+	}
+	if names, _ := filepath.Glob(oldName + "*"); len(names) != 0 {
+		t.Errorf("Expected nothing left at the old name got %v\n", names)
+	}
+	if err := logFile.SetFileName(oldName); err != ErrClosed {
+		t.Errorf("Expected ErrClosed once closed got %v\n", err)
+	}
+}
+
+func Test_CloseErrors(t *testing.T) {
+	debug("Test_CloseErrors start")
+	defer debug("Test_CloseErrors end")
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("needs /dev/full to make writes fail")
+	}
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	os.Remove(logFileName)
+	logFileName += ".link"
+	if err := os.Symlink("/dev/full", logFileName); err != nil {
+		t.Errorf("Failed to create symlink %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors, FlushSeconds: 60})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if _, err := logFile.Write([]byte("one\n")); err != nil {
+		t.Errorf("Expected buffered Write to succeed got %s\n", err)
+	}
+
+	// Both the failed flush and the entry then dropped are reported
+	err = logFile.Close()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		t.Errorf("Expected a *CloseError got %v\n", err)
+		return
+	}
+	if closeErr.FileName != logFileName || len(closeErr.Errors) < 2 {
+		t.Errorf("Expected at least 2 errors closing %s got %s\n", logFileName, closeErr)
+	}
+	if !errors.Is(err, ErrRetryDropped) || !strings.Contains(closeErr.Error(), "1 entries") {
+		t.Errorf("Expected the dropped entry in %s\n", closeErr)
+	}
+
+	// Nothing going wrong gives no error
+	okFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(okFileName)
+	logFile, err = New(&LogFile{FileName: okFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", okFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	if err := logFile.Close(); err != nil {
+		t.Errorf("Expected no error from Close got %s\n", err)
+	}
+}
+
+func Test_AlsoWrite(t *testing.T) {
+	debug("Test_AlsoWrite start")
+	defer debug("Test_AlsoWrite end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	var also bytes.Buffer
+	logFile, err := New(&LogFile{FileName: logFileName, AlsoWrite: &also, StderrMaxSize: 4})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.WriteWithFlags([]byte("two\n"), FileOnly)
+	logFile.WriteWithFlags([]byte("three\n"), StderrOnly)
+	stats := logFile.Stats()
+	logFile.Close()
+
+	if got := also.String(); got != "one\nthre... [2 more bytes only in "+logFileName+"]\n" {
+		t.Errorf("Unexpected AlsoWrite output %q\n", got)
+	}
+	if stats.StderrBytes != int64(also.Len()) {
+		t.Errorf("Expected StderrBytes %d got %d\n", also.Len(), stats.StderrBytes)
+	}
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != "one\ntwo\n" {
+		t.Errorf("Unexpected file contents %q\n", contents)
+	}
+}
+
+func Test_RotateHooks(t *testing.T) {
+	debug("Test_RotateHooks start")
+	defer debug("Test_RotateHooks end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+	defer os.Remove(logFileName + ".1")
+
+	var calls []string
+	logFile, err := New(&LogFile{
+		FileName:    logFileName,
+		Flags:       FileOnly | NoErrors,
+		OldVersions: 1,
+		PreRotate: func(oldName, newName string) error {
+			contents, _ := ioutil.ReadFile(oldName)
+			calls = append(calls, fmt.Sprintf("pre %s %s %q", oldName, newName, contents))
+			return nil
+		},
+		PostRotate: func(oldName, newName string) error {
+			contents, _ := ioutil.ReadFile(newName)
+			calls = append(calls, fmt.Sprintf("post %s %s %q", oldName, newName, contents))
+			return errors.New("upload failed")
+		},
+	})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.RotateFile()
+	_, err = logFile.Write([]byte("two\n"))
+	if err == nil || !strings.Contains(err.Error(), "upload failed") {
+		t.Errorf("Expected the PostRotate error got %v\n", err)
+	}
+	logFile.Close()
+
+	expected := []string{
+		fmt.Sprintf("pre %s %s.1 %q", logFileName, logFileName, "one\n"),
+		fmt.Sprintf("post %s %s.1 %q", logFileName, logFileName, "one\n"),
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %q got %q\n", expected, calls)
+	}
+}
+
+func Test_HookFatal(t *testing.T) {
+	debug("Test_HookFatal start")
+	defer debug("Test_HookFatal end")
+
+	// Run again as a child that calls log.Fatal
+	if logFileName := os.Getenv("LOGFILE_TEST_FATAL"); logFileName != "" {
+		logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, FlushInterval: time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to create log file %s: %s\n", logFileName, err)
+		}
+		log.SetFlags(0)
+		log.SetOutput(logFile)
+		HookFatal()
+		log.Print("one")
+		log.Fatal("fatal")
+	}
+
+	for _, function := range []string{"log.Fatal", "log.Fatalln", "log.(*Logger).Fatalf"} {
+		if !isFatalFunction(function) {
+			t.Errorf("Expected %s to be a Fatal function\n", function)
+		}
+	}
+	for _, function := range []string{"log.Print", "mylog.Fatal", "main.Fatal"} {
+		if isFatalFunction(function) {
+			t.Errorf("Expected %s not to be a Fatal function\n", function)
+		}
+	}
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_HookFatal$")
+	cmd.Env = append(os.Environ(), "LOGFILE_TEST_FATAL="+logFileName)
+	if err := cmd.Run(); err == nil {
+		t.Errorf("Expected log.Fatal to exit with an error\n")
+	}
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != "one\nfatal\n" {
+		t.Errorf("Expected everything logged before exiting in the file got %q\n", contents)
+	}
+}
+
+func Test_RotateNow(t *testing.T) {
+	debug("Test_RotateNow start")
+	defer debug("Test_RotateNow end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	logFileName := filepath.Join(dir, "log")
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, OldVersions: 2})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	rotated, err := logFile.RotateNow()
+	if err != nil || !reflect.DeepEqual(rotated, []string{logFileName + ".1"}) {
+		t.Errorf("Expected %s.1 to be rotated got %v %v\n", logFileName, rotated, err)
+	}
+	if contents, _ := ioutil.ReadFile(logFileName + ".1"); string(contents) != "one\n" {
+		t.Errorf("Expected the rotated file to be in place got %q\n", contents)
+	}
+	logFile.Close()
+
+	timestamped := filepath.Join(dir, "timestamped")
+	logFile, err = New(&LogFile{FileName: timestamped, Flags: FileOnly | TimestampVersions, OldVersions: 2})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", timestamped, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	rotated, err = logFile.RotateNow()
+	if err != nil || len(rotated) != 1 || !strings.HasPrefix(rotated[0], timestamped+".") {
+		t.Errorf("Expected a timestamped version of %s got %v %v\n", timestamped, rotated, err)
+	}
+	logFile.Close()
+
+	// Without old versions nothing is kept
+	noVersions := filepath.Join(dir, "noversions")
+	logFile, err = New(&LogFile{FileName: noVersions, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", noVersions, err)
+		return
+	}
+	if rotated, err := logFile.RotateNow(); err != nil || len(rotated) != 0 {
+		t.Errorf("Expected nothing rotated got %v %v\n", rotated, err)
+	}
+	logFile.Close()
+}
+
+func Test_Replicate(t *testing.T) {
+	debug("Test_Replicate start")
+	defer debug("Test_Replicate end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	mirror := filepath.Join(dir, "mirror")
+	os.Mkdir(mirror, 0755)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen: %s", err)
+	}
+	receiver := NewReceiver(mirror)
+	var receiverErrs int32
+	receiver.OnError = func(err error) { atomic.AddInt32(&receiverErrs, 1) }
+	served := make(chan error, 1)
+	go func() { served <- receiver.Serve(l) }()
+
+	// Something already in the file is sent too
+	logFileName := filepath.Join(dir, "log")
+	ioutil.WriteFile(logFileName, []byte("before\n"), 0644)
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, MaxSize: 20, OldVersions: 2, ReplicateTo: l.Addr().String()})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n", "seven\n"} {
+		logFile.Write([]byte(line))
+	}
+	if _, err := logFile.RotateNow(); err != nil {
+		t.Errorf("RotateNow failed: %s\n", err)
+	}
+	logFile.Write([]byte("eight\n"))
+	logFile.Close()
+
+	// Every version, in the mirror too, has the same contents
+	names := []string{"log", "log.1", "log.2"}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, name := range names {
+		want, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		for {
+			got, _ := ioutil.ReadFile(filepath.Join(mirror, name))
+			if bytes.Equal(got, want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("Expected mirror %s to be %q got %q\n", name, want, got)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if mirrored, _ := filepath.Glob(filepath.Join(mirror, "*")); len(mirrored) != len(names) {
+		t.Errorf("Expected only %v mirrored got %v\n", names, mirrored)
+	}
+	if n := atomic.LoadInt32(&receiverErrs); n != 0 {
+		t.Errorf("Expected no Receiver errors got %d\n", n)
+	}
+
+	receiver.Close()
+	if err := <-served; err != ErrReceiverClosed {
+		t.Errorf("Expected ErrReceiverClosed from Serve got %v\n", err)
+	}
+
+	// Names that would be outside the mirror are refused
+	if err := receiver.apply(replicaOp{op: replicaWrite, name: "../escape", data: []byte("x")}); err == nil {
+		t.Errorf("Expected ../escape to be refused\n")
+	}
+}
+
+func Test_ReplicateErrors(t *testing.T) {
+	debug("Test_ReplicateErrors start")
+	defer debug("Test_ReplicateErrors end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	// Nothing is listening once l is closed so replicating fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var mutex sync.Mutex
+	var stacks []string
+	onError := func(err error) {
+		stack := make([]byte, 64*1024)
+		mutex.Lock()
+		stacks = append(stacks, err.Error()+"\n"+string(stack[:runtime.Stack(stack, false)]))
+		mutex.Unlock()
+	}
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors, ReplicateTo: addr, OnError: onError})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	for deadline := time.Now().Add(5 * time.Second); logFile.Stats().ReplicaErrors == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logFile.Close()
+
+	// OnError is only called from the LogFile's goroutine, never the
+	// replicator's
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(stacks) == 0 {
+		t.Errorf("Expected OnError to be told replicating failed\n")
+	}
+	for _, stack := range stacks {
+		if !strings.Contains(stack, "replicating to "+addr) || !strings.Contains(stack, ".logger(") {
+			t.Errorf("Expected OnError called from the LogFile's goroutine got %s\n", stack)
+		}
+	}
+}
+
+func Test_FlushOnPattern(t *testing.T) {
+	debug("Test_FlushOnPattern start")
+	defer debug("Test_FlushOnPattern end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{
+		FileName:        logFileName,
+		Flags:           FileOnly,
+		FlushInterval:   time.Hour,
+		FlushOnPattern:  regexp.MustCompile(`^FATAL`),
+		FlushOnContains: []string{"AUDIT"},
+	})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+
+	// Only a match flushes, taking everything before it too
+	written, expected := "", ""
+	for _, entry := range []struct {
+		line    string
+		flushed bool
+	}{
+		{"one\n", false},
+		{"user AUDIT login\n", true},
+		{"two FATAL\n", false},
+		{"FATAL three\n", true},
+	} {
+		logFile.Write([]byte(entry.line))
+		written += entry.line
+		if entry.flushed {
+			expected = written
+		}
+		if contents, _ := ioutil.ReadFile(logFileName); string(contents) != expected {
+			t.Errorf("After %q expected %q in the file got %q\n", entry.line, expected, contents)
+		}
+	}
+}
+
+func Test_SentinelErrors(t *testing.T) {
+	debug("Test_SentinelErrors start")
+	defer debug("Test_SentinelErrors end")
+
+	if _, err := New(&LogFile{}); !errors.Is(err, ErrNoFileName) {
+		t.Errorf("Expected ErrNoFileName got %v\n", err)
+	}
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing", "log")
+	_, err = New(&LogFile{FileName: missing, Flags: FileOnly | NoErrors})
+	if !errors.Is(err, ErrCreateFailed) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrCreateFailed wrapping os.ErrNotExist for %s got %v\n", missing, err)
+	}
+
+	if _, err := os.Stat("/dev/full"); err != nil {
+		return
+	}
+	logFileName := filepath.Join(dir, "full")
+	if err := os.Symlink("/dev/full", logFileName); err != nil {
+		t.Errorf("Failed to create symlink %s: %s\n", logFileName, err)
+		return
+	}
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	if _, err := logFile.Write([]byte("one\n")); !errors.Is(err, ErrDiskFull) || !isDiskFull(err) {
+		t.Errorf("Expected ErrDiskFull wrapping ENOSPC got %v\n", err)
+	}
+	logFile.Close()
+}
+
+func Test_TailBuffer(t *testing.T) {
+	debug("Test_TailBuffer start")
+	defer debug("Test_TailBuffer end")
+
+	if (&LogFile{}).TailBytes(0) != nil {
+		t.Errorf("Expected nothing kept without TailBufferSize\n")
+	}
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, TailBufferSize: 16})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+
+	logFile.Write([]byte("one\n"))
+	logFile.Write([]byte("two\n"))
+	if got := string(logFile.TailBytes(0)); got != "one\ntwo\n" {
+		t.Errorf("Expected everything held got %q\n", got)
+	}
+
+	// Once it wraps only the last 16 bytes, and the lines after the first
+	// newline in them, are kept
+	logFile.Write([]byte("three\n"))
+	logFile.Write([]byte("four\n"))
+	if got := string(logFile.TailBytes(0)); got != "\ntwo\nthree\nfour\n" {
+		t.Errorf("Expected the last 16 bytes got %q\n", got)
+	}
+	if got := string(logFile.TailBytes(5)); got != "four\n" {
+		t.Errorf("Expected the last 5 bytes got %q\n", got)
+	}
+	if got := logFile.TailLines(0); !reflect.DeepEqual(got, []string{"two", "three", "four"}) {
+		t.Errorf("Expected lines two, three and four got %q\n", got)
+	}
+	if got := logFile.TailLines(1); !reflect.DeepEqual(got, []string{"four"}) {
+		t.Errorf("Expected line four got %q\n", got)
+	}
+
+	// An entry bigger than the buffer leaves only its end
+	logFile.Write([]byte(strings.Repeat("x", 20) + "\n"))
+	if got := string(logFile.TailBytes(0)); got != strings.Repeat("x", 15)+"\n" {
+		t.Errorf("Expected the end of the big entry got %q\n", got)
+	}
+}
+
+func Test_WriteAfterClose(t *testing.T) {
+	debug("Test_WriteAfterClose start")
+	defer debug("Test_WriteAfterClose end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	// A tee that blocks keeps an entry pending so the next write waits
+	// for room until Close lets it go
+	stalled := &blockingWriter{release: make(chan struct{})}
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, FlushInterval: time.Hour, MaxPendingBytes: 4, Tees: []io.Writer{stalled}})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := logFile.Write([]byte("two\n"))
+		waiting <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- logFile.Close() }()
+	time.Sleep(50 * time.Millisecond)
+	close(stalled.release)
+
+	done := time.After(5 * time.Second)
+	for _, c := range []chan error{waiting, closed} {
+		select {
+		case <-c:
+		case <-done:
+			t.Errorf("Write waiting for room hung on Close\n")
+			return
+		}
+	}
+
+	finished := make(chan bool)
+	go func() {
+		for i := 0; i < logMessages+10; i++ {
+			if _, err := logFile.Write([]byte("late\n")); err != ErrClosed {
+				t.Errorf("Expected ErrClosed from Write after Close got %v\n", err)
+				break
+			}
+		}
+		if err := logFile.Flush(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Flush after Close got %v\n", err)
+		}
+		if err := logFile.Sync(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Sync after Close got %v\n", err)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write or Flush after Close hung\n")
+	}
+
+	// The goroutine stopping by itself, when New fails, leaves it closed too
+	missing := filepath.Join(logFileName+".missing", "log")
+	logFile, err = New(&LogFile{FileName: missing, Flags: FileOnly | NoErrors})
+	if err == nil {
+		t.Errorf("Expected New to fail creating %s\n", missing)
+		logFile.Close()
+		return
+	}
+	finished = make(chan bool)
+	go func() {
+		if _, err := logFile.Write([]byte("lost\n")); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Write after New failed got %v\n", err)
+		}
+		if err := logFile.Flush(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Flush after New failed got %v\n", err)
+		}
+		if err := logFile.Sync(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Sync after New failed got %v\n", err)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write or Flush after New failed hung\n")
+	}
+}
+
+func Test_WriteWhileNotOpen(t *testing.T) {
+	debug("Test_WriteWhileNotOpen start")
+	defer debug("Test_WriteWhileNotOpen end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	logFileName := filepath.Join(dir, "log")
+
+	// Naughty: set the internal error check timer
+	defer func(seconds int) { errorSeconds = seconds }(errorSeconds)
+	errorSeconds = 1
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	// With its directory replaced by a file the log can't be reopened, and
+	// once housekeeping finds it still closed the LogFile must keep working
+	os.RemoveAll(dir)
+	ioutil.WriteFile(dir, nil, 0644)
+	defer os.Remove(dir)
+	logFile.RotateFile()
+	time.Sleep(time.Duration(errorSeconds)*time.Second + 500*time.Millisecond)
+
+	finished := make(chan bool)
+	go func() {
+		logFile.Write([]byte("lost\n"))
+		logFile.Flush()
+		logFile.Close()
+		if _, err := logFile.Write([]byte("late\n")); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Write after Close got %v\n", err)
+		}
+		if err := logFile.Flush(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Flush after Close got %v\n", err)
+		}
+		if err := logFile.Close(); err != nil {
+			t.Errorf("Expected nil from Close after Close got %s\n", err)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write, Flush or Close hung while the file wasn't open\n")
+	}
+}
+
+func Test_CloseTwice(t *testing.T) {
+	debug("Test_CloseTwice start")
+	defer debug("Test_CloseTwice end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	logFile.Write([]byte("one\n"))
+	logFile.Write([]byte("two\n"))
+
+	// Close racing with Flush and with itself
+	finished := make(chan bool)
+	go func() {
+		closed := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() { closed <- logFile.Close() }()
+		}
+		go logFile.Flush()
+		for i := 0; i < 3; i++ {
+			<-closed
+		}
+		if err := logFile.Close(); err != nil {
+			t.Errorf("Expected nil from Close after Close got %s\n", err)
+		}
+		logFile.RotateFile()
+		if _, err := logFile.RotateNow(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from RotateNow after Close got %v\n", err)
+		}
+		if err := logFile.Flush(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Flush after Close got %v\n", err)
+		}
+		if writes := logFile.Stats().Writes; writes != 2 {
+			t.Errorf("Expected Stats after Close to show 2 writes got %d\n", writes)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Close called twice hung\n")
+		return
+	}
+
+	contents, err := ioutil.ReadFile(logFileName)
+	if err != nil {
+		t.Errorf("Failed to read %s: %s\n", logFileName, err)
+		return
+	}
+	if string(contents) != "one\ntwo\n" {
+		t.Errorf("Expected %q in %s got %q\n", "one\ntwo\n", logFileName, contents)
+	}
+
+	// Nor does Close hang once the goroutine stopped when New failed
+	missing := filepath.Join(logFileName+".missing", "log")
+	logFile, err = New(&LogFile{FileName: missing, Flags: FileOnly | NoErrors})
+	if err == nil {
+		t.Errorf("Expected New to fail creating %s\n", missing)
+		logFile.Close()
+		return
+	}
+	closed := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() { closed <- logFile.Close() }()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("Expected nil from Close after New failed got %s\n", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Close after New failed hung\n")
+			return
+		}
+	}
+}
+
+func Test_ReadBack(t *testing.T) {
+	debug("Test_ReadBack start")
+	defer debug("Test_ReadBack end")
+
+	// Every format reads back as what was written
+	original := []byte("one\ntwo\n")
+	dict := []byte("one two three")
+	var gz, dictionary bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(original)
+	zw.Close()
+	DictionaryCompactFunc(dict)(bytes.NewReader(original), &dictionary)
+	for name, encoded := range map[string][]byte{"plain": original, "gzip": gz.Bytes(), "dictionary": dictionary.Bytes()} {
+		r, err := NewReader(bytes.NewReader(encoded), dict)
+		if err != nil {
+			t.Errorf("Failed to read %s file: %s\n", name, err)
+			continue
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(contents, original) {
+			t.Errorf("Expected %q from %s file got %q, %v\n", original, name, contents, err)
+		}
+	}
+	if _, err := NewReader(bytes.NewReader(dictionary.Bytes()), nil); err == nil {
+		t.Errorf("Expected an error reading a dictionary file without the dictionary\n")
+	}
+
+	// A GzipFile is followed as it is written
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | GzipFile | OverWriteOnStart})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer logFile.Close()
+	logFile.Write([]byte("before\n"))
+	logFile.Flush()
+
+	tail, err := NewTail(logFileName, false)
+	if err != nil {
+		t.Errorf("Failed to tail %s: %s\n", logFileName, err)
+		return
+	}
+	defer tail.Close()
+	tail.PollInterval = 10 * time.Millisecond
+	for _, line := range []string{"one", "two"} {
+		logFile.Write([]byte(line + "\n"))
+		logFile.Flush()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		got, err := tail.ReadLine(ctx)
+		cancel()
+		if got != line || err != nil {
+			t.Errorf("Expected line %q got %q, %v\n", line, got, err)
+		}
+	}
+}
+
+func Test_FIFO(t *testing.T) {
+	debug("Test_FIFO start")
+	defer debug("Test_FIFO end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fifoName := filepath.Join(dir, "pipe")
+	if err := exec.Command("mkfifo", fifoName).Run(); err != nil {
+		t.Skipf("Unable to make a named pipe: %s\n", err)
+	}
+
+	if _, err := New(&LogFile{FileName: fifoName, Flags: FileOnly | SharedFile}); err == nil || !strings.Contains(err.Error(), "SharedFile cannot be used with a FIFO") {
+		t.Errorf("Expected SharedFile with a FIFO to be a problem got %v\n", err)
+	}
+
+	logFile, err := New(&LogFile{FileName: fifoName, Flags: FileOnly, OldVersions: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", fifoName, err)
+		return
+	}
+
+	// Nothing is reading yet so this is retried
+	logFile.Write([]byte("one\n"))
+	logFile.Flush()
+
+	read := make(chan string, 1)
+	go func() {
+		f, err := os.Open(fifoName)
+		if err != nil {
+			read <- err.Error()
+			return
+		}
+		defer f.Close()
+		contents, _ := ioutil.ReadAll(f)
+		read <- string(contents)
+	}()
+
+	// RotateFile doesn't end the reader's input
+	logFile.Write([]byte("two\n"))
+	logFile.RotateFile()
+	logFile.Write([]byte("three\n"))
+	time.Sleep(300 * time.Millisecond)
+	logFile.Close()
+
+	select {
+	case contents := <-read:
+		if contents != "one\ntwo\nthree\n" {
+			t.Errorf("Expected %q from %s got %q\n", "one\ntwo\nthree\n", fifoName, contents)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Reading from %s hung\n", fifoName)
+	}
+	if _, err := os.Stat(FileNameVersion(fifoName, 1)); err == nil {
+		t.Errorf("Expected %s not to be rotated\n", fifoName)
+	}
+}
+
+func Test_DropWhenFull(t *testing.T) {
+	debug("Test_DropWhenFull start")
+	defer debug("Test_DropWhenFull end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	// A tee that blocks stops the queue being emptied
+	stalled := &blockingWriter{release: make(chan struct{})}
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | DropWhenFull, FlushInterval: time.Hour, Tees: []io.Writer{stalled}})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+
+	finished := make(chan int)
+	go func() {
+		dropped := 0
+		for i := 0; i < logMessages+10; i++ {
+			if _, err := logFile.Write([]byte("entry\n")); err == ErrQueueFull {
+				dropped++
+			} else if err != nil {
+				t.Errorf("Expected nil or ErrQueueFull from Write got %s\n", err)
+			}
+		}
+		finished <- dropped
+	}()
+	var dropped int
+	select {
+	case dropped = <-finished:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write blocked with DropWhenFull\n")
+	}
+	close(stalled.release)
+	if dropped == 0 {
+		t.Errorf("Expected entries to be dropped once the queue was full\n")
+	}
+	if stats := logFile.Stats(); stats.FullDrops != int64(dropped) {
+		t.Errorf("Expected Stats.FullDrops %d got %d\n", dropped, stats.FullDrops)
+	}
+	logFile.Close()
+}
+
+func Test_QueueSize(t *testing.T) {
+	debug("Test_QueueSize start")
+	defer debug("Test_QueueSize end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	for _, size := range []int{-1, maxQueueSize + 1} {
+		if _, err := New(&LogFile{FileName: logFileName, QueueSize: size}); err == nil {
+			t.Errorf("Expected New to reject QueueSize %d\n", size)
+		}
+	}
+
+	for size, expected := range map[int]int{0: logMessages, 5: 5} {
+		logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, QueueSize: size})
+		if err != nil {
+			t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+			continue
+		}
+		if cap(logFile.messages) != expected {
+			t.Errorf("Expected QueueSize %d to queue %d got %d\n", size, expected, cap(logFile.messages))
+		}
+		logFile.Close()
+	}
+}
+
+func Test_TimersReleased(t *testing.T) {
+	debug("Test_TimersReleased start")
+	defer debug("Test_TimersReleased end")
+
+	logFileName, err := tempFileName()
+	if err != nil {
+		t.Errorf("Failed to create temporary file: %s\n", err)
+		return
+	}
+	defer os.Remove(logFileName)
+
+	// Every job on the timer is due soon, and they all still happen
+	before := GoroutineCount()
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly, FlushInterval: 20 * time.Millisecond,
+		CheckInterval: 30 * time.Millisecond, RotateEvery: MinRotateEvery, OldVersions: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file %s: %s\n", logFileName, err)
+		return
+	}
+	defer os.Remove(FileNameVersion(logFileName, 1))
+	logFile.Write([]byte("one\n"))
+	time.Sleep(50 * time.Millisecond)
+	// It may already have been rotated as rotations are on the clock
+	live, _ := ioutil.ReadFile(logFileName)
+	rotated, _ := ioutil.ReadFile(FileNameVersion(logFileName, 1))
+	if string(rotated)+string(live) != "one\n" {
+		t.Errorf("Expected %q flushed to %s got %q\n", "one\n", logFileName, string(rotated)+string(live))
+	}
+	time.Sleep(MinRotateEvery)
+	if contents, _ := ioutil.ReadFile(FileNameVersion(logFileName, 1)); string(contents) != "one\n" {
+		t.Errorf("Expected %q rotated to %s got %q\n", "one\n", FileNameVersion(logFileName, 1), contents)
+	}
+	os.Remove(logFileName)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(logFileName); err != nil {
+		t.Errorf("Expected %s to be recreated after it was removed: %s\n", logFileName, err)
+	}
+	logFile.Close()
+	if GoroutineCount() != before {
+		t.Errorf("Expected %d goroutines after Close got %d\n", before, GoroutineCount())
+	}
+
+	// Nothing is left running when New fails to open the file
+	missing := filepath.Join(logFileName+".missing", "log")
+	logFile, err = New(&LogFile{FileName: missing, Flags: FileOnly, StderrTimeout: time.Second, FlushInterval: time.Millisecond})
+	if err == nil {
+		t.Errorf("Expected New to fail creating %s\n", missing)
+		logFile.Close()
+		return
+	}
+	if GoroutineCount() != before {
+		t.Errorf("Expected %d goroutines after New failed got %d\n", before, GoroutineCount())
+	}
+	finished := make(chan error, 1)
+	go func() {
+		_, err := logFile.Write([]byte("lost\n"))
+		finished <- err
+	}()
+	select {
+	case err := <-finished:
+		if err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Write after New failed got %v\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Write after New failed hung\n")
+	}
+	if err := logFile.Close(); err != nil {
+		t.Errorf("Expected nil from Close after New failed got %s\n", err)
+	}
+}
+
+func Test_StartRotateError(t *testing.T) {
+	debug("Test_StartRotateError start")
+	defer debug("Test_StartRotateError end")
+
+	dir, err := ioutil.TempDir(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	logFileName := filepath.Join(dir, "log")
+	ioutil.WriteFile(logFileName, []byte("old\n"), 0644)
+
+	// A non empty directory in the way stops the file being rotated
+	os.Mkdir(FileNameVersion(logFileName, 1), 0755)
+	ioutil.WriteFile(filepath.Join(FileNameVersion(logFileName, 1), "x"), nil, 0644)
+
+	errs := make(chan error, 10)
+	logFile, err := New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors | RotateOnStart, OldVersions: 1,
+		OnError: func(err error) { errs <- err }})
+	if err != nil {
+		t.Errorf("Expected New to carry on after failing to rotate got %s\n", err)
+		return
+	}
+	if _, err := logFile.Write([]byte("new\n")); err != nil {
+		t.Errorf("Expected the first Write not to return the rotate error got %s\n", err)
+	}
+	if stats := logFile.Stats(); stats.RotateErrors != 1 {
+		t.Errorf("Expected Stats.RotateErrors 1 got %d\n", stats.RotateErrors)
+	}
+	logFile.Close()
+	close(errs)
+	var startErr *StartRotateError
+	for err := range errs {
+		if errors.As(err, &startErr) {
+			break
+		}
+	}
+	if startErr == nil || !errors.Is(startErr, ErrRotateFailed) || startErr.FileName != logFileName {
+		t.Errorf("Expected OnError to be given a StartRotateError for %s got %v\n", logFileName, startErr)
+	}
+	if contents, _ := ioutil.ReadFile(logFileName); string(contents) != "old\nnew\n" {
+		t.Errorf("Expected %q in %s got %q\n", "old\nnew\n", logFileName, contents)
+	}
+
+	_, err = New(&LogFile{FileName: logFileName, Flags: FileOnly | NoErrors | RotateOnStart | StrictStart, OldVersions: 1})
+	if !errors.As(err, &startErr) || !errors.Is(err, ErrCreateFailed) {
+		t.Errorf("Expected New with StrictStart to fail with a StartRotateError got %v\n", err)
+	}
+
+	// A custom RotateFileFunc reports its own failure
+	custom := &LogFile{FileName: logFileName, Flags: FileOnly | NoErrors | RotateOnStart | StrictStart}
+	custom.RotateFileFunc = func() { custom.RotateFailed(errors.New("upload failed")) }
+	_, err = New(custom)
+	if !errors.As(err, &startErr) || !errors.Is(err, ErrRotateFailed) || !strings.Contains(err.Error(), "upload failed") {
+		t.Errorf("Expected New with a failing RotateFileFunc to fail with a StartRotateError got %v\n", err)
+	}
+
+	if err := (&LogFile{FileName: logFileName, Flags: StrictStart}).Validate(); err == nil {
+		t.Errorf("Expected StrictStart without RotateOnStart to be rejected\n")
+	}
+}
+
+func Test_CurrentFileName(t *testing.T) {
+	debug("Test_CurrentFileName start")
+	defer debug("Test_CurrentFileName end")
+
+	dir, err := os.MkdirTemp(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	logFile, err := New(&LogFile{FileName: filepath.Join(dir, "a"), Flags: FileOnly, OldVersions: 1})
+	if err != nil {
+		t.Errorf("Failed to create log file: %s\n", err)
+		return
+	}
+	defer logFile.Close()
+
+	// Run with -race: reading the name while it changes must not race
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			ListOpenLogFiles()
+			WriteMetrics(io.Discard)
+			logFile.PinnedFiles()
+			CheckLeaks()
+		}
+		close(done)
+	}()
+	for _, name := range []string{"b", "c", "d"} {
+		if err := logFile.SetFileName(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Failed to set file name %s: %s\n", name, err)
+		}
+	}
+	<-done
+	if name := logFile.CurrentFileName(); name != filepath.Join(dir, "d") {
+		t.Errorf("Expected CurrentFileName %s got %s\n", filepath.Join(dir, "d"), name)
+	}
+}
+
+func Test_KeepBuckets(t *testing.T) {
+	debug("Test_KeepBuckets start")
+	defer debug("Test_KeepBuckets end")
+
+	dir, err := os.MkdirTemp(tmpDir, tmpPrefix)
+	if err != nil {
+		t.Errorf("Failed to create temporary directory: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	template := filepath.Join(dir, "app-*.log")
+	bucket := func(id string) string {
+		return strings.Replace(template, "*", id, 1)
+	}
+
+	// Three earlier hours, the middle one pinning a file
+	for _, id := range []string{"2024010100", "2024010101", "2024010102"} {
+		os.WriteFile(bucket(id), []byte(id+"\n"), 0644)
+		state := `{"bucket":"` + id + `"}`
+		if id == "2024010101" {
+			state = `{"pins":["` + bucket(id) + `"]}`
+		}
+		os.WriteFile(stateFileName(bucket(id)), []byte(state), 0644)
+	}
+
+	logFile, err := NewBucketed(template, time.Hour, &LogFile{Flags: FileOnly, KeepBuckets: 1})
+	if err != nil {
+		t.Errorf("Failed to create bucketed log file: %s\n", err)
+		return
+	}
+	logFile.Close()
+
+	for name, kept := range map[string]bool{
+		bucket("2024010102"): true, stateFileName(bucket("2024010102")): false,
+		bucket("2024010101"): true, stateFileName(bucket("2024010101")): true,
+		bucket("2024010100"): false, stateFileName(bucket("2024010100")): false,
+	} {
+		if _, err := os.Stat(name); (err == nil) != kept {
+			t.Errorf("Expected %s kept %v\n", name, kept)
+		}
+	}
+}
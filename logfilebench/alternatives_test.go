@@ -0,0 +1,82 @@
+//go:build bench
+
+/*
+File summary: logfile benchmarks of other rotating writers
+Package: logfilebench
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfilebench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/natefinch/atomic"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func BenchmarkLumberjack(b *testing.B) {
+	run(b, func(w workload, fileName string) (io.WriteCloser, error) {
+		return &lumberjack.Logger{
+			Filename:   fileName,
+			MaxSize:    int(w.maxSize / (1024 * 1024)),
+			MaxBackups: w.oldVersions,
+		}, nil
+	})
+}
+
+// BenchmarkAtomic keeps each file in memory, writing it with
+// atomic.WriteFile when it reaches maxSize or is closed, so a reader never
+// sees a partly written file
+func BenchmarkAtomic(b *testing.B) {
+	run(b, func(w workload, fileName string) (io.WriteCloser, error) {
+		return &atomicFile{w: w, fileName: fileName}, nil
+	})
+}
+
+type atomicFile struct {
+	w        workload
+	fileName string
+	buf      bytes.Buffer
+	files    int
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	if int64(a.buf.Len()+len(p)) > a.w.maxSize {
+		if err := a.writeFile(); err != nil {
+			return 0, err
+		}
+	}
+	return a.buf.Write(p)
+}
+
+// writeFile writes out the buffered file, numbering them round the
+// oldVersions+1 kept
+func (a *atomicFile) writeFile() error {
+	name := fmt.Sprintf("%s.%d", a.fileName, a.files%(a.w.oldVersions+1))
+	a.files++
+	err := atomic.WriteFile(name, &a.buf)
+	a.buf.Reset()
+	return err
+}
+
+func (a *atomicFile) Close() error {
+	return a.writeFile()
+}
@@ -0,0 +1,161 @@
+/*
+File summary: logfile logfile benchmarks
+Package: logfilebench
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfilebench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leemcloughlin/logfile"
+)
+
+// workload is what every benchmark writes: entrySize byte entries, rotating
+// at maxSize and keeping oldVersions old files
+type workload struct {
+	name        string
+	entrySize   int
+	maxSize     int64
+	oldVersions int
+}
+
+// maxSize is 1MB as lumberjack's sizes are in megabytes
+var workloads = []workload{
+	{"small", 100, 1024 * 1024, 2},
+	{"large", 4096, 1024 * 1024, 2},
+}
+
+// entry returns a log line of the workload's size
+func (w workload) entry() []byte {
+	line := bytes.Repeat([]byte("x"), w.entrySize)
+	line[len(line)-1] = '\n'
+	return line
+}
+
+// run writes b.N entries to the writer newWriter creates for each
+// workload, in a new directory, closing it at the end
+func run(b *testing.B, newWriter func(w workload, fileName string) (io.WriteCloser, error)) {
+	for _, w := range workloads {
+		b.Run(w.name, func(b *testing.B) {
+			out, err := newWriter(w, filepath.Join(b.TempDir(), "log"))
+			if err != nil {
+				b.Fatalf("Failed to create writer: %s", err)
+			}
+			entry := w.entry()
+			b.SetBytes(int64(len(entry)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := out.Write(entry); err != nil {
+					b.Fatalf("Write failed: %s", err)
+				}
+			}
+			if err := out.Close(); err != nil {
+				b.Fatalf("Close failed: %s", err)
+			}
+		})
+	}
+}
+
+func BenchmarkLogFile(b *testing.B) {
+	run(b, func(w workload, fileName string) (io.WriteCloser, error) {
+		return logfile.New(&logfile.LogFile{
+			FileName:    fileName,
+			MaxSize:     w.maxSize,
+			OldVersions: w.oldVersions,
+			Flags:       logfile.FileOnly,
+		})
+	})
+}
+
+// BenchmarkLogFileBuffered lets LogFile buffer, flushing once a second
+func BenchmarkLogFileBuffered(b *testing.B) {
+	run(b, func(w workload, fileName string) (io.WriteCloser, error) {
+		return logfile.New(&logfile.LogFile{
+			FileName:      fileName,
+			MaxSize:       w.maxSize,
+			OldVersions:   w.oldVersions,
+			FlushInterval: time.Second,
+			Flags:         logfile.FileOnly,
+		})
+	})
+}
+
+// BenchmarkOSFile is the least any of them could cost: writing to an
+// *os.File, renaming old versions when it gets to maxSize
+func BenchmarkOSFile(b *testing.B) {
+	run(b, func(w workload, fileName string) (io.WriteCloser, error) {
+		return newRotatingFile(w, fileName)
+	})
+}
+
+// rotatingFile is a minimal rotating writer with no buffering or goroutine
+type rotatingFile struct {
+	w        workload
+	fileName string
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(w workload, fileName string) (*rotatingFile, error) {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{w: w, fileName: fileName, file: file}, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size+int64(len(p)) > r.w.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	for v := r.w.oldVersions; v > 1; v-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.fileName, v-1), fmt.Sprintf("%s.%d", r.fileName, v))
+	}
+	if err := os.Rename(r.fileName, r.fileName+".1"); err != nil {
+		return err
+	}
+	file, err := os.Create(r.fileName)
+	if err != nil {
+		return err
+	}
+	r.file, r.size = file, 0
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
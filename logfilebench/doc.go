@@ -0,0 +1,33 @@
+/*
+File summary: logfile logfile benchmarks against other rotating writers
+Package: logfilebench
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package logfilebench benchmarks LogFile's write and rotate throughput, and
+allocations, against other ways of writing rotated log files given the
+same workload: the same entries written until the same size is reached
+and the file rotated, keeping the same number of old versions.
+
+	go test -bench . -benchmem github.com/leemcloughlin/logfile/logfilebench
+
+compares LogFile with writing straight to an *os.File. With -tags bench
+gopkg.in/natefinch/lumberjack.v2 and github.com/natefinch/atomic are
+benchmarked too; they are only needed then so nothing else depends on them.
+*/
+package logfilebench
@@ -0,0 +1,88 @@
+//go:build grpc
+
+/*
+File summary: logfile gRPC server interceptors
+Package: logfilegrpc
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package logfilegrpc provides gRPC server interceptors that log every call
+through a logfile.RPCLogger:
+
+	rpcLog := logfile.NewRPCLogger(logFile)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(logfilegrpc.UnaryServerInterceptor(rpcLog)),
+		grpc.StreamInterceptor(logfilegrpc.StreamServerInterceptor(rpcLog)))
+
+It is only built with -tags grpc so the logfile package itself does not
+depend on gRPC.
+*/
+package logfilegrpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/leemcloughlin/logfile"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns an interceptor logging unary calls to l
+func UnaryServerInterceptor(l *logfile.RPCLogger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		l.Log(&logfile.RPCCall{
+			Method:   info.FullMethod,
+			Peer:     peerAddr(ctx),
+			Code:     status.Code(err).String(),
+			Latency:  time.Since(start),
+			Err:      err,
+			Request:  req,
+			Response: resp,
+		})
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor logging streaming calls to
+// l when they finish
+func StreamServerInterceptor(l *logfile.RPCLogger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		l.Log(&logfile.RPCCall{
+			Method:  info.FullMethod,
+			Peer:    peerAddr(ss.Context()),
+			Code:    status.Code(err).String(),
+			Latency: time.Since(start),
+			Err:     err,
+		})
+		return err
+	}
+}
+
+// peerAddr returns the address of the client making the call in ctx
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
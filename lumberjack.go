@@ -0,0 +1,91 @@
+/*
+File summary: logfile lumberjack compatibility
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"time"
+)
+
+// LumberjackConfig has the same fields as the configuration part of
+// gopkg.in/natefinch/lumberjack.v2's Logger so configuration written for it
+// can be used with FromLumberjack.
+type LumberjackConfig struct {
+	Filename   string `json:"filename" yaml:"filename"`
+	MaxSize    int    `json:"maxsize" yaml:"maxsize"` // megabytes
+	MaxAge     int    `json:"maxage" yaml:"maxage"`   // days
+	MaxBackups int    `json:"maxbackups" yaml:"maxbackups"`
+	LocalTime  bool   `json:"localtime" yaml:"localtime"`
+	Compress   bool   `json:"compress" yaml:"compress"`
+}
+
+const (
+	// lumberjackMaxSize is the megabytes lumberjack uses if MaxSize is 0
+	lumberjackMaxSize = 100
+	megabyte          = 1024 * 1024
+)
+
+// FromLumberjack creates a LogFile, as New does, configured from cfg. Like
+// lumberjack nothing is written to stderr.
+// Options LogFile has no equivalent for (Compress and a MaxBackups of 0
+// meaning keep everything) are reported as errors rather than ignored.
+// LocalTime is ignored as LogFile's old versions are numbered, not timestamped.
+func FromLumberjack(cfg LumberjackConfig) (*LogFile, error) {
+	if cfg.MaxAge < 0 {
+		return nil, fmt.Errorf("LogFile lumberjack MaxAge cannot be negative (%d)", cfg.MaxAge)
+	}
+	if cfg.Compress {
+		return nil, fmt.Errorf("LogFile does not support lumberjack Compress")
+	}
+	if cfg.MaxBackups <= 0 {
+		return nil, fmt.Errorf("LogFile cannot keep unlimited old versions, lumberjack MaxBackups must be set")
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = lumberjackMaxSize
+	}
+
+	return New(&LogFile{
+		FileName:    cfg.Filename,
+		MaxSize:     int64(maxSize) * megabyte,
+		OldVersions: cfg.MaxBackups,
+		MaxAge:      time.Duration(cfg.MaxAge) * 24 * time.Hour,
+		Flags:       FileOnly,
+	})
+}
+
+// Lumberjack wraps a LogFile so that it has the same methods as
+// lumberjack.Logger, for code that expects Rotate() error and Close() error.
+type Lumberjack struct {
+	*LogFile
+}
+
+// Rotate rotates the log file and waits for the rotation to finish
+func (l Lumberjack) Rotate() error {
+	_, err := l.RotateNow()
+	return err
+}
+
+// Close flushes and closes the log file
+func (l Lumberjack) Close() error {
+	return l.LogFile.Close()
+}
@@ -0,0 +1,144 @@
+/*
+File summary: logfile file format detection
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format identifies how a log file written by LogFile is encoded
+type Format int
+
+const (
+	// FormatPlain is text written as is. Plain files have no header so that
+	// they remain ordinary text files. It is also what files written before
+	// headers existed are detected as.
+	FormatPlain Format = iota
+
+	// FormatGzip is gzip compressed. gzip has its own magic number so no
+	// header is added.
+	FormatGzip
+
+	// FormatDictionary is DEFLATE compressed with a preset dictionary, see
+	// DictionaryCompactFunc
+	FormatDictionary
+)
+
+// Non-plain formats defined by this package start with fileMagic followed
+// by a format byte and a version byte. Formats, like gzip, with a magic
+// number of their own are recognised by that instead.
+var (
+	fileMagic = []byte("\x00LMLF")
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// fileHeaderSize is the length of a header written by fileHeader
+var fileHeaderSize = len(fileMagic) + 2
+
+// fileHeader returns the header identifying format f, version v
+func fileHeader(f Format, v int) []byte {
+	return append(append([]byte{}, fileMagic...), byte(f), byte(v))
+}
+
+// DetectFormat looks at the start of r to work out how the log file it is
+// reading was written. It returns the format, the format's version and a
+// reader positioned after any header that should be used in place of r.
+func DetectFormat(r io.Reader) (Format, int, io.Reader, error) {
+	br := bufio.NewReader(r)
+	start, err := br.Peek(fileHeaderSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return FormatPlain, 0, br, fmt.Errorf("LogFile unable to read file header: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(start, fileMagic) && len(start) == fileHeaderSize:
+		f, v := Format(start[len(fileMagic)]), int(start[len(fileMagic)+1])
+		br.Discard(fileHeaderSize)
+		return f, v, br, nil
+	case bytes.HasPrefix(start, gzipMagic):
+		return FormatGzip, 0, br, nil
+	}
+	return FormatPlain, 0, br, nil
+}
+
+// NewReader returns a reader of the contents of r, a log file or old
+// version written by LogFile, decompressing it as needed so it reads as the
+// entries written. dict is the dictionary given to DictionaryCompactFunc,
+// only needed for FormatDictionary files. Reading a GzipFile that is still
+// being written ends with io.ErrUnexpectedEOF rather than io.EOF.
+func NewReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	format, version, r, err := DetectFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatPlain:
+		return io.NopCloser(r), nil
+	case FormatGzip:
+		return gzip.NewReader(r)
+	case FormatDictionary:
+		if dict == nil {
+			return nil, fmt.Errorf("LogFile file is compressed with a dictionary but none was given")
+		}
+		return dictionaryReader(r, version, dict)
+	}
+	return nil, fmt.Errorf("LogFile unknown file format %d", format)
+}
+
+// verifyArchive reads all of fileName checking it is not corrupt. gzip
+// files are checked against their CRC, VerifyFunc is then used if set.
+func (lp *LogFile) verifyArchive(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, _, r, err := DetectFormat(f)
+	if err != nil {
+		return err
+	}
+	if format == FormatGzip {
+		// The CRC is checked on reaching the end
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, zr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if lp.VerifyFunc == nil {
+		return nil
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return lp.VerifyFunc(f)
+}
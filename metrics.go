@@ -0,0 +1,112 @@
+/*
+File summary: logfile Prometheus metrics
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metricCounters are the Stats counters exported as Prometheus metrics
+var metricCounters = []struct {
+	name  string
+	help  string
+	value func(s *Stats) int64
+}{
+	{"logfile_writes_total", "Entries passed to Write.", func(s *Stats) int64 { return s.Writes }},
+	{"logfile_file_bytes_total", "Bytes written to the log file.", func(s *Stats) int64 { return s.FileBytes }},
+	{"logfile_file_errors_total", "Failed writes to the log file.", func(s *Stats) int64 { return s.FileErrors }},
+	{"logfile_retries_total", "Entries queued to retry writing to the log file.", func(s *Stats) int64 { return s.Retries }},
+	{"logfile_retry_drops_total", "Entries dropped that could not be written to the log file.", func(s *Stats) int64 { return s.RetryDrops }},
+	{"logfile_no_file_stderr_total", "Entries only copied to stderr as the log file was not open.", func(s *Stats) int64 { return s.NoFileStderr }},
+	{"logfile_no_file_drops_total", "Entries lost as the log file was not open.", func(s *Stats) int64 { return s.NoFileDrops }},
+	{"logfile_overflow_drops_total", "Entries dropped as too much was pending.", func(s *Stats) int64 { return s.OverflowDrops }},
+	{"logfile_full_drops_total", "Entries dropped as the queue was full.", func(s *Stats) int64 { return s.FullDrops }},
+	{"logfile_oversize_drops_total", "Entries rejected as bigger than MaxEntryBytes.", func(s *Stats) int64 { return s.OversizeDrops }},
+	{"logfile_oversize_chunked_total", "Entries split into chunks as bigger than MaxEntryBytes.", func(s *Stats) int64 { return s.OversizeChunked }},
+	{"logfile_rate_limited_total", "Entries dropped by RateLimit.", func(s *Stats) int64 { return s.RateLimited }},
+	{"logfile_tee_errors_total", "Failed writes to tees.", func(s *Stats) int64 { return s.TeeErrors }},
+	{"logfile_rotate_errors_total", "Failed renames while rotating.", func(s *Stats) int64 { return s.RotateErrors }},
+	{"logfile_archive_errors_total", "Rotated files that failed verification.", func(s *Stats) int64 { return s.ArchiveErrors }},
+	{"logfile_verify_errors_total", "Writes to the log file that failed verification.", func(s *Stats) int64 { return s.VerifyErrors }},
+	{"logfile_replica_errors_total", "Failures sending to ReplicateTo.", func(s *Stats) int64 { return s.ReplicaErrors }},
+	{"logfile_replica_drops_total", "Changes not sent to ReplicateTo.", func(s *Stats) int64 { return s.ReplicaDrops }},
+	{"logfile_stderr_bytes_total", "Bytes copied to stderr.", func(s *Stats) int64 { return s.StderrBytes }},
+	{"logfile_stderr_errors_total", "Failed writes to stderr.", func(s *Stats) int64 { return s.StderrErrors }},
+	{"logfile_stderr_drops_total", "Entries not copied to a blocked stderr.", func(s *Stats) int64 { return s.StderrDrops }},
+}
+
+// WriteMetrics writes the Stats of every open LogFile (see
+// ListOpenLogFiles) to w in the Prometheus text format, labelled with the
+// file name
+func WriteMetrics(w io.Writer) error {
+	logFiles := ListOpenLogFiles()
+	stats := make([]Stats, len(logFiles))
+	for i, lp := range logFiles {
+		stats[i] = lp.Stats()
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, counter := range metricCounters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for i, lp := range logFiles {
+			fmt.Fprintf(bw, "%s{file=%s} %d\n", counter.name, metricLabel(lp.CurrentFileName()), counter.value(&stats[i]))
+		}
+	}
+
+	const latency = "logfile_flush_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time from Write to the entry being flushed to the file.\n# TYPE %s histogram\n", latency, latency)
+	for i, lp := range logFiles {
+		h := &stats[i].FlushLatency
+		file := metricLabel(lp.CurrentFileName())
+		var cumulative int64
+		for b, bound := range LatencyBuckets {
+			cumulative += h.Counts[b]
+			fmt.Fprintf(bw, "%s_bucket{file=%s,le=\"%s\"} %d\n", latency, file,
+				strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{file=%s,le=\"+Inf\"} %d\n", latency, file, h.Count)
+		fmt.Fprintf(bw, "%s_sum{file=%s} %s\n", latency, file, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{file=%s} %d\n", latency, file, h.Count)
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler returns an http.Handler serving WriteMetrics for
+// Prometheus to scrape
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+}
+
+// metricLabelEscaper escapes Prometheus label values
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabel returns s as a quoted Prometheus label value
+func metricLabel(s string) string {
+	return `"` + metricLabelEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,170 @@
+/*
+File summary: logfile net/http access log middleware
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestIDHeader is the header HTTPMiddleware reads and sets the request ID in
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// RequestID returns the request ID HTTPMiddleware gave the request with ctx,
+// "" if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// HTTPMiddleware returns middleware writing an access log line to lp for
+// every request in format (see NewAccessLogWriter), CombinedLogFormat if
+// empty or invalid.
+//
+// When the request comes from a loopback or private address, as it would
+// from a reverse proxy, the client address is taken from X-Forwarded-For:
+// the last address in it that isn't loopback or private, as those before
+// it could have been made up by the client.
+// A request without an X-Request-Id header is given a random one. The ID is
+// set in the request and response headers, so %{X-Request-Id}i logs it, and
+// RequestID returns it from the request's context.
+func HTTPMiddleware(lp *LogFile, format string) func(http.Handler) http.Handler {
+	if format == "" {
+		format = CombinedLogFormat
+	}
+	access, err := NewAccessLogWriter(lp, format)
+	if err != nil {
+		lp.PrintError("LogFile %s, using the combined format\n", err)
+		access, _ = NewAccessLogWriter(lp, CombinedLogFormat)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := r.Header.Get(RequestIDHeader)
+			if id == "" {
+				id = newRequestID()
+				r.Header.Set(RequestIDHeader, id)
+			}
+			w.Header().Set(RequestIDHeader, id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+			rw := &accessResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				e := newAccessLogEntry(r, rw.status, rw.bytes, time.Since(start))
+				e.Time = start
+				if client := forwardedFor(r); client != "" {
+					e.RemoteHost = client
+				}
+				access.Log(e)
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// forwardedFor returns the client address from X-Forwarded-For if r came
+// through a proxy on a loopback or private address, "" otherwise. Each proxy
+// appends the address it got the request from so, working back from the
+// end, the client is the first address not of another proxy.
+func forwardedFor(r *http.Request) string {
+	xff := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+	if xff == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(net.ParseIP(host)) {
+		return ""
+	}
+	hops := strings.Split(xff, ",")
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		client = strings.TrimSpace(hops[i])
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return ""
+		}
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// trustedProxy returns true if ip is loopback or private, where a reverse
+// proxy would be
+func trustedProxy(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate())
+}
+
+// accessResponseWriter records the status and size of a response
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes on flushes for streaming handlers
+func (w *accessResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController the underlying ResponseWriter
+func (w *accessResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,63 @@
+/*
+File summary: logfile folding multi-line entries
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "bytes"
+
+// MultiLinePolicy decides how an entry of several lines, such as a Go stack
+// trace, is written to the file
+type MultiLinePolicy int
+
+const (
+	// MultiLineAsIs writes the entry unchanged
+	MultiLineAsIs MultiLinePolicy = iota
+
+	// MultiLineEscape writes the entry as a single line, each newline
+	// within it replaced by \n
+	MultiLineEscape
+
+	// MultiLineIndent starts every line after the first with a tab, so
+	// shippers can join lines starting with white space onto the one before
+	// (as a Go stack trace's function lines otherwise aren't)
+	MultiLineIndent
+)
+
+// foldLines returns p written as a single record according to policy. A
+// newline ending p is left alone.
+func foldLines(p []byte, policy MultiLinePolicy) []byte {
+	if policy == MultiLineAsIs {
+		return p
+	}
+	body := bytes.TrimSuffix(p, []byte("\n"))
+	if bytes.IndexByte(body, '\n') < 0 {
+		return p
+	}
+
+	sep := []byte("\\n")
+	if policy == MultiLineIndent {
+		sep = []byte("\n\t")
+	}
+	folded := bytes.Replace(body, []byte("\n"), sep, -1)
+	if len(body) < len(p) {
+		folded = append(folded, '\n')
+	}
+	return folded
+}
@@ -0,0 +1,114 @@
+/*
+File summary: logfile limit on the bytes waiting to be written
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a write that would take the bytes
+// pending over MaxPendingBytes
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the write wait until there is room
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDrop drops the entry and returns ErrOverflow
+	OverflowDrop
+
+	// OverflowSummarize drops the entry, like OverflowDrop, and once there
+	// is room again writes a line saying how many were dropped
+	OverflowSummarize
+)
+
+// reservePending counts n bytes about to be queued. If that would go over
+// MaxPendingBytes it either waits for room or, depending on OverflowPolicy,
+// counts the entry as dropped and returns false. An entry is always allowed
+// when nothing is pending, however big it is, or once Close has been called
+// so the caller finds the LogFile closed rather than waiting for ever.
+func (lp *LogFile) reservePending(n int) bool {
+	if lp.MaxPendingBytes <= 0 {
+		atomic.AddInt64(&lp.queuedBytes, int64(n))
+		return true
+	}
+
+	lp.overflowMutex.Lock()
+	defer lp.overflowMutex.Unlock()
+	for {
+		pending := atomic.LoadInt64(&lp.queuedBytes) + atomic.LoadInt64(&lp.heldBytes)
+		if pending == 0 || pending+int64(n) <= lp.MaxPendingBytes || atomic.LoadInt32(&lp.stopping) == 1 {
+			atomic.AddInt64(&lp.queuedBytes, int64(n))
+			return true
+		}
+		if lp.OverflowPolicy == OverflowBlock {
+			if lp.synchronous {
+				// Nothing else could make room, the caller writes it out
+				atomic.AddInt64(&lp.queuedBytes, int64(n))
+				return true
+			}
+			lp.overflowCond.Wait()
+			continue
+		}
+		atomic.AddInt64(&lp.overflowDrops, 1)
+		atomic.AddInt64(&lp.overflowEntries, 1)
+		atomic.AddInt64(&lp.overflowBytes, int64(n))
+		return false
+	}
+}
+
+// releasePending is called by the LogFile's goroutine after each action to
+// record what it is holding and wake any writers waiting for room
+func (lp *LogFile) releasePending() {
+	if lp.MaxPendingBytes <= 0 {
+		return
+	}
+	held := lp.retryBytes
+	if lp.buf != nil {
+		held += int64(lp.buf.Buffered())
+	}
+	atomic.StoreInt64(&lp.heldBytes, held)
+
+	lp.overflowMutex.Lock()
+	lp.overflowCond.Broadcast()
+	lp.overflowMutex.Unlock()
+}
+
+// summarizeOverflow, with OverflowSummarize, queues a line saying how many
+// entries were dropped since the last time. It is called, with closeMutex
+// held, as a write that fitted is queued.
+func (lp *LogFile) summarizeOverflow() {
+	if lp.OverflowPolicy != OverflowSummarize || atomic.LoadInt64(&lp.overflowEntries) == 0 {
+		return
+	}
+	entries := atomic.SwapInt64(&lp.overflowEntries, 0)
+	if entries == 0 {
+		return
+	}
+	bytes := atomic.SwapInt64(&lp.overflowBytes, 0)
+	summary := fmt.Sprintf("LogFile dropped %d entries (%d bytes) as more than %d bytes were waiting to be written\n", entries, bytes, lp.MaxPendingBytes)
+	atomic.AddInt64(&lp.queuedBytes, int64(len(summary)))
+	seq := lp.nextSeq()
+	lp.trace(TraceEnqueue, seq, len(summary), "")
+	lp.send(logMessage{action: writeLog, data: []byte(summary), queued: time.Now(), seq: seq})
+}
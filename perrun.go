@@ -0,0 +1,168 @@
+/*
+File summary: logfile per run log files
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// perRunCount makes run ids unique within a process
+	perRunCount int64
+
+	// runIDRegexp matches the run ids created by runID
+	runIDRegexp = regexp.MustCompile(`^\d{8}T\d{6}\.\d+\.\d+$`)
+
+	// versionRegexp matches the suffix FileNameVersion, or
+	// TimestampVersions, adds
+	versionRegexp = regexp.MustCompile(`^\.(\d+|\d{4}-\d\d-\d\dT\d{6}Z?(-\d+)?)$`)
+)
+
+// NewPerRun is like New but creates a new log file for every run of the
+// program. The last "*" in template is replaced by a run id made from the
+// time, the process id and a counter (for example "app-*.log" might become
+// "app-20150102T150405.1234.1.log").
+// If KeepRuns is greater than zero only the newest KeepRuns run log files,
+// including the new one, are kept. Older ones and their rotated versions are
+// deleted, but only once the new one has been opened, so a NewPerRun that
+// fails leaves them all.
+// FileName is ignored as it is set from template.
+func NewPerRun(template string, lp *LogFile) (*LogFile, error) {
+	i := strings.LastIndex(template, "*")
+	if i < 0 {
+		return lp, fmt.Errorf("LogFile per run template %s has no *", template)
+	}
+	prefix, suffix := template[:i], template[i+1:]
+
+	if lp == nil {
+		lp = new(LogFile)
+	}
+	lp.FileName = prefix + runID(time.Now()) + suffix
+
+	lp, err := New(lp)
+	if err == nil && lp.KeepRuns > 0 {
+		lp.removeOldRuns(prefix, suffix, lp.KeepRuns)
+	}
+	return lp, err
+}
+
+// runID returns a string unique to this run of the program
+func runID(t time.Time) string {
+	return fmt.Sprintf("%s.%d.%d", t.Format("20060102T150405"), os.Getpid(), atomic.AddInt64(&perRunCount, 1))
+}
+
+// runIDLess returns true if run id a sorts before b. The times compare as
+// strings but the process ids and counters as numbers, so run 10 comes after
+// run 9.
+func runIDLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	if as[0] != bs[0] {
+		return as[0] < bs[0]
+	}
+	for i := 1; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			return an < bn
+		}
+	}
+	return false
+}
+
+// splitRun splits what follows the template prefix in a file name into the
+// run id and any version added by rotation
+func splitRun(rest, suffix string) (id, version string) {
+	if suffix != "" {
+		i := strings.Index(rest, suffix)
+		if i < 0 {
+			return "", ""
+		}
+		return rest[:i], rest[i+len(suffix):]
+	}
+
+	// The run id itself ends in digits so only strip a version if what is
+	// left is still a run id
+	if i := strings.LastIndex(rest, "."); i >= 0 && runIDRegexp.MatchString(rest[:i]) {
+		return rest[:i], rest[i:]
+	}
+	return rest, ""
+}
+
+// removeOldRuns deletes all but the newest keep per run log files matching
+// prefix and suffix
+func (lp *LogFile) removeOldRuns(prefix, suffix string, keep int) {
+	dir := filepath.Dir(prefix + suffix)
+	base := filepath.Base(prefix)
+	if strings.HasSuffix(prefix, string(filepath.Separator)) {
+		base = ""
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		lp.PrintError("LogFile unable to read directory %s: %s\n", dir, err)
+		return
+	}
+
+	// runs maps the run file names found to any rotated versions of them,
+	// ids to their run ids
+	runs := make(map[string][]string)
+	ids := make(map[string]string)
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		id, version := splitRun(name[len(base):], suffix)
+		if !runIDRegexp.MatchString(id) || (version != "" && !versionRegexp.MatchString(version)) {
+			continue
+		}
+		run := filepath.Join(dir, base+id+suffix)
+		runs[run] = append(runs[run], filepath.Join(dir, name))
+		ids[run] = id
+	}
+
+	// Run ids start with the time so the oldest sort first
+	names := make([]string, 0, len(runs))
+	for run := range runs {
+		names = append(names, run)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return runIDLess(ids[names[i]], ids[names[j]])
+	})
+
+	for len(names) > keep {
+		for _, name := range runs[names[0]] {
+			err := os.Remove(name)
+			if err != nil {
+				lp.PrintError("LogFile error removing old run file %s: %s\n", name, err)
+			}
+		}
+		names = names[1:]
+	}
+}
@@ -0,0 +1,187 @@
+/*
+File summary: logfile pinning of old versions
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+)
+
+// pin is a pinned file. As the file is renamed by rotation it is tracked
+// by fileInfo, fileName is only where it was last seen.
+type pin struct {
+	fileName string
+	fileInfo os.FileInfo
+}
+
+// Pin stops the file that is currently version v of the log file (see
+// FileNameVersion, or with TimestampVersions the vth newest) from being
+// deleted, for example because it covers an incident that is being
+// investigated. The file still moves through the versions on rotation but
+// when it would be deleted it is kept, renamed as for DeleteGrace, until
+// unpinned.
+// Pins are remembered between runs in the state file.
+func (lp *LogFile) Pin(v int) error {
+	fileName := lp.versionFileName(v)
+	if fileName == "" {
+		return fmt.Errorf("LogFile cannot pin version %d of %s, there are not that many", v, lp.CurrentFileName())
+	}
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return fmt.Errorf("LogFile cannot pin %s: %w", fileName, err)
+	}
+
+	lp.pinMutex.Lock()
+	defer lp.pinMutex.Unlock()
+	for _, p := range lp.pins {
+		if os.SameFile(p.fileInfo, fi) {
+			return nil
+		}
+	}
+	lp.pins = append(lp.pins, pin{fileName: fileName, fileInfo: fi})
+	lp.savePins()
+	return nil
+}
+
+// Unpin releases a pin on the file that is currently version v of the log
+// file. Use UnpinFile for pinned files that are no longer a version.
+func (lp *LogFile) Unpin(v int) error {
+	fileName := lp.versionFileName(v)
+	if fileName == "" {
+		return fmt.Errorf("LogFile cannot unpin version %d of %s, there are not that many", v, lp.CurrentFileName())
+	}
+	return lp.UnpinFile(fileName)
+}
+
+// UnpinFile releases a pin on fileName, which would usually come from
+// PinnedFiles. Once unpinned it is deleted as normal.
+func (lp *LogFile) UnpinFile(fileName string) error {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return fmt.Errorf("LogFile cannot unpin %s: %w", fileName, err)
+	}
+
+	lp.pinMutex.Lock()
+	defer lp.pinMutex.Unlock()
+	for i, p := range lp.pins {
+		if os.SameFile(p.fileInfo, fi) {
+			lp.pins = append(lp.pins[:i], lp.pins[i+1:]...)
+			lp.savePins()
+			return nil
+		}
+	}
+	return fmt.Errorf("LogFile %s is not pinned", fileName)
+}
+
+// PinnedFiles returns the current names of all pinned files
+func (lp *LogFile) PinnedFiles() []string {
+	lp.pinMutex.Lock()
+	defer lp.pinMutex.Unlock()
+
+	lp.findPins()
+	names := make([]string, len(lp.pins))
+	for i, p := range lp.pins {
+		names[i] = p.fileName
+	}
+	return names
+}
+
+// pinned returns true if fileName is pinned
+func (lp *LogFile) pinned(fileName string) bool {
+	lp.pinMutex.Lock()
+	defer lp.pinMutex.Unlock()
+	if len(lp.pins) == 0 {
+		return false
+	}
+
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return false
+	}
+	for _, p := range lp.pins {
+		if os.SameFile(p.fileInfo, fi) {
+			return true
+		}
+	}
+	return false
+}
+
+// findPins updates the names of pinned files that have been renamed since
+// they were last seen. Pins on files that can no longer be found are
+// dropped. pinMutex must be held.
+func (lp *LogFile) findPins() {
+	var candidates []string
+	kept := lp.pins[:0]
+	for _, p := range lp.pins {
+		fi, err := os.Stat(p.fileName)
+		if err == nil && os.SameFile(p.fileInfo, fi) {
+			kept = append(kept, p)
+			continue
+		}
+
+		if candidates == nil {
+			candidates = lp.versionFileNames()
+		}
+		for _, name := range candidates {
+			fi, err := os.Stat(name)
+			if err == nil && os.SameFile(p.fileInfo, fi) {
+				p.fileName = name
+				kept = append(kept, p)
+				break
+			}
+		}
+	}
+	lp.pins = kept
+}
+
+// versionFileNames returns the names of all the old versions of the log
+// file that exist, including those waiting to be deleted
+func (lp *LogFile) versionFileNames() []string {
+	return versionFiles(lp.CurrentFileName())
+}
+
+// savePins records the pinned files in the state file. pinMutex must be held.
+func (lp *LogFile) savePins() {
+	lp.findPins()
+	names := make([]string, len(lp.pins))
+	for i, p := range lp.pins {
+		names[i] = p.fileName
+	}
+	lp.updateState(func(state *logState) {
+		state.Pins = names
+	})
+}
+
+// loadPins picks up the pins saved in the state file by an earlier run
+func (lp *LogFile) loadPins() {
+	state := lp.loadState()
+
+	lp.pinMutex.Lock()
+	defer lp.pinMutex.Unlock()
+	lp.pins = nil
+	for _, name := range state.Pins {
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		lp.pins = append(lp.pins, pin{fileName: name, fileInfo: fi})
+	}
+}
@@ -0,0 +1,146 @@
+/*
+File summary: logfile per call site rate limiting
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// packagePath is this package's import path, see callSite
+var packagePath = reflect.TypeOf(LogFile{}).PkgPath()
+
+// rateBucket is the token bucket for one call site or key
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// WriteKeyed writes p, like Write, rate limited by key rather than by call
+// site (see RateLimit). Use a fixed set of keys, such as "reconnect" or
+// "cache-miss", not ones built from the entry.
+func (lp *LogFile) WriteKeyed(key string, p []byte) (n int, err error) {
+	if !lp.allow(key) {
+		return len(p), nil
+	}
+	return lp.write(p, nil, false, 0)
+}
+
+// rateLimited reports whether an entry from the call site is to be dropped.
+// skip is the number of stack frames between the call site and the caller
+// of rateLimited's caller, as for writeEntry. Call sites are only known, and
+// so only limited, with the CallerInfo flag set.
+func (lp *LogFile) rateLimited(skip int) bool {
+	if lp.RateLimit <= 0 || lp.Flags&CallerInfo != CallerInfo {
+		return false
+	}
+	site, ok := callSite(skip + 2 + lp.CallerSkip)
+	if !ok {
+		return false
+	}
+	return !lp.allow(site)
+}
+
+// callSite returns the file:line skip frames up the stack, as
+// runtime.Caller(skip) would, or the first caller beyond it outside the log
+// package and this one. Otherwise everything written through log.Printf, a
+// Component or the RPCLogger would share their one call to Write.
+func callSite(skip int) (string, bool) {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "" {
+			return "", false
+		}
+		if pkg := framePackage(frame.Function); (pkg != "log" && pkg != packagePath) || strings.HasSuffix(frame.File, "_test.go") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line), true
+		}
+		if !more {
+			return "", false
+		}
+	}
+}
+
+// framePackage returns the import path of the package function, as named by
+// runtime.Frame, is in
+func framePackage(function string) string {
+	slash := strings.LastIndex(function, "/") + 1
+	if dot := strings.Index(function[slash:], "."); dot >= 0 {
+		return function[:slash+dot]
+	}
+	return function
+}
+
+// allow takes a token from key's bucket, reporting false, and counting the
+// entry as suppressed, if there are none left
+func (lp *LogFile) allow(key string) bool {
+	if lp.RateLimit <= 0 {
+		return true
+	}
+	burst := float64(lp.RateBurst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(lp.RateLimit))
+	}
+
+	now := time.Now()
+	lp.rateMutex.Lock()
+	defer lp.rateMutex.Unlock()
+	if lp.rateBuckets == nil {
+		lp.rateBuckets = make(map[string]*rateBucket)
+	}
+	b := lp.rateBuckets[key]
+	if b == nil {
+		b = &rateBucket{tokens: burst}
+		lp.rateBuckets[key] = b
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*lp.RateLimit)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		if lp.suppressed == nil {
+			lp.suppressed = make(map[string]int64)
+		}
+		lp.suppressed[key]++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// suppressedStats fills in the rate limiting counters of stats
+func (lp *LogFile) suppressedStats(stats *Stats) {
+	lp.rateMutex.Lock()
+	defer lp.rateMutex.Unlock()
+	if len(lp.suppressed) == 0 {
+		return
+	}
+	stats.Suppressed = make(map[string]int64, len(lp.suppressed))
+	for key, n := range lp.suppressed {
+		stats.Suppressed[key] = n
+		stats.RateLimited += n
+	}
+}
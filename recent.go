@@ -0,0 +1,117 @@
+/*
+File summary: logfile keeping the most recent entries in memory
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// recentRing holds the last bytes written, see TailBufferSize
+type recentRing struct {
+	mutex sync.Mutex
+	buf   []byte
+	next  int  // where the next byte goes
+	full  bool // buf has wrapped round
+}
+
+func newRecentRing(size int) *recentRing {
+	return &recentRing{buf: make([]byte, size)}
+}
+
+// write adds p, keeping only the last len(buf) bytes
+func (r *recentRing) write(p []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.next = 0
+		r.full = true
+		return
+	}
+	n := copy(r.buf[r.next:], p)
+	if n < len(p) {
+		copy(r.buf, p[n:])
+		r.full = true
+	}
+	r.next = (r.next + len(p)) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// bytes returns a copy of what is held, oldest first, and whether the
+// start of it has been lost
+func (r *recentRing) bytes() ([]byte, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.next]...), false
+	}
+	held := make([]byte, 0, len(r.buf))
+	held = append(held, r.buf[r.next:]...)
+	return append(held, r.buf[:r.next]...), true
+}
+
+// keepRecent adds p, just written, to the TailBufferSize bytes kept
+func (lp *LogFile) keepRecent(p []byte) {
+	if lp.recent != nil {
+		lp.recent.write(p)
+	}
+}
+
+// TailBytes returns the last n bytes (or all of them if n <= 0) written to
+// the log file, from the last TailBufferSize bytes kept in memory, for
+// error reports and health endpoints. It returns nil without a
+// TailBufferSize.
+func (lp *LogFile) TailBytes(n int) []byte {
+	if lp.recent == nil {
+		return nil
+	}
+	held, _ := lp.recent.bytes()
+	if n > 0 && n < len(held) {
+		held = held[len(held)-n:]
+	}
+	return held
+}
+
+// TailLines returns the last n lines (or all of them if n <= 0) held for
+// TailBytes, without their newlines. A line that has partly been lost from
+// the start of what is held isn't returned.
+func (lp *LogFile) TailLines(n int) []string {
+	if lp.recent == nil {
+		return nil
+	}
+	held, wrapped := lp.recent.bytes()
+	if wrapped {
+		i := bytes.IndexByte(held, '\n')
+		held = held[i+1:]
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(held), "\n"), "\n")
+	if n > 0 && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
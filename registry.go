@@ -0,0 +1,159 @@
+/*
+File summary: logfile registry of open log files
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// registry holds every LogFile opened by New until it is closed.
+// logFiles is what ListOpenLogFiles returns, so leaves out those with the
+// Unregistered flag. paths has every LogFile, by absolute file name, and is
+// used to spot the same file being opened twice.
+var registry = struct {
+	sync.Mutex
+	logFiles map[*LogFile]bool
+	paths    map[string]*LogFile
+}{
+	logFiles: make(map[*LogFile]bool),
+	paths:    make(map[string]*LogFile),
+}
+
+// claimPath reserves lp's FileName for lp. If another LogFile already has it
+// then, with the ReuseDuplicate flag, that LogFile is returned (and will need
+// one more Close) or otherwise a *FileNameError is returned.
+func claimPath(lp *LogFile) (*LogFile, error) {
+	path, err := filepath.Abs(lp.FileName)
+	if err != nil {
+		return nil, &FileNameError{FileName: lp.FileName, Reason: fmt.Sprintf("cannot find absolute path: %s", err)}
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, ok := registry.paths[path]; ok {
+		if lp.Flags&ReuseDuplicate == ReuseDuplicate {
+			existing.refs++
+			return existing, nil
+		}
+		return nil, &FileNameError{FileName: lp.FileName, Reason: "is already open by another LogFile"}
+	}
+	lp.path = path
+	lp.refs = 1
+	trackOpen(lp)
+	registry.paths[path] = lp
+	return nil, nil
+}
+
+// movePath moves lp's claim (see claimPath) to fileName. If another
+// LogFile already has it a *FileNameError is returned.
+func movePath(lp *LogFile, fileName string) error {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		return &FileNameError{FileName: fileName, Reason: fmt.Sprintf("cannot find absolute path: %s", err)}
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, ok := registry.paths[path]; ok && existing != lp {
+		return &FileNameError{FileName: fileName, Reason: "is already open by another LogFile"}
+	}
+	if registry.paths[lp.path] == lp {
+		delete(registry.paths, lp.path)
+	}
+	lp.path = path
+	registry.paths[path] = lp
+	return nil
+}
+
+// register adds lp, once it is open, to the list of open LogFiles
+func register(lp *LogFile) {
+	if lp.Flags&Unregistered == Unregistered {
+		return
+	}
+	registry.Lock()
+	registry.logFiles[lp] = true
+	registry.Unlock()
+}
+
+// unregister drops one reference to lp. It returns true if that was the last
+// and lp has been removed from the registry (and so should be closed).
+func unregister(lp *LogFile) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	if lp.refs > 1 {
+		lp.refs--
+		return false
+	}
+	lp.refs = 0
+	delete(registry.logFiles, lp)
+	if registry.paths[lp.path] == lp {
+		delete(registry.paths, lp.path)
+	}
+	return true
+}
+
+// ListOpenLogFiles returns every LogFile, sorted by FileName, that has been
+// opened by New and not yet closed. This includes ones opened by libraries.
+// LogFiles with the Unregistered flag are left out.
+func ListOpenLogFiles() []*LogFile {
+	registry.Lock()
+	logFiles := make([]*LogFile, 0, len(registry.logFiles))
+	for lp := range registry.logFiles {
+		logFiles = append(logFiles, lp)
+	}
+	registry.Unlock()
+
+	sort.Slice(logFiles, func(i, j int) bool {
+		return logFiles[i].CurrentFileName() < logFiles[j].CurrentFileName()
+	})
+	return logFiles
+}
+
+// FlushAll flushes every open LogFile. They are flushed at once so one on a
+// stalled disk doesn't hold up the others.
+func FlushAll() {
+	forEachLogFile(ListOpenLogFiles(), 0, (*LogFile).Flush)
+}
+
+// SyncAll syncs, see Sync, every open LogFile at once like FlushAll
+func SyncAll() {
+	forEachLogFile(ListOpenLogFiles(), 0, (*LogFile).Sync)
+}
+
+// CloseAll closes every open LogFile, even those returned more than once
+// with the ReuseDuplicate flag. Use it on shutdown. Like FlushAll they are
+// all closed at once.
+func CloseAll() {
+	forEachLogFile(ListOpenLogFiles(), 0, (*LogFile).closeAll)
+}
+
+// closeAll closes lp however many News returned it
+func (lp *LogFile) closeAll() error {
+	registry.Lock()
+	if lp.refs > 1 {
+		lp.refs = 1
+	}
+	registry.Unlock()
+	return lp.Close()
+}
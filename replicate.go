@@ -0,0 +1,562 @@
+/*
+File summary: logfile replicating the log file to another host
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With ReplicateTo set everything done to the log file and its old versions
+// is sent, as it happens, to a Receiver on another host which makes the
+// same changes to its copies: bytes written at an offset, renames while
+// rotating and removals of old versions. Copies are named by the file's
+// base name in the Receiver's Dir.
+// The file is sent in full whenever it is opened and after the connection
+// has been lost, or replication has fallen behind, so the live file catches
+// up. Old versions rotated while disconnected, and compacting them with
+// CompactFunc, are not copied.
+
+const (
+	// replicaQueue is how many changes can be waiting to be sent
+	replicaQueue = 1000
+
+	// replicaTimeout limits connecting to, and each write to, the Receiver,
+	// and how long Close waits for the changes still queued
+	replicaTimeout = 5 * time.Second
+
+	// replicaChunk is the most sent as one write when resending a file
+	replicaChunk = 64 * 1024
+
+	// maxReplicaData is the most a Receiver accepts in one change
+	maxReplicaData = 16 * 1024 * 1024
+
+	// maxReplicaFailures is how many failures are kept for the LogFile's
+	// goroutine to report, later ones are only counted
+	maxReplicaFailures = 10
+)
+
+// Changes sent to the Receiver
+const (
+	replicaWrite    byte = iota + 1 // data at offset in name
+	replicaTruncate                 // name truncated to offset
+	replicaRename                   // name renamed to data
+	replicaRemove                   // name removed
+	replicaResend                   // resend the file, only queued by the LogFile
+)
+
+// replicaOp is one change to a file, names are base names
+type replicaOp struct {
+	op     byte
+	name   string
+	offset int64
+	data   []byte
+}
+
+// replicator is the goroutine sending changes to the Receiver
+type replicator struct {
+	lp        *LogFile
+	addr      string
+	tlsConfig *tls.Config
+	ops       chan replicaOp
+	done      chan bool
+	dir       string // of the log file, for resending it
+
+	conn    net.Conn
+	w       *bufio.Writer
+	retryAt time.Time
+	resend  string // the live file to send in full once connected
+
+	// behind is set, atomically, when a change couldn't be queued
+	behind int32
+}
+
+// startReplica starts the replicator goroutine for ReplicateTo
+func (lp *LogFile) startReplica() {
+	r := &replicator{
+		lp:        lp,
+		addr:      lp.ReplicateTo,
+		tlsConfig: lp.ReplicateTLS,
+		ops:       make(chan replicaOp, replicaQueue),
+		done:      make(chan bool),
+		dir:       filepath.Dir(lp.FileName),
+	}
+	lp.replica = r
+	goroutineStarted()
+	go r.run()
+}
+
+// stopReplica stops the replicator giving it up to replicaTimeout to send
+// what it has queued
+func (lp *LogFile) stopReplica() {
+	if lp.replica == nil {
+		return
+	}
+	close(lp.replica.ops)
+	done := lp.replica.done
+	lp.replica = nil
+	timer := time.NewTimer(replicaTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+// replicate queues a change to fileName for the Receiver. If too many are
+// waiting it is dropped and the live file resent once the queue empties.
+func (lp *LogFile) replicate(op byte, fileName string, offset int64, data []byte) {
+	if lp.replica == nil {
+		return
+	}
+	rop := replicaOp{op: op, name: filepath.Base(fileName), offset: offset}
+	if op == replicaWrite {
+		rop.data = append([]byte(nil), data...)
+	} else if op == replicaRename {
+		rop.data = []byte(filepath.Base(string(data)))
+	}
+	select {
+	case lp.replica.ops <- rop:
+	default:
+		atomic.StoreInt32(&lp.replica.behind, 1)
+		atomic.AddInt64(&lp.replicaDrops, 1)
+	}
+}
+
+// replicateRename and replicateRemove queue renames and removals of old
+// versions
+func (lp *LogFile) replicateRename(oldName, newName string) {
+	lp.replicate(replicaRename, oldName, 0, []byte(newName))
+}
+
+func (lp *LogFile) replicateRemove(fileName string) {
+	lp.replicate(replicaRemove, fileName, 0, nil)
+}
+
+// replicatingWriter writes to w, the log file, and replicates what it
+// wrote
+type replicatingWriter struct {
+	lp *LogFile
+	w  io.Writer
+}
+
+func (rw replicatingWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if n > 0 {
+		if end, seekErr := rw.lp.file.Seek(0, io.SeekCurrent); seekErr == nil {
+			rw.lp.replicate(replicaWrite, rw.lp.FileName, end-int64(n), p[:n])
+		} else {
+			rw.lp.replicate(replicaResend, rw.lp.FileName, 0, nil)
+		}
+	}
+	return n, err
+}
+
+func (r *replicator) run() {
+	defer goroutineStopped()
+	defer close(r.done)
+	defer r.disconnect()
+
+	for op := range r.ops {
+		if op.op == replicaResend {
+			r.resend = op.name
+			op.op = 0
+		}
+		if atomic.CompareAndSwapInt32(&r.behind, 1, 0) {
+			r.resend = filepath.Base(r.lp.replicaName())
+		}
+		if !r.connect() {
+			continue
+		}
+		if r.resend != "" {
+			if !r.resendFile() {
+				continue
+			}
+		}
+		if op.op != 0 && !r.send(op) {
+			continue
+		}
+		if len(r.ops) == 0 {
+			r.flush()
+		}
+	}
+}
+
+// connect makes sure there is a connection, waiting a while between
+// attempts. The live file is resent after connecting.
+func (r *replicator) connect() bool {
+	if r.conn != nil {
+		return true
+	}
+	if time.Now().Before(r.retryAt) {
+		atomic.AddInt64(&r.lp.replicaDrops, 1)
+		return false
+	}
+	dialer := &net.Dialer{Timeout: replicaTimeout}
+	var conn net.Conn
+	var err error
+	if r.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.addr, r.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", r.addr)
+	}
+	if err != nil {
+		r.failed(err)
+		return false
+	}
+	r.conn = conn
+	r.w = bufio.NewWriter(conn)
+	if r.resend == "" {
+		r.resend = filepath.Base(r.lp.replicaName())
+	}
+	return true
+}
+
+// resendFile sends the whole of the live file
+func (r *replicator) resendFile() bool {
+	name := r.resend
+	f, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		// Nothing to send, the next open resends it
+		r.resend = ""
+		return true
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		r.resend = ""
+		return true
+	}
+	if !r.send(replicaOp{op: replicaTruncate, name: name, offset: fi.Size()}) {
+		return false
+	}
+	buf := make([]byte, replicaChunk)
+	for offset := int64(0); offset < fi.Size(); {
+		n, err := f.ReadAt(buf, offset)
+		if n > 0 && !r.send(replicaOp{op: replicaWrite, name: name, offset: offset, data: buf[:n]}) {
+			return false
+		}
+		offset += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	r.resend = ""
+	return true
+}
+
+// send writes op to the Receiver
+func (r *replicator) send(op replicaOp) bool {
+	r.conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+	if err := writeReplicaOp(r.w, op); err != nil {
+		r.failed(err)
+		return false
+	}
+	return true
+}
+
+func (r *replicator) flush() {
+	r.conn.SetWriteDeadline(time.Now().Add(replicaTimeout))
+	if err := r.w.Flush(); err != nil {
+		r.failed(err)
+	}
+}
+
+// failed reports err and drops the connection. Once reconnected the live
+// file is resent.
+func (r *replicator) failed(err error) {
+	atomic.AddInt64(&r.lp.replicaErrors, 1)
+	atomic.AddInt64(&r.lp.replicaDrops, 1)
+	r.lp.replicaFailed(err)
+	r.disconnect()
+	r.retryAt = time.Now().Add(time.Second)
+	r.resend = filepath.Base(r.lp.replicaName())
+}
+
+func (r *replicator) disconnect() {
+	if r.conn == nil {
+		return
+	}
+	if r.w != nil {
+		r.w.Flush()
+	}
+	r.conn.Close()
+	r.conn = nil
+	r.w = nil
+}
+
+// replicaFailed passes err to the LogFile's goroutine to report, as OnError
+// is only called from there. If the goroutine is too busy to be told at once
+// it finds err when it next does its housekeeping.
+func (lp *LogFile) replicaFailed(err error) {
+	lp.replicaMutex.Lock()
+	if len(lp.replicaFailures) < maxReplicaFailures {
+		lp.replicaFailures = append(lp.replicaFailures, err)
+	}
+	lp.replicaMutex.Unlock()
+	if lp.synchronous {
+		return
+	}
+	lp.closeMutex.RLock()
+	if !lp.closed {
+		lp.trySend(logMessage{action: replicaFailedLog})
+	}
+	lp.closeMutex.RUnlock()
+}
+
+// reportReplicaFailures reports the errors passed on by replicaFailed
+func (lp *LogFile) reportReplicaFailures() {
+	lp.replicaMutex.Lock()
+	failures := lp.replicaFailures
+	lp.replicaFailures = nil
+	lp.replicaMutex.Unlock()
+	for _, err := range failures {
+		lp.PrintError("LogFile error replicating to %s: %s\n", lp.ReplicateTo, err)
+	}
+}
+
+// replicaName is the live file's name, safe to call from the replicator
+func (lp *LogFile) replicaName() string {
+	lp.replicaMutex.Lock()
+	defer lp.replicaMutex.Unlock()
+	return lp.replicaLive
+}
+
+// replicaOpened queues the live file, just opened, to be resent
+func (lp *LogFile) replicaOpened() {
+	if lp.replica == nil {
+		return
+	}
+	lp.replicaMutex.Lock()
+	lp.replicaLive = lp.FileName
+	lp.replicaMutex.Unlock()
+	lp.replicate(replicaResend, lp.FileName, 0, nil)
+}
+
+// writeReplicaOp writes op as: the change, the name's length and name, the
+// offset and the data's length and data
+func writeReplicaOp(w io.Writer, op replicaOp) error {
+	header := make([]byte, 1+2+8+4)
+	header[0] = op.op
+	binary.BigEndian.PutUint16(header[1:], uint16(len(op.name)))
+	binary.BigEndian.PutUint64(header[3:], uint64(op.offset))
+	binary.BigEndian.PutUint32(header[11:], uint32(len(op.data)))
+	if _, err := w.Write(header[:3]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, op.name); err != nil {
+		return err
+	}
+	if _, err := w.Write(header[3:]); err != nil {
+		return err
+	}
+	_, err := w.Write(op.data)
+	return err
+}
+
+// readReplicaOp reads a change written by writeReplicaOp
+func readReplicaOp(r io.Reader) (replicaOp, error) {
+	var op replicaOp
+	var header [8 + 4]byte
+	if _, err := io.ReadFull(r, header[:3]); err != nil {
+		return op, err
+	}
+	op.op = header[0]
+	name := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return op, err
+	}
+	op.name = string(name)
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return op, err
+	}
+	op.offset = int64(binary.BigEndian.Uint64(header[:]))
+	size := binary.BigEndian.Uint32(header[8:])
+	if size > maxReplicaData {
+		return op, fmt.Errorf("LogFile replica change of %d bytes is too big", size)
+	}
+	op.data = make([]byte, size)
+	_, err := io.ReadFull(r, op.data)
+	return op, err
+}
+
+// Receiver keeps copies, in Dir, of the log files replicated to it by
+// LogFiles with ReplicateTo set.
+type Receiver struct {
+	// Dir is where the copies are kept
+	Dir string
+
+	// OnError, if not nil, is called with each connection's error and each
+	// change that could not be made
+	OnError func(err error)
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]bool
+}
+
+// NewReceiver returns a Receiver keeping copies in dir
+func NewReceiver(dir string) *Receiver {
+	return &Receiver{Dir: dir}
+}
+
+// ErrReceiverClosed is returned by Serve once the Receiver has been closed
+var ErrReceiverClosed = errors.New("LogFile Receiver closed")
+
+// ListenAndServe listens on addr, using TLS if tlsConfig is not nil, and
+// calls Serve
+func (rc *Receiver) ListenAndServe(addr string, tlsConfig *tls.Config) error {
+	var l net.Listener
+	var err error
+	if tlsConfig != nil {
+		l, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	return rc.Serve(l)
+}
+
+// Serve accepts connections on l, making the changes sent on each, until
+// Close is called
+func (rc *Receiver) Serve(l net.Listener) error {
+	rc.mutex.Lock()
+	if rc.listeners == nil {
+		rc.listeners = make(map[net.Listener]bool)
+	}
+	rc.listeners[l] = true
+	rc.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			rc.mutex.Lock()
+			closed := !rc.listeners[l]
+			delete(rc.listeners, l)
+			rc.mutex.Unlock()
+			l.Close()
+			if closed {
+				return ErrReceiverClosed
+			}
+			return err
+		}
+		go rc.receive(conn)
+	}
+}
+
+// Close stops Serve accepting connections. Connections already accepted
+// carry on until the LogFile closes them.
+func (rc *Receiver) Close() error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	for l := range rc.listeners {
+		rc.listeners[l] = false
+		l.Close()
+	}
+	return nil
+}
+
+// receive makes the changes sent on conn
+func (rc *Receiver) receive(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		op, err := readReplicaOp(r)
+		if err != nil {
+			if err != io.EOF {
+				rc.error(fmt.Errorf("LogFile Receiver error reading from %s: %w", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		if err := rc.apply(op); err != nil {
+			rc.error(err)
+		}
+	}
+}
+
+// apply makes the change op to the copies in Dir. Changes are made one at
+// a time even from different connections.
+func (rc *Receiver) apply(op replicaOp) error {
+	name, err := rc.path(op.name)
+	if err != nil {
+		return err
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	switch op.op {
+	case replicaWrite, replicaTruncate:
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if op.op == replicaWrite {
+			_, err = f.WriteAt(op.data, op.offset)
+		} else {
+			err = f.Truncate(op.offset)
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	case replicaRename:
+		newName, err := rc.path(string(op.data))
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(name, newName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	case replicaRemove:
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	default:
+		return fmt.Errorf("LogFile Receiver unknown change %d to %s", op.op, op.name)
+	}
+	return nil
+}
+
+// path returns where the copy of name is kept. Names that aren't plain
+// file names are refused so nothing can be written outside Dir.
+func (rc *Receiver) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("LogFile Receiver refusing file name %q", name)
+	}
+	return filepath.Join(rc.Dir, name), nil
+}
+
+func (rc *Receiver) error(err error) {
+	if rc.OnError != nil {
+		rc.OnError(err)
+	}
+}
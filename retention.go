@@ -0,0 +1,289 @@
+/*
+File summary: logfile removal of old versions
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// expiredSuffix is added to old versions waiting to be deleted
+	expiredSuffix = ".expired."
+
+	// errorsSuffix comes before expiredSuffix on old versions containing
+	// errors, kept until ErrMaxAge
+	errorsSuffix = ".errors"
+)
+
+// expiredFile is an old version that has been moved aside waiting for
+// DeleteGrace to pass or CanDeleteFunc to allow it to be deleted. One
+// containing errors is also kept until keepUntil, see ErrMaxAge.
+type expiredFile struct {
+	fileName  string
+	expired   time.Time
+	keepUntil time.Time
+}
+
+// removeOldFile deletes an old version of the log file. If DeleteGrace or
+// CanDeleteFunc are set, or the file is pinned, it is instead moved aside to
+// be deleted later by removeExpired.
+func (lp *LogFile) removeOldFile(fileName string) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	keepUntil := lp.errorsKeepUntil(fileName, fi)
+
+	if lp.DeleteGrace <= 0 && lp.CanDeleteFunc == nil && !lp.pinned(fileName) && keepUntil.IsZero() {
+		err := os.Remove(fileName)
+		if err != nil {
+			lp.PrintError("LogFile error removing old file %s: %s\n", fileName, err)
+		} else {
+			lp.replicateRemove(fileName)
+		}
+		return
+	}
+
+	now := time.Now()
+	suffix := expiredSuffix
+	if !keepUntil.IsZero() {
+		suffix = errorsSuffix + expiredSuffix
+	}
+	expiredName := fmt.Sprintf("%s%s%d", fileName, suffix, now.UnixNano())
+	err = os.Rename(fileName, expiredName)
+	if err != nil {
+		lp.PrintError("LogFile error renaming old file %s to %s: %s\n", fileName, expiredName, err)
+		return
+	}
+	lp.replicateRename(fileName, expiredName)
+	lp.expired = append(lp.expired, expiredFile{fileName: expiredName, expired: now, keepUntil: keepUntil})
+}
+
+// removeExpired deletes any old versions moved aside by removeOldFile that
+// are now allowed to go
+func (lp *LogFile) removeExpired() {
+	kept := lp.expired[:0]
+	for _, ef := range lp.expired {
+		if time.Since(ef.expired) < lp.DeleteGrace || time.Now().Before(ef.keepUntil) || (lp.CanDeleteFunc != nil && !lp.CanDeleteFunc(ef.fileName)) || lp.pinned(ef.fileName) {
+			kept = append(kept, ef)
+			continue
+		}
+		err := os.Remove(ef.fileName)
+		if err != nil && !os.IsNotExist(err) {
+			lp.PrintError("LogFile error removing old file %s: %s\n", ef.fileName, err)
+			kept = append(kept, ef)
+		} else {
+			lp.replicateRemove(ef.fileName)
+		}
+	}
+	lp.expired = kept
+}
+
+// findExpired picks up any old versions left waiting for deletion by an
+// earlier run
+func (lp *LogFile) findExpired() {
+	for _, name := range versionFiles(lp.FileName) {
+		if !strings.Contains(name[len(lp.FileName):], expiredSuffix) {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		ef := expiredFile{fileName: name, expired: fi.ModTime()}
+		if lp.ErrMaxAge > 0 && strings.Contains(name, errorsSuffix+expiredSuffix) {
+			ef.keepUntil = fi.ModTime().Add(lp.ErrMaxAge)
+		}
+		lp.expired = append(lp.expired, ef)
+	}
+}
+
+// removeAged deletes, with MaxAge, the old versions last written more than
+// MaxAge ago however many OldVersions there are
+func (lp *LogFile) removeAged() {
+	if lp.MaxAge <= 0 {
+		return
+	}
+	var names []string
+	if lp.Flags&TimestampVersions == TimestampVersions {
+		names = lp.timestampVersions()
+	} else {
+		for v := 1; v <= lp.OldVersions; v++ {
+			names = append(names, FileNameVersion(lp.FileName, v))
+		}
+	}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err == nil && time.Since(fi.ModTime()) > lp.MaxAge {
+			lp.removeOldFile(name)
+		}
+	}
+}
+
+// removeOverBudget deletes, with MaxTotalSize, the oldest old versions until
+// they, the log file and the old versions waiting to be deleted together fit
+// in MaxTotalSize
+func (lp *LogFile) removeOverBudget() {
+	if lp.MaxTotalSize <= 0 {
+		return
+	}
+	var names []string
+	if lp.Flags&TimestampVersions == TimestampVersions {
+		names = lp.timestampVersions()
+	} else {
+		for v := 1; v <= lp.OldVersions; v++ {
+			names = append(names, FileNameVersion(lp.FileName, v))
+		}
+	}
+
+	// Those waiting can't go yet so count first, then add up from the
+	// newest and everything after the budget runs out goes
+	var total int64
+	if fi, err := os.Stat(lp.FileName); err == nil {
+		total = fi.Size()
+	}
+	for _, ef := range lp.expired {
+		if fi, err := os.Stat(ef.fileName); err == nil {
+			total += fi.Size()
+		}
+	}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+		if total > lp.MaxTotalSize {
+			lp.removeOldFile(name)
+		}
+	}
+}
+
+// With ErrMaxAge set the state file lists, by base name, the log file and
+// old versions that contain errors. An old version in the list is kept
+// until it is ErrMaxAge old, after it would otherwise have been removed.
+
+// errorsKeepUntil returns when the old version fileName, which is about to
+// be removed, may go if it contains errors. It is zero if it may go now.
+func (lp *LogFile) errorsKeepUntil(fileName string, fi os.FileInfo) time.Time {
+	if lp.ErrMaxAge <= 0 {
+		return time.Time{}
+	}
+	lp.stateMutex.Lock()
+	state := lp.loadState()
+	lp.stateMutex.Unlock()
+	keepUntil := fi.ModTime().Add(lp.ErrMaxAge)
+	if !containsString(state.Errors, filepath.Base(fileName)) || !time.Now().Before(keepUntil) {
+		return time.Time{}
+	}
+	return keepUntil
+}
+
+// openErrors finds out if the newly opened log file already contains
+// errors. A truncated one doesn't.
+func (lp *LogFile) openErrors(truncated bool) {
+	lp.fileHasErrors = false
+	if lp.ErrMaxAge <= 0 {
+		return
+	}
+	base := filepath.Base(lp.FileName)
+	lp.updateState(func(state *logState) {
+		if !truncated {
+			lp.fileHasErrors = containsString(state.Errors, base)
+			return
+		}
+		state.Errors = removeString(state.Errors, base)
+	})
+}
+
+// markErrors records that the log file now contains an error
+func (lp *LogFile) markErrors() {
+	if lp.ErrMaxAge <= 0 || lp.fileHasErrors || lp.file == nil {
+		return
+	}
+	lp.fileHasErrors = true
+	base := filepath.Base(lp.FileName)
+	lp.updateState(func(state *logState) {
+		if !containsString(state.Errors, base) {
+			state.Errors = append(state.Errors, base)
+		}
+	})
+}
+
+// rotateErrors moves the list of files containing errors along with the
+// files, log -> log.1, log.1 -> log.2... rotated is the log file's new name.
+func (lp *LogFile) rotateErrors(rotated string) {
+	if lp.ErrMaxAge <= 0 {
+		return
+	}
+	lp.updateState(func(state *logState) {
+		var errors []string
+		if lp.Flags&TimestampVersions == TimestampVersions {
+			// Timestamped versions keep their names, those removed go
+			dir := filepath.Dir(lp.FileName)
+			for _, name := range state.Errors {
+				if name == filepath.Base(lp.FileName) {
+					if rotated != "" {
+						errors = append(errors, filepath.Base(rotated))
+					}
+				} else if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+					errors = append(errors, name)
+				}
+			}
+			state.Errors = errors
+			return
+		}
+		for v := 0; v < lp.OldVersions; v++ {
+			if containsString(state.Errors, filepath.Base(FileNameVersion(lp.FileName, v))) {
+				errors = append(errors, filepath.Base(FileNameVersion(lp.FileName, v+1)))
+			}
+		}
+		state.Errors = errors
+	})
+}
+
+// containsString reports whether s is in list
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns list without s
+func removeString(list []string, s string) []string {
+	kept := list[:0]
+	for _, l := range list {
+		if l != s {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
@@ -0,0 +1,182 @@
+/*
+File summary: logfile retrying of failed writes
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultRetryMaxBytes is used when RetryMaxBytes is zero
+	defaultRetryMaxBytes = 1024 * 1024
+
+	// The delay between retries starts at retryBackoffMin and doubles up
+	// to retryBackoffMax
+	retryBackoffMin = 100 * time.Millisecond
+	retryBackoffMax = time.Minute
+)
+
+// bufferedEntry is an entry written to buf but not yet flushed to the file
+type bufferedEntry struct {
+	data   []byte
+	queued time.Time
+	seq    uint64 // see Tracer
+}
+
+// retryUnwritten is called when writing to the file fails. Whatever has not
+// reached the file, what is left in buf plus notAccepted bytes of the last
+// entry, is queued to be retried and buf is emptied ready for the retry.
+func (lp *LogFile) retryUnwritten(notAccepted int) {
+	buffered := lp.buf.Buffered()
+	// How much reached the file isn't known so neither is its checksum
+	lp.checksumValid = false
+	lp.stats.FileBytes -= int64(buffered)
+	lp.lifetimeBytes -= int64(buffered)
+	lp.size -= int64(buffered)
+
+	// The unwritten bytes are the end of the unflushed entries, which may
+	// start part way through one
+	unwritten := buffered + notAccepted
+	first := len(lp.unflushed)
+	for first > 0 && unwritten > 0 {
+		first--
+		unwritten -= len(lp.unflushed[first].data)
+	}
+	if unwritten < 0 {
+		lp.unflushed[first].data = lp.unflushed[first].data[-unwritten:]
+	}
+
+	retries := make([]bufferedEntry, 0, len(lp.unflushed)-first+len(lp.retries))
+	retries = append(retries, lp.unflushed[first:]...)
+	lp.retries = append(retries, lp.retries...)
+	lp.stats.Retries += int64(len(lp.unflushed) - first)
+	for _, e := range lp.unflushed[first:] {
+		lp.retryBytes += int64(len(e.data))
+	}
+	lp.unflushed = lp.unflushed[:0]
+	lp.buf.Reset(lp.bufTarget())
+
+	lp.scheduleRetry()
+}
+
+// queueRetry queues e behind the entries already waiting to be retried. If
+// that would go over RetryMaxBytes e is dropped.
+func (lp *LogFile) queueRetry(e bufferedEntry) {
+	maxBytes := lp.RetryMaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultRetryMaxBytes
+	}
+	if lp.retryBytes+int64(len(e.data)) > maxBytes {
+		lp.stats.RetryDrops++
+		lp.trace(TraceDrop, e.seq, len(e.data), "RetryMaxBytes reached")
+		return
+	}
+	lp.retries = append(lp.retries, e)
+	lp.retryBytes += int64(len(e.data))
+	lp.stats.Retries++
+}
+
+// scheduleRetry sets the timer for the next retry, each one waiting longer
+func (lp *LogFile) scheduleRetry() {
+	if !lp.retryAt.IsZero() {
+		return
+	}
+	lp.retryBackoff *= 2
+	if lp.retryBackoff < retryBackoffMin {
+		lp.retryBackoff = retryBackoffMin
+	}
+	if lp.retryBackoff > retryBackoffMax {
+		lp.retryBackoff = retryBackoffMax
+	}
+	lp.retryAt = time.Now().Add(lp.retryBackoff)
+}
+
+// retryLog reopens the file, in case what was wrong was the open file, and
+// tries to write the queued entries to it again
+func (lp *LogFile) retryLog() {
+	lp.stopRetry()
+	retries := lp.retries
+	lp.retries = nil
+	lp.retryBytes = 0
+
+	// Anything left in buf failed along with the rest so nothing is lost by
+	// not flushing it
+	if lp.isOpen() {
+		lp.buf.Reset(lp.bufTarget())
+		lp.stopWatch()
+		lp.closeOutput()
+		lp.gzip = nil
+	}
+	if !lp.openLogFile(noTruncateLog) {
+		lp.retries = retries
+		for _, e := range retries {
+			lp.retryBytes += int64(len(e.data))
+		}
+		lp.scheduleRetry()
+		return
+	}
+
+	for i, e := range retries {
+		lp.unflushed = append(lp.unflushed, e)
+		n, err := lp.buf.Write(e.data)
+		lp.stats.FileBytes += int64(n)
+		lp.lifetimeBytes += int64(n)
+		lp.size += int64(n)
+		if err != nil {
+			lp.stats.FileErrors++
+			lp.retryUnwritten(len(e.data) - n)
+			lp.retries = append(lp.retries, retries[i+1:]...)
+			for _, e := range retries[i+1:] {
+				lp.retryBytes += int64(len(e.data))
+			}
+			return
+		}
+	}
+	if lp.flushLog() != nil {
+		return
+	}
+	lp.retryBackoff = 0
+	lp.PrintError("LogFile wrote %d entries to %s after retrying\n", len(retries), lp.FileName)
+}
+
+// dropRetries makes a last attempt, when closing, to write the entries
+// waiting to be retried. Any still not written are counted as dropped.
+func (lp *LogFile) dropRetries() {
+	if len(lp.retries) == 0 {
+		return
+	}
+	lp.retryLog()
+	lp.stopRetry()
+	if len(lp.retries) > 0 {
+		lp.stats.RetryDrops += int64(len(lp.retries))
+		lp.traceEntries(TraceDrop, lp.retries, "retrying failed")
+		lp.PrintError("LogFile dropped %d entries that could not be written to %s\n", len(lp.retries), lp.FileName)
+		lp.noteError(fmt.Errorf("%w: %d entries could not be written to %s", ErrRetryDropped, len(lp.retries), lp.FileName))
+		lp.retries = nil
+		lp.retryBytes = 0
+	}
+}
+
+// stopRetry cancels any scheduled retry
+func (lp *LogFile) stopRetry() {
+	lp.retryAt = time.Time{}
+}
@@ -0,0 +1,140 @@
+/*
+File summary: logfile RPC call logging, used by the gRPC interceptors
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RPCCall is a finished RPC to be logged by RPCLogger
+type RPCCall struct {
+	Method  string // Full method name, /package.Service/Method
+	Peer    string // Address of the other end
+	Code    string // Status code name, OK on success
+	Latency time.Duration
+	Err     error
+
+	// Request and Response are only logged if RPCLogger.Payloads is set.
+	// Streaming calls have neither.
+	Request  interface{}
+	Response interface{}
+}
+
+// RPCLogger writes a line to a LogFile for each RPC. The server framework
+// integrations (see the logfilegrpc package) use it, it can also be called
+// directly.
+type RPCLogger struct {
+	// JSON writes calls as entries (see WriteEntry) rather than text lines
+	JSON bool
+
+	// Payloads logs the request and response of unary calls
+	Payloads bool
+
+	// Redact, if set, is given each payload before it is logged and returns
+	// what to log instead, for example a copy with passwords removed or nil
+	// to log nothing
+	Redact func(method string, payload interface{}) interface{}
+
+	lp *LogFile
+}
+
+// rpcServerFaults are the status codes logged at LevelError, others are
+// usually the client's fault and are logged at LevelWarn
+var rpcServerFaults = map[string]bool{
+	"Unknown":          true,
+	"Internal":         true,
+	"Unavailable":      true,
+	"DataLoss":         true,
+	"DeadlineExceeded": true,
+	"Unimplemented":    true,
+}
+
+// NewRPCLogger returns an RPCLogger writing to lp
+func NewRPCLogger(lp *LogFile) *RPCLogger {
+	return &RPCLogger{lp: lp}
+}
+
+// Log writes c to the log. Successful calls are logged at LevelInfo and
+// failures at LevelWarn or LevelError depending on the code.
+func (l *RPCLogger) Log(c *RPCCall) error {
+	code := c.Code
+	if code == "" {
+		code = "OK"
+		if c.Err != nil {
+			code = "Unknown"
+		}
+	}
+	level := LevelInfo
+	if code != "OK" {
+		level = LevelWarn
+		if rpcServerFaults[code] {
+			level = LevelError
+		}
+	}
+
+	var request, response interface{}
+	if l.Payloads {
+		request, response = l.payload(c.Method, c.Request), l.payload(c.Method, c.Response)
+	}
+
+	if l.JSON {
+		e := Entry{
+			LevelKey:     level.String(),
+			"method":     c.Method,
+			"peer":       c.Peer,
+			"code":       code,
+			"latency_ms": float64(c.Latency) / float64(time.Millisecond),
+		}
+		if c.Err != nil {
+			e["error"] = c.Err.Error()
+		}
+		if request != nil {
+			e["request"] = request
+		}
+		if response != nil {
+			e["response"] = response
+		}
+		return l.lp.writeEntry(e, 1)
+	}
+
+	line := fmt.Sprintf("rpc %s peer=%s code=%s latency=%s", c.Method, c.Peer, code, c.Latency)
+	if c.Err != nil {
+		line += " error=" + strconv.Quote(c.Err.Error())
+	}
+	if request != nil {
+		line += fmt.Sprintf(" request=%+v", request)
+	}
+	if response != nil {
+		line += fmt.Sprintf(" response=%+v", response)
+	}
+	_, err := l.lp.WriteWithMeta([]byte(line+"\n"), map[string]string{LevelKey: level.String()})
+	return err
+}
+
+// payload returns what to log for payload
+func (l *RPCLogger) payload(method string, payload interface{}) interface{} {
+	if payload == nil || l.Redact == nil {
+		return payload
+	}
+	return l.Redact(method, payload)
+}
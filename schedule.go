@@ -0,0 +1,85 @@
+/*
+File summary: logfile rotating on a schedule
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "time"
+
+// Scheduled rotations are counted from local midnight at the start of
+// Sunday 4th January 1970, so an hourly schedule rotates on the hour, a
+// daily one at midnight and a weekly one at the start of each Sunday (each
+// moved on by RotateAt). Periods of whole days are counted in calendar days
+// so that daylight saving time doesn't move them.
+
+// MinRotateEvery is the shortest RotateEvery allowed. Each rotation renames
+// every old version so much more often than this does little but that.
+const MinRotateEvery = 100 * time.Millisecond
+
+// scheduleEpoch is the date schedules are counted from
+var scheduleEpoch = time.Date(1970, 1, 4, 0, 0, 0, 0, time.UTC)
+
+// nextRotation returns the first scheduled rotation after t
+func (lp *LogFile) nextRotation(t time.Time) time.Time {
+	loc := t.Location()
+	if lp.RotateEvery%(24*time.Hour) == 0 {
+		year, month, day := t.Date()
+		days := int(lp.RotateEvery / (24 * time.Hour))
+		today := int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Sub(scheduleEpoch) / (24 * time.Hour))
+		start := today - today%days
+		atDays, atTime := int(lp.RotateAt/(24*time.Hour)), lp.RotateAt%(24*time.Hour)
+		for {
+			next := time.Date(1970, 1, 4+start+atDays, 0, 0, 0, 0, loc).Add(atTime)
+			if next.After(t) {
+				return next
+			}
+			start += days
+		}
+	}
+
+	epoch := time.Date(1970, 1, 4, 0, 0, 0, 0, loc).Add(lp.RotateAt)
+	periods := t.Sub(epoch) / lp.RotateEvery
+	next := epoch.Add(periods * lp.RotateEvery)
+	for !next.After(t) {
+		next = next.Add(lp.RotateEvery)
+	}
+	return next
+}
+
+// rotateDue returns true, with RotateEvery, once the next scheduled rotation
+// of the open file has been reached
+func (lp *LogFile) rotateDue() bool {
+	return lp.RotateEvery > 0 && !lp.rotateAt.IsZero() && !time.Now().Before(lp.rotateAt)
+}
+
+// rotateScheduled rotates the file if it is due. An empty file is left
+// alone, there is no point in keeping empty old versions.
+func (lp *LogFile) rotateScheduled() {
+	if !lp.rotateDue() {
+		return
+	}
+	if lp.size > 0 {
+		lp.rotateLog()
+	}
+	// Rotating reopens the file, setting the next rotation, unless it
+	// couldn't be done
+	if lp.rotateDue() {
+		lp.rotateAt = lp.nextRotation(time.Now())
+	}
+}
@@ -0,0 +1,169 @@
+/*
+File summary: logfile moving a LogFile to a new file name while it is running
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetFileName switches the LogFile, while it carries on running, to write
+// to newPath: what is pending is flushed, the old file closed and newPath
+// opened (creating its directory if need be) to be appended to. The old
+// file and its old versions are left where they are. Use it when, for
+// example, the volume the logs are on is being migrated.
+// If newPath can't be opened an error is returned and the LogFile carries
+// on without a file until it can be (see CheckInterval).
+// As the LogFile's goroutine changes FileName don't read it directly while
+// the LogFile is open, use CurrentFileName.
+func (lp *LogFile) SetFileName(newPath string) error {
+	return lp.setFileName(newPath, false)
+}
+
+// SetFileNameMoving is SetFileName but also moves the file, its old
+// versions and its state file to newPath, copying them if they can't simply
+// be renamed (to another file system).
+func (lp *LogFile) SetFileNameMoving(newPath string) error {
+	return lp.setFileName(newPath, true)
+}
+
+// CurrentFileName returns FileName. Use it, rather than reading FileName,
+// while the LogFile is open as SetFileName, AttachFile and NewBucketed
+// change FileName from the LogFile's goroutine.
+func (lp *LogFile) CurrentFileName() string {
+	lp.nameMutex.RLock()
+	defer lp.nameMutex.RUnlock()
+	return lp.FileName
+}
+
+// changeFileName sets FileName, from the LogFile's goroutine, which is then
+// the only goroutine that need not use CurrentFileName to read it
+func (lp *LogFile) changeFileName(fileName string) {
+	lp.nameMutex.Lock()
+	lp.FileName = fileName
+	lp.nameMutex.Unlock()
+}
+
+// setFileName does the work of SetFileName and SetFileNameMoving
+func (lp *LogFile) setFileName(newPath string, move bool) error {
+	if err := validateFileName(newPath, lp.AllowedDir); err != nil {
+		return err
+	}
+	complete := make(chan error, 1)
+	if !lp.sendOpen(logMessage{action: setFileNameLog, fileName: newPath, move: move, complete: complete}) {
+		return ErrClosed
+	}
+	return <-complete
+}
+
+// setFileNameLog switches the LogFile to newPath, moving the old files
+// there if move is set
+func (lp *LogFile) setFileNameLog(newPath string, move bool) error {
+	if lp.pending {
+		return fmt.Errorf("LogFile %s is not attached yet, use Attach", lp.FileName)
+	}
+	if lp.Sink != nil {
+		return fmt.Errorf("LogFile %s writes to a Sink not a file", lp.FileName)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0777); err != nil {
+		return fmt.Errorf("LogFile unable to create directory for %s: %w", newPath, err)
+	}
+	if err := movePath(lp, newPath); err != nil {
+		return err
+	}
+
+	lp.closeLog()
+	oldPath := lp.FileName
+	if move {
+		lp.compacting.Wait()
+		for _, name := range lp.oldFiles() {
+			moved := newPath + strings.TrimPrefix(name, oldPath)
+			if err := moveFile(name, moved); err != nil {
+				lp.PrintError("LogFile error moving %s to %s: %s\n", name, moved, err)
+			}
+		}
+	}
+	lp.changeFileName(newPath)
+	lp.loadPins()
+	if !lp.openLogFile(noTruncateLog) {
+		return lp.createError(newPath)
+	}
+	return nil
+}
+
+// oldFiles returns the log file, its old versions and its state file, those
+// of them that exist
+func (lp *LogFile) oldFiles() []string {
+	candidates := []string{lp.FileName, stateFileName(lp.FileName)}
+	if lp.Flags&TimestampVersions == TimestampVersions {
+		candidates = append(candidates, lp.timestampVersions()...)
+	} else {
+		for v := 1; v <= lp.OldVersions; v++ {
+			candidates = append(candidates, FileNameVersion(lp.FileName, v))
+		}
+	}
+
+	var names []string
+	for _, name := range candidates {
+		if _, err := os.Lstat(name); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// moveFile renames from to to or, if that fails (as it does between file
+// systems), copies it and removes the original. An existing to is never
+// replaced.
+func moveFile(from, to string) error {
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%s already exists", to)
+	}
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
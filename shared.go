@@ -0,0 +1,139 @@
+/*
+File summary: logfile several processes sharing one log file
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// With the SharedFile flag several processes can write to the same log
+// file. Each line is prefixed with SharedIdentity so it is clear which
+// process wrote it. Writes to the file are made whole entries at a time,
+// holding an advisory lock on FileName.lock, so lines from different
+// processes are never mixed up. Rotation is done under the same lock and a
+// process that finds the file has already been rotated by another just
+// reopens it. The others notice the file has been replaced when they next
+// check it (see CheckInterval).
+// The file is never truncated, so OverWriteOnStart can't be used, and as no
+// process sees everything GzipFile and Checksum can't be either. Locking
+// is done where the system has flock, elsewhere only the prefix is added.
+// Other programs can take the same lock with LockFile.
+
+// lockSuffix is added to FileName to give the name of the lock file
+const lockSuffix = ".lock"
+
+// shared returns true with the SharedFile flag
+func (lp *LogFile) shared() bool {
+	return lp.Flags&SharedFile == SharedFile
+}
+
+// sharedIdentity returns the default SharedIdentity: the program's name and
+// process id
+func sharedIdentity() string {
+	return fmt.Sprintf("%s[%d]", filepath.Base(os.Args[0]), os.Getpid())
+}
+
+// sharedPrefix returns p with SharedIdentity added to the start of every line
+func (lp *LogFile) sharedPrefix(p []byte) []byte {
+	prefix := lp.SharedIdentity + " "
+	prefixed := make([]byte, 0, len(p)+len(prefix)*(bytes.Count(p, []byte("\n"))+1))
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		prefixed = append(prefixed, prefix...)
+		prefixed = append(prefixed, line...)
+		p = p[len(line):]
+	}
+	return prefixed
+}
+
+// lockShared takes the lock shared with the other processes. Nested calls
+// only take it once.
+func (lp *LogFile) lockShared() {
+	if !lp.shared() {
+		return
+	}
+	lp.lockDepth++
+	if lp.lockDepth > 1 {
+		return
+	}
+	if lp.lock == nil {
+		var err error
+		lp.lock, err = os.OpenFile(lp.FileName+lockSuffix, os.O_RDWR|os.O_CREATE, lp.FileMode)
+		if err != nil {
+			lp.PrintError("LogFile unable to create lock file for %s: %s\n", lp.FileName, err)
+			lp.lock = nil
+			return
+		}
+	}
+	if err := lockFile(lp.lock); err != nil {
+		lp.PrintError("LogFile unable to lock %s: %s\n", lp.lock.Name(), err)
+	}
+}
+
+// unlockShared releases the lock taken by lockShared
+func (lp *LogFile) unlockShared() {
+	if !lp.shared() {
+		return
+	}
+	lp.lockDepth--
+	if lp.lockDepth > 0 || lp.lock == nil {
+		return
+	}
+	if err := unlockFile(lp.lock); err != nil {
+		lp.PrintError("LogFile unable to unlock %s: %s\n", lp.lock.Name(), err)
+	}
+}
+
+// closeShared closes the lock file, once the log file has been closed
+func (lp *LogFile) closeShared() {
+	if lp.lock == nil {
+		return
+	}
+	lp.lock.Close()
+	lp.lock = nil
+}
+
+// sharedMoved returns true, with SharedFile, if FileName is no longer the
+// open file as another process has rotated it
+func (lp *LogFile) sharedMoved() bool {
+	if !lp.shared() || lp.file == nil {
+		return false
+	}
+	fi, err := os.Stat(lp.FileName)
+	return err != nil || lp.fileInfo == nil || !os.SameFile(fi, lp.fileInfo)
+}
+
+// sharedSize updates size, after a flush, to include what the other
+// processes have written so MaxSize applies to the whole file
+func (lp *LogFile) sharedSize() {
+	if !lp.shared() {
+		return
+	}
+	if fi, err := lp.file.Stat(); err == nil {
+		lp.size = fi.Size()
+	}
+}
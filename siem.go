@@ -0,0 +1,203 @@
+/*
+File summary: logfile CEF and LEEF formats for SIEM ingestion
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field names used by CEFFormatter and LEEFFormatter
+const (
+	// MessageKey holds the human readable description of an entry
+	MessageKey = "msg"
+
+	// EventIDKey holds the identifier of the type of event, the CEF
+	// Signature ID or LEEF Event ID
+	EventIDKey = "event_id"
+)
+
+// leefTimeFormat is the LEEF devTimeFormat matching the devTime written
+const (
+	leefTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+	leefTimeFormat = "yyyy-MM-dd'T'HH:mm:ss.SSSXXX"
+)
+
+// siemFields returns the fields of an entry. Entries written by WriteEntry
+// are JSON objects, anything else becomes the message. meta is added.
+func siemFields(p []byte, meta map[string]string) map[string]string {
+	fields := make(map[string]string, len(meta)+4)
+	var entry map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if d.Decode(&entry) == nil {
+		for k, v := range entry {
+			switch v := v.(type) {
+			case string:
+				fields[k] = v
+			case json.Number, bool:
+				fields[k] = fmt.Sprint(v)
+			default:
+				b, _ := json.Marshal(v)
+				fields[k] = string(b)
+			}
+		}
+	} else {
+		fields[MessageKey] = string(bytes.TrimRight(p, "\n"))
+	}
+	for k, v := range meta {
+		fields[k] = v
+	}
+	return fields
+}
+
+// siemTime returns the time of an entry, now if it has none
+func siemTime(fields map[string]string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, fields[TimeKey])
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// siemSeverity returns the 0-10 SIEM severity of an entry
+func siemSeverity(fields map[string]string) int {
+	level, _ := ParseLevel(fields[LevelKey])
+	switch {
+	case level >= LevelError:
+		return 8
+	case level >= LevelWarn:
+		return 6
+	case level >= LevelInfo:
+		return 3
+	}
+	return 1
+}
+
+// siemKeys returns the extension field names of an entry, sorted so lines
+// are repeatable
+func siemKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k == TimeKey || k == LevelKey || k == EventIDKey {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// siemKey returns k with anything other than letters, digits and _ removed.
+// Neither format allows other characters in extension names.
+func siemKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, k)
+}
+
+var (
+	siemHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+// CEFFormatter returns a Formatter that writes entries in ArcSight's Common
+// Event Format with the given device vendor, product and version. The
+// msg field (or the whole of an unstructured entry) is the event name,
+// event_id the signature ID, level the severity and time the receipt time
+// (rt). The remaining fields and the metadata are extensions.
+func CEFFormatter(vendor, product, version string) func(p []byte, meta map[string]string) []byte {
+	header := "CEF:0|" + siemHeaderEscaper.Replace(vendor) + "|" + siemHeaderEscaper.Replace(product) +
+		"|" + siemHeaderEscaper.Replace(version) + "|"
+	return func(p []byte, meta map[string]string) []byte {
+		fields := siemFields(p, meta)
+		eventID := fields[EventIDKey]
+		if eventID == "" {
+			eventID = "log"
+		}
+		name := fields[MessageKey]
+		if name == "" {
+			name = eventID
+		}
+
+		var b bytes.Buffer
+		b.WriteString(header)
+		b.WriteString(siemHeaderEscaper.Replace(eventID))
+		b.WriteByte('|')
+		b.WriteString(siemHeaderEscaper.Replace(name))
+		b.WriteByte('|')
+		b.WriteString(strconv.Itoa(siemSeverity(fields)))
+		b.WriteString("|rt=")
+		b.WriteString(strconv.FormatInt(siemTime(fields).UnixNano()/int64(time.Millisecond), 10))
+		for _, k := range siemKeys(fields) {
+			if k == MessageKey {
+				continue
+			}
+			if key := siemKey(k); key != "" {
+				b.WriteString(" " + key + "=" + cefValueEscaper.Replace(fields[k]))
+			}
+		}
+		b.WriteByte('\n')
+		return b.Bytes()
+	}
+}
+
+// LEEFFormatter returns a Formatter that writes entries in IBM QRadar's Log
+// Event Extended Format 1.0 with the given vendor, product and version.
+// event_id is the event ID, level the severity (sev) and time the device
+// time (devTime). The remaining fields and the metadata are attributes,
+// msg (or the whole of an unstructured entry) among them.
+func LEEFFormatter(vendor, product, version string) func(p []byte, meta map[string]string) []byte {
+	header := "LEEF:1.0|" + siemHeaderEscaper.Replace(vendor) + "|" + siemHeaderEscaper.Replace(product) +
+		"|" + siemHeaderEscaper.Replace(version) + "|"
+	return func(p []byte, meta map[string]string) []byte {
+		fields := siemFields(p, meta)
+		eventID := fields[EventIDKey]
+		if eventID == "" {
+			eventID = "log"
+		}
+
+		var b bytes.Buffer
+		b.WriteString(header)
+		b.WriteString(siemHeaderEscaper.Replace(eventID))
+		b.WriteString("|devTime=")
+		b.WriteString(siemTime(fields).Format(leefTimeLayout))
+		b.WriteString("\tdevTimeFormat=" + leefTimeFormat)
+		b.WriteString("\tsev=")
+		b.WriteString(strconv.Itoa(siemSeverity(fields)))
+		for _, k := range siemKeys(fields) {
+			if key := siemKey(k); key != "" {
+				b.WriteString("\t" + key + "=" + leefValueEscaper.Replace(fields[k]))
+			}
+		}
+		b.WriteByte('\n')
+		return b.Bytes()
+	}
+}
@@ -0,0 +1,106 @@
+/*
+File summary: logfile handling of signals from logrotate and on shutdown
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// EnableSignalHandling handles the given signals, by default SIGHUP,
+// SIGTERM and SIGINT (only os.Interrupt where there is no SIGHUP), for
+// every LogFile open at the time the signal arrives (see ListOpenLogFiles).
+//
+// On SIGHUP, as sent by logrotate after moving the file aside, a LogFile
+// whose file has been moved or deleted is reopened, otherwise it is rotated
+// (see RotateFile). Any other signal is taken as a request to stop: every
+// LogFile is flushed (see FlushAll) and the signal is then delivered again
+// with the default handling, so the program still exits as it would have.
+//
+// The function returned stops the handling. It can be called more than
+// once.
+func EnableSignalHandling(sig ...os.Signal) (stop func()) {
+	if len(sig) == 0 {
+		sig = defaultSignals
+	}
+	signals := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(signals, sig...)
+	goroutineStarted()
+	go func() {
+		defer goroutineStopped()
+		for {
+			select {
+			case s := <-signals:
+				if isHangup(s) {
+					for _, lp := range ListOpenLogFiles() {
+						lp.sendOpen(logMessage{action: hangupLog})
+					}
+					continue
+				}
+				FlushAll()
+				signal.Stop(signals)
+				signal.Reset(s)
+				raise(s)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
+	}
+}
+
+// raise delivers s to this process again, exiting if that isn't supported
+func raise(s os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(s)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LogFile unable to resend %s, exiting: %s\n", s, err)
+		os.Exit(1)
+	}
+}
+
+// hangupLog reopens the log file if it has been moved aside or deleted, or
+// otherwise rotates it
+func (lp *LogFile) hangupLog() {
+	if lp.pending {
+		return
+	}
+	if lp.file != nil && lp.fileInfo != nil && !lp.replaced() && !lp.sharedMoved() {
+		lp.rotateLog()
+		return
+	}
+	lp.closeLog()
+	if !lp.openLogFile(noTruncateLog) {
+		lp.noteError(lp.reopenError())
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !unix
+
+/*
+File summary: logfile signals handled where there is no SIGHUP
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "os"
+
+// defaultSignals are handled by EnableSignalHandling when given none
+var defaultSignals = []os.Signal{os.Interrupt}
+
+// isHangup returns true if s asks for the log files to be reopened, there
+// being no SIGHUP that is never
+func isHangup(s os.Signal) bool {
+	return false
+}
@@ -0,0 +1,128 @@
+/*
+File summary: logfile writing to a Sink rather than a file
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"fmt"
+	"time"
+)
+
+// Sink is where a LogFile with its Sink set writes instead of a file, for
+// example memory, a socket or a cloud store. The LogFile's goroutine drives
+// it just as it does the file: opening it, buffering writes to it, flushing,
+// working out from its Size when MaxSize is reached, rotating and closing
+// it. Only one goroutine uses a Sink at a time.
+type Sink interface {
+	// Open opens the sink ready to be written to, emptying it if truncate
+	// is set. It is called again after each Close.
+	Open(truncate bool) error
+
+	// Write writes p, as for io.Writer
+	Write(p []byte) (int, error)
+
+	// Flush makes everything written durable, as Sync does for a file
+	Flush() error
+
+	// Close closes the sink
+	Close() error
+
+	// Size returns how much the opened sink holds, for MaxSize
+	Size() (int64, error)
+
+	// Rotate sets aside what the sink holds, as the default RotateFile does
+	// for a file, so it is empty when next opened. It is called with the
+	// sink closed.
+	Rotate() error
+}
+
+// Flags that only make sense for a file, which can't be used with a Sink
+var fileOnlyFlags = []struct {
+	flag int
+	name string
+}{
+	{ExclusiveCreate, "ExclusiveCreate"},
+	{Checksum, "Checksum"},
+	{WatchFile, "WatchFile"},
+	{SharedFile, "SharedFile"},
+	{VerifyWrites, "VerifyWrites"},
+	{CopyTruncate, "CopyTruncate"},
+}
+
+// isOpen returns true if the file, or Sink, is open
+func (lp *LogFile) isOpen() bool {
+	return lp.file != nil || lp.sinkOpen
+}
+
+// openSink is openLogFile for a Sink
+func (lp *LogFile) openSink(truncated bool) bool {
+	if err := lp.Sink.Open(truncated); err != nil {
+		lp.PrintError("LogFile failed to open %s: %s\n", lp.FileName, err)
+		lp.openErr = err
+		return false
+	}
+	lp.sinkOpen = true
+
+	var err error
+	lp.size, err = lp.Sink.Size()
+	if err != nil {
+		lp.PrintError("LogFile unable to find initial size of %s: %s\n", lp.FileName, err)
+		lp.size = 0
+	}
+
+	lp.startGzip()
+	opened := time.Now()
+	lp.fileDay = dayOf(opened)
+	lp.fileOpened = opened
+	if lp.RotateEvery > 0 {
+		lp.rotateAt = lp.nextRotation(opened)
+	}
+	lp.buf = bufio.NewWriter(lp.bufTarget())
+	return true
+}
+
+// closeOutput closes the file, or Sink
+func (lp *LogFile) closeOutput() error {
+	if lp.Sink != nil {
+		lp.sinkOpen = false
+		return lp.Sink.Close()
+	}
+	err := lp.file.Close()
+	lp.file = nil
+	return err
+}
+
+// syncOutput waits for what has been written to the file, or Sink, to be
+// durable
+func (lp *LogFile) syncOutput() error {
+	if lp.Sink != nil {
+		return lp.Sink.Flush()
+	}
+	return lp.file.Sync()
+}
+
+// rotateSink is the default RotateFileFunc with a Sink
+func (lp *LogFile) rotateSink() {
+	if err := lp.Sink.Rotate(); err != nil {
+		lp.PrintError("LogFile error rotating %s: %s\n", lp.FileName, err)
+		lp.rotateFailed(fmt.Errorf("%w: rotating %s: %w", ErrRotateFailed, lp.FileName, err))
+	}
+}
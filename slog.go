@@ -0,0 +1,220 @@
+/*
+File summary: logfile log/slog Handler
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// SlogHandler is a log/slog Handler that writes records to a LogFile as
+// single lines of JSON, in the same form as WriteEntry. Create it with
+// NewSlogHandler.
+type SlogHandler struct {
+	lp     *LogFile
+	opts   slog.HandlerOptions
+	fields Entry    // from WithAttrs, already nested in their groups
+	groups []string // from WithGroup
+}
+
+// NewSlogHandler returns a slog.Handler writing to lp, for use with
+// slog.New. opts, which may be nil, sets the minimum level (Info if not
+// set), whether the source of each record is added and a ReplaceAttr
+// function, as for slog's own handlers. Records of LevelError and above
+// are critical, see SyncCritical. The source is also added, and records
+// rate limited by it (see RateLimit), with the CallerInfo flag.
+func NewSlogHandler(lp *LogFile, opts *slog.HandlerOptions) *SlogHandler {
+	h := &SlogHandler{lp: lp, fields: Entry{}}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+// Enabled reports whether records of level are written
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	min := slog.LevelInfo
+	if h.opts.Level != nil {
+		min = h.opts.Level.Level()
+	}
+	return level >= min
+}
+
+// WithAttrs returns a handler adding attrs to every record
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := *h
+	h2.fields = copyFields(h.fields, h.groups)
+	h2.addAttrs(h2.fields, attrs)
+	return &h2
+}
+
+// WithGroup returns a handler putting the attributes added after it, to
+// the handler or to records, in the group name
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+// Handle writes r to the LogFile
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	entry := copyFields(h.fields, h.groups)
+	if r.NumAttrs() > 0 {
+		var attrs []slog.Attr
+		r.Attrs(func(a slog.Attr) bool {
+			attrs = append(attrs, a)
+			return true
+		})
+		h.addAttrs(entry, attrs)
+	}
+	pruneGroups(entry, h.groups)
+
+	var source string
+	if r.PC != 0 && (h.opts.AddSource || h.lp.Flags&CallerInfo == CallerInfo) {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		source = fmt.Sprintf("%s:%d", frame.File, frame.Line)
+	}
+	builtins := []slog.Attr{slog.String(slog.MessageKey, r.Message), slog.String(LevelKey, Level(r.Level).String())}
+	if !r.Time.IsZero() {
+		builtins = append(builtins, slog.String(TimeKey, r.Time.Format(time.RFC3339Nano)))
+	}
+	if source != "" {
+		builtins = append(builtins, slog.String(SourceKey, source))
+	}
+	for _, a := range builtins {
+		if h.opts.ReplaceAttr != nil {
+			a = h.opts.ReplaceAttr(nil, a)
+		}
+		if a.Key != "" {
+			entry[a.Key] = slogValue(a.Value)
+		}
+	}
+
+	p, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("LogFile cannot encode record: %w", err)
+	}
+	critical := r.Level >= slog.LevelError
+	if !critical && source != "" && h.lp.Flags&CallerInfo == CallerInfo && !h.lp.allow(source) {
+		return nil
+	}
+	_, err = h.lp.write(append(p, '\n'), nil, critical, 0)
+	return err
+}
+
+// addAttrs adds attrs to the current group of fields
+func (h *SlogHandler) addAttrs(fields Entry, attrs []slog.Attr) {
+	for _, g := range h.groups {
+		group, ok := fields[g].(Entry)
+		if !ok {
+			group = Entry{}
+			fields[g] = group
+		}
+		fields = group
+	}
+	h.addGroup(fields, h.groups, attrs)
+}
+
+// addGroup adds attrs, which are in groups, to fields
+func (h *SlogHandler) addGroup(fields Entry, groups []string, attrs []slog.Attr) {
+	for _, a := range attrs {
+		a.Value = a.Value.Resolve()
+		if h.opts.ReplaceAttr != nil && a.Value.Kind() != slog.KindGroup {
+			a = h.opts.ReplaceAttr(groups, a)
+			a.Value = a.Value.Resolve()
+		}
+		if a.Equal(slog.Attr{}) {
+			continue
+		}
+		if a.Value.Kind() != slog.KindGroup {
+			fields[a.Key] = slogValue(a.Value)
+			continue
+		}
+		// A group without a key is inlined, an empty one left out
+		group := a.Value.Group()
+		if len(group) == 0 {
+			continue
+		}
+		if a.Key == "" {
+			h.addGroup(fields, groups, group)
+			continue
+		}
+		sub := Entry{}
+		h.addGroup(sub, append(groups[:len(groups):len(groups)], a.Key), group)
+		fields[a.Key] = sub
+	}
+}
+
+// slogValue returns what to put in an entry for v
+func slogValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+	}
+	return v.Any()
+}
+
+// copyFields copies fields, and the groups in it named by path, so they can
+// be added to without changing the original
+func copyFields(fields Entry, path []string) Entry {
+	c := make(Entry, len(fields)+4)
+	for k, v := range fields {
+		c[k] = v
+	}
+	if len(path) > 0 {
+		if group, ok := c[path[0]].(Entry); ok {
+			c[path[0]] = copyFields(group, path[1:])
+		}
+	}
+	return c
+}
+
+// pruneGroups removes the groups named by path, from WithGroup, that have
+// nothing in them
+func pruneGroups(fields Entry, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	group, ok := fields[path[0]].(Entry)
+	if !ok {
+		return
+	}
+	pruneGroups(group, path[1:])
+	if len(group) == 0 {
+		delete(fields, path[0])
+	}
+}
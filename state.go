@@ -0,0 +1,112 @@
+/*
+File summary: logfile state kept between runs
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// stateSuffix is added to FileName to give the name of the state file
+const stateSuffix = ".state"
+
+// logState is what LogFile remembers between runs. It is kept as JSON in
+// the state file next to the log file, which is only created when there is
+// something to remember.
+type logState struct {
+	// Pins are the names of pinned old versions
+	Pins []string `json:"pins,omitempty"`
+
+	// Checksums are the SHA-256 of old versions, by base name, see the
+	// Checksum flag
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// Errors are the base names of the log file and old versions that
+	// contain errors, see ErrMaxAge
+	Errors []string `json:"errors,omitempty"`
+
+	// Bucket is the hour or day the log file was started for, see
+	// NewBucketed
+	Bucket string `json:"bucket,omitempty"`
+}
+
+// stateFileName returns the name of the state file for fileName
+func stateFileName(fileName string) string {
+	return fileName + stateSuffix
+}
+
+// updateState loads the state file, passes it to update to be changed and
+// then saves it.
+func (lp *LogFile) updateState(update func(state *logState)) {
+	lp.stateMutex.Lock()
+	defer lp.stateMutex.Unlock()
+
+	state := lp.loadState()
+	update(&state)
+	lp.saveState(state)
+}
+
+// loadState reads the state file. A missing state file is not an error, an
+// empty state is returned.
+func (lp *LogFile) loadState() logState {
+	var state logState
+	fileName := stateFileName(lp.CurrentFileName())
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			lp.PrintError("LogFile error reading state file %s: %s\n", fileName, err)
+		}
+		return state
+	}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		lp.PrintError("LogFile error in state file %s: %s\n", fileName, err)
+	}
+	return state
+}
+
+// saveState writes the state file, replacing it so it is never left half
+// written. If the state is empty the state file is removed.
+func (lp *LogFile) saveState(state logState) {
+	fileName := stateFileName(lp.CurrentFileName())
+	b, err := json.Marshal(state)
+	if err != nil {
+		lp.PrintError("LogFile error encoding state for %s: %s\n", fileName, err)
+		return
+	}
+	if string(b) == "{}" {
+		err = os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			lp.PrintError("LogFile error removing state file %s: %s\n", fileName, err)
+		}
+		return
+	}
+
+	tmpFileName := fileName + ".tmp"
+	err = os.WriteFile(tmpFileName, b, lp.FileMode)
+	if err == nil {
+		err = os.Rename(tmpFileName, fileName)
+	}
+	if err != nil {
+		lp.PrintError("LogFile error writing state file %s: %s\n", fileName, err)
+		os.Remove(tmpFileName)
+	}
+}
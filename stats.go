@@ -0,0 +1,195 @@
+/*
+File summary: logfile statistics
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters kept by a LogFile since New was called
+type Stats struct {
+	// Writes is the number of entries passed to Write
+	Writes int64
+
+	// FileBytes is the number of bytes written to the log file
+	FileBytes int64
+
+	// FileErrors is the number of writes to the log file that failed
+	FileErrors int64
+
+	// Retries is the number of entries that could not be written to the
+	// log file at first and were queued to be retried
+	Retries int64
+
+	// RetryDrops is the number of entries dropped as the retry queue was
+	// full (see RetryMaxBytes) or never written before Close
+	RetryDrops int64
+
+	// TeeErrors is the number of writes to Tees that failed
+	TeeErrors int64
+
+	// LifetimeBytes is the number of bytes counted towards MaxLifetimeBytes,
+	// including PreviousLifetimeBytes, since New or ResetLifetime
+	LifetimeBytes int64
+
+	// ArchiveErrors is the number of rotated files that failed verification
+	// (see VerifyArchives)
+	ArchiveErrors int64
+
+	// RotateErrors is the number of old versions, or the log file itself,
+	// that could not be renamed while rotating
+	RotateErrors int64
+
+	// StderrBytes is the number of bytes copied to stderr
+	StderrBytes int64
+
+	// StderrErrors is the number of writes to stderr that failed
+	StderrErrors int64
+
+	// StderrDrops is the number of entries not copied to stderr because it
+	// was blocked (see StderrTimeout)
+	StderrDrops int64
+
+	// VerifyErrors is the number of writes to the log file that could not
+	// be read back or read back different (see VerifyWrites)
+	VerifyErrors int64
+
+	// ReplicaErrors is the number of times sending to ReplicateTo failed
+	// and ReplicaDrops the number of changes not sent as it had failed or
+	// fallen behind, see ReplicateTo
+	ReplicaErrors int64
+	ReplicaDrops  int64
+
+	// NoFileStderr is the number of entries that only went to stderr, and
+	// NoFileDrops the number lost (with FileOnly), as the log file wasn't
+	// open
+	NoFileStderr int64
+	NoFileDrops  int64
+
+	// OverflowDrops is the number of entries dropped because MaxPendingBytes
+	// was reached
+	OverflowDrops int64
+
+	// FullDrops is the number of entries dropped, with the DropWhenFull
+	// flag, because the queue was full
+	FullDrops int64
+
+	// OversizeDrops is the number of entries rejected, and OversizeChunked
+	// the number split into chunks, as they were bigger than MaxEntryBytes
+	OversizeDrops   int64
+	OversizeChunked int64
+
+	// Suppressed is the number of entries dropped by RateLimit for each
+	// call site (file:line) or WriteKeyed key, RateLimited is their total
+	Suppressed  map[string]int64
+	RateLimited int64
+
+	// FlushLatency is how long entries waited between being passed to Write
+	// and being flushed to the file
+	FlushLatency Histogram
+}
+
+// LatencyBuckets are the upper bounds of the buckets of a Histogram
+var LatencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// Histogram counts durations in the buckets given by LatencyBuckets
+type Histogram struct {
+	// Counts[i] is the number of durations greater than
+	// LatencyBuckets[i-1] and no more than LatencyBuckets[i]. The last
+	// count is of those over the largest bucket.
+	Counts [len(LatencyBuckets) + 1]int64
+
+	// Count and Sum are the number and total of all durations
+	Count int64
+	Sum   time.Duration
+}
+
+// observe adds d to the histogram
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Quantile returns an estimate, the upper bound of the bucket it falls in,
+// of the q (0 to 1) quantile. Durations over the largest bucket are
+// reported as the largest bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.Count))
+	var seen int64
+	for i, count := range h.Counts[:len(LatencyBuckets)] {
+		seen += count
+		if seen > rank {
+			return LatencyBuckets[i]
+		}
+	}
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+// Stats returns a copy of the LogFile's current counters. Once the LogFile
+// has been closed they are as they were when it closed.
+func (lp *LogFile) Stats() Stats {
+	stats := make(chan Stats, 1)
+	if !lp.sendOpen(logMessage{action: statsLog, stats: stats}) {
+		lp.waitClosed()
+		return lp.closedStats
+	}
+	return <-stats
+}
+
+// currentStats collects the counters for Stats, from the LogFile's
+// goroutine
+func (lp *LogFile) currentStats() Stats {
+	stats := lp.stats
+	stats.LifetimeBytes = lp.lifetimeBytes
+	stats.ArchiveErrors = atomic.LoadInt64(&lp.archiveErrors)
+	stats.ReplicaErrors = atomic.LoadInt64(&lp.replicaErrors)
+	stats.ReplicaDrops = atomic.LoadInt64(&lp.replicaDrops)
+	stats.StderrBytes = atomic.LoadInt64(&lp.stderrBytes)
+	stats.StderrErrors = atomic.LoadInt64(&lp.stderrErrors)
+	stats.OverflowDrops = atomic.LoadInt64(&lp.overflowDrops)
+	stats.FullDrops = atomic.LoadInt64(&lp.fullDrops)
+	stats.OversizeDrops = atomic.LoadInt64(&lp.oversizeDrops)
+	stats.OversizeChunked = atomic.LoadInt64(&lp.oversizeChunked)
+	lp.suppressedStats(&stats)
+	return stats
+}
@@ -0,0 +1,119 @@
+/*
+File summary: logfile copying to stderr
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// stderrQueue is how many entries can be waiting for the stderr goroutine
+const stderrQueue = 100
+
+// writeStderr copies p to stderr. If p is longer than StderrMaxSize only the
+// start of it is copied followed by a note of how much was left out.
+// If there is a stderr goroutine (see StderrTimeout) p is passed to it.
+func (lp *LogFile) writeStderr(p []byte) {
+	if lp.StderrMaxSize > 0 && int64(len(p)) > lp.StderrMaxSize {
+		summary := fmt.Sprintf("... [%d more bytes only in %s]\n", int64(len(p))-lp.StderrMaxSize, lp.FileName)
+		p = append(p[:lp.StderrMaxSize:lp.StderrMaxSize], summary...)
+	}
+
+	if lp.stderrChan == nil {
+		lp.writeStderrNow(lp.alsoWriter(), p)
+		return
+	}
+
+	// Once stderr has blocked don't wait again until it has caught up
+	select {
+	case lp.stderrChan <- p:
+		lp.stderrBlocked = false
+		return
+	default:
+		if lp.stderrBlocked {
+			lp.stats.StderrDrops++
+			return
+		}
+	}
+
+	timer := time.NewTimer(lp.StderrTimeout)
+	defer timer.Stop()
+	select {
+	case lp.stderrChan <- p:
+	case <-timer.C:
+		lp.stderrBlocked = true
+		lp.stats.StderrDrops++
+	}
+}
+
+// alsoWriter returns where entries are copied, AlsoWrite or stderr
+func (lp *LogFile) alsoWriter() io.Writer {
+	if lp.AlsoWrite != nil {
+		return lp.AlsoWrite
+	}
+	return os.Stderr
+}
+
+// writeStderrNow writes p to stderr, or AlsoWrite
+func (lp *LogFile) writeStderrNow(stderr io.Writer, p []byte) {
+	n, err := stderr.Write(p)
+	atomic.AddInt64(&lp.stderrBytes, int64(n))
+	if err != nil {
+		// Well I can't write to stderr to report it... so only tell OnError
+		atomic.AddInt64(&lp.stderrErrors, 1)
+		if lp.OnError != nil {
+			lp.OnError(fmt.Errorf("LogFile error writing to stderr: %w", err))
+		}
+	}
+}
+
+// startStderr starts the stderr goroutine. It writes to whatever stderr, or
+// AlsoWrite, is when it starts.
+func (lp *LogFile) startStderr() {
+	lp.stderrChan = make(chan []byte, stderrQueue)
+	lp.stderrDone = make(chan bool)
+	goroutineStarted()
+	go func(stderr io.Writer, entries <-chan []byte, done chan<- bool) {
+		for p := range entries {
+			lp.writeStderrNow(stderr, p)
+		}
+		goroutineStopped()
+		close(done)
+	}(lp.alsoWriter(), lp.stderrChan, lp.stderrDone)
+}
+
+// stopStderr stops the stderr goroutine giving it up to StderrTimeout to
+// finish writing what it has queued. If stderr is blocked the goroutine is
+// left to finish when it can.
+func (lp *LogFile) stopStderr() {
+	close(lp.stderrChan)
+	lp.stderrChan = nil
+
+	timer := time.NewTimer(lp.StderrTimeout)
+	defer timer.Stop()
+	select {
+	case <-lp.stderrDone:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,60 @@
+/*
+File summary: logfile synchronous (goroutine free) mode
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "time"
+
+// With the Synchronous flag, or always on GOOS=js and wasip1, a LogFile
+// has no goroutine and no timers. Each call does its work in the caller's
+// goroutine, one at a time, and first catches up with anything that is due:
+// flushing after FlushInterval, checking the file after CheckInterval,
+// rotating on RotateEvery's schedule and retrying failed writes. A host loop
+// that may go quiet should call Flush and CheckVanished itself. StderrTimeout
+// is ignored and CompactFunc is run as part of rotating.
+
+// CheckVanished checks the log file is still there, reopening it if it has
+// been moved aside, and does the LogFile's other regular housekeeping.
+// LogFiles normally do this themselves every CheckInterval, it is for use
+// with the Synchronous flag.
+func (lp *LogFile) CheckVanished() {
+	complete := make(chan error, 1)
+	if lp.sendOpen(logMessage{action: checkLog, complete: complete}) {
+		<-complete
+	}
+}
+
+// syncChecks does, for a Synchronous LogFile, whatever the timers would
+// have done by now
+func (lp *LogFile) syncChecks() {
+	now := time.Now()
+	if !lp.retryAt.IsZero() && !now.Before(lp.retryAt) {
+		lp.retryLog()
+	}
+	if lp.FlushInterval > 0 && now.Sub(lp.lastFlush) >= lp.FlushInterval {
+		lp.flushLog()
+	}
+	if lp.CheckInterval > 0 && now.Sub(lp.lastChecked) >= lp.CheckInterval {
+		lp.checkLog()
+	}
+	lp.rotateScheduled()
+	lp.reportDegraded(false)
+	lp.reportReplicaFailures()
+}
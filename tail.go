@@ -0,0 +1,275 @@
+/*
+File summary: logfile following a log file like tail -F
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// defaultTailPoll is used when PollInterval is zero
+const defaultTailPoll = 250 * time.Millisecond
+
+// Tail follows a log file, like tail -F, returning lines as they are
+// written. When the file is rotated Tail finishes the old one and carries
+// on with the new, and when it is truncated starts again from the top.
+// A GzipFile is decompressed as it is read. Create one with NewTail.
+type Tail struct {
+	FileName string
+
+	// PollInterval is how often to look for more once the end of the file
+	// is reached. Zero means 250ms.
+	PollInterval time.Duration
+
+	file     *os.File
+	info     os.FileInfo
+	reader   *bufio.Reader
+	offset   int64
+	partial  []byte // of a line not yet ended
+	draining bool   // FileName is a new file, finishing the old one first
+
+	// A gzip file can't be read on from where the last read stopped so is
+	// read again from the top, skipping offset bytes, once it grows past
+	// size. So is a file too short to tell if it is gzip.
+	reread bool
+	size   int64
+}
+
+// NewTail opens fileName to be followed. With fromStart all of it is read,
+// otherwise only what is written from now on. fileName need not exist yet.
+func NewTail(fileName string, fromStart bool) (*Tail, error) {
+	t := &Tail{FileName: fileName}
+	err := t.open()
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fromStart {
+		if t.reread {
+			t.offset, err = io.Copy(io.Discard, t.reader)
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+		} else {
+			t.offset, err = t.file.Seek(0, io.SeekEnd)
+			t.reader.Reset(t.file)
+		}
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ReadLine returns the next line, without its newline, waiting for it to be
+// written. Once ctx is done it returns ctx's error.
+func (t *Tail) ReadLine(ctx context.Context) (string, error) {
+	for {
+		if t.file != nil {
+			line, err := t.reader.ReadBytes('\n')
+			t.offset += int64(len(line))
+			t.partial = append(t.partial, line...)
+			if err == nil {
+				line := string(t.partial[:len(t.partial)-1])
+				t.partial = t.partial[:0]
+				return line, nil
+			}
+			if err != io.EOF && !(t.reread && err == io.ErrUnexpectedEOF) {
+				return "", err
+			}
+			last, ok, reread, err := t.moved()
+			if ok || err != nil {
+				return last, err
+			}
+			if reread {
+				continue
+			}
+		} else if err := t.open(); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		poll := t.PollInterval
+		if poll <= 0 {
+			poll = defaultTailPoll
+		}
+		timer := time.NewTimer(poll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// moved is called at the end of the file to see if it has been rotated or
+// truncated, returning reread true if there may be more to read now. Once
+// the old file is finished the new one is opened, returning any unended
+// last line of the old one.
+func (t *Tail) moved() (line string, ok, reread bool, err error) {
+	fi, err := os.Stat(t.FileName)
+	if err != nil {
+		// Rotated but not yet recreated, the old file may still grow
+		if os.IsNotExist(err) {
+			return "", false, false, nil
+		}
+		return "", false, false, err
+	}
+	if os.SameFile(fi, t.info) {
+		if t.reread {
+			if fi.Size() == t.size {
+				return "", false, false, nil
+			}
+			if fi.Size() < t.size {
+				t.offset = 0
+				t.partial = t.partial[:0]
+			}
+			return "", false, true, t.readAgain()
+		}
+		if fi.Size() >= t.offset {
+			return "", false, false, nil
+		}
+		// Truncated: what was there has gone, start again
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return "", false, false, err
+		}
+		t.reader.Reset(t.file)
+		t.offset = 0
+		t.partial = t.partial[:0]
+		return "", false, true, nil
+	}
+
+	// Read the old file to the end once more in case more was written to
+	// it after the last read
+	if !t.draining {
+		t.draining = true
+		if t.reread {
+			return "", false, true, t.readAgain()
+		}
+		return "", false, true, nil
+	}
+	line = string(t.partial)
+	ok = len(t.partial) > 0
+	t.Close()
+	if err := t.open(); err != nil && !os.IsNotExist(err) {
+		return line, ok, false, err
+	}
+	return line, ok, true, nil
+}
+
+// open opens FileName from the start
+func (t *Tail) open() error {
+	file, err := os.Open(t.FileName)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file, t.info, t.offset, t.draining = file, info, 0, false
+	t.partial = t.partial[:0]
+	if err := t.startReader(); err != nil {
+		t.Close()
+		return err
+	}
+	return nil
+}
+
+// startReader starts reading file, which is at its start, decompressing it
+// if it is gzip
+func (t *Tail) startReader() error {
+	raw := bufio.NewReader(t.file)
+	start, err := raw.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	t.reread = len(start) < len(gzipMagic) || bytes.HasPrefix(start, gzipMagic)
+	if !t.reread {
+		t.reader = raw
+		return nil
+	}
+
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	t.size = info.Size()
+	var zr *gzip.Reader
+	if len(start) == len(gzipMagic) {
+		zr, err = gzip.NewReader(raw)
+	}
+	if zr == nil && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF) {
+		// Not enough written yet, wait for more
+		t.reader = bufio.NewReader(bytes.NewReader(nil))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.reader = bufio.NewReader(zr)
+	return nil
+}
+
+// readAgain reads file again from the top, skipping the offset bytes
+// already read
+func (t *Tail) readAgain() error {
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := t.startReader(); err != nil {
+		return err
+	}
+	if !t.reread {
+		// Now long enough to tell it is not gzip
+		_, err := t.reader.Discard(int(t.offset))
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	}
+	_, err := io.CopyN(io.Discard, t.reader, t.offset)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return err
+}
+
+// Close closes the file being followed
+func (t *Tail) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
@@ -0,0 +1,121 @@
+/*
+File summary: logfile logfile timers
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import "time"
+
+// logTimers are when the LogFile's goroutine next has each of its regular
+// jobs to do. A single timer is set for whichever is due first, so there is
+// only it to stop when the goroutine finishes. Zero times are never due.
+type logTimers struct {
+	timer     *time.Timer
+	flush     time.Time // see FlushInterval
+	check     time.Time // see CheckInterval
+	rotate    time.Time // see RotateEvery, used until rotateAt is known
+	housekeep time.Time // see housekeepLog
+}
+
+// startTimers sets the first time each job is due
+func (lp *LogFile) startTimers(now time.Time) *logTimers {
+	t := &logTimers{housekeep: now.Add(time.Duration(errorSeconds) * time.Second)}
+	// A negative FlushInterval is handled in writeLog
+	if lp.FlushInterval > 0 {
+		t.flush = now.Add(lp.FlushInterval)
+	}
+	if lp.CheckInterval > 0 {
+		t.check = now.Add(lp.CheckInterval)
+	}
+	if lp.RotateEvery > 0 {
+		t.rotate = now.Add(lp.RotateEvery)
+	}
+	return t
+}
+
+// rotateTime returns when the next scheduled rotation is due
+func (lp *LogFile) rotateTime(t *logTimers) time.Time {
+	if lp.RotateEvery > 0 && !lp.rotateAt.IsZero() {
+		return lp.rotateAt
+	}
+	return t.rotate
+}
+
+// wait sets the timer for the first job due and returns its channel
+func (t *logTimers) wait(lp *LogFile) <-chan time.Time {
+	var next time.Time
+	for _, due := range []time.Time{t.flush, t.check, lp.rotateTime(t), lp.retryAt, t.housekeep} {
+		if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	wait := time.Until(next)
+	if t.timer == nil {
+		t.timer = time.NewTimer(wait)
+		return t.timer.C
+	}
+	if !t.timer.Stop() {
+		// Fired but not yet received. Those jobs are still due so the
+		// timer, set again, fires at once.
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	t.timer.Reset(wait)
+	return t.timer.C
+}
+
+// stop stops the timer
+func (t *logTimers) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// runTimers does each job that is due. The goroutine keeps running while the
+// file isn't open, only Close, which marks the LogFile closed first, stops
+// it. Otherwise Write, Flush and Close would wait forever on its queue.
+func (lp *LogFile) runTimers(t *logTimers) {
+	now := time.Now()
+	due := func(at time.Time) bool {
+		return !at.IsZero() && !now.Before(at)
+	}
+
+	if due(lp.retryAt) {
+		lp.retryLog()
+	}
+	if due(t.flush) {
+		lp.flushLog()
+		t.flush = now.Add(lp.FlushInterval)
+	}
+	if due(t.check) {
+		lp.checkLog()
+		t.check = now.Add(lp.CheckInterval)
+	}
+	if due(lp.rotateTime(t)) {
+		lp.rotateScheduled()
+		// Once the file is open rotateAt says when the next one is due
+		t.rotate = now.Add(lp.RotateEvery)
+	}
+	if due(t.housekeep) {
+		lp.housekeepLog()
+		t.housekeep = now.Add(time.Duration(errorSeconds) * time.Second)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+File summary: logfile write path tracing
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TraceAction is what happened to an entry, see Tracer
+type TraceAction int
+
+const (
+	// TraceEnqueue is a Write method queuing the entry
+	TraceEnqueue TraceAction = iota
+
+	// TraceDequeue is the LogFile's goroutine taking the entry off the queue
+	TraceDequeue
+
+	// TraceFlush is the entry being flushed to the file. An entry that
+	// failed and was retried can be flushed more than once.
+	TraceFlush
+
+	// TraceDrop is the entry being lost, Reason says why
+	TraceDrop
+)
+
+// String returns the name of a
+func (a TraceAction) String() string {
+	switch a {
+	case TraceEnqueue:
+		return "enqueue"
+	case TraceDequeue:
+		return "dequeue"
+	case TraceFlush:
+		return "flush"
+	case TraceDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// TraceEvent is passed to Tracer
+type TraceEvent struct {
+	Action TraceAction
+	Seq    uint64 // numbers the entries of a LogFile, from 1, as they are written
+	Bytes  int
+	Reason string // why the entry was dropped
+	Time   time.Time
+}
+
+// nextSeq returns the number of a new entry for Tracer. Without tracing
+// entries are not numbered.
+func (lp *LogFile) nextSeq() uint64 {
+	if !tracing || lp.Tracer == nil {
+		return 0
+	}
+	return atomic.AddUint64(&lp.traceSeq, 1)
+}
+
+// trace passes an event for entry seq to Tracer
+func (lp *LogFile) trace(action TraceAction, seq uint64, bytes int, reason string) {
+	if !tracing || lp.Tracer == nil {
+		return
+	}
+	lp.Tracer(TraceEvent{Action: action, Seq: seq, Bytes: bytes, Reason: reason, Time: time.Now()})
+}
+
+// traceEntries passes an event for each of entries to Tracer
+func (lp *LogFile) traceEntries(action TraceAction, entries []bufferedEntry, reason string) {
+	if !tracing || lp.Tracer == nil {
+		return
+	}
+	for _, e := range entries {
+		lp.trace(action, e.seq, len(e.data), reason)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+File summary: logfile configuration checking
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigError is returned by Validate and lists every problem found
+type ConfigError struct {
+	Problems []error
+}
+
+func (e *ConfigError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Error()
+	}
+	return "LogFile invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// Unwrap returns the problems so errors.Is and errors.As can look at each
+func (e *ConfigError) Unwrap() []error {
+	return e.Problems
+}
+
+// Validate checks the LogFile's settings make sense, returning a
+// *ConfigError listing all the problems if not. New calls it once the
+// defaults have been filled in.
+// Note OldVersions without MaxSize or RotateOnStart is allowed as RotateFile
+// may be called directly.
+func (lp *LogFile) Validate() error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if lp.FileName == "" {
+		if !lp.deferred {
+			problem("no file name")
+		}
+	} else if err := validateFileName(lp.FileName, lp.AllowedDir); err != nil {
+		problems = append(problems, err)
+	}
+
+	negatives := []struct {
+		name  string
+		value int64
+	}{
+		{"MaxSize", lp.MaxSize},
+		{"OldVersions", int64(lp.OldVersions)},
+		{"KeepRuns", int64(lp.KeepRuns)},
+		{"KeepBuckets", int64(lp.KeepBuckets)},
+		{"CallerSkip", int64(lp.CallerSkip)},
+		{"StderrMaxSize", lp.StderrMaxSize},
+		{"MaxLifetimeBytes", lp.MaxLifetimeBytes},
+		{"PreviousLifetimeBytes", lp.PreviousLifetimeBytes},
+		{"DeleteGrace", int64(lp.DeleteGrace)},
+		{"ErrorRepeatWindow", int64(lp.ErrorRepeatWindow)},
+		{"StderrTimeout", int64(lp.StderrTimeout)},
+		{"DeferredMaxBytes", lp.DeferredMaxBytes},
+		{"RetryMaxBytes", lp.RetryMaxBytes},
+		{"MaxPendingBytes", lp.MaxPendingBytes},
+		{"QueueSize", int64(lp.QueueSize)},
+		{"MaxEntryBytes", lp.MaxEntryBytes},
+		{"MaxAge", int64(lp.MaxAge)},
+		{"MaxTotalSize", lp.MaxTotalSize},
+		{"ErrMaxAge", int64(lp.ErrMaxAge)},
+		{"RotateEvery", int64(lp.RotateEvery)},
+		{"RotateAt", int64(lp.RotateAt)},
+		{"RateBurst", int64(lp.RateBurst)},
+		{"Thresholds.BytesPerDay", lp.Thresholds.BytesPerDay},
+		{"Thresholds.RotationsPerHour", lp.Thresholds.RotationsPerHour},
+		{"Thresholds.ErrorsPerHour", lp.Thresholds.ErrorsPerHour},
+	}
+	for _, n := range negatives {
+		if n.value < 0 {
+			problem("%s cannot be negative (%d)", n.name, n.value)
+		}
+	}
+
+	if lp.QueueSize > maxQueueSize {
+		problem("QueueSize (%d) is too big, it can be at most %d", lp.QueueSize, maxQueueSize)
+	}
+	if lp.TailBufferSize < 0 {
+		problem("TailBufferSize cannot be negative (%d)", lp.TailBufferSize)
+	}
+	if lp.RateLimit < 0 {
+		problem("RateLimit cannot be negative (%g)", lp.RateLimit)
+	}
+	if lp.OversizePolicy == OversizeChunk && lp.MaxEntryBytes > 0 && lp.MaxEntryBytes < int64(minChunkedEntryBytes) {
+		problem("MaxEntryBytes (%d) is too small to chunk entries, it must be at least %d", lp.MaxEntryBytes, minChunkedEntryBytes)
+	}
+	if lp.MaxTotalSize > 0 && lp.MaxSize > lp.MaxTotalSize {
+		problem("MaxSize (%d) is bigger than MaxTotalSize (%d)", lp.MaxSize, lp.MaxTotalSize)
+	}
+	if lp.RotateEvery > 0 && lp.RotateEvery < MinRotateEvery {
+		problem("RotateEvery (%s) is less than MinRotateEvery (%s)", lp.RotateEvery, MinRotateEvery)
+	}
+	if lp.RotateAt > 0 && lp.RotateAt >= lp.RotateEvery {
+		problem("RotateAt (%s) must be less than RotateEvery (%s)", lp.RotateAt, lp.RotateEvery)
+	}
+	if lp.Sink != nil {
+		// The Sink for a FIFO is filled in by New, not given
+		with := "a Sink"
+		if lp.fifo() {
+			with = "a FIFO"
+		}
+		for _, f := range fileOnlyFlags {
+			if lp.Flags&f.flag == f.flag {
+				problem("%s cannot be used with %s", f.name, with)
+			}
+		}
+	}
+	if lp.ReplicateTo != "" {
+		if lp.Sink != nil {
+			problem("ReplicateTo cannot be used with a Sink")
+		}
+		if lp.Flags&SharedFile == SharedFile {
+			problem("ReplicateTo cannot be used with SharedFile")
+		}
+	}
+	if lp.Flags&SharedFile == SharedFile {
+		// Without the lock the sharing processes' writes would interleave
+		if !lockSupported {
+			problem("SharedFile needs file locking, which is not supported on this platform")
+		}
+		for _, f := range []struct {
+			flag int
+			name string
+		}{{OverWriteOnStart, "OverWriteOnStart"}, {GzipFile, "GzipFile"}, {Checksum, "Checksum"}} {
+			if lp.Flags&f.flag == f.flag {
+				problem("%s cannot be used with SharedFile", f.name)
+			}
+		}
+		// A shared file is never truncated so has to be rotated
+		if lp.MaxSize > 0 && lp.OldVersions <= 0 {
+			problem("MaxSize with SharedFile needs OldVersions")
+		}
+	}
+	if lp.Flags&StrictStart == StrictStart && lp.Flags&RotateOnStart != RotateOnStart {
+		problem("StrictStart is only used with the RotateOnStart flag")
+	}
+	if lp.VerifyFunc != nil && lp.Flags&VerifyArchives != VerifyArchives {
+		problem("VerifyFunc is only used with the VerifyArchives flag")
+	}
+	if lp.Dictionary != nil && lp.Flags&GzipFile != GzipFile {
+		problem("Dictionary is only used with the GzipFile flag")
+	}
+	if len(lp.Dictionary) > MaxDictionarySize {
+		problem("Dictionary is too big (%d), it can be at most %d", len(lp.Dictionary), MaxDictionarySize)
+	}
+	if lp.Flags&VerifyArchives == VerifyArchives && lp.CompactFunc == nil {
+		problem("VerifyArchives needs a CompactFunc")
+	}
+	if lp.CompactFunc != nil && lp.OldVersions <= 0 && (lp.RotateFileFunc == nil || lp.defaultRotate) {
+		problem("CompactFunc is never used without OldVersions")
+	}
+
+	// Pipes, terminals and the like can't be rotated or truncated
+	if fi, err := os.Stat(lp.FileName); err == nil && !fi.Mode().IsRegular() {
+		if lp.Flags&RotateOnStart == RotateOnStart {
+			problem("RotateOnStart on %s which is not a regular file", lp.FileName)
+		}
+		if lp.Flags&OverWriteOnStart == OverWriteOnStart {
+			problem("OverWriteOnStart on %s which is not a regular file", lp.FileName)
+		}
+		if lp.MaxSize > 0 {
+			problem("MaxSize on %s which is not a regular file", lp.FileName)
+		}
+		if lp.Flags&RotateDaily == RotateDaily {
+			problem("RotateDaily on %s which is not a regular file", lp.FileName)
+		}
+		if lp.RotateEvery > 0 {
+			problem("RotateEvery on %s which is not a regular file", lp.FileName)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+File summary: logfile read back verification of writes
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// verifyReadAt reads back what was written, tests replace it to simulate
+// storage that silently loses writes
+var verifyReadAt = (*os.File).ReadAt
+
+// verifyingWriter writes to the log file and, with the VerifyWrites flag,
+// reads back each block written and checks its checksum matches. It is
+// meant for qualifying flaky storage (such as SD cards) where writes can
+// fail silently. The read back may be served from the OS cache rather than
+// the device so it finds fewer problems than reading after a reboot would.
+type verifyingWriter struct {
+	lp *LogFile
+}
+
+func (v verifyingWriter) Write(p []byte) (int, error) {
+	n, err := v.lp.file.Write(p)
+	if n > 0 {
+		v.lp.verifyWrite(p[:n])
+	}
+	return n, err
+}
+
+// fileTarget returns what writes to the file go through
+func (lp *LogFile) fileTarget() io.Writer {
+	if lp.Sink != nil {
+		return lp.Sink
+	}
+	var w io.Writer = lp.file
+	if lp.Flags&VerifyWrites == VerifyWrites {
+		w = verifyingWriter{lp}
+	}
+	if lp.replica != nil {
+		w = replicatingWriter{lp, w}
+	}
+	return w
+}
+
+// verifyWrite reads back p, just written to the file, and reports any
+// difference via OnError
+func (lp *LogFile) verifyWrite(p []byte) {
+	end, err := lp.file.Seek(0, io.SeekCurrent)
+	if err == nil {
+		back := make([]byte, len(p))
+		_, err = verifyReadAt(lp.file, back, end-int64(len(p)))
+		if err == nil && crc32.ChecksumIEEE(back) != crc32.ChecksumIEEE(p) {
+			err = fmt.Errorf("%d bytes read back at offset %d do not match those written", len(p), end-int64(len(p)))
+		}
+	}
+	if err != nil {
+		lp.stats.VerifyErrors++
+		lp.PrintError("LogFile verifying write to %s failed: %s\n", lp.FileName, err)
+		lp.noteError(fmt.Errorf("LogFile verifying write to %s failed: %w", lp.FileName, err))
+	}
+}
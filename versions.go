@@ -0,0 +1,156 @@
+/*
+File summary: logfile old versions named by time
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampVersionFormat is the time layout, in UTC, the TimestampVersions
+// flag names old versions with, so log is rotated to, for example,
+// log.2015-05-01T120000Z. Unlike local time UTC never goes back an hour so
+// the names are always in the order the versions were rotated. A second
+// rotation within the same second adds -1, -2...
+const TimestampVersionFormat = "2006-01-02T150405Z"
+
+// localTimestampVersionFormat is the layout, in local time, old versions
+// were named with before TimestampVersionFormat was in UTC. They are still
+// found, and put in order by the time in their name.
+const localTimestampVersionFormat = "2006-01-02T150405"
+
+// timestampVersionRegexp matches the suffix TimestampVersions adds
+var timestampVersionRegexp = regexp.MustCompile(`^\.(\d{4}-\d\d-\d\dT\d{6}Z?)(?:-(\d+))?$`)
+
+// timestampVersion is an old version named by the time it was rotated
+type timestampVersion struct {
+	fileName string
+	time     time.Time
+	n        int
+}
+
+// timestampVersionName returns the name to rotate the log file to at t
+func (lp *LogFile) timestampVersionName(t time.Time) string {
+	name := lp.FileName + "." + t.UTC().Format(TimestampVersionFormat)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = lp.FileName + "." + t.UTC().Format(TimestampVersionFormat) + "-" + strconv.Itoa(n)
+	}
+}
+
+// timestampVersions returns the names of the old versions, newest first
+func (lp *LogFile) timestampVersions() []string {
+	fileName := lp.CurrentFileName()
+	var versions []timestampVersion
+	for _, name := range versionFiles(fileName) {
+		m := timestampVersionRegexp.FindStringSubmatch(name[len(fileName):])
+		if m == nil {
+			continue
+		}
+		t, err := time.Parse(TimestampVersionFormat, m[1])
+		if !strings.HasSuffix(m[1], "Z") {
+			t, err = time.ParseInLocation(localTimestampVersionFormat, m[1], time.Local)
+		}
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		versions = append(versions, timestampVersion{fileName: name, time: t, n: n})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].time.Equal(versions[j].time) {
+			return versions[i].time.After(versions[j].time)
+		}
+		return versions[i].n > versions[j].n
+	})
+
+	fileNames := make([]string, len(versions))
+	for i, v := range versions {
+		fileNames[i] = v.fileName
+	}
+	return fileNames
+}
+
+// versionFiles returns, sorted, the names of the files in fileName's
+// directory that are fileName followed by a "." and more, its old versions
+// and the like. Unlike globbing fileName+".*" this works whatever
+// characters fileName has in it. The names all start with fileName as
+// given.
+func versionFiles(fileName string) []string {
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		return nil
+	}
+	base := filepath.Base(fileName)
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), base+".") {
+			names = append(names, fileName+entry.Name()[len(base):])
+		}
+	}
+	return names
+}
+
+// versionFileName returns the name of version v of the log file. With
+// TimestampVersions version 1 is the newest old version and so on, "" if
+// there aren't that many.
+func (lp *LogFile) versionFileName(v int) string {
+	if lp.Flags&TimestampVersions != TimestampVersions || v == 0 {
+		return FileNameVersion(lp.CurrentFileName(), v)
+	}
+	versions := lp.timestampVersions()
+	if v > len(versions) {
+		return ""
+	}
+	return versions[v-1]
+}
+
+// rotateTimestamped renames the log file to a name with the time in it and
+// deletes all but the newest OldVersions old versions. It returns the new
+// name of the log file, "" if there wasn't one.
+func (lp *LogFile) rotateTimestamped() string {
+	rotated := ""
+	if _, err := os.Stat(lp.FileName); err == nil {
+		rotated = lp.timestampVersionName(time.Now())
+		err = lp.moveLive(rotated)
+		if err != nil {
+			lp.PrintError("LogFile error renaming old file %s to %s: %s\n", lp.FileName, rotated, err)
+			lp.rotateFailed(fmt.Errorf("%w: renaming old file %s to %s: %w", ErrRotateFailed, lp.FileName, rotated, err))
+			rotated = ""
+		}
+	}
+
+	versions := lp.timestampVersions()
+	for len(versions) > lp.OldVersions {
+		lp.removeOldFile(versions[len(versions)-1])
+		versions = versions[:len(versions)-1]
+	}
+	lp.removeExpired()
+	return rotated
+}
@@ -0,0 +1,73 @@
+/*
+File summary: logfile watching for the log file vanishing
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+// With the WatchFile flag the open log file is watched, where the system
+// supports it (inotify on Linux, kqueue on the BSDs and macOS), so that the
+// LogFile notices at once when it is moved or deleted rather than at the
+// next CheckInterval check. Elsewhere, and with the Synchronous flag,
+// CheckInterval is all there is. The CheckInterval check is still made as
+// watching can miss changes made by other machines to files on network file
+// systems. Where that can't happen CheckInterval can be made negative to
+// save the stat it costs.
+
+// fileWatcher tells the LogFile's goroutine that the open file may have
+// vanished
+type fileWatcher interface {
+	// Events is sent to, without blocking, when the file may have vanished
+	Events() <-chan struct{}
+	Close() error
+}
+
+// newWatcher starts watching f. It returns nil, and no error, if the system
+// has no way to watch files. Tests replace it.
+var newWatcher = platformWatcher
+
+// startWatch starts watching the newly opened file
+func (lp *LogFile) startWatch() {
+	if lp.Flags&WatchFile != WatchFile || lp.synchronous {
+		return
+	}
+	w, err := newWatcher(lp.file)
+	if err != nil {
+		lp.PrintError("LogFile unable to watch %s, checking every %s instead: %s\n", lp.FileName, lp.CheckInterval, err)
+		return
+	}
+	lp.watcher = w
+}
+
+// stopWatch stops watching the file, before it is closed
+func (lp *LogFile) stopWatch() {
+	if lp.watcher == nil {
+		return
+	}
+	lp.watcher.Close()
+	lp.watcher = nil
+}
+
+// watchEvents returns the channel the watcher sends to, nil if the file is
+// not being watched
+func (lp *LogFile) watchEvents() <-chan struct{} {
+	if lp.watcher == nil {
+		return nil
+	}
+	return lp.watcher.Events()
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+/*
+File summary: logfile watching the log file with inotify
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// inotifyMask is the events that mean the file may have vanished. Deleting
+// a file that is still open only changes its link count (IN_ATTRIB).
+const inotifyMask = syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF | syscall.IN_ATTRIB
+
+// inotifyWatcher watches a file with inotify for it being deleted or
+// renamed. Its goroutine waits in epoll, on the inotify descriptor and a
+// pipe that is closed to wake it when the watcher is closed.
+type inotifyWatcher struct {
+	events chan struct{}
+	wake   *os.File
+}
+
+// platformWatcher watches f with inotify
+func platformWatcher(f *os.File) (fileWatcher, error) {
+	in, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	// Watching through /proc makes sure it is the open file that is watched
+	// even if FileName has already been replaced
+	_, err = syscall.InotifyAddWatch(in, fmt.Sprintf("/proc/self/fd/%d", f.Fd()), inotifyMask)
+	if err != nil {
+		_, err = syscall.InotifyAddWatch(in, f.Name(), inotifyMask)
+	}
+	if err != nil {
+		syscall.Close(in)
+		return nil, err
+	}
+
+	ep, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(in)
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		syscall.Close(ep)
+		syscall.Close(in)
+		return nil, err
+	}
+	for _, fd := range []int{in, int(r.Fd())} {
+		if err == nil {
+			err = syscall.EpollCtl(ep, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+		}
+	}
+	if err != nil {
+		syscall.Close(ep)
+		syscall.Close(in)
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+
+	iw := &inotifyWatcher{events: make(chan struct{}, 1), wake: w}
+	goroutineStarted()
+	go iw.run(ep, in, r, int(r.Fd()))
+	return iw, nil
+}
+
+// run waits for inotify events until woken by Close
+func (iw *inotifyWatcher) run(ep, in int, wake *os.File, wakeFd int) {
+	defer goroutineStopped()
+	defer wake.Close()
+	defer syscall.Close(in)
+	defer syscall.Close(ep)
+
+	events := make([]syscall.EpollEvent, 2)
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.EpollWait(ep, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == wakeFd {
+				return
+			}
+			// Only that something happened matters, not what
+			if _, err := syscall.Read(in, buf); err != nil && err != syscall.EINTR {
+				return
+			}
+			select {
+			case iw.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (iw *inotifyWatcher) Events() <-chan struct{} {
+	return iw.events
+}
+
+func (iw *inotifyWatcher) Close() error {
+	// Closing the write end of the pipe makes its read end readable
+	return iw.wake.Close()
+}
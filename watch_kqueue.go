@@ -0,0 +1,101 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+/*
+File summary: logfile watching the log file with kqueue
+Package: logfile
+Author: Lee McLoughlin
+
+Copyright (C) 2015 LMMR Tech Ltd All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// kqueueWatcher watches a file with kqueue for it being deleted or renamed.
+// Its goroutine waits in kevent, which is woken by writing to a pipe when
+// the watcher is closed.
+type kqueueWatcher struct {
+	events chan struct{}
+	wake   *os.File
+}
+
+// platformWatcher watches f with kqueue
+func platformWatcher(f *os.File) (fileWatcher, error) {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		syscall.Close(kq)
+		return nil, err
+	}
+
+	changes := make([]syscall.Kevent_t, 2)
+	syscall.SetKevent(&changes[0], int(f.Fd()), syscall.EVFILT_VNODE, syscall.EV_ADD|syscall.EV_CLEAR)
+	changes[0].Fflags = syscall.NOTE_DELETE | syscall.NOTE_RENAME
+	syscall.SetKevent(&changes[1], int(r.Fd()), syscall.EVFILT_READ, syscall.EV_ADD)
+	if _, err := syscall.Kevent(kq, changes, nil, nil); err != nil {
+		syscall.Close(kq)
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+
+	kw := &kqueueWatcher{events: make(chan struct{}, 1), wake: w}
+	goroutineStarted()
+	go kw.run(kq, r, int(r.Fd()))
+	return kw, nil
+}
+
+// run waits for kqueue events until woken by Close
+func (kw *kqueueWatcher) run(kq int, wake *os.File, wakeFd int) {
+	defer goroutineStopped()
+	defer wake.Close()
+	defer syscall.Close(kq)
+
+	events := make([]syscall.Kevent_t, 2)
+	for {
+		n, err := syscall.Kevent(kq, nil, events, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Ident) == wakeFd {
+				return
+			}
+			select {
+			case kw.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (kw *kqueueWatcher) Events() <-chan struct{} {
+	return kw.events
+}
+
+func (kw *kqueueWatcher) Close() error {
+	// Closing the write end of the pipe makes its read end readable
+	return kw.wake.Close()
+}